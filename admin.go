@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Admin: result cleanup =====
+// /admin lists the results this replica knows about and deletes them by age,
+// owner (client IP or mail sender) or size, or purges everything under
+// RESULTS_PREFIX (and CAS_PREFIX with DEDUP_OUTPUTS). Disabled unless
+// ADMIN_PASSWORD is set (basic auth as ADMIN_USER) or an OIDC admin logs in.
+//
+//	ADMIN_PASSWORD=secret ADMIN_USER=admin
+//	curl -u admin:secret -d older_than=72h -H 'Accept: application/json' .../admin/delete
+
+func setupAdmin() { updateLive(adminSettings) }
+
+// adminSettings reads ADMIN_USER and ADMIN_PASSWORD into c.
+func adminSettings(c *liveConfig) error {
+	c.ADMIN_USER = liveDefaults.ADMIN_USER
+	if v := os.Getenv("ADMIN_USER"); v != "" {
+		c.ADMIN_USER = v
+	}
+	c.ADMIN_PASSWORD = os.Getenv("ADMIN_PASSWORD")
+	return nil
+}
+
+// requireAdmin answers the request itself unless it carries the admin credentials.
+// An OIDC login with the admin role counts too. Anything but GET and HEAD must
+// also come from this site's own pages, since the browser replays both.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+		log.Printf("admin: cross-site %s %s from %s refused", r.Method, r.URL.Path, clientIP(r))
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return false
+	}
+	if u := currentUser(r); u != nil && u.Role == roleAdmin {
+		return true
+	}
+	cfg := live()
+	if cfg.ADMIN_PASSWORD == "" {
+		if currentUser(r) != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		http.Error(w, "admin disabled (set ADMIN_PASSWORD)", http.StatusNotFound)
+		return false
+	}
+	u, p, ok := r.BasicAuth()
+	if ok && subtle.ConstantTimeCompare([]byte(u), []byte(cfg.ADMIN_USER)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(p), []byte(cfg.ADMIN_PASSWORD)) == 1 {
+		return true
+	}
+	if ok {
+		log.Printf("admin: failed login from %s", clientIP(r))
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="multicompress admin"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// sameOrigin reports whether a browser request came from this site's own
+// pages. Browsers send Sec-Fetch-Site, older ones at least Origin on a POST;
+// a request with neither (curl, scripts) has no cookies or cached basic auth
+// riding along that another site could abuse.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if pub, err := url.Parse(PUBLIC_BASE_URL); err == nil && PUBLIC_BASE_URL != "" && u.Host == pub.Host {
+		return true
+	}
+	return u.Host == r.Host
+}
+
+type resultInfo struct {
+	Token    string    `json:"token"`
+	Owner    string    `json:"owner"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+func (ri resultInfo) Age() time.Duration { return time.Since(ri.Created).Round(time.Minute) }
+
+func listResults() []resultInfo {
+	resultLRU.Lock()
+	defer resultLRU.Unlock()
+	out := make([]resultInfo, 0, len(resultLRU.m))
+	for t, u := range resultLRU.m {
+		out = append(out, resultInfo{Token: t, Owner: u.owner, Size: u.size, Created: u.created, LastUsed: u.lastUsed})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// deleteResults removes every tracked result match accepts.
+func deleteResults(match func(resultInfo) bool) (n int, freed int64) {
+	for _, ri := range listResults() {
+		if !match(ri) {
+			continue
+		}
+		resultLRU.Lock()
+		u, ok := resultLRU.m[ri.Token]
+		if ok {
+			resultLRU.total -= u.size
+			delete(resultLRU.m, ri.Token)
+		}
+		resultLRU.Unlock()
+		if ok {
+			evictResult(ri.Token)
+			n++
+			freed += u.size
+		}
+	}
+	return n, freed
+}
+
+// purgeResults deletes every result, including storage objects no replica tracks.
+func purgeResults(ctx context.Context) (int, int64, error) {
+	n, freed := deleteResults(func(resultInfo) bool { return true })
+	if store == nil {
+		return n, freed, nil
+	}
+	prefixes := []string{RESULTS_PREFIX}
+	if DEDUP_OUTPUTS {
+		prefixes = append(prefixes, CAS_PREFIX)
+	}
+	for _, prefix := range prefixes {
+		keys, err := store.List(ctx, prefix)
+		if err != nil {
+			return n, freed, err
+		}
+		for _, key := range keys {
+			if err := store.Delete(ctx, key); err != nil {
+				return n, freed, fmt.Errorf("delete %s: %w", key, err)
+			}
+			if strings.HasPrefix(key, RESULTS_PREFIX) {
+				n++
+			}
+		}
+	}
+	if DEDUP_OUTPUTS {
+		casRefs.Lock()
+		casRefs.m = map[string]int{}
+		casRefs.Unlock()
+	}
+	return n, freed, nil
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	results := listResults()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+	total := int64(0)
+	for _, ri := range results {
+		total += ri.Size
+	}
+	tplAdmin.Execute(w, map[string]interface{}{"Results": results, "Total": total, "TTL": live().RESULT_TTL, "Message": r.FormValue("msg"),
+		"Maintenance": maintenanceNotice() != "", "ActiveJobs": activeJobs()})
+}
+
+// adminDeleteHandler: POST older_than (duration), owner, min_size (KB); filters
+// combine with AND and at least one is required. purge=1 with confirm=HAPUS
+// deletes everything instead.
+func adminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		n     int
+		freed int64
+	)
+	if r.FormValue("purge") == "1" {
+		if r.FormValue("confirm") != "HAPUS" {
+			http.Error(w, `purge needs confirm=HAPUS`, http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*storageTimeout)
+		defer cancel()
+		var err error
+		if n, freed, err = purgeResults(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	} else {
+		var olderThan time.Duration
+		if v := r.FormValue("older_than"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid older_than: "+v, http.StatusBadRequest)
+				return
+			}
+			olderThan = d
+		}
+		var minSize int64
+		if v := r.FormValue("min_size"); v != "" {
+			kb, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || kb <= 0 {
+				http.Error(w, "invalid min_size: "+v, http.StatusBadRequest)
+				return
+			}
+			minSize = kb * 1024
+		}
+		owner := strings.TrimSpace(r.FormValue("owner"))
+		if olderThan == 0 && minSize == 0 && owner == "" {
+			http.Error(w, "need older_than, owner or min_size", http.StatusBadRequest)
+			return
+		}
+		n, freed = deleteResults(func(ri resultInfo) bool {
+			return (olderThan == 0 || time.Since(ri.Created) >= olderThan) &&
+				(minSize == 0 || ri.Size >= minSize) &&
+				(owner == "" || strings.EqualFold(ri.Owner, owner))
+		})
+	}
+	log.Printf("admin: %s deleted %d results (%d bytes)", clientIP(r), n, freed)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": n, "freed_bytes": freed})
+		return
+	}
+	msg := fmt.Sprintf("%d hasil dihapus, %.1f MB dibebaskan.", n, float64(freed)/(1<<20))
+	http.Redirect(w, r, BASE_PATH+"/admin?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+var tplAdmin = template.Must(template.New("admin").Funcs(tplFuncs).Funcs(template.FuncMap{
+	"mb": func(b int64) float64 { return float64(b) / (1 << 20) },
+}).Parse(`<!doctype html>
+<html lang="id">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width,initial-scale=1" />
+  <title>Admin hasil</title>
+  <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body class="bg-light">
+  <div class="container py-4">
+    <h3>🧹 Pembersihan hasil</h3>
+    {{if .Message}}<div class="alert alert-info">{{.Message}}</div>{{end}}
+    <form class="row g-2 mb-4 align-items-center" method="post" action="{{base}}/admin/maintenance">
+      {{if .Maintenance}}
+      <div class="col-auto">🛠️ <b>Mode pemeliharaan aktif</b>: {{.ActiveJobs}} pekerjaan masih berjalan{{if eq .ActiveJobs 0}}, aman untuk restart{{end}}.</div>
+      <input type="hidden" name="on" value="0">
+      <div class="col-auto"><button class="btn btn-success" type="submit">Matikan pemeliharaan</button></div>
+      {{else}}
+      <input type="hidden" name="on" value="1">
+      <div class="col-auto"><input class="form-control" name="message" placeholder="Pesan untuk pengguna (opsional)"></div>
+      <div class="col-auto"><button class="btn btn-outline-danger" type="submit">🛠️ Mode pemeliharaan</button></div>
+      <div class="col-auto text-muted"><small>{{.ActiveJobs}} pekerjaan berjalan</small></div>
+      {{end}}
+    </form>
+    <p>{{len .Results}} hasil, total {{printf "%.1f" (mb .Total)}} MB di replika ini.</p>
+    <form class="row g-2 mb-3" method="post" action="{{base}}/admin/delete">
+      <div class="col-auto"><input class="form-control" name="older_than" placeholder="Lebih lama dari (mis. 72h)"></div>
+      <div class="col-auto"><input class="form-control" name="owner" placeholder="Pemilik (IP / email)"></div>
+      <div class="col-auto"><input class="form-control" name="min_size" type="number" min="1" placeholder="Ukuran min. (KB)"></div>
+      <div class="col-auto"><button class="btn btn-warning" type="submit">Hapus yang cocok</button></div>
+    </form>
+    <form class="row g-2 mb-3" method="post" action="{{base}}/cleanup">
+      <div class="col-auto"><button class="btn btn-outline-secondary" type="submit">Hapus yang kedaluwarsa (lebih lama dari {{.TTL}})</button></div>
+    </form>
+    <form class="row g-2 mb-4" method="post" action="{{base}}/admin/delete">
+      <input type="hidden" name="purge" value="1">
+      <div class="col-auto"><input class="form-control" name="confirm" placeholder="Ketik HAPUS" required></div>
+      <div class="col-auto"><button class="btn btn-danger" type="submit">Hapus semua</button></div>
+    </form>
+    <table class="table table-sm">
+      <thead><tr><th>Token</th><th>Pemilik</th><th>Ukuran</th><th>Umur</th><th>Terakhir dipakai</th></tr></thead>
+      <tbody>
+      {{range .Results}}
+        <tr><td><a href="{{base}}/download/{{.Token}}"><code>{{.Token}}</code></a></td><td>{{.Owner}}</td>
+          <td>{{printf "%.1f" (mb .Size)}} MB</td><td>{{.Age}}</td><td>{{.LastUsed.Format "02/01 15:04"}}</td></tr>
+      {{end}}
+      </tbody>
+    </table>
+    <h5 class="mt-4">⚙️ Konfigurasi</h5>
+    <p><a href="{{base}}/admin/config">Ekspor pengaturan & preset (JSON)</a></p>
+    <form class="row g-2" method="post" action="{{base}}/admin/config" enctype="multipart/form-data">
+      <div class="col-auto"><input class="form-control" type="file" name="bundle" accept=".json" required></div>
+      <div class="col-auto"><button class="btn btn-outline-primary" type="submit">Impor</button></div>
+    </form>
+    <p class="mt-4"><a href="{{base}}/">← Kembali</a></p>
+  </div>
+</body>
+</html>`))
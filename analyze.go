@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/adityafaths/multicompressgo/compress"
+	"github.com/disintegration/imaging"
+)
+
+// ===== Upload analysis =====
+// POST /api/v1/analyze takes the uploads /api/v1/compress takes (multipart or
+// JSON, ZIPs expanded the same way) and, without compressing or storing
+// anything, answers per file: format, dimensions, colour model, ICC profile,
+// the main EXIF tags, the page count of PDFs and an estimate of how far the
+// image has to shrink to fit max_kb, with warnings a client can show before
+// submitting ("48.0 MP photo will be downscaled to about 18%").
+//
+// The estimate encodes a copy at most ANALYZE_PROBE_PX on its long side and
+// scales its bits per pixel up to the full picture; small copies carry more
+// detail per pixel, so it errs towards less shrinking than the real run.
+//
+//	curl -F files=@foto.jpg -F max_kb=174 .../api/v1/analyze
+
+var ANALYZE_PROBE_PX = 1024
+
+type analysisFile struct {
+	File         string            `json:"file"`
+	SizeB        int               `json:"size_bytes"`
+	Format       string            `json:"format,omitempty"`
+	Width        int               `json:"width,omitempty"`
+	Height       int               `json:"height,omitempty"`
+	Megapixels   float64           `json:"megapixels,omitempty"`
+	ColorModel   string            `json:"color_model,omitempty"` // rgb, ycbcr, gray, cmyk or palette
+	ICC          bool              `json:"icc_profile,omitempty"`
+	EXIF         map[string]string `json:"exif,omitempty"`
+	Pages        int               `json:"pages,omitempty"` // PDFs
+	BitsPerPixel float64           `json:"bits_per_pixel,omitempty"`
+	EstScale     float64           `json:"est_scale,omitempty"` // 1 = fits max_kb at full size
+	Warnings     []string          `json:"warnings,omitempty"`
+	Skip         string            `json:"skip,omitempty"` // why a job would not take the file
+}
+
+func apiAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if reason, retry := saturated(); reason != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		apiError(w, http.StatusServiceUnavailable, "server busy: "+reason)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxBody)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var opts Options
+	var jobs []Job
+	var err error
+	switch ct {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(apiMaxBody); err != nil {
+			apiReadError(w, err)
+			return
+		}
+		if err := checkStoredInputs(r); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts, err = readSettings(r, ""); err == nil {
+			jobs = collectJobs(r, opts)
+		}
+	case "application/json":
+		var req apiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiReadError(w, fmt.Errorf("bad JSON: %w", err))
+			return
+		}
+		if opts, err = settingsFrom(func(k string) string { return req.Settings[k] }); err == nil {
+			pol := extPolicyFrom(opts)
+			pol.zipPassword = req.ZipPassword
+			usedLabels := map[string]int{}
+			for i, f := range req.Files {
+				data, derr := base64.StdEncoding.DecodeString(f.Data)
+				if derr != nil || f.Name == "" {
+					apiError(w, http.StatusBadRequest, fmt.Sprintf("files[%d]: need a name and base64 data", i))
+					return
+				}
+				if f.Path != "" {
+					jobs = append(jobs, jobsFromFolderUpload(f.Path, data, pol)...)
+					continue
+				}
+				jobs = append(jobs, jobsFromUpload(f.Name, data, usedLabels, pol)...)
+			}
+		}
+	default:
+		apiError(w, http.StatusUnsupportedMediaType, "send multipart/form-data or application/json")
+		return
+	}
+	var errs settingsErrors
+	if errors.As(err, &errs) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": errs.Error(), "fields": errs.byField()})
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(jobs) == 0 {
+		apiError(w, http.StatusBadRequest, "no files")
+		return
+	}
+	files := make([]analysisFile, 0, len(jobs))
+	for _, j := range jobs {
+		if j.Skip != "" {
+			files = append(files, analysisFile{File: j.Rel, Skip: j.Skip})
+			continue
+		}
+		files = append(files, analyzeFile(j.Rel, j.Data, opts))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"max_kb": opts.MaxKB, "min_side": opts.MinSide, "files": files})
+}
+
+// analyzeFile describes one input; decode problems become warnings.
+func analyzeFile(name string, raw []byte, opts Options) analysisFile {
+	a := analysisFile{File: name, SizeB: len(raw), Format: strings.TrimPrefix(inputExt(name), ".")}
+	if PDF_EXT[inputExt(name)] {
+		a.Format = "pdf"
+		a.Pages = pdfPageCount(raw)
+		if a.Pages > 0 {
+			a.Warnings = append(a.Warnings, fmt.Sprintf("%d pages, each becomes its own output", a.Pages))
+		}
+		if err := pdfUnavailable(); err != nil {
+			a.Warnings = append(a.Warnings, "PDF rendering is unavailable on this server, the file would be skipped")
+		}
+		return a
+	}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(raw)); err == nil {
+		a.Format, a.Width, a.Height = format, cfg.Width, cfg.Height
+		a.ColorModel = colorModelName(cfg.ColorModel)
+	}
+	var tiff []byte
+	switch a.Format {
+	case "jpeg":
+		tiff, a.ICC = jpegMetadata(raw)
+	case "tiff":
+		tiff = raw
+	}
+	if tiff != nil {
+		a.EXIF = exifTags(tiff)
+		if _, ok := a.EXIF["GPS"]; ok {
+			a.Warnings = append(a.Warnings, "contains a GPS location")
+		}
+	}
+	if a.ColorModel == "cmyk" {
+		a.Warnings = append(a.Warnings, "CMYK image, colours may shift in the RGB output")
+	}
+
+	img, err := decodeImageFromBytes(name, raw)
+	if err != nil {
+		a.Warnings = append(a.Warnings, "cannot be decoded: "+err.Error())
+		return a
+	}
+	b := img.Bounds()
+	a.Width, a.Height = b.Dx(), b.Dy()
+	pixels := float64(a.Width) * float64(a.Height)
+	a.Megapixels = math.Round(pixels/1e5) / 10
+	probe := imaging.Fit(img, ANALYZE_PROBE_PX, ANALYZE_PROBE_PX, imaging.Box)
+	data, err := compress.EncodeJPEG(compress.FlattenWhite(probe), opts.MinQuality)
+	if err != nil || pixels == 0 {
+		return a
+	}
+	pb := probe.Bounds()
+	a.BitsPerPixel = math.Round(float64(len(data)*8)/float64(pb.Dx()*pb.Dy())*100) / 100
+	a.EstScale = math.Min(1, math.Sqrt(float64(opts.MaxKB*8192)/a.BitsPerPixel/pixels))
+	a.EstScale = math.Round(a.EstScale*100) / 100
+
+	short := min(a.Width, a.Height)
+	switch {
+	case short < opts.MinSide:
+		a.Warnings = append(a.Warnings, fmt.Sprintf("shortest side %d px is below %d px, it will be upscaled", short, opts.MinSide))
+	case a.EstScale < opts.ScaleMin:
+		a.Warnings = append(a.Warnings, fmt.Sprintf("%.1f MP will not fit %d KB even at scale_min %.2f, quality will drop", a.Megapixels, opts.MaxKB, opts.ScaleMin))
+	case a.EstScale < 0.5:
+		a.Warnings = append(a.Warnings, fmt.Sprintf("%.1f MP photo will be downscaled to about %d%%", a.Megapixels, int(a.EstScale*100)))
+	}
+	return a
+}
+
+func colorModelName(m color.Model) string {
+	if _, ok := m.(color.Palette); ok {
+		return "palette"
+	}
+	switch m {
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.GrayModel, color.Gray16Model:
+		return "gray"
+	case color.CMYKModel:
+		return "cmyk"
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model:
+		return "rgb"
+	}
+	return ""
+}
+
+// jpegMetadata returns the EXIF TIFF blob of a JPEG (nil without one) and
+// whether it embeds an ICC profile; it stops at the first scan.
+func jpegMetadata(data []byte) ([]byte, bool) {
+	var tiff []byte
+	icc := false
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || n < 2 || i+2+n > len(data) {
+			break
+		}
+		payload := data[i+4 : i+2+n]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) && tiff == nil:
+			tiff = payload[6:]
+		case marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			icc = true
+		}
+		i += 2 + n
+	}
+	return tiff, icc
+}
+
+// exifNames are the tags worth showing, from IFD0 and the Exif sub-IFD.
+var exifNames = map[uint16]string{
+	0x010F: "Make", 0x0110: "Model", 0x0112: "Orientation", 0x0131: "Software", 0x0132: "DateTime",
+	0x829A: "ExposureTime", 0x829D: "FNumber", 0x8827: "ISO", 0x9003: "DateTimeOriginal",
+	0x920A: "FocalLength", 0xA001: "ColorSpace",
+}
+
+// exifTags reads exifNames from a TIFF blob; a GPS sub-IFD shows up as "GPS".
+func exifTags(tiff []byte) map[string]string {
+	if len(tiff) < 8 {
+		return nil
+	}
+	var bo binary.ByteOrder = binary.BigEndian
+	if tiff[0] == 'I' {
+		bo = binary.LittleEndian
+	}
+	tags := map[string]string{}
+	var walk func(off, depth int)
+	walk = func(off, depth int) {
+		if off+2 > len(tiff) || depth > 1 {
+			return
+		}
+		count := int(bo.Uint16(tiff[off:]))
+		for k := 0; k < count; k++ {
+			e := off + 2 + 12*k
+			if e+12 > len(tiff) {
+				return
+			}
+			tag, typ, n := bo.Uint16(tiff[e:]), bo.Uint16(tiff[e+2:]), int(bo.Uint32(tiff[e+4:]))
+			switch tag {
+			case 0x8769:
+				walk(int(bo.Uint32(tiff[e+8:])), depth+1)
+				continue
+			case 0x8825:
+				tags["GPS"] = "present"
+				continue
+			}
+			if name, ok := exifNames[tag]; ok {
+				if v := exifValue(tiff, bo, e, typ, n); v != "" {
+					tags[name] = v
+				}
+			}
+		}
+	}
+	walk(int(bo.Uint32(tiff[4:])), 0)
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// exifValue formats the ASCII, SHORT, LONG or RATIONAL value of the entry at e.
+func exifValue(tiff []byte, bo binary.ByteOrder, e int, typ uint16, n int) string {
+	at := func(size int) []byte {
+		if size <= 4 {
+			return tiff[e+8 : e+8+size]
+		}
+		off := int(bo.Uint32(tiff[e+8:]))
+		if off < 0 || off+size > len(tiff) {
+			return nil
+		}
+		return tiff[off : off+size]
+	}
+	switch typ {
+	case 2: // ASCII
+		if n > 256 {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimRight(string(at(n)), "\x00"))
+	case 3: // SHORT
+		return strconv.Itoa(int(bo.Uint16(tiff[e+8:])))
+	case 4: // LONG
+		return strconv.Itoa(int(bo.Uint32(tiff[e+8:])))
+	case 5: // RATIONAL
+		b := at(8)
+		if b == nil {
+			return ""
+		}
+		num, den := bo.Uint32(b), bo.Uint32(b[4:])
+		if den == 0 {
+			return ""
+		}
+		if num < den && num > 0 {
+			return fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+		}
+		return strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+	}
+	return ""
+}
+
+var (
+	pdfPageObject = regexp.MustCompile(`/Type\s*/Page[^s]`)
+	pdfPagesCount = regexp.MustCompile(`/Count\s+(\d+)`)
+)
+
+// pdfPageCount counts page objects without rendering; documents that keep
+// them in compressed object streams fall back to the largest /Count of a
+// page tree. 0 when neither is found.
+func pdfPageCount(raw []byte) int {
+	if n := len(pdfPageObject.FindAllIndex(raw, -1)); n > 0 {
+		return n
+	}
+	best := 0
+	for _, m := range pdfPagesCount.FindAllSubmatch(raw, -1) {
+		if n, err := strconv.Atoi(string(m[1])); err == nil && n > best {
+			best = n
+		}
+	}
+	return best
+}
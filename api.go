@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ===== JSON API =====
+// POST /api/v1/compress runs a job and always answers JSON: per input file its
+// status, sizes, skip reasons and every output (name, bytes, scale, quality),
+// plus an absolute download URL for the master ZIP. It takes the same
+// multipart fields as /process, or a JSON body with base64 file data and the
+// form settings as strings. A JSON file with a "path" (its webkitRelativePath)
+// is part of a folder upload: its folder tree is mirrored in the ZIP below the
+// top folder, like the "folder" field of the page.
+//
+// With direct=1 (form field, query parameter or "direct": true) and exactly
+// one image and one target, the answer is the compressed image itself instead
+// of JSON and a stored ZIP: Content-Type of the output, X-Original-Bytes for
+// the upload size. Errors stay JSON.
+//
+// Status codes: 200 when something was compressed (status ok or partial), 422
+// when nothing was (status failed, skips say why), 400 bad request or settings
+// (with "fields"), 413 too large, 415 other content types, 503 busy or in
+// maintenance (with Retry-After), 507 result storage full.
+//
+//	curl -F files=@scans.zip -F targets=168-174 .../api/v1/compress
+//	curl -H 'Content-Type: application/json' \
+//	  -d '{"settings":{"targets":"90-100"},"files":[{"name":"a.jpg","data":"<base64>"}]}' .../api/v1/compress
+//	curl -F files=@foto.jpg -F direct=1 -o foto_kecil.jpg .../api/v1/compress
+
+const apiMaxBody = 200 << 20
+
+type apiRequest struct {
+	Settings    map[string]string `json:"settings"`
+	ZipPassword string            `json:"zip_password"`
+	Direct      bool              `json:"direct"`
+	Files       []struct {
+		Name string `json:"name"`
+		Path string `json:"path,omitempty"` // "folder/sub/a.jpg": part of a folder upload, tree kept
+		Data string `json:"data"`           // standard base64
+	} `json:"files"`
+}
+
+type apiResponse struct {
+	Status      string     `json:"status"`
+	Token       string     `json:"token,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Files       []apiFile  `json:"files"`
+	Skips       []skipItem `json:"skips"`
+}
+
+type apiFile struct {
+	File     string         `json:"file"`
+	Label    string         `json:"label"`
+	Source   string         `json:"source,omitempty"`
+	Status   string         `json:"status"` // ok, partial or skipped
+	InBytes  int            `json:"in_bytes"`
+	OutBytes int            `json:"out_bytes"`
+	Outputs  []outputRecord `json:"outputs"`
+	Skipped  []string       `json:"skipped"`
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+}
+
+// apiReadError maps a body read error to 413 or 400.
+func apiReadError(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		apiError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body over %d bytes", apiMaxBody))
+		return
+	}
+	apiError(w, http.StatusBadRequest, err.Error())
+}
+
+func apiCompressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	release, reason, retry := reserveJob()
+	if reason != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		if notice := maintenanceNotice(); notice != "" {
+			apiError(w, http.StatusServiceUnavailable, "maintenance: "+notice)
+			return
+		}
+		apiError(w, http.StatusServiceUnavailable, "server busy: "+reason)
+		return
+	}
+	defer release()
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxBody)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var opts Options
+	var jobs []Job
+	var err error
+	direct := r.URL.Query().Get("direct") == "1"
+	switch ct {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(apiMaxBody); err != nil {
+			apiReadError(w, err)
+			return
+		}
+		if err := verifyUploadChecksums(r); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := checkStoredInputs(r); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts, err = readSettings(r, ""); err == nil {
+			jobs = collectJobs(r, opts)
+		}
+		direct = direct || r.FormValue("direct") == "1"
+	case "application/json":
+		var req apiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiReadError(w, fmt.Errorf("bad JSON: %w", err))
+			return
+		}
+		direct = direct || req.Direct
+		if opts, err = settingsFrom(func(k string) string { return req.Settings[k] }); err == nil {
+			pol := extPolicyFrom(opts)
+			pol.zipPassword = req.ZipPassword
+			usedLabels := map[string]int{}
+			splits := newSplitZips()
+			for i, f := range req.Files {
+				data, derr := base64.StdEncoding.DecodeString(f.Data)
+				if derr != nil || f.Name == "" {
+					apiError(w, http.StatusBadRequest, fmt.Sprintf("files[%d]: need a name and base64 data", i))
+					return
+				}
+				if f.Path != "" {
+					jobs = append(jobs, jobsFromFolderUpload(f.Path, data, pol)...)
+					continue
+				}
+				jobs = append(jobs, splits.jobs(f.Name, data, usedLabels, pol)...)
+			}
+			jobs = append(jobs, splits.incomplete()...)
+		}
+	default:
+		apiError(w, http.StatusUnsupportedMediaType, "send multipart/form-data or application/json")
+		return
+	}
+	var errs settingsErrors
+	if errors.As(err, &errs) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": errs.Error(), "fields": errs.byField()})
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(jobs) == 0 {
+		apiError(w, http.StatusBadRequest, "no files")
+		return
+	}
+
+	if direct {
+		if len(jobs) != 1 || jobs[0].Skip != "" || !IMG_EXT[inputExt(jobs[0].Rel)] || len(opts.targets) != 1 {
+			apiError(w, http.StatusBadRequest, "direct=1 needs exactly one image and one target")
+			return
+		}
+		writeDirect(w, jobs[0].Rel, jobs[0].Data, opts)
+		return
+	}
+
+	resp := apiResponse{Status: "failed", Files: []apiFile{}, Skips: []skipItem{}}
+	if hasWork(jobs) {
+		manifest, _, err := runJobs(jobs, opts, "")
+		switch {
+		case errors.Is(err, errStoreFull):
+			apiError(w, http.StatusInsufficientStorage, err.Error())
+			return
+		case err != nil:
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		setResultOwner(manifest.Token, resultOwner(r))
+		resp = apiResponseFrom(manifest)
+		resp.DownloadURL = absoluteDownloadURL(r, manifest.Token)
+	} else {
+		// nothing to run: report the refused inputs the way a job would
+		for _, j := range jobs {
+			msgs := []string{j.Rel + ": " + j.Skip}
+			resp.Files = append(resp.Files, apiFile{File: j.Rel, Label: j.Label, Source: j.Source, Status: "skipped",
+				Outputs: []outputRecord{}, Skipped: msgs})
+			resp.Skips = append(resp.Skips, newSkipItems(j.Label, msgs, []skipKind{j.SkipKind})...)
+		}
+	}
+	code := http.StatusOK
+	if resp.Status == "failed" {
+		code = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("api: %v", err)
+	}
+}
+
+// writeDirect compresses one image within the request and answers with the
+// output bytes; it returns their size, or false after answering 422 JSON with
+// the skip reasons. There is no ZIP, no stored result and no thumbnail, but
+// it counts as a running job against MAX_ACTIVE_JOBS while it works.
+func writeDirect(w http.ResponseWriter, name string, raw []byte, opts Options) (int, bool) {
+	progress, _ := startJob("", []Job{{Rel: name}}) // a fresh id cannot clash
+	defer finishJob(progress.ID)
+	opts.Thumbs, opts.ContactSheet = false, false
+	_, _, skipped, outs := processOneFileEntry(name, raw, "direct", opts)
+	if len(outs) != 1 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "not compressed", "skipped": skipMessages(skipped)})
+		return 0, false
+	}
+	for out, data := range outs {
+		ct := mime.TypeByExtension(extLower(out))
+		if ct == "" {
+			ct = http.DetectContentType(data)
+		}
+		w.Header().Set("Content-Type", ct)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(out)}))
+		w.Header().Set("X-Original-Bytes", strconv.Itoa(len(raw)))
+		w.Write(data)
+		return len(data), true
+	}
+	return 0, false
+}
+
+func apiResponseFrom(m resultManifest) apiResponse {
+	resp := apiResponse{Status: m.Status, Token: m.Token, Expires: m.Expires, Files: []apiFile{}, Skips: m.Skips}
+	for _, f := range m.Files {
+		af := apiFile{File: f.File, Label: f.Label, Source: f.Source, Status: f.Status,
+			InBytes: f.InBytes, OutBytes: f.OutBytes, Outputs: []outputRecord{}, Skipped: f.Skipped}
+		if af.Skipped == nil {
+			af.Skipped = []string{}
+		}
+		af.Outputs = append(af.Outputs, f.Records...)
+		resp.Files = append(resp.Files, af)
+	}
+	return resp
+}
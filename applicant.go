@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ===== Applicant metadata =====
+// The form can tag an upload batch with the applicant's name/ID and a document
+// type. Everything in the batch then lands in one folder named after the
+// applicant ("12345_Budi_Santoso/"), and loose files are named after the
+// document type ("KTP.jpg", "KTP_2.jpg") instead of their upload names.
+// ZIP and folder uploads keep their own structure inside the applicant folder.
+//
+//	DOC_TYPES="KTP,KK,Ijazah,Transkrip nilai,Pas foto,Lainnya"
+
+func setupDocTypes() { updateLive(docTypeSettings) }
+
+// docTypeSettings reads DOC_TYPES into c.
+func docTypeSettings(c *liveConfig) error {
+	c.DOC_TYPES = liveDefaults.DOC_TYPES
+	if v := os.Getenv("DOC_TYPES"); v != "" {
+		c.DOC_TYPES = nil
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				c.DOC_TYPES = append(c.DOC_TYPES, t)
+			}
+		}
+	}
+	return nil
+}
+
+type applicantMeta struct {
+	Folder  string // "" when no metadata was given
+	DocType string
+	used    map[string]int
+}
+
+// safeName keeps letters and digits, turning runs of anything else into "_".
+func safeName(s string) string {
+	var b strings.Builder
+	sep := false
+	for _, r := range strings.TrimSpace(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			sep = false
+		} else {
+			sep = true
+		}
+	}
+	return b.String()
+}
+
+func applicantFrom(r *http.Request) *applicantMeta {
+	m := &applicantMeta{used: map[string]int{}}
+	parts := []string{}
+	for _, k := range []string{"applicant_id", "applicant_name"} {
+		if v := safeName(r.FormValue(k)); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	m.Folder = strings.Join(parts, "_")
+	// API clients may send types outside DOC_TYPES; they are only sanitized
+	if m.DocType = safeName(r.FormValue("doc_type")); m.DocType != "" && m.Folder == "" {
+		m.Folder = "pemohon"
+	}
+	return m
+}
+
+// apply moves jobs into the applicant folder; loose marks single uploaded
+// files, which are renamed after the document type.
+func (m *applicantMeta) apply(jobs []Job, loose bool) []Job {
+	if m.Folder == "" {
+		return jobs
+	}
+	for i := range jobs {
+		if loose && m.DocType != "" && jobs[i].Skip == "" {
+			m.used[m.DocType]++
+			name := m.DocType
+			if n := m.used[m.DocType]; n > 1 {
+				name = fmt.Sprintf("%s_%d", name, n)
+			}
+			jobs[i].Rel = name + filepath.Ext(jobs[i].Rel)
+		} else if !loose {
+			jobs[i].Rel = path.Join(jobs[i].Label, jobs[i].Rel)
+		}
+		jobs[i].Label = m.Folder
+	}
+	return jobs
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ===== OIDC login =====
+// With OIDC_ISSUER set every page needs a login through the organisation's
+// OpenID Connect provider. Group membership (OIDC_GROUPS_CLAIM, default
+// "groups") maps to roles: OIDC_ADMIN_GROUPS may use /admin, OIDC_USER_GROUPS
+// may use the app (empty = anyone the provider lets in). Share links (/s/)
+// stay public and the extension API checks its own tokens. The login lives in
+// a signed cookie for OIDC_SESSION_TTL.
+//
+//	OIDC_ISSUER=https://login.example.com/realms/office OIDC_CLIENT_ID=multicompress
+//	OIDC_CLIENT_SECRET=... OIDC_ADMIN_GROUPS=it-admins OIDC_USER_GROUPS=staff
+//	OIDC_REDIRECT_URL=https://compress.example.com/auth/callback (default: derived per request)
+
+const (
+	authCookie  = "mc_auth"
+	oidcCookie  = "mc_oidc"
+	roleUser    = "user"
+	roleAdmin   = "admin"
+	authCtxUser = ctxKey("user")
+)
+
+type ctxKey string
+
+var (
+	OIDC_ISSUER       = ""
+	OIDC_REDIRECT_URL = ""
+	OIDC_GROUPS_CLAIM = "groups"
+	OIDC_ADMIN_GROUPS = map[string]bool{}
+	OIDC_USER_GROUPS  = map[string]bool{}
+	OIDC_SESSION_TTL  = 12 * time.Hour
+
+	oidcVerifier *oidc.IDTokenVerifier
+	oauthConfig  oauth2.Config
+)
+
+// authUser is who is logged in; stored in the auth cookie.
+type authUser struct {
+	Subject string    `json:"sub"`
+	Email   string    `json:"email"`
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"exp"`
+}
+
+// ID is how results and preferences are attributed to the user.
+func (u *authUser) ID() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.Subject
+}
+
+type oidcLogin struct {
+	State string `json:"state"`
+	Nonce string `json:"nonce"`
+	Next  string `json:"next"`
+}
+
+func splitSet(v string) map[string]bool {
+	m := map[string]bool{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			m[s] = true
+		}
+	}
+	return m
+}
+
+func setupAuth() error {
+	OIDC_ISSUER = os.Getenv("OIDC_ISSUER")
+	if OIDC_ISSUER == "" {
+		return nil
+	}
+	OIDC_REDIRECT_URL = os.Getenv("OIDC_REDIRECT_URL")
+	if v := os.Getenv("OIDC_GROUPS_CLAIM"); v != "" {
+		OIDC_GROUPS_CLAIM = v
+	}
+	OIDC_ADMIN_GROUPS = splitSet(os.Getenv("OIDC_ADMIN_GROUPS"))
+	OIDC_USER_GROUPS = splitSet(os.Getenv("OIDC_USER_GROUPS"))
+	if d, err := time.ParseDuration(os.Getenv("OIDC_SESSION_TTL")); err == nil && d > 0 {
+		OIDC_SESSION_TTL = d
+	}
+	if os.Getenv("SESSION_SECRET") == "" {
+		log.Printf("OIDC without SESSION_SECRET: logins end on restart")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, OIDC_ISSUER)
+	if err != nil {
+		return err
+	}
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if clientID == "" {
+		return fmt.Errorf("OIDC_ISSUER needs OIDC_CLIENT_ID")
+	}
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: clientID})
+	oauthConfig = oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func currentUser(r *http.Request) *authUser {
+	u, _ := r.Context().Value(authCtxUser).(*authUser)
+	return u
+}
+
+// resultOwner labels a result for the admin page: the login if any, else the client IP.
+func resultOwner(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.ID()
+	}
+	return clientIP(r)
+}
+
+// withAuth requires an OIDC login for everything but the login flow, share
+// links and the extension API.
+func withAuth(next http.Handler) http.Handler {
+	if OIDC_ISSUER == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/auth/") || strings.HasPrefix(r.URL.Path, "/s/") || strings.HasPrefix(r.URL.Path, extensionPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var u authUser
+		if !readSignedCookie(r, authCookie, &u) || time.Now().After(u.Expires) {
+			if r.Method == http.MethodGet && !wantsJSON(r) {
+				http.Redirect(w, r, BASE_PATH+"/auth/login?next="+BASE_PATH+r.URL.RequestURI(), http.StatusFound)
+				return
+			}
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authCtxUser, &u)))
+	})
+}
+
+func redirectURL(r *http.Request) string {
+	if OIDC_REDIRECT_URL != "" {
+		return OIDC_REDIRECT_URL
+	}
+	return requestScheme(r) + "://" + r.Host + BASE_PATH + "/auth/callback"
+}
+
+// localNext returns next when it is a path on this site, else the start page.
+// Browsers read "/\evil.com" like "//evil.com", so backslashes are refused
+// along with anything that has a scheme or host (url.Parse already refuses
+// the control characters browsers would strip).
+func localNext(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return BASE_PATH + "/"
+	}
+	return next
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if OIDC_ISSUER == "" {
+		http.NotFound(w, r)
+		return
+	}
+	st := oidcLogin{State: randomHex(16), Nonce: randomHex(16), Next: localNext(r.FormValue("next"))}
+	setSignedCookie(w, r, oidcCookie, st, 10*time.Minute)
+	cfg := oauthConfig
+	cfg.RedirectURL = redirectURL(r)
+	http.Redirect(w, r, cfg.AuthCodeURL(st.State, oidc.Nonce(st.Nonce)), http.StatusFound)
+}
+
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	if OIDC_ISSUER == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var st oidcLogin
+	if !readSignedCookie(r, oidcCookie, &st) || r.FormValue("state") != st.State {
+		http.Error(w, "login expired, try again", http.StatusBadRequest)
+		return
+	}
+	clearCookie(w, oidcCookie)
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "login failed: "+e+" "+r.FormValue("error_description"), http.StatusForbidden)
+		return
+	}
+	cfg := oauthConfig
+	cfg.RedirectURL = redirectURL(r)
+	tok, err := cfg.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		http.Error(w, "token exchange: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	raw, _ := tok.Extra("id_token").(string)
+	idt, err := oidcVerifier.Verify(r.Context(), raw)
+	if err != nil {
+		http.Error(w, "id token: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if idt.Nonce != st.Nonce {
+		http.Error(w, "id token: nonce mismatch", http.StatusForbidden)
+		return
+	}
+	var claims map[string]interface{}
+	if err := idt.Claims(&claims); err != nil {
+		http.Error(w, "id token: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	u := authUser{Subject: idt.Subject, Expires: time.Now().Add(OIDC_SESSION_TTL)}
+	u.Email, _ = claims["email"].(string)
+	u.Name, _ = claims["name"].(string)
+	u.Role = roleFor(claims[OIDC_GROUPS_CLAIM])
+	if u.Role == "" {
+		log.Printf("auth: %s (%s) not in OIDC_USER_GROUPS", u.ID(), clientIP(r))
+		http.Error(w, "Akun Anda tidak punya akses ke aplikasi ini.", http.StatusForbidden)
+		return
+	}
+	log.Printf("auth: %s logged in as %s", u.ID(), u.Role)
+	setSignedCookie(w, r, authCookie, u, OIDC_SESSION_TTL)
+	http.Redirect(w, r, st.Next, http.StatusFound)
+}
+
+// roleFor maps the groups claim (a list, or a single string) to a role; "" means no access.
+func roleFor(claim interface{}) string {
+	groups := []string{}
+	switch g := claim.(type) {
+	case string:
+		groups = append(groups, g)
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	user := len(OIDC_USER_GROUPS) == 0
+	for _, g := range groups {
+		if OIDC_ADMIN_GROUPS[g] {
+			return roleAdmin
+		}
+		user = user || OIDC_USER_GROUPS[g]
+	}
+	if user {
+		return roleUser
+	}
+	return ""
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, authCookie)
+	http.Redirect(w, r, BASE_PATH+"/", http.StatusFound)
+}
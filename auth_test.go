@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestLocalNext(t *testing.T) {
+	home := BASE_PATH + "/"
+	for next, want := range map[string]string{
+		"/history?page=2":       "/history?page=2",
+		"/":                     "/",
+		"":                      home,
+		"history":               home,
+		"//evil.com":            home,
+		"/\\evil.com":           home,
+		"/\\/evil.com":          home,
+		"https://evil.com/":     home,
+		"javascript:alert(1)":   home,
+		"/\t/evil.com":          home,
+		"/%0a/evil.com":         "/%0a/evil.com",
+		"///evil.com":           home,
+		"\\\\evil.com":          home,
+		"https:/evil.com":       home,
+		"/path/with:colon?x=//": "/path/with:colon?x=//",
+	} {
+		if got := localNext(next); got != want {
+			t.Errorf("localNext(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Backpressure =====
+// New work is turned away with 503 + Retry-After while too many jobs are running
+// or memory is above the soft limit, instead of accepting uploads that would OOM.
+//
+// MEM_HARD_LIMIT_MB is the container's memory; the Go runtime gets 90% of it
+// as GOMEMLIMIT (the rest is left to C decoders), unless GOMEMLIMIT is set
+// explicitly. MEM_SOFT_LIMIT_MB (default 75% of the hard limit; MAX_HEAP_MB is
+// the old name) pauses intake: new jobs get 503 and running jobs wait before
+// starting their next file. Memory is read from runtime/metrics (total mapped
+// minus released to the OS), which needs no stop-the-world.
+//
+//	MAX_ACTIVE_JOBS=4 MEM_HARD_LIMIT_MB=512 MEM_SOFT_LIMIT_MB=384   (0 = no limit)
+
+func setupBackpressure() { updateLive(backpressureSettings) }
+
+// backpressureSettings reads the job and memory limits into c.
+func backpressureSettings(c *liveConfig) error {
+	c.MAX_ACTIVE_JOBS, c.MEM_HARD_LIMIT_MB = liveDefaults.MAX_ACTIVE_JOBS, liveDefaults.MEM_HARD_LIMIT_MB
+	if n, err := strconv.Atoi(os.Getenv("MAX_ACTIVE_JOBS")); err == nil && n >= 0 {
+		c.MAX_ACTIVE_JOBS = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("MEM_HARD_LIMIT_MB")); err == nil && n >= 0 {
+		c.MEM_HARD_LIMIT_MB = n
+	}
+	c.MEM_SOFT_LIMIT_MB = c.MEM_HARD_LIMIT_MB * 3 / 4
+	for _, k := range []string{"MAX_HEAP_MB", "MEM_SOFT_LIMIT_MB"} {
+		if n, err := strconv.Atoi(os.Getenv(k)); err == nil && n >= 0 {
+			c.MEM_SOFT_LIMIT_MB = n
+		}
+	}
+	if c.MEM_HARD_LIMIT_MB > 0 && c.MEM_SOFT_LIMIT_MB > c.MEM_HARD_LIMIT_MB {
+		log.Printf("memory: soft limit %d MB above hard limit %d MB, using the hard limit", c.MEM_SOFT_LIMIT_MB, c.MEM_HARD_LIMIT_MB)
+		c.MEM_SOFT_LIMIT_MB = c.MEM_HARD_LIMIT_MB
+	}
+	switch {
+	case os.Getenv("GOMEMLIMIT") != "":
+		if c.MEM_HARD_LIMIT_MB > 0 {
+			log.Printf("memory: GOMEMLIMIT=%s set explicitly, not derived from MEM_HARD_LIMIT_MB", os.Getenv("GOMEMLIMIT"))
+		}
+	case c.MEM_HARD_LIMIT_MB > 0:
+		debug.SetMemoryLimit(int64(c.MEM_HARD_LIMIT_MB) << 20 * 9 / 10)
+	default:
+		// the limit was removed on reload: no limit, the runtime's default
+		debug.SetMemoryLimit(math.MaxInt64)
+	}
+	return nil
+}
+
+var memSamples = []rtmetrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// memoryInUseMB is the memory the Go runtime holds from the OS.
+func memoryInUseMB() int {
+	s := make([]rtmetrics.Sample, len(memSamples))
+	copy(s, memSamples)
+	rtmetrics.Read(s)
+	return int((s[0].Value.Uint64() - s[1].Value.Uint64()) >> 20)
+}
+
+// overSoftLimit reports the memory in use when it is at or above MEM_SOFT_LIMIT_MB.
+func overSoftLimit() (int, bool) {
+	soft := live().MEM_SOFT_LIMIT_MB
+	if soft <= 0 {
+		return 0, false
+	}
+	used := memoryInUseMB()
+	return used, used >= soft
+}
+
+// waitForMemory holds a job's next file while memory is over the soft limit
+// and other files of the job (inFlight) are still running and will free some.
+// It gives up after a minute so a job can't stall forever.
+func waitForMemory(inFlight func() int) {
+	deadline := time.Now().Add(time.Minute)
+	for logged := false; inFlight() > 0 && time.Now().Before(deadline); {
+		used, over := overSoftLimit()
+		if !over {
+			return
+		}
+		if !logged {
+			log.Printf("memory: %d MB in use (soft limit %d MB), pausing intake", used, live().MEM_SOFT_LIMIT_MB)
+			logged = true
+		}
+		runtime.GC()
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// jobSlots counts the requests holding an active-job slot (reserveJob);
+// guarded by jobsMu. A slot is taken before the upload is read and covers the
+// job the request starts later, so MAX_ACTIVE_JOBS holds even while uploads
+// that passed the check have not registered their job yet.
+var jobSlots int
+
+// saturated reports why new work should wait ("" if it shouldn't) and a retry hint in seconds.
+func saturated() (string, int) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return saturatedLocked()
+}
+
+// reserveJob takes an active-job slot unless the server is saturated; the
+// check and the reservation are one step under jobsMu. release (nil when
+// refused) gives the slot back and may be called more than once.
+func reserveJob() (release func(), reason string, retry int) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if reason, retry := saturatedLocked(); reason != "" {
+		return nil, reason, retry
+	}
+	jobSlots++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			jobsMu.Lock()
+			jobSlots--
+			jobsMu.Unlock()
+		})
+	}, "", 0
+}
+
+// saturatedLocked is saturated with jobsMu held.
+func saturatedLocked() (string, int) {
+	if maintenanceNotice() != "" {
+		return "maintenance", MAINTENANCE_RETRY
+	}
+	running, eta := 0, math.MaxFloat64
+	for _, p := range jobsRunning {
+		if p.State == "running" {
+			running++
+			eta = math.Min(eta, p.ETASeconds)
+		}
+	}
+	// a job started without a slot (the CLI) still counts
+	active := max(jobSlots, running)
+	retry := 30
+	if running > 0 {
+		retry = clampInt(int(math.Ceil(eta)), 5, 300)
+	}
+	cfg := live()
+	if cfg.MAX_ACTIVE_JOBS > 0 && active >= cfg.MAX_ACTIVE_JOBS {
+		return fmt.Sprintf("%d jobs running (limit %d)", active, cfg.MAX_ACTIVE_JOBS), retry
+	}
+	if used, over := overSoftLimit(); over {
+		return fmt.Sprintf("memory %d MB (soft limit %d MB)", used, cfg.MEM_SOFT_LIMIT_MB), retry
+	}
+	return "", 0
+}
+
+// admitJob reserves an active-job slot for the request, or answers 503 and
+// returns false when the server is saturated. Call it before parsing the
+// upload so a rejected body isn't buffered, and defer release.
+func admitJob(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	release, reason, retry := reserveJob()
+	if reason == "" {
+		return release, true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	notice := maintenanceNotice()
+	// not wantsJSON: FormValue would read the whole body
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if notice != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "maintenance: " + notice, "maintenance": true, "retry_after": retry})
+			return nil, false
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "server busy: " + reason, "retry_after": retry})
+		return nil, false
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if notice != "" {
+		// the page shows the notice itself (see the maintenance template func)
+		tplIndex.Execute(w, map[string]interface{}{})
+		return nil, false
+	}
+	tplIndex.Execute(w, map[string]interface{}{"Message": fmt.Sprintf("Server sedang sibuk, coba lagi dalam %d detik.", retry)})
+	return nil, false
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+)
+
+// ===== Batch CLI =====
+// `multicompressgo compress` runs the same pipeline as the web form on local
+// files and writes the master ZIP, for cron jobs and CI where a server is
+// overkill. Folders given with -in (or as arguments) are walked; ZIPs, images
+// and PDFs are taken as if uploaded. Any form field can be passed with -set.
+// Progress goes to stderr (or a live view with -tui, see tui.go), the summary
+// to stdout; with -json stdout carries the same result manifest /process
+// answers with format=json instead, plus "output". Exit status:
+//
+//	0  every file compressed
+//	1  fatal: nothing compressed, or the ZIP could not be built or written
+//	2  usage: bad flags or settings
+//	3  partial: some files (or PDF pages / targets) were skipped
+//
+// How much is printed is set with -q (totals and skip counts), the default
+// (totals, per-source lines, skipped files), -v (plus a progress line per
+// file) and -vv (plus sizes and times, and a summary line per output).
+//
+//	multicompressgo compress -in ./scans -out compressed.zip -target 168-174
+//	STORAGE_BACKEND=s3 S3_BUCKET=scans multicompressgo compress -input-prefix inbox/ -output-prefix done/ -output-files
+//	multicompressgo compress -json -set min_kb=90 -set max_kb=100 -set thumbs=on a.zip b.pdf | jq .status
+
+const (
+	exitOK      = 0
+	exitFatal   = 1
+	exitUsage   = 2
+	exitPartial = 3
+)
+
+// givenString is a string flag that remembers whether it was set.
+type givenString struct {
+	value string
+	given bool
+}
+
+func (s *givenString) String() string { return s.value }
+
+func (s *givenString) Set(v string) error {
+	s.value, s.given = v, true
+	return nil
+}
+
+var compressOpts struct {
+	in, target, speed   string
+	out                 givenString
+	inPrefix, outPrefix string
+	zipPassword         string
+	sets                map[string]string // -set key=value
+	json, tui, outFiles bool
+	quiet, verbose, vv  bool
+}
+
+func compressFlags(fset *flag.FlagSet) {
+	o := &compressOpts
+	fset.StringVar(&o.in, "in", "", "folder to walk (in addition to the path arguments)")
+	o.out = givenString{value: MASTER_ZIP_NAME}
+	fset.Var(&o.out, "out", "master ZIP to write")
+	fset.StringVar(&o.target, "target", "", "size targets, e.g. 168-174 or 168-174,95-100@1600px (default: min_kb-max_kb)")
+	fset.StringVar(&o.speed, "speed", "", "fast or balanced (default SPEED_PRESET)")
+	fset.BoolVar(&o.json, "json", false, "print the result manifest as JSON on stdout")
+	fset.BoolVar(&o.tui, "tui", false, "show a live terminal view instead of progress lines (needs a terminal)")
+	fset.BoolVar(&o.quiet, "q", false, "quiet: no progress, only the totals and skip counts")
+	fset.BoolVar(&o.verbose, "v", false, "verbose: a progress line per file and every skip")
+	fset.StringVar(&o.inPrefix, "input-prefix", "", "also compress every object under this STORAGE_BACKEND prefix")
+	fset.StringVar(&o.outPrefix, "output-prefix", "", "write the result under this STORAGE_BACKEND prefix (then -out is only written when given)")
+	fset.BoolVar(&o.outFiles, "output-files", false, "with -output-prefix: write the individual outputs instead of the ZIP")
+	fset.StringVar(&o.zipPassword, "zip-password", "", "password for encrypted ZIPs (ZipCrypto or AES)")
+	fset.BoolVar(&o.vv, "vv", false, "very verbose: like -v, plus sizes and times per file and a summary line per output")
+	o.sets = map[string]string{}
+	fset.Func("set", "form setting as key=value (repeatable)", func(kv string) error {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", kv)
+		}
+		o.sets[strings.TrimSpace(k)] = v
+		return nil
+	})
+}
+
+func runCompressCLI(args []string) {
+	o := &compressOpts
+	sets := o.sets
+	level := 1
+	switch {
+	case o.vv:
+		level = 3
+	case o.verbose:
+		level = 2
+	case o.quiet:
+		level = 0
+	}
+
+	// fail ends the run with code, as a manifest on stdout when -json is set.
+	fail := func(code int, format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		fmt.Fprintln(os.Stderr, msg)
+		if o.json {
+			json.NewEncoder(os.Stdout).Encode(resultManifest{Status: "failed", Files: []manifestFile{}, Skips: []skipItem{}, Error: msg})
+		}
+		os.Exit(code)
+	}
+	setupProcessing()
+	if err := setupDecoders(); err != nil {
+		fail(exitFatal, "%v", err)
+	}
+	if o.target != "" {
+		sets["targets"] = o.target
+	}
+	sets["speed"] = live().SPEED_PRESET
+	if o.speed != "" {
+		sets["speed"] = o.speed
+	}
+	opts, err := settingsFrom(func(k string) string { return sets[k] })
+	if err != nil {
+		fail(exitUsage, "invalid settings: %v", err)
+	}
+
+	paths := args
+	if o.in != "" {
+		paths = append(paths, o.in)
+	}
+	if len(paths) == 0 && o.inPrefix == "" {
+		fail(exitUsage, "usage: multicompressgo compress [-in folder] [-input-prefix p] [-out file.zip] [-output-prefix p] [-target MIN-MAX] [-set key=value] [-json] [paths...]")
+	}
+	writeOut := true
+	if o.inPrefix != "" || o.outPrefix != "" {
+		if err := setupStorage(); err != nil {
+			fail(exitFatal, "storage: %v", err)
+		}
+		if store == nil {
+			fail(exitUsage, "-input-prefix and -output-prefix need STORAGE_BACKEND")
+		}
+		if o.outPrefix != "" {
+			if err := checkOutputPrefix(o.outPrefix); err != nil {
+				fail(exitUsage, "%v", err)
+			}
+			writeOut = o.out.given
+		}
+	}
+	usedLabels := map[string]int{}
+	pol := extPolicyFrom(opts)
+	pol.zipPassword = o.zipPassword
+	jobs := cliJobs(paths, usedLabels, pol)
+	if o.inPrefix != "" {
+		more, err := jobsFromStorage(o.inPrefix, usedLabels, pol)
+		if err != nil {
+			fail(exitFatal, "%s: %v", o.inPrefix, err)
+		}
+		jobs = append(jobs, more...)
+	}
+	if len(jobs) == 0 {
+		fail(exitFatal, "no input files found")
+	}
+
+	jobID := newToken("cli")
+	report := newJobReport(jobID)
+	written := int64(0)
+	run := func() (resultManifest, error) {
+		result, _, err := buildMasterZip(jobs, opts, jobID)
+		manifest := report.finish()
+		if err != nil {
+			return manifest, fmt.Errorf("building %s: %v", o.out.value, err)
+		}
+		defer result.remove()
+		if o.outPrefix != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+			defer cancel()
+			n, err := exportResult(ctx, result, o.outPrefix, filepath.Base(o.out.value), o.outFiles)
+			if err != nil {
+				return manifest, fmt.Errorf("writing to %s: %v", o.outPrefix, err)
+			}
+			manifest.Output, manifest.Exported = o.outPrefix, n
+		}
+		if writeOut {
+			if err := result.saveAs(o.out.value, 0o644); err != nil {
+				return manifest, fmt.Errorf("writing %s: %v", o.out.value, err)
+			}
+			manifest.Output, written = o.out.value, result.size
+		}
+		return manifest, nil
+	}
+
+	var manifest resultManifest
+	if o.tui && isatty.IsTerminal(os.Stderr.Fd()) {
+		var aborted bool
+		manifest, aborted, err = runCompressTUI(jobs, jobID, run)
+		if aborted {
+			fail(exitFatal, "aborted")
+		}
+	} else {
+		var mu sync.Mutex
+		done := 0
+		stop := subscribe(func(ev jobEvent) {
+			if ev.Job != jobID || (ev.Type != evFileDone && ev.Type != evFileSkipped) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			status := "skip"
+			if ev.Type == evFileDone {
+				status = "ok  "
+			}
+			switch {
+			case level >= 3:
+				fmt.Fprintf(os.Stderr, "[%d/%d] %s %s (%d -> %d bytes, %.1fs)\n", done, len(jobs), status, ev.File, ev.InBytes, ev.OutBytes, ev.Seconds)
+			case level == 2 || level == 1 && ev.Type == evFileSkipped:
+				fmt.Fprintf(os.Stderr, "[%d/%d] %s %s\n", done, len(jobs), status, ev.File)
+			}
+		})
+		manifest, err = run()
+		stop()
+		o.tui = false
+	}
+	if err != nil {
+		fail(exitFatal, "%v", err)
+	}
+	switch {
+	case o.json:
+		json.NewEncoder(os.Stdout).Encode(manifest)
+	case !o.tui:
+		printCLISummary(manifest, level)
+		fmt.Println()
+		if o.outPrefix != "" {
+			fmt.Printf("wrote %d objects under %s\n", manifest.Exported, o.outPrefix)
+		}
+		if writeOut {
+			fmt.Printf("wrote %s (%d bytes)\n", o.out.value, written)
+		}
+	}
+	switch manifest.Status {
+	case "failed":
+		os.Exit(exitFatal)
+	case "partial":
+		os.Exit(exitPartial)
+	}
+}
+
+// printCLISummary prints the result for the verbosity level: totals (and the
+// per-source lines) always, the skips one by one from level 1 (counts only
+// below) and every output line at level 3.
+func printCLISummary(m resultManifest, level int) {
+	total, bySource := &sourceStats{}, map[string]*sourceStats{}
+	for _, f := range m.Files {
+		if bySource[f.Source] == nil {
+			bySource[f.Source] = &sourceStats{}
+		}
+		bySource[f.Source].add(f.InBytes, f.OutBytes, f.Records, f.Skipped)
+		total.add(f.InBytes, f.OutBytes, f.Records, f.Skipped)
+	}
+	if level >= 3 {
+		fmt.Println(m.Summary)
+	} else {
+		for _, l := range sourceSummary(bySource) {
+			fmt.Println(l)
+		}
+	}
+	fmt.Println(total.line("total"))
+	if level == 0 {
+		for _, c := range skipCounts(m.Skips) {
+			fmt.Printf("skipped (%s): %d\n", c.Category, c.Count)
+		}
+		return
+	}
+	for _, s := range m.Skips {
+		fmt.Printf("skipped %s: %s\n", s.Label, s.Message)
+	}
+}
+
+// cliJobs reads every path (folders recursively, in name order) into jobs the
+// way an upload of the same files would: a folder like a folder upload of the
+// page, labelled after the folder with its tree mirrored below.
+func cliJobs(paths []string, usedLabels map[string]int, pol extPolicy) []Job {
+	jobs := []Job{}
+	splits := newSplitZips()
+	for _, root := range paths {
+		top := ""
+		if st, err := os.Stat(root); err == nil && st.IsDir() {
+			base := safeName(filepath.Base(filepath.Clean(root)))
+			if base == "" {
+				base = "folder"
+			}
+			top = base
+			if usedLabels[base] > 0 {
+				top = fmt.Sprintf("%s_%d", base, usedLabels[base]+1)
+			}
+			usedLabels[base]++
+		}
+		files := []string{}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", root, err)
+			continue
+		}
+		sort.Strings(files)
+		for _, path := range files {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				continue
+			}
+			// name as an upload would: the file itself, or its path in the walked folder
+			name := filepath.Base(path)
+			if rel, err := filepath.Rel(root, path); err == nil && top != "" && splitPart(name) == 0 {
+				jobs = append(jobs, jobsFromFolderUpload(top+"/"+filepath.ToSlash(rel), b, pol)...)
+				continue
+			}
+			jobs = append(jobs, splits.jobs(name, b, usedLabels, pol)...)
+		}
+	}
+	return append(jobs, splits.incomplete()...)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ===== Capabilities =====
+// PDF rendering needs a native backend (MuPDF by default, see pdfrender.go),
+// which may be missing or broken on the host. It is probed at startup by
+// rendering a one-page built-in PDF; when that fails, PDFs are skipped up front
+// with a clear message and the page shows a banner instead of every PDF
+// failing deep inside processing.
+// GET /capabilities re-runs the probe and reports what this server can do.
+
+// probePDF is about the smallest document the renderers open (they rebuild the missing xref).
+const probePDF = "%PDF-1.1\n" +
+	"1 0 obj<</Type/Catalog/Pages 2 0 R>>endobj\n" +
+	"2 0 obj<</Type/Pages/Kids[3 0 R]/Count 1>>endobj\n" +
+	"3 0 obj<</Type/Page/Parent 2 0 R/MediaBox[0 0 10 10]>>endobj\n" +
+	"trailer<</Root 1 0 R>>\n%%EOF\n"
+
+var pdfState = struct {
+	sync.RWMutex
+	err error
+}{}
+
+// checkPDF renders probePDF (through the sandbox when enabled) and records the outcome.
+func checkPDF() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		pdfState.Lock()
+		pdfState.err = err
+		pdfState.Unlock()
+	}()
+	imgs, err := pdfBytesToImages([]byte(probePDF), 72)
+	if err == nil && len(imgs) == 0 {
+		err = errors.New("rendered no pages")
+	}
+	return err
+}
+
+func setupPDFCheck() {
+	if err := checkPDF(); err != nil {
+		log.Printf("WARNING: PDF rendering (%s) unavailable, PDFs will be skipped: %v", PDF_RENDERER, err)
+	}
+}
+
+// pdfUnavailable is why PDFs cannot be rendered, or nil when they can.
+func pdfUnavailable() error {
+	pdfState.RLock()
+	defer pdfState.RUnlock()
+	return pdfState.err
+}
+
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	caps := map[string]interface{}{
+		"pdf":              true,
+		"pdf_renderer":     PDF_RENDERER,
+		"pdf_renderers":    pdfRendererNames(),
+		"heic":             heifDecode,
+		"external_decoder": externalKind,
+		"external_formats": externalFormats(),
+		"jxl_decode":       jxlDecode,
+		"jxl_encode":       jxlEncode,
+		"jpeg_encoders":    jpegEncoders(),
+		"zip":              ALLOW_ZIP,
+		"accepted_ext":     acceptedExts(),
+		"optional_ext":     optionalExts(),
+		"sandbox":          DECODE_SANDBOX,
+	}
+	if err := checkPDF(); err != nil {
+		caps["pdf"] = false
+		caps["pdf_error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ===== Check-only mode =====
+// Inspects files against the target constraints without re-encoding anything.
+
+type checkResult struct {
+	Name     string   `json:"name"`
+	SizeB    int      `json:"size_bytes"`
+	Format   string   `json:"format"`
+	Width    int      `json:"width"`
+	Height   int      `json:"height"`
+	Pages    int      `json:"pages,omitempty"` // PDFs
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+type checkReport struct {
+	MinKB   int           `json:"min_kb"`
+	MaxKB   int           `json:"max_kb"`
+	MinSide int           `json:"min_side"`
+	Passed  int           `json:"passed"`
+	Failed  int           `json:"failed"`
+	Files   []checkResult `json:"files"`
+
+	zipPassword string // for encrypted ZIPs, as zip_password of /process
+}
+
+// checkOneFile reports whether raw already satisfies the size window,
+// the minimum side and the JPEG output format. A PDF never does: it is only
+// counted, since every page becomes a JPEG of its own.
+func checkOneFile(relpath string, raw []byte, minKB, maxKB, minSide int) checkResult {
+	res := checkResult{Name: relpath, SizeB: len(raw)}
+	if PDF_EXT[inputExt(relpath)] {
+		res.Format, res.Pages = "pdf", pdfPageCount(raw)
+		if res.Pages == 0 {
+			res.Problems = append(res.Problems, "PDF without readable pages")
+		} else {
+			res.Problems = append(res.Problems, fmt.Sprintf("PDF with %d pages, each would become its own JPEG", res.Pages))
+		}
+		return res
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		res.Format = strings.TrimPrefix(extLower(relpath), ".")
+		res.Problems = append(res.Problems, "not a decodable image: "+err.Error())
+	} else {
+		res.Format, res.Width, res.Height = format, cfg.Width, cfg.Height
+		if format != "jpeg" {
+			res.Problems = append(res.Problems, "format "+format+" is not JPEG")
+		}
+		if min(cfg.Width, cfg.Height) < minSide {
+			res.Problems = append(res.Problems, fmt.Sprintf("shortest side %d px < %d px", min(cfg.Width, cfg.Height), minSide))
+		}
+	}
+	if len(raw) < minKB*1024 || len(raw) > maxKB*1024 {
+		res.Problems = append(res.Problems, fmt.Sprintf("size %d bytes outside %d–%d KB", len(raw), minKB, maxKB))
+	}
+	res.OK = len(res.Problems) == 0
+	return res
+}
+
+// checkEntries expands ZIPs and checks every image/PDF entry.
+func checkEntries(name string, raw []byte, rep *checkReport) {
+	ext := extLower(name)
+	if ext == ".zip" && ALLOW_ZIP {
+		pairs, err := extractZipToMemory(raw, rep.zipPassword)
+		if err != nil {
+			rep.add(checkResult{Name: name, SizeB: len(raw), Format: "zip", Problems: []string{"unzip error: " + err.Error()}})
+			return
+		}
+		for _, p := range pairs {
+			if systemFile(p.Rel) {
+				continue
+			}
+			if p.Skip != "" {
+				rep.add(checkResult{Name: name + "/" + p.Rel, Problems: []string{p.Skip}})
+				continue
+			}
+			checkEntries(name+"/"+p.Rel, p.Data, rep)
+		}
+		return
+	}
+	if ext = inputExt(name); IMG_EXT[ext] || PDF_EXT[ext] {
+		rep.add(checkOneFile(name, raw, rep.MinKB, rep.MaxKB, rep.MinSide))
+	}
+}
+
+func (rep *checkReport) add(res checkResult) {
+	if res.OK {
+		rep.Passed++
+	} else {
+		rep.Failed++
+	}
+	rep.Files = append(rep.Files, res)
+}
+
+// newCheckReport takes the size window and minimum side (or a preset) from
+// val, validated like the settings of a /process submission.
+func newCheckReport(val func(string) string) (*checkReport, error) {
+	opts, err := settingsFrom(func(k string) string {
+		switch k {
+		case "preset", "min_kb", "max_kb", "min_side":
+			return val(k)
+		}
+		return ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &checkReport{MinKB: opts.MinKB, MaxKB: opts.MaxKB, MinSide: opts.MinSide, Files: []checkResult{}}, nil
+}
+
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(200 << 20); err != nil {
+		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rep, err := newCheckReport(r.FormValue)
+	if err != nil {
+		var errs settingsErrors
+		errors.As(err, &errs)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "fields": errs.byField()})
+		return
+	}
+	rep.zipPassword = r.FormValue("zip_password")
+	for _, fh := range r.MultipartForm.File["files"] {
+		f, err := fh.Open()
+		if err != nil {
+			continue
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		checkEntries(fh.Filename, b, rep)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+var checkOpts struct {
+	sets        map[string]string // form settings given as flags
+	zipPassword string
+	json        bool
+}
+
+func checkFlags(fset *flag.FlagSet) {
+	sets := map[string]string{}
+	checkOpts.sets = sets
+	fset.Func("min-kb", "smallest allowed size in KB (default MIN_KB)", func(v string) error { sets["min_kb"] = v; return nil })
+	fset.Func("max-kb", "largest allowed size in KB (default TARGET_KB)", func(v string) error { sets["max_kb"] = v; return nil })
+	fset.Func("min-side", "shortest allowed side in px (default MIN_SIDE_PX)", func(v string) error { sets["min_side"] = v; return nil })
+	fset.Func("preset", "take the limits from a preset", func(v string) error { sets["preset"] = v; return nil })
+	fset.StringVar(&checkOpts.zipPassword, "zip-password", "", "password for encrypted ZIPs (ZipCrypto or AES)")
+	fset.BoolVar(&checkOpts.json, "json", false, "print the report as JSON")
+}
+
+// runCheckCLI implements `multicompressgo check [flags] [paths...]`; exits 1
+// when any file fails, 2 on bad flags.
+func runCheckCLI(args []string) {
+	setupProcessing()
+	rep, err := newCheckReport(func(k string) string { return checkOpts.sets[k] })
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid settings: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	rep.zipPassword = checkOpts.zipPassword
+	for _, root := range args {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				return nil
+			}
+			checkEntries(path, b, rep)
+			return nil
+		})
+	}
+	if checkOpts.json {
+		json.NewEncoder(os.Stdout).Encode(rep)
+	} else {
+		printCheckReport(rep)
+	}
+	if rep.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printCheckReport(rep *checkReport) {
+	for _, res := range rep.Files {
+		status := "OK  "
+		if !res.OK {
+			status = "FAIL"
+		}
+		if res.Format == "pdf" {
+			fmt.Printf("%s %s (%d bytes, pdf, %d pages)\n", status, res.Name, res.SizeB, res.Pages)
+		} else {
+			fmt.Printf("%s %s (%d bytes, %s %dx%d)\n", status, res.Name, res.SizeB, res.Format, res.Width, res.Height)
+		}
+		for _, p := range res.Problems {
+			fmt.Printf("     - %s\n", p)
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed (target %d–%d KB, min side %d px)\n", rep.Passed, rep.Failed, rep.MinKB, rep.MaxKB, rep.MinSide)
+}
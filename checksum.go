@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// ===== Upload checksums =====
+// Clients on flaky connections can send the SHA-256 of each upload so a
+// corrupted body is rejected before any processing. Hex digests go in
+// "files_sha256" / "folder_sha256" (same order as the files; empty = skip),
+// or for plain API calls in an "X-Files-SHA256: hex,hex" header.
+
+var errChecksum = errors.New("checksum mismatch")
+
+func verifyUploadChecksums(r *http.Request) error {
+	want := r.MultipartForm.Value["files_sha256"]
+	if len(want) == 0 && r.Header.Get("X-Files-SHA256") != "" {
+		want = strings.Split(r.Header.Get("X-Files-SHA256"), ",")
+	}
+	if err := verifyFileHeaders(r.MultipartForm.File["files"], want); err != nil {
+		return err
+	}
+	return verifyFileHeaders(r.MultipartForm.File["folder"], r.MultipartForm.Value["folder_sha256"])
+}
+
+func verifyFileHeaders(files []*multipart.FileHeader, want []string) error {
+	for i, fh := range files {
+		if i >= len(want) {
+			return nil
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return err
+		}
+		err = verifyDigest(fh.Filename, f, want[i])
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDigest checks the SHA-256 of one upload against a hex digest ("" = skip).
+func verifyDigest(name string, f io.Reader, want string) error {
+	exp := strings.ToLower(strings.TrimSpace(want))
+	if exp == "" {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != exp {
+		return fmt.Errorf("%w for %s: got %s, want %s", errChecksum, name, got, exp)
+	}
+	return nil
+}
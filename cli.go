@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== Subcommands =====
+// The subcommands live in one table, so `help`, the shell completions and the
+// man page are generated from the flags the commands really parse. A command's
+// flags function only defines its flags (bound to its options); runCommand
+// parses them and hands the remaining arguments to run, and the docs call the
+// flags function alone, so describing never runs a command.
+//
+//	multicompressgo completion bash > /etc/bash_completion.d/multicompressgo
+//	multicompressgo completion zsh > "${fpath[1]}/_multicompressgo"
+//	multicompressgo completion fish > ~/.config/fish/completions/multicompressgo.fish
+//	multicompressgo man > /usr/local/share/man/man1/multicompressgo.1
+
+const cliName = "multicompressgo"
+
+type cliCommand struct {
+	name    string
+	args    string // positional arguments, for usage lines
+	summary string
+	flags   func(fs *flag.FlagSet) // defines the flags; nil passes the arguments through unparsed
+	run     func(args []string)    // gets the arguments left after the flags
+	words   []string               // fixed first arguments (config export|import)
+	hidden  bool                   // internal workers
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{name: "compress", args: "[paths...]", summary: "compress local files (or a storage prefix) into a master ZIP", flags: compressFlags, run: runCompressCLI},
+		{name: "check", args: "[paths...]", summary: "check files against the size targets without changing them", flags: checkFlags, run: runCheckCLI},
+		{name: "diff", args: "a.zip b.zip", summary: "compare two result ZIPs", run: runDiffCLI},
+		{name: "rotate", args: "files...", summary: "rotate or mirror JPEGs losslessly", flags: rotateFlags, run: runRotateCLI},
+		{name: "selftest", summary: "exercise every configured backend and report timings", flags: selftestFlags, run: runSelftestCLI},
+		{name: "loadgen", summary: "send synthetic batches to a running server and report latency", flags: loadgenFlags, run: runLoadgenCLI},
+		{name: "config", args: "export [-secrets] | import bundle.json", summary: "export or import settings and presets", run: runConfigCLI, words: []string{"export", "import"}},
+		{name: "install-service", summary: "run the server at boot as a systemd unit or Windows service", flags: installServiceFlags, run: runInstallServiceCLI},
+		{name: "uninstall-service", summary: "stop and remove the installed service", flags: uninstallServiceFlags, run: runUninstallServiceCLI},
+		{name: "completion", args: "bash|zsh|fish", summary: "print a shell completion script", run: runCompletionCLI, words: []string{"bash", "zsh", "fish"}},
+		{name: "man", summary: "print the man page (roff)", run: runManCLI},
+		{name: "help", summary: "list the commands", run: func([]string) { printCLIHelp() }},
+		{name: "decode-worker", run: runDecodeWorker, hidden: true},
+		{name: "job-worker", run: runJobWorker, hidden: true},
+	}
+}
+
+// findCommand looks a subcommand up by name.
+func findCommand(name string) (cliCommand, bool) {
+	for _, c := range cliCommands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+// runCommand parses c's flags, if it has any, and runs it.
+func runCommand(c cliCommand, args []string) {
+	if c.flags != nil {
+		fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+		c.flags(fs)
+		fs.Parse(args)
+		args = fs.Args()
+	}
+	c.run(args)
+}
+
+// commandFlags returns c's flags in name order (none when it has no FlagSet).
+func commandFlags(c cliCommand) []*flag.Flag {
+	if c.flags == nil {
+		return nil
+	}
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.flags(fs)
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func visibleCommands() []cliCommand {
+	out := []cliCommand{}
+	for _, c := range cliCommands {
+		if !c.hidden {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func printCLIHelp() {
+	fmt.Printf("usage: %s [command] [flags]\n\nWithout a command the web server starts (see `%s man`).\n\nCommands:\n", cliName, cliName)
+	for _, c := range visibleCommands() {
+		fmt.Printf("  %-18s %s\n", c.name, c.summary)
+	}
+	fmt.Printf("\nRun `%s <command> -h` for the flags of a command.\n", cliName)
+}
+
+func runCompletionCLI(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s completion bash|zsh|fish\n", cliName)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown shell %q (bash, zsh or fish)\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func bashCompletion() string {
+	b := &strings.Builder{}
+	names := []string{}
+	for _, c := range visibleCommands() {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(b, "# bash completion for %s\n_%s() {\n", cliName, cliName)
+	b.WriteString("  local cur=${COMP_WORDS[COMP_CWORD]} flags=\"\" subs=\"\"\n")
+	fmt.Fprintf(b, "  if [ \"$COMP_CWORD\" -eq 1 ]; then\n    COMPREPLY=($(compgen -W %q -- \"$cur\"))\n    return\n  fi\n", strings.Join(names, " "))
+	b.WriteString("  case ${COMP_WORDS[1]} in\n")
+	for _, c := range visibleCommands() {
+		flags := []string{}
+		for _, f := range commandFlags(c) {
+			flags = append(flags, "-"+f.Name)
+		}
+		if len(flags) > 0 || len(c.words) > 0 {
+			fmt.Fprintf(b, "    %s) flags=%q subs=%q ;;\n", c.name, strings.Join(flags, " "), strings.Join(c.words, " "))
+		}
+	}
+	b.WriteString("  esac\n")
+	b.WriteString("  if [[ $cur == -* ]]; then\n    COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("  elif [ \"$COMP_CWORD\" -eq 2 ] && [ -n \"$subs\" ]; then\n    COMPREPLY=($(compgen -W \"$subs\" -- \"$cur\"))\n  fi\n}\n")
+	fmt.Fprintf(b, "complete -o default -F _%s %s\n", cliName, cliName)
+	return b.String()
+}
+
+// zshQuote escapes text for a single-quoted _arguments spec.
+func zshQuote(s string) string {
+	r := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+	return r.Replace(s)
+}
+
+func zshCompletion() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#compdef %s\n\n_%s() {\n  local -a cmds\n  cmds=(\n", cliName, cliName)
+	for _, c := range visibleCommands() {
+		fmt.Fprintf(b, "    '%s:%s'\n", c.name, zshQuote(c.summary))
+	}
+	b.WriteString("  )\n  if (( CURRENT == 2 )); then\n    _describe 'command' cmds\n    return\n  fi\n  case $words[2] in\n")
+	for _, c := range visibleCommands() {
+		specs := []string{}
+		for _, f := range commandFlags(c) {
+			spec := fmt.Sprintf("'-%s[%s]", f.Name, zshQuote(f.Usage))
+			if !isBoolFlag(f) {
+				spec += ":value:_files"
+			}
+			specs = append(specs, spec+"'")
+		}
+		if len(c.words) > 0 {
+			specs = append(specs, fmt.Sprintf("'1:%s:(%s)'", c.name, strings.Join(c.words, " ")))
+		}
+		specs = append(specs, "'*:file:_files'")
+		fmt.Fprintf(b, "    %s)\n      shift words; (( CURRENT-- ))\n      _arguments %s ;;\n", c.name, strings.Join(specs, " \\\n        "))
+	}
+	fmt.Fprintf(b, "  esac\n}\n\n_%s \"$@\"\n", cliName)
+	return b.String()
+}
+
+// fishQuote escapes text for a single-quoted fish string.
+func fishQuote(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(s)
+}
+
+func fishCompletion() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# fish completion for %s\ncomplete -c %s -f\n", cliName, cliName)
+	for _, c := range visibleCommands() {
+		fmt.Fprintf(b, "complete -c %s -n __fish_use_subcommand -a %s -d '%s'\n", cliName, c.name, fishQuote(c.summary))
+	}
+	for _, c := range visibleCommands() {
+		cond := "'__fish_seen_subcommand_from " + c.name + "'"
+		if len(c.words) > 0 {
+			fmt.Fprintf(b, "complete -c %s -n %s -a '%s'\n", cliName, cond, strings.Join(c.words, " "))
+		}
+		for _, f := range commandFlags(c) {
+			value := " -r -F"
+			if isBoolFlag(f) {
+				value = ""
+			}
+			fmt.Fprintf(b, "complete -c %s -n %s -o %s -d '%s'%s\n", cliName, cond, f.Name, fishQuote(f.Usage), value)
+		}
+		if c.args != "" && len(c.words) == 0 {
+			fmt.Fprintf(b, "complete -c %s -n %s -F\n", cliName, cond)
+		}
+	}
+	return b.String()
+}
+
+// roff escapes text for the man page.
+func roff(s string) string {
+	s = strings.NewReplacer("\\", "\\e", "-", "\\-").Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = "\\&" + s
+	}
+	return s
+}
+
+func runManCLI(args []string) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, ".TH %s 1 %q\n", strings.ToUpper(cliName), time.Now().Format("2006-01-02"))
+	fmt.Fprintf(b, ".SH NAME\n%s \\- compress photos and scanned PDFs into size\\-bounded JPEGs\n", cliName)
+	fmt.Fprintf(b, ".SH SYNOPSIS\n.B %s\n.br\n.B %s\n.I command\n[flags] [arguments]\n", cliName, cliName)
+	b.WriteString(".SH DESCRIPTION\nWithout a command the web server starts on :8080. It is configured with\nenvironment variables, which can also be kept in the config file\n(see ENVIRONMENT and FILES). The commands below run the same pipeline from\nthe shell or help operate a deployment.\n")
+	b.WriteString(".SH COMMANDS\n")
+	for _, c := range visibleCommands() {
+		fmt.Fprintf(b, ".SS %s %s\n%s.\n", roff(c.name), roff(c.args), roff(c.summary))
+		for _, f := range commandFlags(c) {
+			b.WriteString(".TP\n.B \\-" + roff(f.Name))
+			if !isBoolFlag(f) {
+				b.WriteString(" \\fIvalue\\fR")
+			}
+			b.WriteString("\n" + roff(f.Usage))
+			if f.DefValue != "" && !isBoolFlag(f) {
+				b.WriteString(" (default: " + roff(f.DefValue) + ")")
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString(".SH ENVIRONMENT\nSettings read by the server and the commands:\n.PP\n")
+	for _, k := range configKeys {
+		fmt.Fprintf(b, ".B %s\n.br\n", roff(k))
+	}
+	fmt.Fprintf(b, ".SH FILES\n.TP\n.I %s\nsettings and presets (CONFIG_FILE); written by the setup wizard and\n.BR \"%s config import\" .\n", roff(CONFIG_FILE), cliName)
+	b.WriteString(".SH EXIT STATUS\nThe compress command exits 0 when every file was compressed, 1 on fatal\nerrors or when nothing was compressed, 2 on usage errors and 3 when some\nfiles were skipped. The other commands exit non\\-zero on failure.\n")
+	fmt.Print(b.String())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/adityafaths/multicompressgo/compress"
+	"github.com/disintegration/imaging"
+)
+
+// ===== A/B encode comparison =====
+// POST /compare with one "file" and two parameter sets prefixed "a_" and "b_"
+// (same names as the main form). Each set is run through the normal pipeline.
+
+type compareOutput struct {
+	Name       string  `json:"name"`
+	Bytes      int     `json:"bytes"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	SSIM       float64 `json:"ssim"`
+	Detail     string  `json:"detail"`
+	JPEGBase64 string  `json:"jpeg_base64"`
+}
+
+type compareVariant struct {
+	Settings Options         `json:"settings"`
+	Outputs  []compareOutput `json:"outputs"`
+	Skipped  []string        `json:"skipped,omitempty"`
+}
+
+type compareResponse struct {
+	Name          string          `json:"name"`
+	OriginalBytes int             `json:"original_bytes"`
+	Width         int             `json:"width"`
+	Height        int             `json:"height"`
+	A             *compareVariant `json:"a"`
+	B             *compareVariant `json:"b"`
+}
+
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(200 << 20); err != nil {
+		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+	raw, _ := io.ReadAll(f)
+	f.Close()
+	if !IMG_EXT[inputExt(fh.Filename)] {
+		http.Error(w, "compare supports single images only", http.StatusBadRequest)
+		return
+	}
+	orig, err := decodeImageFromBytes(fh.Filename, raw)
+	if err != nil || orig == nil {
+		http.Error(w, "decode error", http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp := compareResponse{Name: fh.Filename, OriginalBytes: len(raw), Width: orig.Bounds().Dx(), Height: orig.Bounds().Dy()}
+	for _, prefix := range []string{"a_", "b_"} {
+		opts, err := readSettings(r, prefix)
+		if err != nil {
+			http.Error(w, prefix+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Thumbs, opts.ContactSheet = false, false
+		v := &compareVariant{Settings: opts, Outputs: []compareOutput{}}
+		_, processed, skipped, outs := processOneFileEntry(fh.Filename, raw, "compare", opts)
+		v.Skipped = skipMessages(skipped)
+		names := make([]string, 0, len(outs))
+		for name := range outs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			out := compareOutput{Name: name, Bytes: len(outs[name]), JPEGBase64: base64.StdEncoding.EncodeToString(outs[name])}
+			if enc, err := imaging.Decode(bytes.NewReader(outs[name])); err == nil {
+				out.Width, out.Height = enc.Bounds().Dx(), enc.Bounds().Dy()
+				out.SSIM = ssim(orig, enc)
+			}
+			for _, o := range processed {
+				if o.Name == name {
+					out.Detail = o.line()
+				}
+			}
+			v.Outputs = append(v.Outputs, out)
+		}
+		if prefix == "a_" {
+			resp.A = v
+		} else {
+			resp.B = v
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ssim computes the mean structural similarity of the luma channel over 8x8
+// blocks. The reference is resampled to the candidate's dimensions first.
+func ssim(ref, cand image.Image) float64 {
+	w, h := cand.Bounds().Dx(), cand.Bounds().Dy()
+	a := compress.ToGray(imaging.Resize(compress.FlattenWhite(ref), w, h, imaging.Lanczos))
+	b := compress.ToGray(compress.FlattenWhite(cand))
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+	const win = 8
+	total, n := 0.0, 0
+	for y := 0; y+win <= h; y += win {
+		for x := 0; x+win <= w; x += win {
+			var sa, sb, saa, sbb, sab float64
+			for j := 0; j < win; j++ {
+				for i := 0; i < win; i++ {
+					va := float64(a.GrayAt(x+i, y+j).Y)
+					vb := float64(b.GrayAt(x+i, y+j).Y)
+					sa, sb = sa+va, sb+vb
+					saa, sbb, sab = saa+va*va, sbb+vb*vb, sab+va*vb
+				}
+			}
+			const cnt = win * win
+			ma, mb := sa/cnt, sb/cnt
+			va, vb := saa/cnt-ma*ma, sbb/cnt-mb*mb
+			cov := sab/cnt - ma*mb
+			total += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float64(n)
+}
@@ -0,0 +1,137 @@
+package compress
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Archive assembles a ZIP in memory or in a file; Add and Dir are safe to call
+// from several goroutines.
+type Archive struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	file      *os.File
+	syncEvery int
+	added     int
+	zw        *zip.Writer
+	dirs      map[string]bool
+	err       error // first write error, reported by Bytes
+}
+
+func NewArchive() *Archive {
+	a := &Archive{dirs: map[string]bool{}}
+	a.zw = zip.NewWriter(&a.buf)
+	return a
+}
+
+// NewFileArchive writes the archive to f as entries are added and syncs it to
+// disk every syncEvery entries (0 = only at the end), so after a crash the
+// entries written so far can be recovered (e.g. with `zip -FF`). The caller
+// owns f and closes it after Bytes.
+func NewFileArchive(f *os.File, syncEvery int) *Archive {
+	a := &Archive{dirs: map[string]bool{}, file: f, syncEvery: syncEvery}
+	a.zw = zip.NewWriter(f)
+	return a
+}
+
+// Dir adds a folder entry (and those above it) once, however often it is
+// called. Add does this for the folders of every file, so Dir is only needed
+// for a folder that should appear even while empty.
+func (a *Archive) Dir(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dir(strings.TrimSuffix(name, "/") + "/")
+}
+
+// dir writes the folder entries of name's path that are still missing, up to
+// its last "/"; a.mu must be held.
+func (a *Archive) dir(name string) error {
+	for i, c := range name {
+		if c != '/' || i == 0 || a.dirs[name[:i]] {
+			continue
+		}
+		a.dirs[name[:i]] = true
+		if _, err := a.zw.Create(name[:i+1]); err != nil {
+			return a.fail(err)
+		}
+	}
+	return nil
+}
+
+// Add stores data under name, after the entries of the folders it sits in.
+func (a *Archive) Add(name string, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.dir(name); err != nil {
+		return err
+	}
+	w, err := a.zw.Create(name)
+	if err != nil {
+		return a.fail(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return a.fail(err)
+	}
+	a.added++
+	if a.file != nil && a.syncEvery > 0 && a.added%a.syncEvery == 0 {
+		if err := a.zw.Flush(); err != nil {
+			return a.fail(err)
+		}
+		return a.fail(a.file.Sync())
+	}
+	return nil
+}
+
+func (a *Archive) fail(err error) error {
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	return err
+}
+
+// Finish completes a file archive in place (flushed and synced) and returns
+// its size, without reading it back; nothing can be added afterwards.
+func (a *Archive) Finish() (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return 0, a.err
+	}
+	if err := a.zw.Close(); err != nil {
+		return 0, err
+	}
+	if a.file == nil {
+		return int64(a.buf.Len()), nil
+	}
+	if err := a.file.Sync(); err != nil {
+		return 0, err
+	}
+	return a.file.Seek(0, io.SeekEnd)
+}
+
+// Bytes finishes the archive and returns it (read back from the file for a
+// file archive); nothing can be added afterwards.
+func (a *Archive) Bytes() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err := a.zw.Close(); err != nil {
+		return nil, err
+	}
+	if a.file == nil {
+		return a.buf.Bytes(), nil
+	}
+	if err := a.file.Sync(); err != nil {
+		return nil, err
+	}
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(a.file)
+}
@@ -0,0 +1,230 @@
+// Package compress squeezes images into a JPEG size window. It searches the
+// JPEG quality first, then the scale, upscales outputs that land under the
+// window and escalates (grayscale, shrinking below ScaleMin) when nothing else
+// fits. It is the core of the multicompressgo server and works on its own:
+//
+//	c := compress.New(compress.DefaultOptions())
+//	res, err := c.CompressBytes(data)
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// Quality bounds of every search.
+const (
+	MinQuality = 15
+	MaxQuality = 95
+)
+
+// ErrTargetUnreachable marks images that could not be brought under MaxKB.
+var ErrTargetUnreachable = errors.New("target unreachable")
+
+// Options describe one size window and how far the image may be changed to hit it.
+type Options struct {
+	MinKB, MaxKB  int     // output size window
+	MinSide       int     // shortest side kept while downscaling (px)
+	ScaleMin      float64 // smallest scale tried before escalating
+	UpscaleMax    float64 // largest scale tried to grow outputs under MinKB
+	Sharpen       bool    // sharpen after resizing
+	SharpenAmount float64
+	Fast          bool // fewer search steps
+	MinQuality    int  // quality floor of the normal search; 0 means MinQuality
+}
+
+// DefaultOptions are the server's defaults: 168–174 KB, fast.
+func DefaultOptions() Options {
+	return Options{MinKB: 168, MaxKB: 174, MinSide: 256, ScaleMin: 0.35, UpscaleMax: 2.0,
+		Sharpen: true, SharpenAmount: 1.0, Fast: true, MinQuality: MinQuality}
+}
+
+// Result is one compressed image. On ErrTargetUnreachable, Data is nil and
+// Size/Scale/Quality describe the closest attempt.
+type Result struct {
+	Data    []byte
+	Size    int
+	Scale   float64
+	Quality int
+	Warning string // set when escalation had to degrade the image
+}
+
+// Compressor runs the search for one set of Options. Model remembers the
+// qualities found so later searches start close; nil disables that. Encoder
+// writes the JPEGs; nil means StdEncoder.
+type Compressor struct {
+	Options
+	Model   *QualityModel
+	Encoder Encoder
+}
+
+// New returns a Compressor sharing the package-wide DefaultModel.
+func New(opts Options) *Compressor {
+	return &Compressor{Options: opts, Model: DefaultModel}
+}
+
+// CompressBytes decodes data (see Decode) and compresses it.
+func (c *Compressor) CompressBytes(data []byte) (Result, error) {
+	img, err := Decode(data)
+	if err != nil {
+		return Result{}, err
+	}
+	return c.Compress(img)
+}
+
+// Compress produces a JPEG in [MinKB, MaxKB]. The output is guaranteed to be at
+// most MaxKB; otherwise the error wraps ErrTargetUnreachable.
+func (c *Compressor) Compress(img image.Image) (Result, error) {
+	res, err := c.search(img)
+	if err != nil {
+		return Result{}, err
+	}
+	if res.Data == nil || len(res.Data) > c.MaxKB*1024 {
+		res.Data = nil
+		return res, fmt.Errorf("%w: %d bytes > %d KB", ErrTargetUnreachable, res.Size, c.MaxKB)
+	}
+	return res, nil
+}
+
+func (c *Compressor) minQuality() int {
+	if c.MinQuality <= 0 {
+		return MinQuality
+	}
+	return c.MinQuality
+}
+
+func (c *Compressor) encoder() Encoder {
+	if c.Encoder == nil {
+		return StdEncoder{}
+	}
+	return c.Encoder
+}
+
+func (c *Compressor) quality(img image.Image, qmin int) ([]byte, int, error) {
+	return SearchQualityWith(c.encoder(), img, c.MaxKB, qmin, MaxQuality, c.Model)
+}
+
+func (c *Compressor) resize(img image.Image, scale float64) image.Image {
+	return EnsureMinSide(Resize(img, scale, c.Sharpen, c.SharpenAmount), c.MinSide, c.Sharpen, c.SharpenAmount)
+}
+
+func (c *Compressor) search(baseImg image.Image) (Result, error) {
+	rgb := FlattenWhite(baseImg)
+	minQ := c.minQuality()
+
+	// try quality on original size first
+	data, q, err := c.quality(rgb, minQ)
+	if err != nil {
+		return Result{}, err
+	}
+	if data != nil {
+		return Result{Data: data, Size: len(data), Scale: 1.0, Quality: q}, nil
+	}
+
+	// binary search over scale between ScaleMin..1.0
+	lo, hi := c.ScaleMin, 1.0
+	var bestData []byte
+	var bestScale float64
+	var bestQ int
+	maxSteps := 8
+	if !c.Fast {
+		maxSteps = 12
+	}
+	for i := 0; i < maxSteps; i++ {
+		mid := (lo + hi) / 2
+		d, q2, err := c.quality(c.resize(rgb, mid), minQ)
+		if err != nil {
+			return Result{}, err
+		}
+		if d != nil {
+			bestData, bestScale, bestQ = d, mid, q2
+			lo = mid + (hi-mid)*0.35
+		} else {
+			hi = mid - (mid-lo)*0.35
+		}
+		if hi-lo < 1e-3 {
+			break
+		}
+	}
+
+	if bestData == nil {
+		// nothing fits even at ScaleMin: escalate instead of emitting an over-target file
+		return c.escalate(rgb)
+	}
+
+	// if size < MinKB, try upscales
+	sizeB := len(bestData)
+	curScale := bestScale
+	if sizeB < c.MinKB*1024 {
+		d, q2, err := c.quality(c.resize(rgb, curScale), maxInt(bestQ, minQ))
+		if err == nil && d != nil && len(d) > sizeB {
+			bestData, bestQ, sizeB = d, q2, len(d)
+		}
+
+		iters := 0
+		maxIters := 6
+		if !c.Fast {
+			maxIters = 12
+		}
+		for sizeB < c.MinKB*1024 && curScale < c.UpscaleMax && iters < maxIters {
+			curScale = curScale * 1.2
+			if curScale > c.UpscaleMax {
+				curScale = c.UpscaleMax
+			}
+			d, q3, err := c.quality(c.resize(rgb, curScale), minQ)
+			if err != nil {
+				iters++
+				continue
+			}
+			if d == nil {
+				curScale *= 0.95
+				iters++
+				continue
+			}
+			if len(d) > sizeB {
+				bestData, bestQ, sizeB, bestScale = d, q3, len(d), curScale
+			}
+			iters++
+		}
+	}
+	return Result{Data: bestData, Size: len(bestData), Scale: bestScale, Quality: bestQ}, nil
+}
+
+// escalate is used when MinQuality at ScaleMin still exceeds MaxKB (typical
+// for huge text scans): first retry in grayscale, then keep shrinking below
+// ScaleMin, ignoring MinSide, until the file fits.
+func (c *Compressor) escalate(rgb image.Image) (Result, error) {
+	d, q, err := c.quality(ToGray(c.resize(rgb, c.ScaleMin)), MinQuality)
+	if err != nil {
+		return Result{}, err
+	}
+	if d != nil {
+		return Result{Data: d, Size: len(d), Scale: c.ScaleMin, Quality: q, Warning: "target unreachable in color, converted to grayscale"}, nil
+	}
+
+	gray := ToGray(rgb)
+	scale := c.ScaleMin
+	var last []byte
+	for scale > 0.02 {
+		scale *= 0.8
+		candidate := ToGray(Resize(gray, scale, c.Sharpen, c.SharpenAmount))
+		d, q, err := c.quality(candidate, MinQuality)
+		if err != nil {
+			return Result{}, err
+		}
+		if d != nil {
+			return Result{Data: d, Size: len(d), Scale: scale, Quality: q,
+				Warning: fmt.Sprintf("target unreachable, grayscale and downscaled below scale_min to %.3f", scale)}, nil
+		}
+		last, _ = c.encoder().Encode(candidate, MinQuality)
+	}
+	return Result{}, fmt.Errorf("%w: still %d bytes at scale %.3f", ErrTargetUnreachable, len(last), scale)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
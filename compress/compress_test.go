@@ -0,0 +1,55 @@
+package compress
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// noisyImage is a gradient with noise, so the JPEG size follows the quality.
+func noisyImage(w, h int) image.Image {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := uint8(rng.Intn(64))
+			img.Set(x, y, color.RGBA{uint8(x*255/w) ^ n, uint8(y*255/h) ^ n, n * 4, 255})
+		}
+	}
+	return img
+}
+
+// bloatEncoder writes JPEGs too big for any window.
+type bloatEncoder struct{}
+
+func (bloatEncoder) Encode(img image.Image, quality int) ([]byte, error) {
+	return make([]byte, 4<<20), nil
+}
+
+func TestCompressMeetsTarget(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MinKB, opts.MaxKB = 40, 60
+	c := &Compressor{Options: opts}
+	res, err := c.Compress(noisyImage(800, 600))
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if len(res.Data) == 0 || len(res.Data) > opts.MaxKB*1024 {
+		t.Errorf("got %d bytes, want 1..%d", len(res.Data), opts.MaxKB*1024)
+	}
+}
+
+func TestCompressTargetUnreachable(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MinKB, opts.MaxKB = 10, 20
+	c := &Compressor{Options: opts, Encoder: bloatEncoder{}}
+	res, err := c.Compress(noisyImage(200, 150))
+	if !errors.Is(err, ErrTargetUnreachable) {
+		t.Fatalf("got error %v, want ErrTargetUnreachable", err)
+	}
+	if res.Data != nil {
+		t.Errorf("got %d bytes of data with the error", len(res.Data))
+	}
+}
@@ -0,0 +1,84 @@
+package compress
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // imaging has no WebP decoder of its own
+)
+
+// Decode reads JPEG, PNG, GIF (first frame), BMP, TIFF or WebP data. JPEGs
+// are turned upright according to their EXIF Orientation.
+func Decode(data []byte) (image.Image, error) {
+	return imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+}
+
+// Orient applies an EXIF Orientation value (1–8) to img, for formats whose
+// tag Decode does not read itself.
+func Orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// Resize scales img by scale (Lanczos), optionally sharpening the result.
+func Resize(img image.Image, scale float64, sharpen bool, amount float64) image.Image {
+	w := int(float64(img.Bounds().Dx()) * scale)
+	h := int(float64(img.Bounds().Dy()) * scale)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	out := imaging.Resize(img, w, h, imaging.Lanczos)
+	if sharpen && amount > 0 {
+		out = imaging.Sharpen(out, amount)
+	}
+	return out
+}
+
+// EnsureMinSide upscales img so its shorter side is at least minSide.
+func EnsureMinSide(img image.Image, minSide int, sharpen bool, amount float64) image.Image {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	if w >= minSide && h >= minSide {
+		return img
+	}
+	scale := float64(minSide) / float64(minInt(w, h))
+	if scale < 1.0 {
+		scale = 1.0
+	}
+	return Resize(img, scale, sharpen, amount)
+}
+
+// FlattenWhite converts to an opaque image on a white background.
+func FlattenWhite(img image.Image) *image.NRGBA {
+	rgb := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+	draw.Draw(rgb, rgb.Bounds(), img, img.Bounds().Min, draw.Over)
+	return rgb
+}
+
+// ToGray drops chroma so the JPEG is encoded with a single component.
+func ToGray(img image.Image) *image.Gray {
+	g := image.NewGray(img.Bounds())
+	draw.Draw(g, g.Bounds(), img, img.Bounds().Min, draw.Src)
+	return g
+}
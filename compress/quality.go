@@ -0,0 +1,247 @@
+package compress
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// EncodeJPEG encodes img at the given quality.
+func EncodeJPEG(img image.Image, quality int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder writes img as a JPEG at a quality of 1..100. Encoders other than
+// the standard library's may offer progressive scans or 4:4:4 chroma.
+type Encoder interface {
+	Encode(img image.Image, quality int) ([]byte, error)
+}
+
+// StdEncoder is image/jpeg: baseline, 4:2:0 chroma subsampling.
+type StdEncoder struct{}
+
+func (StdEncoder) Encode(img image.Image, quality int) ([]byte, error) {
+	return EncodeJPEG(img, quality)
+}
+
+// SearchQuality finds the highest quality in qmin..qmax whose JPEG is at most
+// maxKB, returning nil data when even qmin is too big. With a model, the
+// search gallops out from the predicted quality instead of starting in the
+// middle.
+func SearchQuality(img image.Image, maxKB, qmin, qmax int, model *QualityModel) ([]byte, int, error) {
+	return SearchQualityWith(StdEncoder{}, img, maxKB, qmin, qmax, model)
+}
+
+// SearchQualityWith is SearchQuality with the JPEGs written by enc.
+func SearchQualityWith(enc Encoder, img image.Image, maxKB, qmin, qmax int, model *QualityModel) ([]byte, int, error) {
+	lo, hi := qmin, qmax
+	var best []byte
+	var bestQ int
+	encodes := 0
+	fits := func(q int) (bool, error) {
+		encodes++
+		b, err := enc.Encode(img, q)
+		if err != nil {
+			return false, err
+		}
+		if len(b) <= maxKB*1024 {
+			best, bestQ = b, q
+			return true, nil
+		}
+		return false, nil
+	}
+
+	var key qualityKey
+	pred, seeded := 0, false
+	if model != nil {
+		key = qualityKeyFor(img, maxKB)
+		pred, seeded = model.predict(key)
+		seeded = seeded && pred >= lo && pred <= hi
+	}
+	if seeded {
+		ok, err := fits(pred)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			lo = pred + 1
+		} else {
+			hi = pred - 1
+		}
+		// double the step away from pred until the answer is bracketed
+		for step := 1; lo <= hi; step *= 2 {
+			q := maxInt(pred-step, lo)
+			if ok {
+				q = minInt(pred+step, hi)
+			}
+			good, err := fits(q)
+			if err != nil {
+				return nil, 0, err
+			}
+			if good {
+				lo = q + 1
+			} else {
+				hi = q - 1
+			}
+			if good != ok {
+				break
+			}
+		}
+	}
+
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	if model != nil {
+		model.learn(key, pred, seeded, bestQ, encodes)
+	}
+	if best == nil {
+		return nil, 0, nil
+	}
+	return best, bestQ, nil
+}
+
+// ===== Quality prediction =====
+// The quality chosen for an image mostly depends on the bit budget per pixel
+// and on how much detail it has. A QualityModel remembers answers per (budget,
+// detail) bucket, and SearchQuality starts at the remembered quality: a good
+// guess settles in about two encodes instead of ~7.
+
+type qualityKey struct {
+	budget int // half-octave bucket of target bits per pixel
+	detail int // half-octave bucket of mean gradient on a small preview
+}
+
+// QualityStats count how well the predictions worked.
+type QualityStats struct {
+	Searches int // all quality searches
+	Seeded   int // searches that started from a prediction
+	Hits     int // seeded searches whose answer was within ±1 of the prediction
+	Encodes  int // JPEG encodes spent by seeded searches
+	Plain    int // JPEG encodes spent by unseeded searches
+}
+
+// HitRate is the percentage of seeded searches the prediction got right.
+func (q QualityStats) HitRate() float64 {
+	if q.Seeded == 0 {
+		return 0
+	}
+	return 100 * float64(q.Hits) / float64(q.Seeded)
+}
+
+// AvgSeeded is the mean number of encodes of a seeded search.
+func (q QualityStats) AvgSeeded() float64 {
+	if q.Seeded == 0 {
+		return 0
+	}
+	return float64(q.Encodes) / float64(q.Seeded)
+}
+
+// AvgPlain is the mean number of encodes of an unseeded search.
+func (q QualityStats) AvgPlain() float64 {
+	if q.Searches == q.Seeded {
+		return 0
+	}
+	return float64(q.Plain) / float64(q.Searches-q.Seeded)
+}
+
+const qualityAlpha = 0.3
+
+// QualityModel is safe for concurrent use.
+type QualityModel struct {
+	mu    sync.Mutex
+	q     map[qualityKey]float64
+	stats QualityStats
+}
+
+func NewQualityModel() *QualityModel {
+	return &QualityModel{q: map[qualityKey]float64{}}
+}
+
+// DefaultModel lives for the whole process and is shared by New.
+var DefaultModel = NewQualityModel()
+
+func qualityKeyFor(img image.Image, targetKB int) qualityKey {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	bpp := float64(targetKB*1024*8) / float64(maxInt(w*h, 1))
+	preview := imaging.Grayscale(imaging.Resize(img, 128, 0, imaging.Box))
+	pw, ph := preview.Bounds().Dx(), preview.Bounds().Dy()
+	sum, n := 0.0, 0
+	for y := 0; y < ph-1; y++ {
+		for x := 0; x < pw-1; x++ {
+			c := preview.Pix[y*preview.Stride+x*4]
+			right := preview.Pix[y*preview.Stride+(x+1)*4]
+			down := preview.Pix[(y+1)*preview.Stride+x*4]
+			sum += math.Abs(float64(c)-float64(right)) + math.Abs(float64(c)-float64(down))
+			n++
+		}
+	}
+	detail := sum / float64(maxInt(n, 1))
+	return qualityKey{
+		budget: int(math.Round(2 * math.Log2(bpp))),
+		detail: int(math.Round(2 * math.Log2(1+detail))),
+	}
+}
+
+func (m *QualityModel) predict(k qualityKey) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.q[k]
+	return int(math.Round(q)), ok
+}
+
+// learn folds a finished search into the model and the hit-rate counters.
+func (m *QualityModel) learn(k qualityKey, pred int, seeded bool, answer, encodes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := &m.stats
+	st.Searches++
+	if seeded {
+		st.Seeded++
+		st.Encodes += encodes
+		if answer > 0 && answer-pred <= 1 && pred-answer <= 1 {
+			st.Hits++
+		}
+	} else {
+		st.Plain += encodes
+	}
+	if answer == 0 {
+		return
+	}
+	if old, ok := m.q[k]; ok {
+		m.q[k] = (1-qualityAlpha)*old + qualityAlpha*float64(answer)
+	} else {
+		m.q[k] = float64(answer)
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (m *QualityModel) Stats() QualityStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ===== Config bundle (JSON) =====
+// Settings (the env vars below) and destination presets can be kept in
+// CONFIG_FILE and moved between instances as one JSON bundle. Real env vars
+// still win over the file. Secrets are left out of exports unless asked for,
+// and REPLICA_ID never leaves the instance. Program paths (CJPEG, PDFTOPPM,
+// ...) are only taken from the CLI import, never from a POST.
+//
+//	multicompressgo config export [-secrets] > office.json
+//	multicompressgo config import office.json      (or POST it to /admin/config)
+//	CONFIG_FILE=/etc/multicompress.json
+
+var CONFIG_FILE = "multicompress.json"
+
+type configBundle struct {
+	Version  int                          `json:"version"`
+	Settings map[string]string            `json:"settings,omitempty"`
+	Presets  map[string]map[string]string `json:"presets,omitempty"`
+}
+
+var configKeys = []string{
+	"ACCESS_LOG", "ADMIN_PASSWORD", "ADMIN_USER", "ALLOWED_EXT", "AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_CONTAINER",
+	"AZURE_STORAGE_KEY", "BASE_PATH", "CJPEG", "CJXL", "CONFIG_WATCH", "CORS_HEADERS", "CORS_METHODS", "CORS_ORIGINS", "DECODE_HARDEN", "DECODE_MEM_MB", "DECODE_SANDBOX",
+	"DECODE_TIMEOUT", "DEDUP_OUTPUTS", "DENIED_EXT", "DJXL", "DOC_TYPES", "EVENT_LOG", "EVENT_WEBHOOK_EVENTS", "EVENT_WEBHOOK_URL", "EXTENSION_TOKENS", "EXTERNAL_DECODER", "EXTERNAL_DECODER_EXT", "EXT_ALIASES",
+	"GCS_BUCKET", "GIF_MAX_FRAMES", "HEIF_DEC", "HISTORY_DB",
+	"IMAP_ADDR", "IMAP_MAILBOX", "IMAP_PASSWORD", "IMAP_USER",
+	"JOB_CGROUP_ROOT", "JOB_CPU", "JOB_ISOLATION", "JOB_MEM_MB", "JPEGTRAN", "JPEG_ENCODER", "MAIL_FROM", "MAIL_MAX_ATTACH_MB", "MAIL_POLL", "MAX_ACTIVE_JOBS", "MAX_ENTRY_MB", "MAX_HEAP_MB", "MAX_PIXELS", "MAX_STORAGE_BYTES", "MAX_ZIP_DEPTH", "MAX_ZIP_FILES", "MAX_ZIP_TOTAL_MB", "MEM_HARD_LIMIT_MB", "MEM_SOFT_LIMIT_MB",
+	"OIDC_ADMIN_GROUPS", "OIDC_CLIENT_ID", "OIDC_CLIENT_SECRET", "OIDC_GROUPS_CLAIM", "OIDC_ISSUER", "OIDC_REDIRECT_URL",
+	"OIDC_SESSION_TTL", "OIDC_USER_GROUPS", "OPTIONAL_EXT", "PDFIUM_TEST", "PDFTOPPM", "PDF_DPI_MAX", "PDF_DPI_MIN", "PDF_LONG_SIDE_PX", "PDF_THREADS",
+	"PDF_RENDERER", "PHOTO_MIN_QUALITY", "PUBLIC_BASE_URL", "REDIS_URL",
+	"REPLICAS", "REPLICA_ID", "RESULT_MIN_AGE", "RESULT_SWEEP_EVERY", "RESULT_TTL", "S3_BUCKET", "S3_ENDPOINT", "S3_PATH_STYLE", "S3_REGION", "SESSION_RECENT",
+	"SESSION_SECRET", "SHARE_MAX_TTL", "SHARE_TTL", "SLACK_WEBHOOK_URL", "SMTP_ADDR", "SMTP_PASSWORD", "SMTP_USER",
+	"SPEED_PRESET", "STORAGE_BACKEND", "STORAGE_LOCAL_DIR", "TELEGRAM_BOT_TOKEN", "TELEGRAM_CHAT_ID", "TEXT_PAGE_CHARS",
+	"TEXT_SCALE_MIN", "THREADS", "TLS_CERT", "TLS_KEY", "TRUSTED_PROXIES", "ZIP_SPOOL_DIR", "ZIP_STRICT", "ZIP_SYNC_EVERY",
+}
+
+var secretKeys = map[string]bool{
+	"ADMIN_PASSWORD": true, "AZURE_STORAGE_KEY": true, "IMAP_PASSWORD": true, "SMTP_PASSWORD": true,
+	"SESSION_SECRET": true, "REDIS_URL": true, "OIDC_CLIENT_SECRET": true, "SLACK_WEBHOOK_URL": true, "TELEGRAM_BOT_TOKEN": true, "EVENT_WEBHOOK_URL": true,
+	"EXTENSION_TOKENS": true,
+}
+
+// execKeys name programs the server runs. Importing them over HTTP would turn
+// an admin session into command execution, so only `config import` sets them.
+var execKeys = map[string]bool{
+	"CJPEG": true, "CJXL": true, "DJXL": true, "EXTERNAL_DECODER": true, "HEIF_DEC": true, "JPEGTRAN": true,
+	"PDFIUM_TEST": true, "PDFTOPPM": true,
+}
+
+func knownConfigKey(k string) bool {
+	for _, c := range configKeys {
+		if c == k {
+			return true
+		}
+	}
+	return false
+}
+
+func readConfigFile(path string) (configBundle, error) {
+	b := configBundle{Version: 1}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// loadConfigFile runs first in main: file settings become env defaults so every
+// setupX() picks them up, and file presets join the built-in ones.
+func loadConfigFile() error {
+	if v := os.Getenv("CONFIG_FILE"); v != "" {
+		CONFIG_FILE = v
+	}
+	b, err := readConfigFile(CONFIG_FILE)
+	if err != nil {
+		return err
+	}
+	applyConfigBundle(b)
+	return nil
+}
+
+// fileEnv holds the env vars set from CONFIG_FILE, which a reload may change
+// or drop; the others came from the real environment and win.
+var fileEnv = map[string]string{}
+
+// applyConfigBundle makes b's settings the env defaults and live().PRESETS the
+// built-in presets plus b's. It returns the settings whose value changed.
+func applyConfigBundle(b configBundle) []string {
+	changed := []string{}
+	for k, v := range fileEnv {
+		if _, kept := b.Settings[k]; !kept && os.Getenv(k) == v {
+			os.Unsetenv(k)
+			delete(fileEnv, k)
+			changed = append(changed, k)
+		}
+	}
+	for k, v := range b.Settings {
+		cur, set := os.LookupEnv(k)
+		if prev, ok := fileEnv[k]; !knownConfigKey(k) || set && (!ok || prev != cur) {
+			continue
+		}
+		if !set || cur != v {
+			os.Setenv(k, v)
+			changed = append(changed, k)
+		}
+		fileEnv[k] = v
+	}
+	sort.Strings(changed)
+
+	presets := map[string]map[string]string{}
+	for name, p := range builtinPresets {
+		presets[name] = p
+	}
+	for name, p := range b.Presets {
+		presets[name] = p
+	}
+	updateLive(func(c *liveConfig) error {
+		c.PRESETS = presets
+		return nil
+	})
+	return changed
+}
+
+func exportConfig(secrets bool) configBundle {
+	b := configBundle{Version: 1, Settings: map[string]string{}, Presets: map[string]map[string]string{}}
+	for _, k := range configKeys {
+		if v := os.Getenv(k); v != "" && k != "REPLICA_ID" && (secrets || !secretKeys[k]) {
+			b.Settings[k] = v
+		}
+	}
+	for name, p := range live().PRESETS {
+		b.Presets[name] = p
+	}
+	return b
+}
+
+func validateConfig(b configBundle) error {
+	if b.Version != 1 {
+		return fmt.Errorf("unsupported config version %d", b.Version)
+	}
+	for k := range b.Settings {
+		if !knownConfigKey(k) {
+			return fmt.Errorf("unknown setting %s", k)
+		}
+		if k == "REPLICA_ID" {
+			return fmt.Errorf("REPLICA_ID is per instance and can't be imported")
+		}
+		if _, ok := pdfRenderers[strings.ToLower(b.Settings[k])]; k == "PDF_RENDERER" && !ok {
+			return fmt.Errorf("unknown PDF_RENDERER %q", b.Settings[k])
+		}
+	}
+	for name, p := range b.Presets {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("bad preset name %q", name)
+		}
+		if _, err := settingsFrom(func(k string) string { return p[k] }); err != nil {
+			return fmt.Errorf("preset %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// importConfig merges b into CONFIG_FILE. Presets apply at once; the server
+// takes the settings it can change live on its next reload (see reloadConfig).
+func importConfig(b configBundle) error {
+	if err := validateConfig(b); err != nil {
+		return err
+	}
+	cur, err := readConfigFile(CONFIG_FILE)
+	if err != nil {
+		return err
+	}
+	if cur.Settings == nil {
+		cur.Settings = map[string]string{}
+	}
+	if cur.Presets == nil {
+		cur.Presets = map[string]map[string]string{}
+	}
+	for k, v := range b.Settings {
+		cur.Settings[k] = v
+	}
+	for name, p := range b.Presets {
+		cur.Presets[name] = p
+	}
+	data, _ := json.MarshalIndent(cur, "", "  ")
+	tmp, err := os.CreateTemp(filepath.Dir(CONFIG_FILE), ".config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), CONFIG_FILE); err != nil {
+		return err
+	}
+	updateLive(func(c *liveConfig) error {
+		presets := map[string]map[string]string{}
+		for name, p := range c.PRESETS {
+			presets[name] = p
+		}
+		for name, p := range b.Presets {
+			presets[name] = p
+		}
+		c.PRESETS = presets
+		return nil
+	})
+	return nil
+}
+
+func presetNames() []string {
+	presets := live().PRESETS
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configHandler: GET exports the bundle (?secrets=1 includes secrets), POST
+// imports one from an application/json body or a multipart "bundle" file
+// field. Bundles setting execKeys are refused.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="multicompress-config.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(exportConfig(r.FormValue("secrets") == "1"))
+	case http.MethodPost:
+		var body io.Reader
+		switch ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct {
+		case "application/json":
+			body = r.Body
+		case "multipart/form-data":
+			f, _, err := r.FormFile("bundle")
+			if err != nil {
+				http.Error(w, "missing bundle file", http.StatusBadRequest)
+				return
+			}
+			defer f.Close()
+			body = f
+		default:
+			http.Error(w, "send application/json or a multipart bundle file", http.StatusUnsupportedMediaType)
+			return
+		}
+		var b configBundle
+		if err := json.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&b); err != nil {
+			http.Error(w, "bad bundle: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k := range b.Settings {
+			if execKeys[k] {
+				http.Error(w, k+" names a program; set it with `multicompressgo config import` on the server", http.StatusForbidden)
+				return
+			}
+		}
+		if err := importConfig(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin: %s imported %d settings, %d presets", clientIP(r), len(b.Settings), len(b.Presets))
+		_, restart, err := reloadConfig()
+		if err != nil {
+			http.Error(w, "imported, but the reload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"settings": len(b.Settings), "presets": len(b.Presets), "restart_needed": len(restart) > 0, "restart_keys": restart})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runConfigCLI: `config export [-secrets]` or `config import bundle.json`.
+func runConfigCLI(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: multicompressgo config export [-secrets] | import <bundle.json>")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("config export", flag.ExitOnError)
+		secrets := fs.Bool("secrets", false, "include passwords and tokens")
+		fs.Parse(args[1:])
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(exportConfig(*secrets))
+	case "import":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: multicompressgo config import <bundle.json>")
+			os.Exit(2)
+		}
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		var b configBundle
+		if err := json.Unmarshal(data, &b); err != nil {
+			log.Fatalf("%s: %v", args[1], err)
+		}
+		if err := importConfig(b); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("imported %d settings and %d presets into %s\n", len(b.Settings), len(b.Presets), CONFIG_FILE)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+		os.Exit(2)
+	}
+}
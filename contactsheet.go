@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/adityafaths/multicompressgo/compress"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// ===== Contact sheet =====
+// A grid of thumbnails with names and output sizes for reviewing a whole batch:
+// one tile per decoded image, PDF page and kept GIF frame, whatever the output
+// format, and for strip mode the untouched JPEG.
+
+var (
+	SHEET_COLS = 6
+	SHEET_ROWS = 8
+)
+
+type sheetEntry struct {
+	Name  string
+	SizeB int
+	Thumb []byte
+}
+
+// buildContactSheets renders entries into one or more JPEG pages of SHEET_COLS x SHEET_ROWS cells.
+func buildContactSheets(entries []sheetEntry) ([][]byte, error) {
+	const pad, textH = 10, 30
+	cellW, cellH := THUMB_SIDE_PX+2*pad, THUMB_SIDE_PX+textH+2*pad
+	perPage := SHEET_COLS * SHEET_ROWS
+	pages := [][]byte{}
+	for start := 0; start < len(entries); start += perPage {
+		chunk := entries[start:min(start+perPage, len(entries))]
+		rows := (len(chunk) + SHEET_COLS - 1) / SHEET_COLS
+		sheet := imaging.New(SHEET_COLS*cellW, rows*cellH, color.White)
+		for i, e := range chunk {
+			x0, y0 := (i%SHEET_COLS)*cellW, (i/SHEET_COLS)*cellH
+			if thumb, err := imaging.Decode(bytes.NewReader(e.Thumb)); err == nil {
+				// center the thumbnail inside its cell
+				off := image.Pt(x0+pad+(THUMB_SIDE_PX-thumb.Bounds().Dx())/2, y0+pad+(THUMB_SIDE_PX-thumb.Bounds().Dy())/2)
+				draw.Draw(sheet, thumb.Bounds().Add(off), thumb, thumb.Bounds().Min, draw.Src)
+			}
+			drawLabel(sheet, x0+pad, y0+pad+THUMB_SIDE_PX+13, fitLabel(e.Name, THUMB_SIDE_PX))
+			drawLabel(sheet, x0+pad, y0+pad+THUMB_SIDE_PX+26, fmt.Sprintf("%.1f KB", float64(e.SizeB)/1024))
+		}
+		data, err := compress.EncodeJPEG(sheet, THUMB_QUALITY)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, data)
+	}
+	return pages, nil
+}
+
+func drawLabel(dst draw.Image, x, y int, text string) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(color.Black),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+// fitLabel keeps the tail of long paths, which is usually the distinguishing part.
+func fitLabel(s string, widthPx int) string {
+	maxChars := widthPx / 7
+	r := []rune(s)
+	if len(r) <= maxChars {
+		return s
+	}
+	return "..." + string(r[len(r)-maxChars+3:])
+}
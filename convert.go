@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"sort"
+	"strings"
+
+	"github.com/adityafaths/multicompressgo/compress"
+)
+
+// ===== Convert-only mode =====
+// mode=convert skips size targeting: every image / PDF page is re-encoded once
+// as convert_format (jpg|png, jxl when cjxl is installed), JPEG/JXL at
+// convert_quality. An optional convert_max_kb caps the size instead: the
+// quality is searched downwards from convert_quality until the file fits.
+// PDFs are only ever inputs: their pages come out as images, and no mode
+// writes a PDF, so there is nothing to linearize for fast web view.
+
+const CONVERT_QUALITY = 90
+
+var CONVERT_FORMATS = map[string]bool{"jpg": true, "png": true}
+
+// parseConvert fills the convert_* options of o from vals.
+func parseConvert(o *Options, vals map[string]string) error {
+	if o.ConvertFormat = vals["convert_format"]; o.ConvertFormat == "" {
+		o.ConvertFormat = "jpg"
+	}
+	if !CONVERT_FORMATS[o.ConvertFormat] {
+		formats := []string{}
+		for f := range CONVERT_FORMATS {
+			formats = append(formats, f)
+		}
+		sort.Strings(formats)
+		return fieldError{"convert_format", fmt.Errorf("unsupported convert_format %q (%s)", o.ConvertFormat, strings.Join(formats, ", "))}
+	}
+	var err error
+	if o.ConvertQuality, err = optInt(vals, "convert_quality", CONVERT_QUALITY, 1, 100); err != nil {
+		return err
+	}
+	if o.ConvertMaxKB, err = optInt(vals, "convert_max_kb", 0, 1, 1<<20); err != nil {
+		return err
+	}
+	if o.ConvertMaxKB > 0 && o.ConvertFormat == "png" {
+		return fieldError{"convert_max_kb", fmt.Errorf("convert_max_kb needs a lossy format (jpg or jxl)")}
+	}
+	return nil
+}
+
+// encodeConverted returns the encoded image and the quality used (0 for PNG).
+func encodeConverted(img image.Image, opts Options, speedFast bool) ([]byte, int, error) {
+	q, maxKB := opts.ConvertQuality, opts.ConvertMaxKB
+	switch opts.ConvertFormat {
+	case "png":
+		enc := png.Encoder{CompressionLevel: png.DefaultCompression}
+		if speedFast {
+			enc.CompressionLevel = png.BestSpeed
+		}
+		buf := &bytes.Buffer{}
+		err := enc.Encode(buf, img)
+		return buf.Bytes(), 0, err
+	case "jxl":
+		if maxKB > 0 {
+			return fitConverted(jxlQualityBS(img, maxKB, 1, q, speedFast))
+		}
+		enc, err := newJXLEncoder(img, speedFast)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer enc.close()
+		data, err := enc.encode(q)
+		return data, q, err
+	}
+	enc, model := jpegEncoderFor(opts)
+	if maxKB > 0 {
+		return fitConverted(compress.SearchQualityWith(enc, compress.FlattenWhite(img), maxKB, MIN_QUALITY, q, model))
+	}
+	data, err := enc.Encode(compress.FlattenWhite(img), q)
+	return data, q, err
+}
+
+// fitConverted turns a quality search that found nothing into an error.
+func fitConverted(data []byte, q int, err error) ([]byte, int, error) {
+	if err == nil && data == nil {
+		err = fmt.Errorf("%w at the lowest quality", compress.ErrTargetUnreachable)
+	}
+	return data, q, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ===== CORS =====
+// Lets frontends on other origins call the API (/process, /jobs/, /check, ...).
+// Off unless CORS_ORIGINS is set; "*" allows any origin (without credentials).
+// The extension API answers CORS itself (see extension.go).
+//
+//	CORS_ORIGINS=https://app.example.com,https://admin.example.com
+//	CORS_METHODS=GET,POST,OPTIONS CORS_HEADERS=Content-Type,Accept,X-Files-SHA256
+
+func setupCORS() { updateLive(corsSettings) }
+
+// corsSettings reads CORS_ORIGINS, CORS_METHODS and CORS_HEADERS into c.
+func corsSettings(c *liveConfig) error {
+	// a fresh map, so a reload never writes one that requests are reading
+	origins := map[string]bool{}
+	for _, o := range strings.Split(os.Getenv("CORS_ORIGINS"), ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins[o] = true
+		}
+	}
+	c.CORS_ORIGINS = origins
+	c.CORS_METHODS, c.CORS_HEADERS = liveDefaults.CORS_METHODS, liveDefaults.CORS_HEADERS
+	if v := os.Getenv("CORS_METHODS"); v != "" {
+		c.CORS_METHODS = v
+	}
+	if v := os.Getenv("CORS_HEADERS"); v != "" {
+		c.CORS_HEADERS = v
+	}
+	return nil
+}
+
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin, cfg := r.Header.Get("Origin"), live()
+		if origin == "" || len(cfg.CORS_ORIGINS) == 0 || strings.HasPrefix(r.URL.Path, extensionPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !cfg.CORS_ORIGINS["*"] && !cfg.CORS_ORIGINS[origin] {
+			next.ServeHTTP(w, r) // browser will block the response
+			return
+		}
+		if cfg.CORS_ORIGINS["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After, Content-Disposition, X-Original-Bytes")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", cfg.CORS_METHODS)
+			w.Header().Set("Access-Control-Allow-Headers", cfg.CORS_HEADERS)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
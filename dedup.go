@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ===== Content-addressed output storage =====
+// With DEDUP_OUTPUTS=1 (and a STORAGE_BACKEND) a result isn't stored as one ZIP:
+// every output file goes to cas/<sha256> once, and results/<token>.json lists
+// which blobs make up the archive. Resubmitted batches then cost only a manifest.
+// Reference counts are rebuilt from the manifests at startup, so only one
+// replica should write to a dedup store.
+
+var DEDUP_OUTPUTS = false
+
+const CAS_PREFIX = "cas/"
+
+type manifestEntry struct {
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"` // empty for directory entries
+}
+
+var casRefs = struct {
+	sync.Mutex
+	m map[string]int
+}{m: map[string]int{}}
+
+// casLocks serialize storing and deleting a blob per digest (striped by its
+// first byte): a manifest never lists a blob whose Put is still running or
+// failed, and a release can't delete a blob that is being stored again.
+var casLocks [256]sync.Mutex
+
+func casLock(hash string) *sync.Mutex {
+	b, _ := strconv.ParseUint(hash[:2], 16, 8)
+	return &casLocks[b]
+}
+
+func setupDedup() error {
+	DEDUP_OUTPUTS = os.Getenv("DEDUP_OUTPUTS") == "1"
+	if !DEDUP_OUTPUTS {
+		return nil
+	}
+	if store == nil {
+		log.Printf("DEDUP_OUTPUTS ignored: no STORAGE_BACKEND")
+		DEDUP_OUTPUTS = false
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	keys, err := store.List(ctx, RESULTS_PREFIX)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		entries, err := loadManifest(ctx, key)
+		if err != nil {
+			log.Printf("dedup: %s: %v", key, err)
+			continue
+		}
+		for _, e := range entries {
+			if e.Hash != "" {
+				casRefs.m[e.Hash]++
+			}
+		}
+	}
+	return nil
+}
+
+func manifestKey(token string) string { return RESULTS_PREFIX + token + ".json" }
+
+func loadManifest(ctx context.Context, key string) ([]manifestEntry, error) {
+	b, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	entries := []manifestEntry{}
+	err = json.Unmarshal(b, &entries)
+	return entries, err
+}
+
+// putDedup splits a finished master ZIP into blobs plus a manifest; returns the manifest key.
+// On failure the blobs it referenced are released again.
+func putDedup(ctx context.Context, token string, result resultZip) (key string, err error) {
+	var held []string
+	defer func() {
+		if err != nil {
+			for _, hash := range held {
+				releaseBlob(ctx, hash)
+			}
+		}
+	}()
+	f, err := result.open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, result.size)
+	if err != nil {
+		return "", err
+	}
+	entries := make([]manifestEntry, 0, len(zr.File))
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			entries = append(entries, manifestEntry{Name: f.Name})
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if err := holdBlob(ctx, hash, data); err != nil {
+			return "", err
+		}
+		held = append(held, hash)
+		entries = append(entries, manifestEntry{Name: f.Name, Hash: hash})
+	}
+	b, _ := json.Marshal(entries)
+	key = manifestKey(token)
+	return key, store.Put(ctx, key, b)
+}
+
+// holdBlob takes a reference to the blob hash, storing data first when
+// nothing references it yet.
+func holdBlob(ctx context.Context, hash string, data []byte) error {
+	mu := casLock(hash)
+	mu.Lock()
+	defer mu.Unlock()
+	casRefs.Lock()
+	fresh := casRefs.m[hash] == 0
+	casRefs.Unlock()
+	if fresh {
+		if err := store.Put(ctx, CAS_PREFIX+hash, data); err != nil {
+			return err
+		}
+	}
+	casRefs.Lock()
+	casRefs.m[hash]++
+	casRefs.Unlock()
+	return nil
+}
+
+func releaseBlob(ctx context.Context, hash string) {
+	mu := casLock(hash)
+	mu.Lock()
+	defer mu.Unlock()
+	casRefs.Lock()
+	casRefs.m[hash]--
+	gone := casRefs.m[hash] <= 0
+	if gone {
+		delete(casRefs.m, hash)
+	}
+	casRefs.Unlock()
+	if gone {
+		if err := store.Delete(ctx, CAS_PREFIX+hash); err != nil {
+			log.Printf("dedup: delete %s: %v", hash, err)
+		}
+	}
+}
+
+// releaseManifest drops a result's manifest and the blobs nobody else references.
+func releaseManifest(ctx context.Context, token string) error {
+	key := manifestKey(token)
+	entries, err := loadManifest(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Hash != "" {
+			releaseBlob(ctx, e.Hash)
+		}
+	}
+	return store.Delete(ctx, key)
+}
+
+// serveDedupZip reassembles the archive described by a manifest straight into w.
+func serveDedupZip(w http.ResponseWriter, r *http.Request, key string) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	entries, err := loadManifest(ctx, key)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=compressed.zip")
+	if err := writeDedupEntries(ctx, w, entries); err != nil {
+		// headers are already out; a truncated archive is the best signal left
+		log.Printf("dedup: %s: %v", key, err)
+	}
+}
+
+func writeDedupZip(ctx context.Context, w io.Writer, key string) error {
+	entries, err := loadManifest(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeDedupEntries(ctx, w, entries)
+}
+
+func writeDedupEntries(ctx context.Context, w io.Writer, entries []manifestEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		fw, err := zw.Create(e.Name)
+		if err != nil {
+			return err
+		}
+		if e.Hash == "" {
+			continue
+		}
+		data, err := store.Get(ctx, CAS_PREFIX+e.Hash)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Hash, err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ===== Result diffing =====
+// Compares two result archives of the same inputs run with different settings:
+// per file size, estimated JPEG quality and dimensions. Top-level "<label>_compressed"
+// folders are ignored when matching, since loose-file labels carry a timestamp.
+//
+//	GET /diff?a=<token>&b=<token>
+//	multicompressgo diff a.zip b.zip
+
+type diffSide struct {
+	Bytes   int `json:"bytes"`
+	Quality int `json:"quality"` // estimated from the quantization table; 0 if not JPEG
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+}
+
+type fileDiff struct {
+	Name       string    `json:"name"`
+	A          *diffSide `json:"a,omitempty"`
+	B          *diffSide `json:"b,omitempty"`
+	DeltaBytes int       `json:"delta_bytes"`
+}
+
+type diffReport struct {
+	Files  []fileDiff `json:"files"`
+	BytesA int        `json:"bytes_a"`
+	BytesB int        `json:"bytes_b"`
+	OnlyA  int        `json:"only_a"`
+	OnlyB  int        `json:"only_b"`
+}
+
+func diffKey(name string) string {
+	if top, rest, ok := strings.Cut(name, "/"); ok && strings.HasSuffix(top, "_compressed") {
+		return rest
+	}
+	return name
+}
+
+func diffSides(zipData []byte) (map[string]*diffSide, error) {
+	pairs, err := extractZipToMemory(zipData, "")
+	if err != nil {
+		return nil, err
+	}
+	sides := map[string]*diffSide{}
+	for _, p := range pairs {
+		if p.Skip != "" || !IMG_EXT[extLower(p.Rel)] || systemFile(p.Rel) {
+			continue
+		}
+		s := &diffSide{Bytes: len(p.Data), Quality: estimateJPEGQuality(p.Data)}
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(p.Data)); err == nil {
+			s.Width, s.Height = cfg.Width, cfg.Height
+		}
+		sides[diffKey(p.Rel)] = s
+	}
+	return sides, nil
+}
+
+func diffResults(a, b []byte) (*diffReport, error) {
+	sa, err := diffSides(a)
+	if err != nil {
+		return nil, fmt.Errorf("a: %w", err)
+	}
+	sb, err := diffSides(b)
+	if err != nil {
+		return nil, fmt.Errorf("b: %w", err)
+	}
+	rep := &diffReport{Files: []fileDiff{}}
+	names := map[string]bool{}
+	for n := range sa {
+		names[n] = true
+	}
+	for n := range sb {
+		names[n] = true
+	}
+	for n := range names {
+		d := fileDiff{Name: n, A: sa[n], B: sb[n]}
+		switch {
+		case d.A == nil:
+			rep.OnlyB++
+			rep.BytesB += d.B.Bytes
+		case d.B == nil:
+			rep.OnlyA++
+			rep.BytesA += d.A.Bytes
+		default:
+			d.DeltaBytes = d.B.Bytes - d.A.Bytes
+			rep.BytesA += d.A.Bytes
+			rep.BytesB += d.B.Bytes
+		}
+		rep.Files = append(rep.Files, d)
+	}
+	sort.Slice(rep.Files, func(i, j int) bool { return rep.Files[i].Name < rep.Files[j].Name })
+	return rep, nil
+}
+
+// lumaQuant is the standard luminance table in zigzag order (as in image/jpeg).
+var lumaQuant = [64]float64{
+	16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+// estimateJPEGQuality inverts libjpeg-style scaling of the first quantization table.
+func estimateJPEGQuality(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 0
+		}
+		marker := data[i+1]
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+n > len(data) {
+			return 0
+		}
+		if marker == 0xDB && n >= 67 {
+			seg := data[i+4 : i+2+n]
+			if seg[0]>>4 != 0 || seg[0]&0x0F != 0 {
+				// 16-bit or non-luma first table: rare, not worth estimating
+				return 0
+			}
+			scale := 0.0
+			for k := 0; k < 64; k++ {
+				scale += float64(seg[1+k]) * 100 / lumaQuant[k]
+			}
+			scale /= 64
+			if scale <= 100 {
+				return clampInt(int(math.Round((200-scale)/2)), 1, 100)
+			}
+			return clampInt(int(math.Round(5000/scale)), 1, 100)
+		}
+		i += 2 + n
+	}
+	return 0
+}
+
+// resultBytes loads a finished result archive by token from memory or storage.
+func resultBytes(ctx context.Context, token string) ([]byte, error) {
+	memZips.RLock()
+	result, ok := memZips.m[token]
+	memZips.RUnlock()
+	if ok {
+		return result.bytes()
+	}
+	if store == nil {
+		return nil, errNoResult
+	}
+	if DEDUP_OUTPUTS {
+		buf := &bytes.Buffer{}
+		if err := writeDedupZip(ctx, buf, manifestKey(token)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return store.Get(ctx, RESULTS_PREFIX+token+".zip")
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	ta, tb := r.FormValue("a"), r.FormValue("b")
+	if ta == "" || tb == "" {
+		http.Error(w, "need a and b tokens", http.StatusBadRequest)
+		return
+	}
+	a, err := resultBytes(r.Context(), ta)
+	if err != nil {
+		http.Error(w, "a: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	b, err := resultBytes(r.Context(), tb)
+	if err != nil {
+		http.Error(w, "b: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	rep, err := diffResults(a, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+// runDiffCLI implements `multicompressgo diff a.zip b.zip`.
+func runDiffCLI(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: multicompressgo diff a.zip b.zip")
+		os.Exit(2)
+	}
+	a, errA := os.ReadFile(args[0])
+	b, errB := os.ReadFile(args[1])
+	if err := errors.Join(errA, errB); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	rep, err := diffResults(a, b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	side := func(s *diffSide) string {
+		if s == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%d B q%d %dx%d", s.Bytes, s.Quality, s.Width, s.Height)
+	}
+	for _, d := range rep.Files {
+		fmt.Printf("%-40s %-28s %-28s %+d\n", d.Name, side(d.A), side(d.B), d.DeltaBytes)
+	}
+	fmt.Printf("\ntotal %d -> %d bytes (%+d), %d only in a, %d only in b\n", rep.BytesA, rep.BytesB, rep.BytesB-rep.BytesA, rep.OnlyA, rep.OnlyB)
+}
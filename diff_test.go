@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestEstimateJPEGQuality(t *testing.T) {
+	// image/jpeg scales the libjpeg tables the same way, so the estimate
+	// should land on the quality it was written with
+	for _, q := range []int{30, 50, 75, 90} {
+		if got := estimateJPEGQuality(testJPEG(t, q)); got < q-1 || got > q+1 {
+			t.Errorf("quality %d: estimated %d", q, got)
+		}
+	}
+	if got := estimateJPEGQuality([]byte("not a jpeg")); got != 0 {
+		t.Errorf("not a JPEG: estimated %d, want 0", got)
+	}
+}
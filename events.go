@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Job events =====
+// runJobs only publishes what happens (job started, file started, file done,
+// file skipped, job done); everything that reacts subscribes to the bus:
+//   - progress/ETA for /jobs/{id} and the SQLite history (jobs.go, history.go)
+//   - the job's own summary and skip list (jobReport)
+//   - /events/{id} (also /jobs/{id}/events): Server-Sent Events, used by the
+//     page's progress bar and file log
+//   - Slack/Telegram on job done (notify.go)
+//   - EVENT_WEBHOOK_URL: every event POSTed as JSON (EVENT_WEBHOOK_EVENTS filters)
+//   - EVENT_QUEUE_URL: file events to NATS, Kafka or AMQP (queue.go)
+//   - EVENT_LOG=1: one JSON log line per event
+//   - /metrics: counters in the Prometheus text format
+//
+// Subscribers run in the publishing goroutine and must not block; slow ones
+// (SSE, webhook) hand events to a buffered channel and drop when it is full.
+//
+//	EVENT_WEBHOOK_URL=https://hooks.example.com/compress EVENT_WEBHOOK_EVENTS=job_done,file_skipped EVENT_LOG=1
+
+const (
+	evJobStarted  = "job_started"
+	evFileStarted = "file_started"
+	evFileDone    = "file_done"
+	evFileSkipped = "file_skipped"
+	evJobDone     = "job_done"
+)
+
+type jobEvent struct {
+	Type      string         `json:"type"`
+	Job       string         `json:"job"`
+	Time      time.Time      `json:"time"`
+	File      string         `json:"file,omitempty"`
+	Label     string         `json:"label,omitempty"`
+	Source    string         `json:"source,omitempty"`
+	Lines     []string       `json:"lines,omitempty"`           // file_done: one summary line per output
+	Records   []outputRecord `json:"records,omitempty"`         // file_done: the same outputs, structured
+	Paths     []string       `json:"paths,omitempty"`           // file_done: the outputs in the result ZIP
+	Flat      string         `json:"flat,omitempty"`            // file_done: the input's name in flatten mode, when it had folders
+	Skipped   []string       `json:"skipped,omitempty"`         // why (parts of) the file were skipped
+	SkipKinds []skipKind     `json:"skip_categories,omitempty"` // the category of each of Skipped
+	InBytes   int            `json:"in_bytes,omitempty"`
+	OutBytes  int            `json:"out_bytes,omitempty"`
+	Seconds   float64        `json:"seconds,omitempty"`
+	Ignored   bool           `json:"ignored,omitempty"` // file_skipped: under the job's ignore_below_kb, not a problem
+	Files     int            `json:"files,omitempty"`   // job_started
+	Token     string         `json:"token,omitempty"`   // job_done
+	Error     string         `json:"error,omitempty"`   // job_done without a result
+	Progress  *jobProgress   `json:"progress,omitempty"`
+
+	outputs map[string][]byte // file_done: Paths with their bytes, in process only (queue.go)
+}
+
+var (
+	EVENT_WEBHOOK_URL    = ""
+	EVENT_WEBHOOK_EVENTS = map[string]bool{}
+	EVENT_LOG            = false
+)
+
+var eventBus = struct {
+	sync.RWMutex
+	subs []eventSub
+	next int
+}{}
+
+type eventSub struct {
+	id int
+	fn func(jobEvent)
+}
+
+// subscribe adds fn to the bus; call the returned func to leave it.
+func subscribe(fn func(jobEvent)) func() {
+	eventBus.Lock()
+	eventBus.next++
+	id := eventBus.next
+	eventBus.subs = append(eventBus.subs, eventSub{id, fn})
+	eventBus.Unlock()
+	return func() {
+		eventBus.Lock()
+		defer eventBus.Unlock()
+		for i, s := range eventBus.subs {
+			if s.id == id {
+				eventBus.subs = append(eventBus.subs[:i:i], eventBus.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// publish hands ev to every subscriber, in subscription order.
+func publish(ev jobEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	eventBus.RLock()
+	subs := eventBus.subs
+	eventBus.RUnlock()
+	for _, s := range subs {
+		s.fn(ev)
+	}
+}
+
+// setupEvents wires the process-wide subscribers; progress comes first so the
+// later ones see the updated snapshot.
+func setupEvents() {
+	subscribe(trackProgress)
+	subscribe(recordHistory)
+	subscribe(notifyOnDone)
+	subscribe(countMetrics)
+	EVENT_LOG = os.Getenv("EVENT_LOG") == "1"
+	if EVENT_LOG {
+		subscribe(func(ev jobEvent) {
+			b, _ := json.Marshal(ev)
+			log.Printf("event %s", b)
+		})
+	}
+	EVENT_WEBHOOK_URL = os.Getenv("EVENT_WEBHOOK_URL")
+	for _, t := range strings.Split(os.Getenv("EVENT_WEBHOOK_EVENTS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			EVENT_WEBHOOK_EVENTS[t] = true
+		}
+	}
+	if EVENT_WEBHOOK_URL != "" {
+		queue := make(chan jobEvent, 256)
+		go func() {
+			for ev := range queue {
+				b, _ := json.Marshal(ev)
+				if err := postNotification(EVENT_WEBHOOK_URL, "application/json", bytes.NewReader(b)); err != nil {
+					log.Printf("event webhook: %v", err)
+				}
+			}
+		}()
+		subscribe(func(ev jobEvent) {
+			if len(EVENT_WEBHOOK_EVENTS) > 0 && !EVENT_WEBHOOK_EVENTS[ev.Type] {
+				return
+			}
+			select {
+			case queue <- ev:
+			default:
+				log.Printf("event webhook: queue full, dropped %s of %s", ev.Type, ev.Job)
+			}
+		})
+	}
+}
+
+// ----- per-job summary -----
+
+// resultManifest is the machine-readable result of a job, answered by
+// /process?format=json and printed by `compress -json`.
+type resultManifest struct {
+	Status   string         `json:"status"` // ok, partial (something was skipped) or failed (nothing compressed)
+	Token    string         `json:"token,omitempty"`
+	Download string         `json:"download,omitempty"`
+	Expires  *time.Time     `json:"expires,omitempty"`  // when the download link stops working
+	Output   string         `json:"output,omitempty"`   // the ZIP file (CLI) or storage prefix written
+	Exported int            `json:"exported,omitempty"` // objects written under the storage prefix
+	Summary  string         `json:"summary"`
+	Files    []manifestFile `json:"files"`
+	Skips    []skipItem     `json:"skips"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// manifestFile is one input of the job.
+type manifestFile struct {
+	File     string         `json:"file"`
+	Label    string         `json:"label"`
+	Source   string         `json:"source,omitempty"`
+	Status   string         `json:"status"` // ok, partial, skipped or ignored (ignore_below_kb)
+	InBytes  int            `json:"in_bytes"`
+	OutBytes int            `json:"out_bytes"`
+	Outputs  []string       `json:"outputs,omitempty"`
+	Records  []outputRecord `json:"records,omitempty"` // Outputs, structured
+	Paths    []string       `json:"paths,omitempty"`   // in the ZIP, also /download/<token>/<path>
+	Flat     string         `json:"flat,omitempty"`    // flatten mode: the name File was flattened to
+	Skipped  []string       `json:"skipped,omitempty"`
+}
+
+// jobReport collects one job's summary lines, per-source stats, files and skips from its events.
+type jobReport struct {
+	mu       sync.Mutex
+	lines    []string
+	bySource map[string]*sourceStats
+	files    []manifestFile
+	skips    []skipItem
+	stop     func()
+}
+
+func newJobReport(jobID string) *jobReport {
+	rep := &jobReport{bySource: map[string]*sourceStats{}}
+	rep.stop = subscribe(func(ev jobEvent) {
+		if ev.Job != jobID || (ev.Type != evFileDone && ev.Type != evFileSkipped) {
+			return
+		}
+		rep.mu.Lock()
+		defer rep.mu.Unlock()
+		if ev.Ignored {
+			rep.files = append(rep.files, manifestFile{File: ev.File, Label: ev.Label, Source: ev.Source, Status: "ignored", InBytes: ev.InBytes})
+			return
+		}
+		if rep.bySource[ev.Source] == nil {
+			rep.bySource[ev.Source] = &sourceStats{}
+		}
+		rep.bySource[ev.Source].add(ev.InBytes, ev.OutBytes, ev.Records, ev.Skipped)
+		for _, s := range ev.Lines {
+			rep.lines = append(rep.lines, fmt.Sprintf("%s: %s", ev.Label, s))
+		}
+		rep.skips = append(rep.skips, newSkipItems(ev.Label, ev.Skipped, ev.SkipKinds)...)
+		f := manifestFile{File: ev.File, Label: ev.Label, Source: ev.Source, Status: "ok",
+			InBytes: ev.InBytes, OutBytes: ev.OutBytes, Outputs: ev.Lines, Records: ev.Records, Paths: ev.Paths, Flat: ev.Flat, Skipped: ev.Skipped}
+		if ev.Type == evFileSkipped {
+			f.Status = "skipped"
+		} else if len(ev.Skipped) > 0 {
+			f.Status = "partial"
+		}
+		rep.files = append(rep.files, f)
+	})
+	return rep
+}
+
+// finish leaves the bus and returns the manifest (without token) of the job.
+func (rep *jobReport) finish() resultManifest {
+	rep.stop()
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	lines := append(sourceSummary(rep.bySource), rep.lines...)
+	sort.SliceStable(rep.skips, func(i, j int) bool { return rep.skips[i].Message < rep.skips[j].Message })
+	sort.SliceStable(rep.files, func(i, j int) bool {
+		a, b := rep.files[i], rep.files[j]
+		return a.Label < b.Label || a.Label == b.Label && a.File < b.File
+	})
+	m := resultManifest{Status: "ok", Summary: strings.Join(lines, "\n"), Files: rep.files, Skips: rep.skips}
+	if m.Files == nil {
+		m.Files = []manifestFile{}
+	}
+	if m.Skips == nil {
+		m.Skips = []skipItem{}
+	}
+	compressed := 0
+	for _, f := range m.Files {
+		if f.Status == "ok" || f.Status == "partial" {
+			compressed++
+		}
+	}
+	switch {
+	case compressed == 0:
+		m.Status = "failed"
+	case len(m.Skips) > 0:
+		m.Status = "partial"
+	}
+	return m
+}
+
+// ----- Server-Sent Events -----
+
+// eventsHandler serves /events/{id}, the page's progress stream; the same as
+// /jobs/{id}/events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	jobEventsHandler(w, r, strings.TrimPrefix(r.URL.Path, "/events/"))
+}
+
+// jobEventsHandler streams /jobs/{id}/events until the job is done. The page
+// connects before its upload finishes, so unknown (not yet started) IDs are fine.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !jobIDPattern.MatchString(id) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan jobEvent, 64)
+	done := make(chan jobEvent, 1) // job_done is never dropped, the client waits for it
+	stop := subscribe(func(ev jobEvent) {
+		if ev.Job != id {
+			return
+		}
+		if ev.Type == evJobDone {
+			select {
+			case done <- ev:
+			default: // already have it
+			}
+			return
+		}
+		select {
+		case ch <- ev:
+		default: // the client is behind; the next event carries the progress anyway
+		}
+	})
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	send := func(ev jobEvent) {
+		if p, ok := jobSnapshot(id); ok {
+			ev.Progress = &p
+		}
+		b, _ := json.Marshal(ev)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+		flusher.Flush()
+	}
+	if p, ok := jobSnapshot(id); ok {
+		if p.State == "done" {
+			send(jobEvent{Type: evJobDone, Job: id, Time: p.Finished})
+			return
+		}
+		send(jobEvent{Type: "progress", Job: id, Time: time.Now()})
+	}
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			send(ev)
+		case ev := <-done:
+			// what is still queued came first
+			for len(ch) > 0 {
+				send(<-ch)
+			}
+			send(ev)
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ----- /metrics -----
+
+var metrics = struct {
+	sync.Mutex
+	counts map[string]float64
+}{counts: map[string]float64{}}
+
+func countMetrics(ev jobEvent) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	switch ev.Type {
+	case evJobStarted:
+		metrics.counts["multicompress_jobs_started_total"]++
+	case evJobDone:
+		metrics.counts["multicompress_jobs_done_total"]++
+		if ev.Error != "" {
+			metrics.counts["multicompress_jobs_failed_total"]++
+		}
+	case evFileDone, evFileSkipped:
+		result := "done"
+		if ev.Type == evFileSkipped {
+			result = "skipped"
+		}
+		metrics.counts[`multicompress_files_total{result="`+result+`"}`]++
+		metrics.counts["multicompress_input_bytes_total"] += float64(ev.InBytes)
+		metrics.counts["multicompress_output_bytes_total"] += float64(ev.OutBytes)
+		metrics.counts["multicompress_file_seconds_total"] += ev.Seconds
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	names := make([]string, 0, len(metrics.counts))
+	for name := range metrics.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %g\n", name, metrics.counts[name])
+	}
+	metrics.Unlock()
+}
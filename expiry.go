@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ===== Result expiry =====
+// Every result is deleted RESULT_TTL after it was made (24h by default), by a
+// sweeper running every RESULT_SWEEP_EVERY, quota or not, so a long-running
+// server doesn't keep every ZIP it ever built. The result page, the JSON
+// manifest ("expires") and the Expires header of /download tell the user how
+// long the link works. POST /cleanup (admin) sweeps right away. Results are
+// kept on disk in ZIP_SPOOL_DIR (or in STORAGE_BACKEND), in memory only with
+// ZIP_SPOOL_DIR=off.
+//
+//	RESULT_TTL=6h RESULT_SWEEP_EVERY=5m
+//	curl -u admin:secret -X POST -H 'Accept: application/json' .../cleanup
+
+var RESULT_SWEEP_EVERY = 5 * time.Minute
+
+func setupExpiry() {
+	updateLive(expirySettings)
+	if d, err := time.ParseDuration(os.Getenv("RESULT_SWEEP_EVERY")); err == nil && d > 0 {
+		RESULT_SWEEP_EVERY = d
+	}
+	go func() {
+		for range time.Tick(RESULT_SWEEP_EVERY) {
+			sweepExpired()
+		}
+	}()
+}
+
+// expirySettings reads RESULT_TTL into c; a reload changes it for every kept
+// result, while RESULT_SWEEP_EVERY needs a restart.
+func expirySettings(c *liveConfig) error {
+	c.RESULT_TTL = liveDefaults.RESULT_TTL
+	if d, err := time.ParseDuration(os.Getenv("RESULT_TTL")); err == nil && d > 0 {
+		c.RESULT_TTL = d
+	}
+	return nil
+}
+
+// resultExpiry is when token's result will be swept.
+func resultExpiry(token string) (time.Time, bool) {
+	resultLRU.Lock()
+	defer resultLRU.Unlock()
+	u, ok := resultLRU.m[token]
+	if !ok {
+		return time.Time{}, false
+	}
+	return u.created.Add(live().RESULT_TTL), true
+}
+
+// sweepExpired deletes the results older than RESULT_TTL.
+func sweepExpired() (int, int64) {
+	ttl := live().RESULT_TTL
+	n, freed := deleteResults(func(ri resultInfo) bool { return time.Since(ri.Created) >= ttl })
+	if n > 0 {
+		log.Printf("expiry: removed %d results (%d bytes)", n, freed)
+	}
+	return n, freed
+}
+
+func cleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, freed := sweepExpired()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": n, "freed_bytes": freed, "ttl": live().RESULT_TTL.String()})
+		return
+	}
+	msg := fmt.Sprintf("%d hasil kedaluwarsa dihapus, %.1f MB dibebaskan.", n, float64(freed)/(1<<20))
+	http.Redirect(w, r, BASE_PATH+"/admin?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
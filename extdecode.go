@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ===== External decoder fallback =====
+// Formats the Go decoders reject (JPEG 2000, PSD, EMF, ...) can be handed to
+// ImageMagick or libvips. EXTERNAL_DECODER names the command ("magick",
+// "vips" or a path to either); its extensions are then accepted as images and
+// any image Go fails to decode gets a second try through it. A missing command
+// only logs a warning and leaves the fallback off.
+//
+//	EXTERNAL_DECODER=magick EXTERNAL_DECODER_EXT=".jp2,.j2k,.psd,.emf,.wmf"
+
+var (
+	EXTERNAL_DECODER     = ""
+	EXTERNAL_DECODER_EXT = []string{".jp2", ".j2k", ".jpf", ".jpx", ".psd", ".emf", ".wmf", ".eps"}
+
+	externalKind string // "magick" or "vips"
+)
+
+func setupExternalDecoder() error {
+	EXTERNAL_DECODER = os.Getenv("EXTERNAL_DECODER")
+	if EXTERNAL_DECODER == "" {
+		return nil
+	}
+	switch base := strings.TrimSuffix(filepath.Base(EXTERNAL_DECODER), ".exe"); base {
+	case "magick", "convert":
+		externalKind = "magick"
+	case "vips":
+		externalKind = "vips"
+	default:
+		return fmt.Errorf("EXTERNAL_DECODER %q is neither magick nor vips", EXTERNAL_DECODER)
+	}
+	if _, err := exec.LookPath(EXTERNAL_DECODER); err != nil {
+		log.Printf("WARNING: external decoder disabled: %v", err)
+		EXTERNAL_DECODER = ""
+		return nil
+	}
+	if v := os.Getenv("EXTERNAL_DECODER_EXT"); v != "" {
+		EXTERNAL_DECODER_EXT = nil
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+				if !strings.HasPrefix(e, ".") {
+					e = "." + e
+				}
+				EXTERNAL_DECODER_EXT = append(EXTERNAL_DECODER_EXT, e)
+			}
+		}
+	}
+	for _, e := range EXTERNAL_DECODER_EXT {
+		IMG_EXT[e] = true
+	}
+	return nil
+}
+
+// externalFormats lists the extensions only the external decoder handles; nil when it is off.
+func externalFormats() []string {
+	if EXTERNAL_DECODER == "" {
+		return nil
+	}
+	return EXTERNAL_DECODER_EXT
+}
+
+// decodeExternal converts b (named by ext) to PNG with the external decoder
+// and decodes that; multi-page/layered inputs keep their first image.
+func decodeExternal(ext string, b []byte) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "xdecode-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in"+ext), filepath.Join(dir, "out.png")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	// both rotate by the EXIF Orientation like compress.Decode does
+	args := []string{in + "[0]", "-auto-orient", out}
+	if externalKind == "vips" {
+		args = []string{"autorot", in, out}
+	}
+	if _, err := runTool(ctx, EXTERNAL_DECODER, args...); err != nil {
+		return nil, err
+	}
+	return imaging.Open(out)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ===== Browser extension intake =====
+// POST /api/v1/extension/compress is the fast path for a companion browser
+// extension ("compress this image for upload" on right-click): one image as
+// the raw request body, the file name in ?name= (or X-Filename) and the form
+// settings as query parameters, and the compressed bytes come straight back.
+// No ZIP and no stored result; a single target only.
+//
+// It needs "Authorization: Bearer <token>" with one of EXTENSION_TOKENS (off
+// when unset) and skips the OIDC login. Because the token and not a cookie is
+// the credential, it answers CORS for any origin itself: extension origins
+// (chrome-extension://<id>, moz-extension://<uuid>) differ per install.
+// Errors are JSON like /api/v1/compress.
+//
+//	EXTENSION_TOKENS=laptop-rina:9f2c41...,kiosk:77ab03...
+//	curl -H 'Authorization: Bearer 9f2c41...' --data-binary @foto.jpg -o foto_kecil.jpg \
+//	  '.../api/v1/extension/compress?name=foto.jpg&targets=90-100'
+
+const extensionPath = "/api/v1/extension/"
+
+func setupExtension() { updateLive(extensionSettings) }
+
+// extensionSettings reads EXTENSION_TOKENS into c.
+func extensionSettings(c *liveConfig) error {
+	tokens := map[string]string{}
+	for i, t := range strings.Split(os.Getenv("EXTENSION_TOKENS"), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		name, tok, ok := strings.Cut(t, ":")
+		if !ok {
+			name, tok = "token"+strconv.Itoa(i+1), t
+		}
+		tokens[tok] = name
+	}
+	c.EXTENSION_TOKENS = tokens
+	return nil
+}
+
+// extensionClient names the token the request carries, "" when none matches.
+func extensionClient(r *http.Request) string {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || given == "" {
+		return ""
+	}
+	client := ""
+	for tok, name := range live().EXTENSION_TOKENS {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(tok)) == 1 {
+			client = name
+		}
+	}
+	return client
+}
+
+func extensionCORS(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Origin") == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, Retry-After, X-Original-Bytes")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Filename")
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+}
+
+func extensionCompressHandler(w http.ResponseWriter, r *http.Request) {
+	extensionCORS(w, r)
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		apiError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if len(live().EXTENSION_TOKENS) == 0 {
+		apiError(w, http.StatusNotFound, "extension API disabled (set EXTENSION_TOKENS)")
+		return
+	}
+	client := extensionClient(r)
+	if client == "" {
+		log.Printf("extension: bad token from %s", clientIP(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="multicompress"`)
+		apiError(w, http.StatusUnauthorized, "missing or unknown bearer token")
+		return
+	}
+	release, reason, retry := reserveJob()
+	if reason != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		if notice := maintenanceNotice(); notice != "" {
+			apiError(w, http.StatusServiceUnavailable, "maintenance: "+notice)
+			return
+		}
+		apiError(w, http.StatusServiceUnavailable, "server busy: "+reason)
+		return
+	}
+	defer release()
+
+	q := r.URL.Query()
+	name := filepath.Base(q.Get("name"))
+	if name == "." || name == "/" {
+		name = filepath.Base(r.Header.Get("X-Filename"))
+	}
+	if !IMG_EXT[inputExt(name)] {
+		apiError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("name %q: send one image, named with its extension", name))
+		return
+	}
+	opts, err := settingsFrom(q.Get)
+	if errs, ok := err.(settingsErrors); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": errs.Error(), "fields": errs.byField()})
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(opts.targets) > 1 {
+		apiError(w, http.StatusBadRequest, "one target per request (use /api/v1/compress for several)")
+		return
+	}
+	if why := extPolicyFrom(opts).refuse(name); why != "" {
+		apiError(w, http.StatusUnsupportedMediaType, why)
+		return
+	}
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	if err != nil {
+		apiReadError(w, err)
+		return
+	}
+	if len(raw) == 0 {
+		apiError(w, http.StatusBadRequest, "empty body")
+		return
+	}
+
+	if n, ok := writeDirect(w, name, raw, opts); ok {
+		log.Printf("extension: %s compressed %s, %d -> %d bytes", client, name, len(raw), n)
+	}
+}
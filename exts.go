@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ===== Accepted extensions =====
+// Operators decide which inputs this server takes at all:
+//   - ALLOWED_EXT:  only these are accepted (empty = everything decodable)
+//   - DENIED_EXT:   never accepted, e.g. ".gif"
+//   - OPTIONAL_EXT: accepted only when a request names them in allow_ext
+//   - EXT_ALIASES:  extra extensions decoded like an existing one
+//
+// A request can then narrow that set with allow_ext (only these; may switch
+// on OPTIONAL_EXT) and deny_ext, but never go beyond it. Refused files show
+// up as skipped, not silently dropped. ZIPs are governed by ALLOW_ZIP; the
+// rules apply to their entries.
+//
+// The files operating systems leave behind (__MACOSX/, AppleDouble "._x",
+// .DS_Store, Thumbs.db) are different: they are dropped from ZIPs, folders
+// and uploads without a trace, since they only clutter the summary and the
+// "._x.jpg" ones would fail to decode. keep_hidden=1 takes them in again.
+//
+//	ALLOWED_EXT=".jpg,.jpeg,.png,.pdf,.scan" DENIED_EXT=".gif" OPTIONAL_EXT=".tif,.tiff"
+//	EXT_ALIASES=".scan=.tif,.jpe=.jpg"
+
+var (
+	ALLOWED_EXT  = map[string]bool{}
+	DENIED_EXT   = map[string]bool{}
+	OPTIONAL_EXT = map[string]bool{}
+	EXT_ALIASES  = map[string]string{}
+)
+
+// setupExtensions runs after the decoders registered their extensions.
+func setupExtensions() error {
+	for _, pair := range strings.Split(os.Getenv("EXT_ALIASES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		alias, target, ok := strings.Cut(pair, "=")
+		alias, target = normExt(alias), normExt(target)
+		if !ok || alias == "" || target == "" {
+			return fmt.Errorf("EXT_ALIASES: bad entry %q (want .alias=.ext)", pair)
+		}
+		if !IMG_EXT[target] && !PDF_EXT[target] {
+			return fmt.Errorf("EXT_ALIASES: %s maps to %s, which no decoder handles", alias, target)
+		}
+		if IMG_EXT[alias] || PDF_EXT[alias] || alias == ".zip" {
+			return fmt.Errorf("EXT_ALIASES: %s is already a supported extension", alias)
+		}
+		EXT_ALIASES[alias] = target
+	}
+	ALLOWED_EXT = parseExtList(os.Getenv("ALLOWED_EXT"))
+	DENIED_EXT = parseExtList(os.Getenv("DENIED_EXT"))
+	OPTIONAL_EXT = parseExtList(os.Getenv("OPTIONAL_EXT"))
+	return nil
+}
+
+func normExt(e string) string {
+	e = strings.ToLower(strings.TrimSpace(e))
+	if e != "" && !strings.HasPrefix(e, ".") {
+		e = "." + e
+	}
+	return e
+}
+
+func parseExtList(v string) map[string]bool {
+	m := map[string]bool{}
+	for _, e := range strings.Split(v, ",") {
+		if e = normExt(e); e != "" {
+			m[e] = true
+		}
+	}
+	return m
+}
+
+// inputExt is name's lowercased extension with EXT_ALIASES resolved, i.e. the
+// format it is decoded as.
+func inputExt(name string) string {
+	ext := extLower(name)
+	if target, ok := EXT_ALIASES[ext]; ok {
+		return target
+	}
+	return ext
+}
+
+// serverAccepts reports whether the operator lets ext in for at least some requests.
+func serverAccepts(ext string) bool {
+	canon := ext
+	if target, ok := EXT_ALIASES[ext]; ok {
+		canon = target
+	}
+	if !IMG_EXT[canon] && !PDF_EXT[canon] {
+		return false
+	}
+	return !DENIED_EXT[ext] && (len(ALLOWED_EXT) == 0 || ALLOWED_EXT[ext])
+}
+
+// acceptedExts lists what serverAccepts, for /capabilities.
+func acceptedExts() []string {
+	exts := []string{}
+	for _, set := range []map[string]bool{IMG_EXT, PDF_EXT} {
+		for e := range set {
+			if serverAccepts(e) {
+				exts = append(exts, e)
+			}
+		}
+	}
+	for e := range EXT_ALIASES {
+		if serverAccepts(e) {
+			exts = append(exts, e)
+		}
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+func optionalExts() []string {
+	exts := []string{}
+	for e := range OPTIONAL_EXT {
+		exts = append(exts, e)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// extPolicy is how one request takes its inputs: allow_ext/deny_ext on top of
+// the operator rules, and the password for encrypted ZIPs (zip_password).
+type extPolicy struct {
+	allow, deny map[string]bool
+	zipPassword string
+	keepHidden  bool
+}
+
+// validateExtPolicy rejects an allow_ext asking for more than the operator permits.
+func validateExtPolicy(allow string) error {
+	for e := range parseExtList(allow) {
+		if !serverAccepts(e) {
+			return fmt.Errorf("allow_ext: %s is not accepted by this server", e)
+		}
+	}
+	return nil
+}
+
+func extPolicyFrom(opts Options) extPolicy {
+	return extPolicy{allow: parseExtList(opts.AllowExt), deny: parseExtList(opts.DenyExt), keepHidden: opts.KeepHidden}
+}
+
+// hidden reports whether name is left out as an OS leftover in this request.
+func (p extPolicy) hidden(name string) bool {
+	return !p.keepHidden && systemFile(name)
+}
+
+// systemFile reports whether name is, or lies inside, a file the OS keeps for
+// itself: macOS resource forks and folder metadata, Windows thumbnail caches.
+func systemFile(name string) bool {
+	for _, seg := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		switch {
+		case seg == "__MACOSX", seg == ".DS_Store", strings.EqualFold(seg, "Thumbs.db"), strings.HasPrefix(seg, "._"):
+			return true
+		}
+	}
+	return false
+}
+
+// refuse says why name is not taken in this request, "" when it is.
+func (p extPolicy) refuse(name string) string {
+	ext := extLower(name)
+	canon := inputExt(name)
+	if !IMG_EXT[canon] && !PDF_EXT[canon] {
+		return "unsupported format"
+	}
+	allowed := serverAccepts(ext) && !p.deny[ext]
+	if len(p.allow) > 0 {
+		allowed = allowed && p.allow[ext]
+	} else if OPTIONAL_EXT[ext] {
+		allowed = false
+	}
+	if !allowed {
+		return "format " + ext + " not allowed"
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ===== Flatten mode =====
+// flatten=prefix|hash|seq puts every output straight into its label folder,
+// dropping the folders it had inside a ZIP or folder upload. Inputs whose
+// names then clash in one label folder are renamed by the chosen strategy;
+// the first to arrive keeps its plain name:
+//   - prefix: the folders joined in front, "scans/2024/a.jpg" -> "scans_2024_a.jpg"
+//   - hash:   8 hex digits of the folder path, "a_3f2c9e1b.jpg"
+//   - seq:    a running number, "a_2.jpg", "a_3.jpg"
+//
+// A renamed name that still clashes gets a running number on top. The
+// manifest lists the flattened name of every input that had folders ("flat").
+
+func validateFlatten(mode string) error {
+	switch mode {
+	case "", "prefix", "hash", "seq":
+		return nil
+	}
+	return fmt.Errorf("flatten must be prefix, hash or seq, got %q", mode)
+}
+
+// flatNamer hands out the flattened names of one job. Not safe for concurrent
+// use: buildMasterZipFrom names jobs in arrival order, before the workers.
+type flatNamer struct {
+	mode string
+	used map[string]bool // label + "/" + lower-case name without extension
+}
+
+func newFlatNamer(mode string) *flatNamer {
+	return &flatNamer{mode: mode, used: map[string]bool{}}
+}
+
+// name returns rel as it goes into the label folder: rel itself with flatten
+// off, else its base name, renamed when the label folder already has it.
+// Outputs are named after the input without its extension, so "a.png" and
+// "a.jpg" clash too.
+func (n *flatNamer) name(label, rel string) string {
+	if n.mode == "" {
+		return rel
+	}
+	dir, base := path.Split(rel)
+	dir = strings.Trim(dir, "/")
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if n.take(label, stem) {
+		return base
+	}
+	switch {
+	case dir == "":
+	case n.mode == "prefix":
+		stem = strings.ReplaceAll(dir, "/", "_") + "_" + stem
+	case n.mode == "hash":
+		sum := sha256.Sum256([]byte(dir))
+		stem += "_" + hex.EncodeToString(sum[:4])
+	}
+	if stem != strings.TrimSuffix(base, ext) && n.take(label, stem) {
+		return stem + ext
+	}
+	for i := 2; ; i++ {
+		if s := fmt.Sprintf("%s_%d", stem, i); n.take(label, s) {
+			return s + ext
+		}
+	}
+}
+
+// take claims stem in label's folder; false when it is already used.
+func (n *flatNamer) take(label, stem string) bool {
+	key := label + "/" + strings.ToLower(stem)
+	if n.used[key] {
+		return false
+	}
+	n.used[key] = true
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"strconv"
+)
+
+// ===== Animated GIFs =====
+// Outputs are still JPEGs, so an animated GIF keeps the frames the gif_frame
+// setting picks: "first" (default), "middle", "last", "longest" (shown the
+// longest, e.g. the title card of a slideshow), "all" (one output per frame,
+// named _f1, _f2, ...) or a 1-based frame number; the summary line says which
+// frame of how many was kept. "all" keeps at most GIF_MAX_FRAMES frames (the
+// first ones) and lists the rest as skipped. Like any image, its logical
+// screen may not declare more than MAX_PIXELS (width x height).
+//
+//	GIF_MAX_FRAMES=100 MAX_PIXELS=150000000
+
+func validateGIFFrame(v string) error {
+	switch v {
+	case "", "first", "middle", "last", "longest", "all":
+		return nil
+	}
+	if n, err := strconv.Atoi(v); err != nil || n < 1 {
+		return fmt.Errorf("invalid gif_frame %q (first, middle, last, longest, all or a frame number)", v)
+	}
+	return nil
+}
+
+// decodeGIF reads every frame of a GIF, still paletted. The logical screen
+// must be within MAX_PIXELS, since gifFrames allocates canvases that size.
+func decodeGIF(raw []byte) (*gif.GIF, error) {
+	if err := checkPixels(raw); err != nil {
+		return nil, err
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, fmt.Errorf("gif has no frames")
+	}
+	return g, nil
+}
+
+// gifFrames renders the chosen frames of g as they appear on screen (frames
+// are drawn over each other) and hands them to fn one at a time, with their
+// 1-based index. The image is only valid during the call: the next frame is
+// drawn onto it. It returns how many frames fn got.
+func gifFrames(g *gif.GIF, choice string, fn func(frame image.Image, k int)) int {
+	total := len(g.Image)
+	want := []int{0}
+	switch choice {
+	case "", "first":
+	case "middle":
+		want[0] = total / 2
+	case "last":
+		want[0] = total - 1
+	case "longest":
+		for i, d := range g.Delay {
+			if i < total && d > g.Delay[want[0]] {
+				want[0] = i
+			}
+		}
+	case "all":
+		want = make([]int, min(total, max(live().GIF_MAX_FRAMES, 1)))
+		for i := range want {
+			want[i] = i
+		}
+	default:
+		n, _ := strconv.Atoi(choice)
+		want[0] = clampInt(n-1, 0, total-1)
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	var prev *image.RGBA
+	last := want[len(want)-1]
+	for i, next := 0, 0; i <= last; i++ {
+		fr := g.Image[i]
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if i < last && disposal == gif.DisposalPrevious {
+			if prev == nil {
+				prev = image.NewRGBA(bounds)
+			}
+			copy(prev.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, fr.Bounds(), fr, fr.Bounds().Min, draw.Over)
+		if i == want[next] {
+			fn(canvas, i+1)
+			next++
+		}
+		if i == last {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, fr.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, prev.Pix)
+		}
+	}
+	return len(want)
+}
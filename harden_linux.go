@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The decode worker is confined in two steps before it touches untrusted input:
+//   - confineWorker: landlock, filesystem access only beneath workdir plus
+//     reading (not writing) the worker binary and the system libraries it
+//     loads; already open fds, like stdin/stdout, keep working. Landlock binds
+//     to the calling thread, and a Go process has several threads from the
+//     start, so the worker restricts one locked thread and re-executes itself
+//     from it: every thread of the new image descends from that thread and
+//     inherits the domain.
+//   - hardenWorker, in the re-executed worker: seccomp, process-wide, so no
+//     sockets, exec, ptrace, io_uring, mounts, namespaces or signals to other
+//     processes.
+
+// sysLibDirs hold the shared libraries a cgo build loads after the re-exec.
+var sysLibDirs = []string{"/lib", "/lib32", "/lib64", "/usr/lib", "/usr/lib32", "/usr/lib64", "/etc/ld.so.cache"}
+
+// confineWorker landlocks the process to workdir and re-executes it with args;
+// it only returns on failure.
+func confineWorker(workdir string, args []string) error {
+	runtime.LockOSThread()
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	if err := landlockWorkdir(workdir, self); err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+	return unix.Exec(self, args, os.Environ())
+}
+
+// hardenWorker installs the seccomp filter on every thread of the worker.
+func hardenWorker() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	if err := seccompDenyEscapes(); err != nil {
+		return fmt.Errorf("seccomp: %w", err)
+	}
+	return nil
+}
+
+func landlockWorkdir(workdir, self string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("not available: %w", errno)
+	}
+	// ABI 1 rights, plus refer (2) and truncate (3) when the kernel knows them
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	attr := struct{ fs uint64 }{access}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(fd))
+
+	const readExec = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE
+	if err := landlockAllow(fd, workdir, access); err != nil {
+		return err
+	}
+	if err := landlockAllow(fd, self, readExec); err != nil {
+		return err
+	}
+	for _, lib := range sysLibDirs {
+		fi, err := os.Stat(lib)
+		if err != nil {
+			continue
+		}
+		rights := uint64(readExec)
+		if fi.IsDir() {
+			rights |= unix.LANDLOCK_ACCESS_FS_READ_DIR
+		}
+		if err := landlockAllow(fd, lib, rights); err != nil {
+			return err
+		}
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// landlockAllow grants rights beneath path (or on path, for a file) in ruleset fd.
+func landlockAllow(fd uintptr, path string, rights uint64) error {
+	dir, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: rights, Parent_fd: int32(dir)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("%s: %w", path, errno)
+	}
+	return nil
+}
+
+var deniedSyscalls = []uintptr{
+	unix.SYS_SOCKET, unix.SYS_SOCKETPAIR, unix.SYS_CONNECT, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT4,
+	unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_IO_URING_SETUP, unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER,
+	unix.SYS_TKILL, unix.SYS_PIDFD_SEND_SIGNAL,
+}
+
+// cloneNewFlags are the CLONE_NEW* bits; threads never need them.
+const cloneNewFlags = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// x32Bit marks the x32 syscall numbers, which share the x86-64 arch value.
+const x32Bit = 0x40000000
+
+func seccompDenyEscapes() error {
+	var arch uint32
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		arch = unix.AUDIT_ARCH_AARCH64
+	default:
+		return fmt.Errorf("unsupported arch %s", runtime.GOARCH)
+	}
+	const (
+		ldAbs = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jset  = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		ret   = unix.BPF_RET | unix.BPF_K
+
+		// seccomp_data offsets; arg0 is the low word (both arches are little-endian)
+		offNr, offArch, offArg0 = 0, 4, 16
+
+		allow = unix.SECCOMP_RET_ALLOW
+		eperm = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+		enosy = unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+		kill  = unix.SECCOMP_RET_KILL_PROCESS
+	)
+	// every check jumps at most over its own block, so offsets stay small
+	prog := []unix.SockFilter{
+		{Code: ldAbs, K: offArch},
+		{Code: jeq, K: arch, Jt: 1},
+		{Code: ret, K: kill},
+		{Code: ldAbs, K: offNr},
+	}
+	if arch == unix.AUDIT_ARCH_X86_64 {
+		prog = append(prog,
+			unix.SockFilter{Code: jset, K: x32Bit, Jf: 1},
+			unix.SockFilter{Code: ret, K: kill},
+		)
+	}
+	for _, nr := range deniedSyscalls {
+		prog = append(prog,
+			unix.SockFilter{Code: jeq, K: uint32(nr), Jf: 1},
+			unix.SockFilter{Code: ret, K: eperm},
+		)
+	}
+	// clone3 hides its flags behind a pointer: ENOSYS makes libc fall back
+	// to clone, whose flags can be checked
+	prog = append(prog,
+		unix.SockFilter{Code: jeq, K: unix.SYS_CLONE3, Jf: 1},
+		unix.SockFilter{Code: ret, K: enosy},
+		unix.SockFilter{Code: jeq, K: unix.SYS_CLONE, Jf: 4},
+		unix.SockFilter{Code: ldAbs, K: offArg0},
+		unix.SockFilter{Code: jset, K: cloneNewFlags, Jf: 1},
+		unix.SockFilter{Code: ret, K: eperm},
+		unix.SockFilter{Code: ret, K: allow},
+	)
+	// kill and tgkill only within the worker (the Go runtime signals its own threads)
+	pid := uint32(os.Getpid())
+	for _, nr := range []uintptr{unix.SYS_KILL, unix.SYS_TGKILL} {
+		prog = append(prog,
+			unix.SockFilter{Code: jeq, K: uint32(nr), Jf: 4},
+			unix.SockFilter{Code: ldAbs, K: offArg0},
+			unix.SockFilter{Code: jeq, K: pid, Jf: 1},
+			unix.SockFilter{Code: ret, K: allow},
+			unix.SockFilter{Code: ret, K: eperm},
+		)
+	}
+	prog = append(prog, unix.SockFilter{Code: ret, K: allow})
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errHardenLinux = errors.New("DECODE_HARDEN is only supported on Linux")
+
+// confineWorker and hardenWorker need landlock and seccomp, which only exist on Linux.
+func confineWorker(workdir string, args []string) error { return errHardenLinux }
+
+func hardenWorker() error { return errHardenLinux }
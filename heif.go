@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// ===== HEIF containers =====
+// A .heic can hold more than one picture: bursts and edited photos carry extra
+// image items next to the primary one, and image sequences (brands msf1/hevs)
+// add a movie track. Only the primary item ('pitm') is "the photo"; decoding
+// must pick it instead of failing on, or emitting, every item. heifInfo reads
+// just the box structure, so it works without a HEIC decoder.
+
+type heifInfo struct {
+	Brand    string
+	Primary  uint32 // primary item ID, 0 for a pure sequence
+	Images   int    // top-level pictures: not grid tiles, thumbnails or auxiliary (depth/alpha) images
+	Sequence bool   // has a 'moov' track (burst/Live Photo sequence)
+
+	items map[uint32]bool // image item IDs
+	order []uint32        // image item IDs in file order
+	parts map[uint32]bool // IDs that are tiles, thumbnails or auxiliary images
+}
+
+// heifImageTypes are item types holding a picture (not Exif/XMP metadata).
+var heifImageTypes = map[string]bool{"hvc1": true, "av01": true, "grid": true, "iden": true, "iovl": true, "jpeg": true}
+
+var errNotHEIF = errors.New("not a HEIF container")
+
+// primaryIndex is the 1-based position of the primary item among the
+// top-level pictures (the numbering libheif uses for its outputs), 0 if unknown.
+func (h *heifInfo) primaryIndex() int {
+	n := 0
+	for _, id := range h.order {
+		if h.parts[id] {
+			continue
+		}
+		n++
+		if id == h.Primary {
+			return n
+		}
+	}
+	return 0
+}
+
+// multi reports whether the container holds more than the one picture we keep.
+func (h *heifInfo) multi() bool {
+	return h.Images > 1 || h.Sequence
+}
+
+// heifBoxes walks the boxes in b, calling fn with each type and payload.
+func heifBoxes(b []byte, fn func(typ string, body []byte) error) error {
+	for len(b) >= 8 {
+		size, typ, hdr := uint64(binary.BigEndian.Uint32(b)), string(b[4:8]), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return fmt.Errorf("box %q: truncated", typ)
+			}
+			size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return fmt.Errorf("box %q: bad size %d", typ, size)
+		}
+		if err := fn(typ, b[hdr:size]); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+func readHEIF(b []byte) (*heifInfo, error) {
+	info := &heifInfo{items: map[uint32]bool{}, parts: map[uint32]bool{}}
+	err := heifBoxes(b, func(typ string, body []byte) error {
+		switch typ {
+		case "ftyp":
+			if len(body) >= 4 {
+				info.Brand = string(body[:4])
+			}
+		case "moov":
+			info.Sequence = true
+		case "meta":
+			if len(body) < 4 {
+				return errors.New("meta: truncated")
+			}
+			return heifBoxes(body[4:], info.metaBox) // skip FullBox version/flags
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.Brand == "" {
+		return nil, errNotHEIF
+	}
+	for id := range info.items {
+		if !info.parts[id] {
+			info.Images++
+		}
+	}
+	return info, nil
+}
+
+func (h *heifInfo) metaBox(typ string, body []byte) error {
+	if len(body) < 4 {
+		return nil
+	}
+	version, body := body[0], body[4:]
+	switch typ {
+	case "pitm":
+		if version == 0 && len(body) >= 2 {
+			h.Primary = uint32(binary.BigEndian.Uint16(body))
+		} else if len(body) >= 4 {
+			h.Primary = binary.BigEndian.Uint32(body)
+		}
+	case "iinf":
+		skip := 2
+		if version != 0 {
+			skip = 4
+		}
+		if len(body) < skip {
+			return errors.New("iinf: truncated")
+		}
+		return heifBoxes(body[skip:], func(typ string, infe []byte) error {
+			// infe version 2 has a 16-bit item ID, version 3 a 32-bit one; older ones have no type
+			if typ != "infe" || len(infe) < 4+2+2+4 || infe[0] < 2 {
+				return nil
+			}
+			id, off := uint32(binary.BigEndian.Uint16(infe[4:])), 4+2+2
+			if infe[0] >= 3 {
+				if len(infe) < 4+4+2+4 {
+					return nil
+				}
+				id, off = binary.BigEndian.Uint32(infe[4:]), 4+4+2
+			}
+			if heifImageTypes[string(infe[off:off+4])] && !h.items[id] {
+				h.items[id] = true
+				h.order = append(h.order, id)
+			}
+			return nil
+		})
+	case "iref":
+		// references: from_item, count, to_items (16-bit IDs, 32-bit in version 1)
+		return heifBoxes(body, func(typ string, ref []byte) error {
+			ids := []uint32{}
+			for len(ref) > 0 {
+				if version == 0 && len(ref) >= 2 {
+					ids, ref = append(ids, uint32(binary.BigEndian.Uint16(ref))), ref[2:]
+				} else if version != 0 && len(ref) >= 4 {
+					ids, ref = append(ids, binary.BigEndian.Uint32(ref)), ref[4:]
+				} else {
+					break
+				}
+				if len(ids) == 1 && len(ref) >= 2 {
+					ref = ref[2:] // reference_count; the rest are to_items
+				}
+			}
+			if len(ids) < 2 {
+				return nil
+			}
+			switch typ {
+			case "thmb", "auxl":
+				h.parts[ids[0]] = true
+			case "dimg":
+				for _, id := range ids[1:] {
+					h.parts[id] = true
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// ===== HEIC decoding =====
+// .heic/.heif inputs are decoded with libheif's command line decoder (heif-dec,
+// called heif-convert before libheif 1.17) when one is found; otherwise they are
+// skipped as before. For bursts the decoder writes every top-level picture and
+// the primary one is kept.
+//
+//	HEIF_DEC=/usr/bin/heif-dec
+
+var (
+	HEIF_DEC = ""
+
+	heifDecode bool
+)
+
+func setupHEIF() {
+	HEIF_DEC = os.Getenv("HEIF_DEC")
+	candidates := []string{"heif-dec", "heif-convert"}
+	if HEIF_DEC != "" {
+		candidates = []string{HEIF_DEC}
+	}
+	for _, c := range candidates {
+		if path, err := exec.LookPath(c); err == nil {
+			HEIF_DEC, heifDecode = path, true
+			return
+		}
+	}
+}
+
+func decodeHEIF(b []byte) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "heif-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.heic"), filepath.Join(dir, "out.png")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	if _, err := runTool(ctx, HEIF_DEC, in, out); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(out); err == nil {
+		return imaging.Open(out)
+	}
+	// several pictures: out-1.png, out-2.png, ...
+	k := 1
+	if info, err := readHEIF(b); err == nil && info.primaryIndex() > 0 {
+		k = info.primaryIndex()
+	}
+	return imaging.Open(filepath.Join(dir, fmt.Sprintf("out-%d.png", k)))
+}
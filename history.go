@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// ===== Job history (SQLite) =====
+// Every processed file is recorded so /stats can aggregate over time.
+// Set HISTORY_DB to a file path, or to "off" to disable.
+
+var HISTORY_DB = "history.db"
+
+var historyDB *sql.DB
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id        TEXT PRIMARY KEY,
+	started   INTEGER NOT NULL,
+	finished  INTEGER NOT NULL,
+	files     INTEGER NOT NULL,
+	skipped   INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS files (
+	job_id    TEXT NOT NULL,
+	ext       TEXT NOT NULL,
+	in_bytes  INTEGER NOT NULL,
+	out_bytes INTEGER NOT NULL,
+	ok        INTEGER NOT NULL,
+	finished  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_finished ON files(finished);
+CREATE TABLE IF NOT EXISTS user_prefs (
+	user      TEXT NOT NULL,
+	kind      TEXT NOT NULL, -- "last" or "default"
+	vals      TEXT NOT NULL, -- JSON form values
+	updated   INTEGER NOT NULL,
+	PRIMARY KEY (user, kind)
+);
+`
+
+func openHistory(path string) {
+	if path == "" || path == "off" {
+		return
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		log.Printf("history disabled: %v", err)
+		return
+	}
+	// sqlite allows a single writer; serialize through one connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		log.Printf("history disabled: %v", err)
+		db.Close()
+		return
+	}
+	historyDB = db
+}
+
+// recordHistory stores finished files and jobs from the event bus.
+func recordHistory(ev jobEvent) {
+	switch ev.Type {
+	case evFileDone, evFileSkipped:
+		recordFile(ev.Job, ev.File, ev.InBytes, ev.OutBytes, ev.Type == evFileDone)
+	case evJobDone:
+		if p, ok := jobSnapshot(ev.Job); ok {
+			recordJob(&p)
+		}
+	}
+}
+
+func recordFile(jobID, rel string, inBytes, outBytes int, ok bool) {
+	if historyDB == nil {
+		return
+	}
+	okInt := 0
+	if ok {
+		okInt = 1
+	}
+	if _, err := historyDB.Exec(`INSERT INTO files (job_id, ext, in_bytes, out_bytes, ok, finished) VALUES (?, ?, ?, ?, ?, ?)`,
+		jobID, fileType(rel), inBytes, outBytes, okInt, time.Now().Unix()); err != nil {
+		log.Printf("history: %v", err)
+	}
+}
+
+func recordJob(p *jobProgress) {
+	if historyDB == nil {
+		return
+	}
+	if _, err := historyDB.Exec(`INSERT OR REPLACE INTO jobs (id, started, finished, files, skipped) VALUES (?, ?, ?, ?, ?)`,
+		p.ID, p.Started.Unix(), p.Finished.Unix(), p.Total, p.Skipped); err != nil {
+		log.Printf("history: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ===== Job isolation =====
+// With JOB_ISOLATION=1 each job's master ZIP is built in a child "job-worker"
+// process placed in its own cgroup (Linux, cgroup v2) with JOB_CPU cores and
+// JOB_MEM_MB of memory, so one enormous job is throttled or OOM-killed on its
+// own instead of slowing everyone down. The parent hands over the files and
+// options on stdin, republishes the worker's events (progress, SSE, history
+// keep working) and takes the ZIP over as the result file. Per-job cgroups are
+// created below JOB_CGROUP_ROOT, which must be writable (a delegated subtree);
+// with neither limit set the worker is just a separate process.
+//
+//	JOB_ISOLATION=1 JOB_CPU=1.5 JOB_MEM_MB=768 JOB_CGROUP_ROOT=/sys/fs/cgroup/multicompressgo
+
+var (
+	JOB_ISOLATION   = false
+	JOB_CPU         = 0.0
+	JOB_MEM_MB      = 0
+	JOB_CGROUP_ROOT = "/sys/fs/cgroup/multicompressgo"
+)
+
+func setupIsolation() error {
+	JOB_ISOLATION = os.Getenv("JOB_ISOLATION") == "1"
+	if !JOB_ISOLATION {
+		return nil
+	}
+	if v := os.Getenv("JOB_CPU"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("JOB_CPU: expected a number of cores, got %q", v)
+		}
+		JOB_CPU = f
+	}
+	if v := os.Getenv("JOB_MEM_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("JOB_MEM_MB: expected megabytes, got %q", v)
+		}
+		JOB_MEM_MB = n
+	}
+	if v := os.Getenv("JOB_CGROUP_ROOT"); v != "" {
+		JOB_CGROUP_ROOT = v
+	}
+	if JOB_CPU == 0 && JOB_MEM_MB == 0 {
+		return nil
+	}
+	return setupCgroupRoot(JOB_CGROUP_ROOT)
+}
+
+// workerInput is what the parent sends a job-worker (gob on stdin).
+type workerInput struct {
+	Jobs []Job
+	Opts Options
+}
+
+// workerMsg is one line of a job-worker's stdout: an event, or the gallery at the end.
+type workerMsg struct {
+	Event   *jobEvent     `json:"event,omitempty"`
+	Gallery []galleryItem `json:"gallery,omitempty"`
+}
+
+// buildMasterZipIsolated is buildMasterZip in a job-worker process.
+func buildMasterZipIsolated(jobs []Job, opts Options, jobID string) (resultZip, []galleryItem, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return resultZip{}, nil, err
+	}
+	out, err := os.CreateTemp(ZIP_SPOOL_DIR, jobID+"-*.zip")
+	if err != nil {
+		return resultZip{}, nil, err
+	}
+	out.Close()
+	result := resultZip{path: out.Name()}
+	ok := false
+	defer func() {
+		if !ok {
+			result.remove()
+		}
+	}()
+
+	input := &bytes.Buffer{}
+	if err := gob.NewEncoder(input).Encode(workerInput{Jobs: jobs, Opts: opts}); err != nil {
+		return resultZip{}, nil, err
+	}
+	cmd := exec.Command(self, "job-worker", "-job", jobID, "-out", out.Name())
+	cmd.Stdin = input
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return resultZip{}, nil, err
+	}
+	cg, err := startInCgroup(cmd, jobID)
+	if err != nil {
+		return resultZip{}, nil, err
+	}
+	defer cg.remove()
+
+	var gallery []galleryItem
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var msg workerMsg
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Event != nil {
+			publish(*msg.Event)
+		}
+		if msg.Gallery != nil {
+			gallery = msg.Gallery
+		}
+	}
+	// a line over the buffer stops the scanner early; keep reading so the
+	// worker never blocks on a full pipe and Wait returns
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		if cg.oomKilled() {
+			return resultZip{}, nil, fmt.Errorf("job worker exceeded JOB_MEM_MB=%d and was killed", JOB_MEM_MB)
+		}
+		if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); msg != "" {
+			return resultZip{}, nil, fmt.Errorf("job worker: %s (%v)", msg, err)
+		}
+		return resultZip{}, nil, fmt.Errorf("job worker crashed: %v", err)
+	}
+	st, err := os.Stat(result.path)
+	if err != nil {
+		return resultZip{}, nil, err
+	}
+	result.size, ok = st.Size(), true
+	return result, gallery, nil
+}
+
+// runJobWorker is the child side: `multicompressgo job-worker -job ID -out file.zip < input`.
+func runJobWorker(args []string) {
+	fs := flag.NewFlagSet("job-worker", flag.ExitOnError)
+	jobID := fs.String("job", "", "job ID the events are published under")
+	out := fs.String("out", "", "where to write the master ZIP")
+	fs.Parse(args)
+	setupProcessing()
+	if err := setupDecoders(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var in workerInput
+	if err := gob.NewDecoder(os.Stdin).Decode(&in); err != nil {
+		fmt.Fprintln(os.Stderr, "input:", err)
+		os.Exit(1)
+	}
+	opts := in.Opts
+	var err error
+	if opts.targets, err = parseTargets(opts.Targets, outputTarget{MinKB: opts.MinKB, MaxKB: opts.MaxKB}); err != nil {
+		fmt.Fprintln(os.Stderr, "targets:", err)
+		os.Exit(1)
+	}
+
+	if err := setupQueue(); err != nil {
+		fmt.Fprintln(os.Stderr, "event queue:", err)
+		os.Exit(1)
+	}
+
+	var mu sync.Mutex
+	enc := json.NewEncoder(os.Stdout)
+	subscribe(func(ev jobEvent) {
+		mu.Lock()
+		enc.Encode(workerMsg{Event: &ev})
+		mu.Unlock()
+	})
+	result, gallery, err := buildMasterZip(in.Jobs, opts, *jobID)
+	flushQueue()
+	if err == nil {
+		err = result.saveAs(*out, 0o600)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	mu.Lock()
+	enc.Encode(workerMsg{Gallery: gallery})
+	mu.Unlock()
+}
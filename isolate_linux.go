@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// jobCgroup is a job-worker's cgroup; the zero value stands for "none".
+type jobCgroup struct {
+	dir string
+}
+
+// setupCgroupRoot creates root and enables the cpu and memory controllers for
+// the per-job groups below it.
+func setupCgroupRoot(root string) error {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(root), "cgroup.controllers")); err != nil {
+			return fmt.Errorf("job cgroups: %s is not in a cgroup v2 hierarchy: %w", root, err)
+		}
+		if err := os.Mkdir(root, 0o755); err != nil {
+			return fmt.Errorf("job cgroups: %w", err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("job cgroups: %s is not a cgroup v2 directory: %w", root, err)
+	}
+	enable := []string{}
+	for _, c := range []string{"cpu", "memory"} {
+		if !strings.Contains(" "+string(b)+" ", " "+c+" ") {
+			return fmt.Errorf("job cgroups: controller %q not delegated to %s", c, root)
+		}
+		enable = append(enable, "+"+c)
+	}
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0o644); err != nil {
+		return fmt.Errorf("job cgroups: %w", err)
+	}
+	return nil
+}
+
+// startInCgroup starts cmd inside a new cgroup for jobID carrying the JOB_CPU
+// and JOB_MEM_MB limits (or plainly, when neither is set).
+func startInCgroup(cmd *exec.Cmd, jobID string) (jobCgroup, error) {
+	if JOB_CPU == 0 && JOB_MEM_MB == 0 {
+		return jobCgroup{}, cmd.Start()
+	}
+	cg := jobCgroup{dir: filepath.Join(JOB_CGROUP_ROOT, jobID)}
+	if err := os.Mkdir(cg.dir, 0o755); err != nil {
+		return jobCgroup{}, fmt.Errorf("job cgroup: %w", err)
+	}
+	limits := map[string]string{}
+	if JOB_MEM_MB > 0 {
+		limits["memory.max"] = strconv.Itoa(JOB_MEM_MB << 20)
+		limits["memory.swap.max"] = "0"
+	}
+	if JOB_CPU > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d 100000", int(JOB_CPU*100000))
+	}
+	for file, v := range limits {
+		if err := os.WriteFile(filepath.Join(cg.dir, file), []byte(v), 0o644); err != nil && file != "memory.swap.max" {
+			cg.remove()
+			return jobCgroup{}, fmt.Errorf("job cgroup %s: %w", file, err)
+		}
+	}
+	fd, err := syscall.Open(cg.dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		cg.remove()
+		return jobCgroup{}, fmt.Errorf("job cgroup: %w", err)
+	}
+	defer syscall.Close(fd)
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: fd}
+	if err := cmd.Start(); err != nil {
+		cg.remove()
+		return jobCgroup{}, err
+	}
+	return cg, nil
+}
+
+// oomKilled reports whether the kernel killed a process of the group for memory.
+func (cg jobCgroup) oomKilled() bool {
+	if cg.dir == "" {
+		return false
+	}
+	b, err := os.ReadFile(filepath.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if n, ok := strings.CutPrefix(line, "oom_kill "); ok && n != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes the (empty, after the worker exited) cgroup.
+func (cg jobCgroup) remove() {
+	if cg.dir != "" {
+		os.Remove(cg.dir)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// jobCgroup is a stub outside Linux: the worker still runs as its own process.
+type jobCgroup struct{}
+
+func setupCgroupRoot(root string) error {
+	return errors.New("job cgroups: JOB_CPU/JOB_MEM_MB need Linux with cgroup v2")
+}
+
+func startInCgroup(cmd *exec.Cmd, jobID string) (jobCgroup, error) {
+	return jobCgroup{}, cmd.Start()
+}
+
+func (cg jobCgroup) oomKilled() bool { return false }
+
+func (cg jobCgroup) remove() {}
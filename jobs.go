@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Job progress & ETA =====
+// Running jobs are tracked so the UI (and /jobs/{id}) can show progress while
+// the upload request is still being processed; updates come from the job
+// events (events.go).
+
+// JOB_KEEP is how long finished job progress stays queryable.
+var JOB_KEEP = 10 * time.Minute
+
+type jobProgress struct {
+	ID         string    `json:"id"`
+	State      string    `json:"state"` // running | done
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Skipped    int       `json:"skipped"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	ETASeconds float64   `json:"eta_seconds"`
+	remaining  map[string]int
+}
+
+var jobsMu sync.Mutex
+var jobsRunning = map[string]*jobProgress{}
+
+// typeStats holds a moving average of seconds per file, keyed by file type.
+// Seeded with rough guesses so the first job still gets an estimate.
+var typeStats = map[string]float64{"image": 1.5, "pdf": 6.0}
+
+const statsAlpha = 0.2
+
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Errors for a client-supplied job id: malformed, or naming a job that is
+// still tracked (running, or finished within JOB_KEEP).
+var (
+	errJobID      = errors.New("job_id must be 1-64 letters, digits, _ or -")
+	errJobIDTaken = errors.New("job_id already in use")
+)
+
+func fileType(rel string) string {
+	if PDF_EXT[inputExt(rel)] {
+		return "pdf"
+	}
+	if ext := strings.TrimPrefix(extLower(rel), "."); ext != "" {
+		return ext
+	}
+	return "image"
+}
+
+func secondsPerFile(typ string) float64 {
+	if v, ok := typeStats[typ]; ok {
+		return v
+	}
+	if typ == "pdf" {
+		return typeStats["pdf"]
+	}
+	return typeStats["image"]
+}
+
+// startJob registers a job; id may come from the client so it can poll before
+// the response arrives, and a new one is made when it is empty. It fails with
+// errJobID or errJobIDTaken rather than replace another job's progress.
+func startJob(id string, jobs []Job) (*jobProgress, error) {
+	if id == "" {
+		id = newToken("j")
+	} else if !jobIDPattern.MatchString(id) {
+		return nil, errJobID
+	}
+	p := &jobProgress{ID: id, State: "running", Total: len(jobs), Started: time.Now(), remaining: map[string]int{}}
+	for _, j := range jobs {
+		p.remaining[fileType(j.Rel)]++
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for k, old := range jobsRunning {
+		if old.State == "done" && time.Since(old.Finished) > JOB_KEEP {
+			delete(jobsRunning, k)
+		}
+	}
+	if _, taken := jobsRunning[id]; taken {
+		return nil, fmt.Errorf("%w: %s", errJobIDTaken, id)
+	}
+	jobsRunning[id] = p
+	p.updateETA()
+	return p, nil
+}
+
+// jobErrorStatus is the HTTP status for an error from runJobs or runJobStream.
+func jobErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errJobID):
+		return http.StatusBadRequest
+	case errors.Is(err, errJobIDTaken):
+		return http.StatusConflict
+	}
+	return http.StatusInsufficientStorage
+}
+
+// finishJob marks a job done without publishing job_done: for work answered
+// within the request (direct compressions) that only holds an active-job slot.
+func finishJob(id string) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if p, ok := jobsRunning[id]; ok {
+		p.State, p.Finished, p.ETASeconds = "done", time.Now(), 0
+	}
+}
+
+// addJobs grows a running job by inputs that arrived after it started (a
+// streamed upload).
+func addJobs(id string, jobs []Job) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	p, ok := jobsRunning[id]
+	if !ok {
+		return
+	}
+	p.Total += len(jobs)
+	for _, j := range jobs {
+		p.remaining[fileType(j.Rel)]++
+	}
+	p.updateETA()
+}
+
+// trackProgress keeps jobsRunning current from the event bus and feeds file
+// durations into the throughput stats.
+func trackProgress(ev jobEvent) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	p, ok := jobsRunning[ev.Job]
+	if !ok {
+		return
+	}
+	switch ev.Type {
+	case evFileDone, evFileSkipped:
+		typ := fileType(ev.File)
+		p.Done++
+		if ev.Type == evFileSkipped {
+			p.Skipped++
+		}
+		p.remaining[typ]--
+		typeStats[typ] = (1-statsAlpha)*secondsPerFile(typ) + statsAlpha*ev.Seconds
+		p.updateETA()
+	case evJobDone:
+		p.State, p.Finished, p.ETASeconds = "done", ev.Time, 0
+	}
+}
+
+// jobSnapshot copies a job's progress.
+func jobSnapshot(id string) (jobProgress, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	p, ok := jobsRunning[id]
+	if !ok {
+		return jobProgress{}, false
+	}
+	return *p, true
+}
+
+// updateETA must be called with jobsMu held.
+func (p *jobProgress) updateETA() {
+	total, left := 0.0, 0
+	for typ, n := range p.remaining {
+		total += float64(n) * secondsPerFile(typ)
+		left += n
+	}
+	workers := min(max(live().THREADS, 1), max(left, 1))
+	p.ETASeconds = total / float64(workers)
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id, ok := strings.CutSuffix(id, "/events"); ok {
+		jobEventsHandler(w, r, id)
+		return
+	}
+	snapshot, ok := jobSnapshot(id)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// ===== JPEG XL =====
+// .jxl inputs are decoded with djxl and convert mode can write .jxl with cjxl
+// (libjxl tools). Each direction turns on when its command is found; with
+// convert_max_kb the quality is searched like for JPEG so the file fits.
+//
+//	DJXL=/usr/bin/djxl CJXL=/usr/bin/cjxl
+
+var (
+	DJXL = "djxl"
+	CJXL = "cjxl"
+
+	jxlDecode, jxlEncode bool
+)
+
+func setupJXL() {
+	if v := os.Getenv("DJXL"); v != "" {
+		DJXL = v
+	}
+	if v := os.Getenv("CJXL"); v != "" {
+		CJXL = v
+	}
+	if _, err := exec.LookPath(DJXL); err == nil {
+		jxlDecode = true
+		IMG_EXT[".jxl"] = true
+	}
+	if _, err := exec.LookPath(CJXL); err == nil {
+		jxlEncode = true
+		CONVERT_FORMATS["jxl"] = true
+	}
+}
+
+func decodeJXL(b []byte) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "jxl-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.jxl"), filepath.Join(dir, "out.png")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	if _, err := runTool(ctx, DJXL, in, out); err != nil {
+		return nil, err
+	}
+	return imaging.Open(out)
+}
+
+// jxlEncoder writes img once as lossless PNG and re-encodes it at any quality.
+type jxlEncoder struct {
+	dir    string
+	effort string
+}
+
+func newJXLEncoder(img image.Image, speedFast bool) (*jxlEncoder, error) {
+	dir, err := os.MkdirTemp("", "jxl-*")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, "in.png"))
+	if err == nil {
+		err = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(f, img)
+		f.Close()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	e := &jxlEncoder{dir: dir, effort: "7"}
+	if speedFast {
+		e.effort = "3"
+	}
+	return e, nil
+}
+
+func (e *jxlEncoder) encode(q int) ([]byte, error) {
+	out := filepath.Join(e.dir, "out.jxl")
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	if _, err := runTool(ctx, CJXL, filepath.Join(e.dir, "in.png"), out, "-q", strconv.Itoa(q), "-e", e.effort); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(out)
+}
+
+func (e *jxlEncoder) close() { os.RemoveAll(e.dir) }
+
+// jxlQualityBS finds the highest quality in qmin..qmax whose output fits maxKB; nil if none does.
+func jxlQualityBS(img image.Image, maxKB, qmin, qmax int, speedFast bool) ([]byte, int, error) {
+	enc, err := newJXLEncoder(img, speedFast)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer enc.close()
+	var best []byte
+	bestQ := 0
+	for lo, hi := qmin, qmax; lo <= hi; {
+		mid := (lo + hi) / 2
+		b, err := enc.encode(mid)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(b) <= maxKB*1024 {
+			best, bestQ = b, mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best, bestQ, nil
+}
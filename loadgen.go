@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adityafaths/multicompressgo/compress"
+)
+
+// ===== Load generator =====
+// `multicompressgo loadgen` sends synthetic batches (noisy photos and scanned
+// looking multi-page PDFs of configurable size and count) to a running server
+// and reports throughput and latency percentiles, to size hardware before a
+// rollout. Batches are generated before their request is timed; 503 answers
+// from the backpressure limits are counted as "busy", not retried.
+//
+//	multicompressgo loadgen -url http://localhost:8080 -batches 50 -concurrency 4 -images 5 -pdfs 1 -pdf-pages 3 -size 3000x2000
+
+var loadgenOpts struct {
+	url         string
+	batches     int
+	concurrency int
+	images      int
+	pdfs        int
+	pages       int
+	size        string
+	download    bool
+	seed        int64
+}
+
+func loadgenFlags(fs *flag.FlagSet) {
+	o := &loadgenOpts
+	fs.StringVar(&o.url, "url", "http://localhost:8080", "server base URL (including BASE_PATH)")
+	fs.IntVar(&o.batches, "batches", 20, "number of /process requests")
+	fs.IntVar(&o.concurrency, "concurrency", 4, "requests in flight")
+	fs.IntVar(&o.images, "images", 5, "images per batch")
+	fs.IntVar(&o.pdfs, "pdfs", 1, "PDFs per batch")
+	fs.IntVar(&o.pages, "pdf-pages", 3, "pages per PDF")
+	fs.StringVar(&o.size, "size", "3000x2000", "image size WxH (each image varies ±25%)")
+	fs.BoolVar(&o.download, "download", false, "also download each result ZIP (timed with the request)")
+	fs.Int64Var(&o.seed, "seed", 1, "random seed")
+}
+
+func runLoadgenCLI(args []string) {
+	var w, h int
+	if _, err := fmt.Sscanf(loadgenOpts.size, "%dx%d", &w, &h); err != nil || w < 16 || h < 16 {
+		fmt.Fprintf(os.Stderr, "-size: expected WxH, got %q\n", loadgenOpts.size)
+		os.Exit(2)
+	}
+	if loadgenOpts.batches < 1 || loadgenOpts.concurrency < 1 || loadgenOpts.images+loadgenOpts.pdfs < 1 {
+		fmt.Fprintln(os.Stderr, "need at least one batch, one worker and one file per batch")
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Minute}
+	server := strings.TrimSuffix(loadgenOpts.url, "/")
+	type outcome struct {
+		status  string // ok, busy or error
+		latency time.Duration
+		files   int
+		bytes   int
+		detail  string
+	}
+	outcomes := make([]outcome, loadgenOpts.batches)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < loadgenOpts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				rng := rand.New(rand.NewSource(loadgenOpts.seed + int64(n)))
+				body, ctype, err := loadgenBatch(rng, n, loadgenOpts.images, loadgenOpts.pdfs, loadgenOpts.pages, w, h)
+				if err != nil {
+					outcomes[n] = outcome{status: "error", detail: err.Error()}
+					continue
+				}
+				o := outcome{files: loadgenOpts.images + loadgenOpts.pdfs, bytes: body.Len()}
+				t := time.Now()
+				o.status, o.detail = loadgenPost(client, server, body, ctype, loadgenOpts.download)
+				o.latency = time.Since(t)
+				outcomes[n] = o
+				fmt.Fprintf(os.Stderr, "batch %d: %s %.2fs %s\n", n+1, o.status, o.latency.Seconds(), o.detail)
+			}
+		}()
+	}
+	for n := 0; n < loadgenOpts.batches; n++ {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	counts := map[string]int{}
+	lat := []float64{}
+	files, sent := 0, 0
+	for _, o := range outcomes {
+		counts[o.status]++
+		if o.status == "ok" {
+			lat = append(lat, o.latency.Seconds())
+			files += o.files
+			sent += o.bytes
+		}
+	}
+	sort.Float64s(lat)
+	fmt.Printf("batches: %d ok, %d busy (503), %d errors in %.1fs\n", counts["ok"], counts["busy"], counts["error"], elapsed.Seconds())
+	fmt.Printf("throughput: %.2f files/s, %.2f MB/s uploaded\n", float64(files)/elapsed.Seconds(), float64(sent)/(1<<20)/elapsed.Seconds())
+	if len(lat) > 0 {
+		fmt.Printf("latency: p50 %.2fs  p90 %.2fs  p99 %.2fs  max %.2fs\n",
+			percentile(lat, 50), percentile(lat, 90), percentile(lat, 99), lat[len(lat)-1])
+	}
+	if counts["ok"] == 0 {
+		os.Exit(1)
+	}
+}
+
+// percentile of sorted values (nearest rank).
+func percentile(sorted []float64, p float64) float64 {
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	return sorted[clampInt(i, 0, len(sorted)-1)]
+}
+
+// loadgenBatch builds the multipart body of batch n.
+func loadgenBatch(rng *rand.Rand, n, images, pdfs, pages, w, h int) (*bytes.Buffer, string, error) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	jitter := func(v int) int { return v * (75 + rng.Intn(51)) / 100 }
+	add := func(name string, data []byte) error {
+		fw, err := mw.CreateFormFile("files", name)
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+		return err
+	}
+	for i := 0; i < images; i++ {
+		b, err := compress.EncodeJPEG(syntheticImage(rng, jitter(w), jitter(h)), 92)
+		if err == nil {
+			err = add(fmt.Sprintf("b%d_img%d.jpg", n+1, i+1), b)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	for i := 0; i < pdfs; i++ {
+		scans := make([][]byte, pages)
+		for p := range scans {
+			// an A4 page at 150 DPI, like a scanner default
+			b, err := compress.EncodeJPEG(syntheticImage(rng, 1240, 1754), 85)
+			if err != nil {
+				return nil, "", err
+			}
+			scans[p] = b
+		}
+		if err := add(fmt.Sprintf("b%d_doc%d.pdf", n+1, i+1), syntheticPDF(scans, 1240, 1754)); err != nil {
+			return nil, "", err
+		}
+	}
+	mw.WriteField("job_id", fmt.Sprintf("lg%d%d", time.Now().UnixNano(), n))
+	mw.WriteField("format", "json")
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, mw.FormDataContentType(), nil
+}
+
+// loadgenPost sends one batch and classifies the answer.
+func loadgenPost(client *http.Client, server string, body io.Reader, ctype string, download bool) (string, string) {
+	req, err := http.NewRequest(http.MethodPost, server+"/process", body)
+	if err != nil {
+		return "error", err.Error()
+	}
+	req.Header.Set("Content-Type", ctype)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "error", err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return "busy", "retry after " + resp.Header.Get("Retry-After") + "s"
+	}
+	var res struct {
+		Token    string `json:"token"`
+		Download string `json:"download"`
+		Error    string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK || res.Token == "" {
+		return "error", fmt.Sprintf("HTTP %d %s", resp.StatusCode, res.Error)
+	}
+	if !download {
+		return "ok", res.Token
+	}
+	// the download path already carries BASE_PATH
+	u, err := neturl.Parse(server)
+	if err != nil {
+		return "error", err.Error()
+	}
+	u.Path = res.Download
+	dl, err := client.Get(u.String())
+	if err != nil {
+		return "error", err.Error()
+	}
+	defer dl.Body.Close()
+	n, _ := io.Copy(io.Discard, dl.Body)
+	if dl.StatusCode != http.StatusOK {
+		return "error", fmt.Sprintf("download HTTP %d", dl.StatusCode)
+	}
+	return "ok", fmt.Sprintf("%s, %d bytes", res.Token, n)
+}
+
+// syntheticImage is a colour gradient with noise: detailed enough that the
+// quality search has to work, like a real photo.
+func syntheticImage(rng *rand.Rand, w, h int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	tint := uint8(rng.Intn(128))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := uint8(rng.Intn(48))
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), tint + n, 255})
+		}
+	}
+	return img
+}
+
+// syntheticPDF wraps JPEG scans (w×h px each) into an A4 PDF, one per page.
+func syntheticPDF(scans [][]byte, w, h int) []byte {
+	buf := &bytes.Buffer{}
+	offsets := []int{}
+	obj := func(body string, stream []byte) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			buf.WriteString("stream\n")
+			buf.Write(stream)
+			buf.WriteString("\nendstream\n")
+		}
+		buf.WriteString("endobj\n")
+	}
+	buf.WriteString("%PDF-1.4\n")
+	kids := []string{}
+	for i := range scans {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 3+3*i))
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(scans)), nil)
+	for i, scan := range scans {
+		content, im := 4+3*i, 5+3*i
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>", im, content), nil)
+		draw := []byte("q 595 0 0 842 0 0 cm /Im0 Do Q")
+		obj(fmt.Sprintf("<< /Length %d >>", len(draw)), draw)
+		obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>", w, h, len(scan)), scan)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
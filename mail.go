@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// ===== Email-in gateway =====
+// When IMAP_ADDR is set the server polls that mailbox, processes attachments of
+// unseen mail and replies with the master ZIP (or a download link if too big).
+//
+//	IMAP_ADDR=imap.example.com:993 IMAP_USER=... IMAP_PASSWORD=... IMAP_MAILBOX=INBOX
+//	SMTP_ADDR=smtp.example.com:587 (SMTP_USER/SMTP_PASSWORD default to the IMAP ones)
+//	MAIL_FROM=compress@example.com MAIL_POLL=60s MAIL_MAX_ATTACH_MB=20
+
+type mailConfig struct {
+	IMAPAddr, IMAPUser, IMAPPassword, Mailbox string
+	SMTPAddr, SMTPUser, SMTPPassword, From    string
+	Poll                                      time.Duration
+	MaxAttach                                 int
+}
+
+func mailConfigFromEnv() (mailConfig, bool) {
+	mc := mailConfig{
+		IMAPAddr:     os.Getenv("IMAP_ADDR"),
+		IMAPUser:     os.Getenv("IMAP_USER"),
+		IMAPPassword: os.Getenv("IMAP_PASSWORD"),
+		Mailbox:      os.Getenv("IMAP_MAILBOX"),
+		SMTPAddr:     os.Getenv("SMTP_ADDR"),
+		SMTPUser:     os.Getenv("SMTP_USER"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		From:         os.Getenv("MAIL_FROM"),
+		Poll:         time.Minute,
+		MaxAttach:    20 << 20,
+	}
+	if mc.IMAPAddr == "" {
+		return mc, false
+	}
+	if mc.Mailbox == "" {
+		mc.Mailbox = "INBOX"
+	}
+	if mc.SMTPUser == "" {
+		mc.SMTPUser, mc.SMTPPassword = mc.IMAPUser, mc.IMAPPassword
+	}
+	if mc.From == "" {
+		mc.From = mc.IMAPUser
+	}
+	if d, err := time.ParseDuration(os.Getenv("MAIL_POLL")); err == nil && d > 0 {
+		mc.Poll = d
+	}
+	var mb int
+	if _, err := fmt.Sscan(os.Getenv("MAIL_MAX_ATTACH_MB"), &mb); err == nil && mb > 0 {
+		mc.MaxAttach = mb << 20
+	}
+	return mc, true
+}
+
+func runMailPoller(mc mailConfig) {
+	log.Printf("mail gateway polling %s/%s every %s", mc.IMAPAddr, mc.Mailbox, mc.Poll)
+	for {
+		if err := pollMailbox(mc); err != nil {
+			log.Printf("mail poll: %v", err)
+		}
+		time.Sleep(mc.Poll)
+	}
+}
+
+// pollMailbox fetches unseen messages; fetching BODY[] marks them \Seen.
+func pollMailbox(mc mailConfig) error {
+	release, reason, _ := reserveJob()
+	if reason != "" {
+		log.Printf("mail poll deferred: %s", reason)
+		return nil
+	}
+	defer release()
+	c, err := client.DialTLS(mc.IMAPAddr, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	if err := c.Login(mc.IMAPUser, mc.IMAPPassword); err != nil {
+		return err
+	}
+	if _, err := c.Select(mc.Mailbox, false); err != nil {
+		return err
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	section := &imap.BodySectionName{}
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
+	}()
+	raws := [][]byte{}
+	for msg := range messages {
+		if body := msg.GetBody(section); body != nil {
+			b, _ := io.ReadAll(body)
+			raws = append(raws, b)
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	for _, raw := range raws {
+		if err := handleMail(mc, raw); err != nil {
+			log.Printf("mail: %v", err)
+		}
+	}
+	return nil
+}
+
+var subjectTarget = regexp.MustCompile(`(\d+)\s*-\s*(\d+)\s*kb`)
+
+// settingsFromSubject infers processing settings, e.g. "whatsapp", "balanced" or "90-100 KB".
+func settingsFromSubject(subject string) (Options, error) {
+	subject = strings.ToLower(subject)
+	vals := map[string]string{}
+	for _, name := range presetNames() {
+		if strings.Contains(subject, name) {
+			vals["preset"] = name
+		}
+	}
+	if strings.Contains(subject, "balanced") {
+		vals["speed"] = "balanced"
+	}
+	if m := subjectTarget.FindStringSubmatch(subject); m != nil {
+		vals["targets"] = m[1] + "-" + m[2]
+	}
+	vals["sharpen"] = "on"
+	return settingsFrom(func(k string) string { return vals[k] })
+}
+
+func handleMail(mc mailConfig, raw []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	replyTo := msg.Header.Get("Reply-To")
+	if replyTo == "" {
+		replyTo = msg.Header.Get("From")
+	}
+	to, err := mail.ParseAddress(replyTo)
+	if err != nil {
+		return fmt.Errorf("bad sender %q: %v", replyTo, err)
+	}
+
+	opts, err := settingsFromSubject(subject)
+	if err != nil {
+		return sendReply(mc, to.Address, subject, msg.Header.Get("Message-Id"), "Subjek tidak valid: "+err.Error(), nil)
+	}
+	jobs := []Job{}
+	usedLabels := map[string]int{}
+	pol := extPolicyFrom(opts)
+	splits := newSplitZips()
+	err = walkMailParts(textproto.MIMEHeader(msg.Header), msg.Body, func(name string, data []byte) {
+		jobs = append(jobs, splits.jobs(name, data, usedLabels, pol)...)
+	})
+	if err != nil {
+		return err
+	}
+	jobs = append(jobs, splits.incomplete()...)
+	if !hasWork(jobs) {
+		return sendReply(mc, to.Address, subject, msg.Header.Get("Message-Id"), "Tidak ada lampiran valid (gambar/PDF/ZIP).", nil)
+	}
+
+	manifest, _, err := runJobs(jobs, opts, "")
+	if err != nil {
+		return sendReply(mc, to.Address, subject, msg.Header.Get("Message-Id"), "Gagal memproses: "+err.Error(), nil)
+	}
+	token, summary, skips := manifest.Token, manifest.Summary, manifest.Skips
+	setResultOwner(token, to.Address)
+	memZips.RLock()
+	result := memZips.m[token]
+	memZips.RUnlock()
+	body := "Hasil kompresi:\n\n" + summary + "\n"
+	if s := skipText(skips); s != "" {
+		body += "\n" + s
+	}
+	var zipData []byte
+	if result.size <= int64(mc.MaxAttach) {
+		if zipData, err = result.bytes(); err != nil {
+			log.Printf("mail: result %s: %v", token, err)
+		}
+	}
+	if zipData == nil {
+		body += fmt.Sprintf("\nArsip terlalu besar untuk lampiran; unduh di %s/download/%s\n", PUBLIC_BASE_URL, token)
+	}
+	return sendReply(mc, to.Address, subject, msg.Header.Get("Message-Id"), body, zipData)
+}
+
+// walkMailParts calls fn for every attachment, descending into nested multiparts.
+func walkMailParts(h textproto.MIMEHeader, body io.Reader, fn func(name string, data []byte)) error {
+	mediaType, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkMailParts(p.Header, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	name := params["name"]
+	if _, dp, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dp["filename"] != "" {
+		name = dp["filename"]
+	}
+	if name == "" {
+		return nil
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	fn(name, data)
+	return nil
+}
+
+func sendReply(mc mailConfig, to, subject, inReplyTo, text string, zipData []byte) error {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", mc.From, to, mime.QEncoding.Encode("utf-8", "Re: "+subject))
+	if inReplyTo != "" {
+		fmt.Fprintf(buf, "In-Reply-To: %s\r\nReferences: %s\r\n", inReplyTo, inReplyTo)
+	}
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	pw, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	pw.Write([]byte(text))
+	if zipData != nil {
+		pw, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/zip"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="` + MASTER_ZIP_NAME + `"`},
+		})
+		enc := base64.StdEncoding.EncodeToString(zipData)
+		for len(enc) > 76 {
+			pw.Write([]byte(enc[:76] + "\r\n"))
+			enc = enc[76:]
+		}
+		pw.Write([]byte(enc + "\r\n"))
+	}
+	mw.Close()
+
+	host, _, _ := net.SplitHostPort(mc.SMTPAddr)
+	auth := smtp.PlainAuth("", mc.SMTPUser, mc.SMTPPassword, host)
+	return smtp.SendMail(mc.SMTPAddr, auth, mc.From, []string{to}, buf.Bytes())
+}
@@ -4,28 +4,34 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
 	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
 	"io"
 	"log"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/adityafaths/multicompressgo/compress"
 	"github.com/disintegration/imaging"
 	fitz "github.com/gen2brain/go-fitz"
+	cryptzip "github.com/yeka/zip"
 )
 
 // ===== Settings (default mirrors Streamlit app) =====
 var (
-	SPEED_PRESET      = "fast" // or "balanced"
 	MIN_SIDE_PX       = 256
 	SCALE_MIN         = 0.35
 	UPSCALE_MAX       = 2.0
@@ -34,11 +40,11 @@ var (
 	PDF_DPI_FAST      = 150
 	PDF_DPI_BALANCED  = 200
 	MASTER_ZIP_NAME   = "compressed.zip"
-	MAX_QUALITY       = 95
-	MIN_QUALITY       = 15
-	THREADS           = 4
+	MAX_QUALITY       = compress.MaxQuality
+	MIN_QUALITY       = compress.MinQuality
 	TARGET_KB         = 174
 	MIN_KB            = 168
+	MAX_TARGET_KB     = 20 << 10 // upper bound for min_kb/max_kb and target windows
 	IMG_EXT           = map[string]bool{".jpg": true, ".jpeg": true, ".jfif": true, ".png": true, ".webp": true, ".tif": true, ".tiff": true, ".bmp": true, ".gif": true, ".heic": true, ".heif": true}
 	PDF_EXT           = map[string]bool{".pdf": true}
 	ALLOW_ZIP         = true
@@ -73,256 +79,381 @@ func extLower(name string) string {
 	return strings.ToLower(filepath.Ext(name))
 }
 
-// decodeImageFromBytes tries to decode JPEG/PNG/GIF/BMP/TIFF/WEBP via imaging
-func decodeImageFromBytes(name string, b []byte) (image.Image, error) {
-	ext := extLower(name)
-	if ext == ".heic" || ext == ".heif" {
-		return nil, nil
-	}
-	img, err := imaging.Decode(bytes.NewReader(b))
+// errTooManyPixels: the header declares more than MAX_PIXELS (default 150
+// million); a few hundred bytes can otherwise ask for gigabytes of canvas.
+var errTooManyPixels = errors.New("image too large")
+
+// checkPixels reads just the header of b and refuses sizes over MAX_PIXELS.
+// Formats Go can't parse the header of pass; their decoder decides.
+func checkPixels(b []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	return img, nil
+	if limit := live().MAX_PIXELS; int64(cfg.Width)*int64(cfg.Height) > int64(limit) {
+		return fmt.Errorf("%w: %dx%d is over MAX_PIXELS (%d)", errTooManyPixels, cfg.Width, cfg.Height, limit)
+	}
+	return nil
 }
 
-func saveJPGBytes(img image.Image, quality int, speedFast bool) ([]byte, error) {
-	buf := &bytes.Buffer{}
-	opt := &jpeg.Options{Quality: quality}
-	if err := jpeg.Encode(buf, img, opt); err != nil {
+// decodeImageFromBytes tries to decode JPEG/PNG/GIF/BMP/TIFF/WEBP via imaging
+func decodeImageFromBytes(name string, b []byte) (image.Image, error) {
+	if err := checkPixels(b); err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
-}
-
-// tryQualityBS: binary search over quality to get <= target_kb
-func tryQualityBS(img image.Image, targetKB int, qmin, qmax int, speedFast bool) ([]byte, int, error) {
-	lo, hi := qmin, qmax
-	var best []byte
-	var bestQ int
-
-	for lo <= hi {
-		mid := (lo + hi) / 2
-		b, err := saveJPGBytes(img, mid, speedFast)
-		if err != nil {
-			return nil, 0, err
-		}
-		if len(b) <= targetKB*1024 {
-			best, bestQ = b, mid
-			lo = mid + 1
-		} else {
-			hi = mid - 1
+	ext := inputExt(name)
+	if ext == ".heic" || ext == ".heif" {
+		if !heifDecode {
+			return nil, fmt.Errorf("no HEIC decoder (heif-dec) available")
 		}
+		return decodeHEIF(b)
 	}
-	if best == nil {
-		return nil, 0, nil
-	}
-	return best, bestQ, nil
-}
-
-func resizeToScale(img image.Image, scale float64, doSharpen bool, amount float64) image.Image {
-	w := int(float64(img.Bounds().Dx()) * scale)
-	h := int(float64(img.Bounds().Dy()) * scale)
-	if w < 1 {
-		w = 1
-	}
-	if h < 1 {
-		h = 1
-	}
-	out := imaging.Resize(img, w, h, imaging.Lanczos)
-	if doSharpen && amount > 0 {
-		out = imaging.Sharpen(out, amount)
+	if ext == ".jxl" && jxlDecode {
+		return decodeJXL(b)
 	}
-	return out
-}
-
-func ensureMinSide(img image.Image, minSide int, doSharpen bool, amount float64) image.Image {
-	w := img.Bounds().Dx()
-	h := img.Bounds().Dy()
-	if w >= minSide && h >= minSide {
-		return img
+	var img image.Image
+	var err error
+	if DECODE_SANDBOX && SANDBOX_EXT[ext] {
+		var imgs []image.Image
+		if imgs, err = decodeSandboxed(ext, b, 0); err == nil {
+			img = imgs[0]
+		}
+	} else {
+		img, err = compress.Decode(b)
 	}
-	scale := float64(minSide) / float64(min(w, h))
-	if scale < 1.0 {
-		scale = 1.0
+	if err != nil && EXTERNAL_DECODER != "" {
+		// second try for formats Go can't read (extdecode.go)
+		ximg, xerr := decodeExternal(ext, b)
+		if xerr == nil {
+			return ximg, nil
+		}
+		err = fmt.Errorf("%v; %v", err, xerr)
 	}
-	return resizeToScale(img, scale, doSharpen, amount)
-}
-
-// compressIntoRange attempts to produce JPEG in [min_kb, max_kb]
-func compressIntoRange(baseImg image.Image, minKB, maxKB, minSide int, scaleMin, upscaleMax float64, doSharpen bool, sharpenAmount float64, speedFast bool) ([]byte, float64, int, int, error) {
-	// convert to opaque white background if needed
-	// create RGB with white bg
-	rgb := imaging.New(baseImg.Bounds().Dx(), baseImg.Bounds().Dy(), color.White)
-	draw.Draw(rgb, rgb.Bounds(), baseImg, baseImg.Bounds().Min, draw.Over)
-
-	// try quality on original size first
-	data, q, err := tryQualityBS(rgb, maxKB, MIN_QUALITY, MAX_QUALITY, speedFast)
 	if err != nil {
-		return nil, 0, 0, 0, err
-	}
-	if data != nil {
-		return data, 1.0, q, len(data), nil
-	}
-
-	// binary search over scale between scaleMin..1.0
-	lo, hi := scaleMin, 1.0
-	var bestData []byte
-	var bestScale float64
-	var bestQ int
-	maxSteps := 8
-	if !speedFast {
-		maxSteps = 12
-	}
-
-	for i := 0; i < maxSteps; i++ {
-		mid := (lo + hi) / 2
-		candidate := resizeToScale(rgb, mid, doSharpen, sharpenAmount)
-		candidate = ensureMinSide(candidate, minSide, doSharpen, sharpenAmount)
-		d, q2, err := tryQualityBS(candidate, maxKB, MIN_QUALITY, MAX_QUALITY, speedFast)
-		if err != nil {
-			return nil, 0, 0, 0, err
-		}
-		if d != nil {
-			bestData, bestScale, bestQ = d, mid, q2
-			lo = mid + (hi-mid)*0.35
-		} else {
-			hi = mid - (mid-lo)*0.35
-		}
-		if hi-lo < 1e-3 {
-			break
-		}
+		return nil, err
 	}
-
-	if bestData == nil {
-		// fall back: smallest at scaleMin
-		small := resizeToScale(rgb, scaleMin, doSharpen, sharpenAmount)
-		small = ensureMinSide(small, minSide, doSharpen, sharpenAmount)
-		d, _ := saveJPGBytes(small, MIN_QUALITY, speedFast)
-		return d, scaleMin, MIN_QUALITY, len(d), nil
+	if ext == ".tif" || ext == ".tiff" {
+		// the TIFF decoder ignores the Orientation tag; JPEGs are handled by compress.Decode
+		img = compress.Orient(img, exifOrientation(b))
 	}
+	return img, nil
+}
 
-	// if size < minKB, try upscales
-	sizeB := len(bestData)
-	curScale := bestScale
-	if sizeB < minKB*1024 {
-		imgNow := resizeToScale(rgb, curScale, doSharpen, sharpenAmount)
-		imgNow = ensureMinSide(imgNow, minSide, doSharpen, sharpenAmount)
-		d, q2, err := tryQualityBS(imgNow, maxKB, max(bestQ, MIN_QUALITY), MAX_QUALITY, speedFast)
-		if err == nil && d != nil && len(d) > sizeB {
-			bestData, bestQ, sizeB = d, q2, len(d)
-		}
-
-		iters := 0
-		maxIters := 6
-		if !speedFast {
-			maxIters = 12
-		}
-		for sizeB < minKB*1024 && curScale < upscaleMax && iters < maxIters {
-			curScale = curScale * 1.2
-			if curScale > upscaleMax {
-				curScale = upscaleMax
-			}
-			candidate := resizeToScale(rgb, curScale, doSharpen, sharpenAmount)
-			candidate = ensureMinSide(candidate, minSide, doSharpen, sharpenAmount)
-			d, q3, err := tryQualityBS(candidate, maxKB, MIN_QUALITY, MAX_QUALITY, speedFast)
-			if err != nil {
-				iters++
-				continue
-			}
-			if d == nil {
-				curScale *= 0.95
-				iters++
-				continue
-			}
-			if len(d) > sizeB {
-				bestData, bestQ, sizeB, bestScale = d, q3, len(d), curScale
-			}
-			iters++
-		}
+// ----- PDF to images (see pdfrender.go for the backends) -----
+func pdfBytesToImages(pdfBytes []byte, dpi int) ([]image.Image, error) {
+	if DECODE_SANDBOX && PDF_RENDERER == "mupdf" {
+		return decodeSandboxed(".pdf", pdfBytes, dpi)
 	}
-	return bestData, bestScale, bestQ, len(bestData), nil
+	return renderPDF(pdfBytes, dpi)
 }
 
-// ----- PDF to images using go-fitz -----
-func pdfBytesToImages(pdfBytes []byte, dpi int) ([]image.Image, error) {
+// withMuPDF opens pdfBytes with MuPDF (go-fitz) for the duration of fn. path
+// is the temp file, for opening more documents on it: go-fitz serializes calls
+// on one Document.
+func withMuPDF(pdfBytes []byte, fn func(doc *fitz.Document, path string) error) error {
 	// go-fitz requires a filename on disk, write to temp file
 	tmp, err := os.CreateTemp("", "upload-*.pdf")
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer os.Remove(tmp.Name())
 
 	if _, err := tmp.Write(pdfBytes); err != nil {
 		tmp.Close()
-		return nil, err
+		return err
 	}
 	tmp.Close()
 
-	doc, err := fitz.New(tmp.Name())
+	var doc *fitz.Document
+	err = retryMuPDF("open", func() (err error) {
+		doc, err = fitz.New(tmp.Name())
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer doc.Close()
+	return fn(doc, tmp.Name())
+}
 
+// renderMuPDF rasterizes every page in-process with MuPDF, PDF_THREADS pages
+// at a time; the first worker uses the open document, the others their own.
+func renderMuPDF(pdfBytes []byte, dpi int) ([]image.Image, error) {
 	imgs := []image.Image{}
-	for n := 0; n < doc.NumPage(); n++ {
-		page, err := doc.Image(n)
-		if err != nil {
-			return nil, err
-		}
-		imgs = append(imgs, page)
-	}
-	return imgs, nil
+	err := withMuPDF(pdfBytes, func(doc *fitz.Document, path string) error {
+		imgs = make([]image.Image, doc.NumPage())
+		spare := make(chan *fitz.Document, 1)
+		spare <- doc
+		return eachPage(len(imgs), func() (func(int) error, func(), error) {
+			d, done := doc, func() {}
+			select {
+			case d = <-spare:
+			default:
+				err := retryMuPDF("open", func() (err error) {
+					d, err = fitz.New(path)
+					return err
+				})
+				if err != nil {
+					return nil, nil, err
+				}
+				done = func() { d.Close() }
+			}
+			return func(n int) error {
+				pageDpi := dpi
+				if b, err := d.Bound(n); err == nil {
+					pageDpi = pageDPI(float64(b.Dx()), float64(b.Dy()), dpi)
+				}
+				return retryMuPDF(fmt.Sprintf("page %d", n+1), func() error {
+					page, err := d.ImageDPI(n, float64(pageDpi))
+					if err != nil {
+						return err
+					}
+					imgs[n] = page
+					return nil
+				})
+			}, done, nil
+		})
+	})
+	return imgs, err
 }
 
 // ----- ZIP extraction -----
-func extractZipToMemory(b []byte) ([]struct {
-	Rel  string
-	Data []byte
-}, error) {
+// Entries that cannot be read (encrypted without the right password, over
+// MAX_ENTRY_MB, corrupt) are returned with Skip set and no Data, so callers can
+// report them. Encrypted entries (ZipCrypto or WinZip AES) are read with
+// password through github.com/yeka/zip, everything else with archive/zip.
+//
+// Against zip bombs an upload as a whole may not hold more than MAX_ZIP_FILES
+// entries nor inflate past MAX_ZIP_TOTAL_MB; the whole archive is refused with
+// errZipLimit then. ZIPs inside it are expanded like folders ("a/b.zip" ->
+// "a/b/...") down to MAX_ZIP_DEPTH levels, sharing those limits; deeper ones
+// are skipped. Their entries carry the nested ZIP in From, so the summary has
+// a line per inner archive.
+//
+// Every entry's CRC is checked as it is read; a mismatch skips that entry as
+// "corrupt ZIP entry". An archive whose central directory is cut off (an
+// interrupted upload or download) is read from its local headers instead,
+// keeping the entries before the damage (zipsalvage.go); ZIP_STRICT=1
+// refuses it whole.
+//
+//	MAX_ENTRY_MB=100 MAX_ZIP_TOTAL_MB=1024 MAX_ZIP_FILES=10000 MAX_ZIP_DEPTH=2 ZIP_STRICT=1
+type zipEntry struct {
+	Rel      string
+	Data     []byte
+	Skip     string
+	SkipKind skipKind
+	From     string // the nested ZIP holding the entry, "" for the upload itself
+}
+
+var errZipLimit = errors.New("ZIP refused")
+
+// zipBudget is what is left of the limits while one upload is expanded.
+type zipBudget struct {
+	files int
+	bytes int64
+}
+
+func extractZipToMemory(b []byte, password string) ([]zipEntry, error) {
+	cfg := live()
+	return extractZip(b, password, 1, &zipBudget{files: cfg.MAX_ZIP_FILES, bytes: cfg.MAX_ZIP_BYTES})
+}
+
+func extractZip(b []byte, password string, depth int, budget *zipBudget) ([]zipEntry, error) {
+	cfg := live()
 	r := bytes.NewReader(b)
 	zf, err := zip.NewReader(r, int64(len(b)))
-	if err != nil {
+	if errors.Is(err, zip.ErrFormat) && !cfg.ZIP_STRICT {
+		return salvageZip(b, password, depth, budget)
+	} else if err != nil {
 		return nil, err
 	}
-	out := []struct {
-		Rel  string
-		Data []byte
-	}{}
+	// refuse what the headers announce before inflating anything
+	if budget.files -= len(zf.File); budget.files < 0 {
+		return nil, fmt.Errorf("%w: more than %d files (MAX_ZIP_FILES)", errZipLimit, cfg.MAX_ZIP_FILES)
+	}
+	declared := uint64(0)
 	for _, f := range zf.File {
+		if f.UncompressedSize64 <= uint64(cfg.MAX_ENTRY_BYTES) { // larger ones are skipped unread
+			declared += f.UncompressedSize64
+		}
+	}
+	if declared > uint64(budget.bytes) {
+		return nil, zipTooBig()
+	}
+	var locked *cryptzip.Reader
+	out := []zipEntry{}
+	for i, f := range zf.File {
 		if f.FileInfo().IsDir() {
 			continue
 		}
-		rc, err := f.Open()
+		encrypted := f.Flags&0x1 != 0
+		switch {
+		case encrypted && f.Flags&0x40 != 0:
+			out = append(out, zipEntry{Rel: f.Name, Skip: "encrypted ZIP entry: PKWARE strong encryption is not supported", SkipKind: skipEncrypted})
+			continue
+		case encrypted && password == "":
+			out = append(out, zipEntry{Rel: f.Name, Skip: "encrypted ZIP entry: no password given", SkipKind: skipEncrypted})
+			continue
+		}
+		if cfg.MAX_ENTRY_BYTES > 0 && f.UncompressedSize64 > uint64(cfg.MAX_ENTRY_BYTES) {
+			out = append(out, zipEntry{Rel: f.Name, Skip: fmt.Sprintf("too large: %d bytes (max %d)", f.UncompressedSize64, cfg.MAX_ENTRY_BYTES), SkipKind: skipTooLarge})
+			continue
+		}
+		var rc io.ReadCloser
+		if encrypted {
+			if locked == nil {
+				if locked, err = cryptzip.NewReader(r, int64(len(b))); err != nil {
+					return nil, err
+				}
+			}
+			// both readers list the central directory in the same order
+			lf := locked.File[i]
+			lf.SetPassword(password)
+			rc, err = lf.Open()
+		} else {
+			rc, err = f.Open()
+		}
 		if err != nil {
+			kind, msg := zipReadSkip(encrypted, err)
+			out = append(out, zipEntry{Rel: f.Name, Skip: msg, SkipKind: kind})
 			continue
 		}
-		data, err := io.ReadAll(rc)
+		// the header size can lie; never read past the limit
+		data, err := io.ReadAll(io.LimitReader(rc, cfg.MAX_ENTRY_BYTES+1))
 		rc.Close()
 		if err != nil {
+			kind, msg := zipReadSkip(encrypted, err)
+			out = append(out, zipEntry{Rel: f.Name, Skip: msg, SkipKind: kind})
 			continue
 		}
-		out = append(out, struct {
-			Rel  string
-			Data []byte
-		}{Rel: f.Name, Data: data})
+		if int64(len(data)) > cfg.MAX_ENTRY_BYTES {
+			out = append(out, zipEntry{Rel: f.Name, Skip: fmt.Sprintf("too large: over %d bytes", cfg.MAX_ENTRY_BYTES), SkipKind: skipTooLarge})
+			continue
+		}
+		if out, err = appendZipEntry(out, f.Name, data, password, depth, budget); err != nil {
+			return nil, err
+		}
 	}
 	return out, nil
 }
 
+// appendZipEntry adds one read entry to out, expanding it when it is a ZIP.
+// It fails only when the upload's limits are exceeded.
+func appendZipEntry(out []zipEntry, name string, data []byte, password string, depth int, budget *zipBudget) ([]zipEntry, error) {
+	// the sizes in the headers can lie too
+	if budget.bytes -= int64(len(data)); budget.bytes < 0 {
+		return nil, zipTooBig()
+	}
+	if extLower(name) != ".zip" || !ALLOW_ZIP {
+		return append(out, zipEntry{Rel: name, Data: data}), nil
+	}
+	if maxDepth := live().MAX_ZIP_DEPTH; depth >= maxDepth {
+		return append(out, zipEntry{Rel: name, Skip: fmt.Sprintf("nested ZIP more than %d levels deep (MAX_ZIP_DEPTH)", maxDepth), SkipKind: skipOther}), nil
+	}
+	inner, err := extractZip(data, password, depth+1, budget)
+	if errors.Is(err, errZipLimit) {
+		return nil, err
+	} else if err != nil {
+		return append(out, zipEntry{Rel: name, Skip: "unzip error: " + err.Error(), SkipKind: skipOther}), nil
+	}
+	prefix := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, e := range inner {
+		e.Rel, e.From = path.Join(prefix, e.Rel), path.Join(name, e.From)
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func zipTooBig() error {
+	return fmt.Errorf("%w: expands past %d MB (MAX_ZIP_TOTAL_MB)", errZipLimit, live().MAX_ZIP_BYTES>>20)
+}
+
+// zipReadSkip sorts and words a failed entry read. archive/zip checks each
+// entry's CRC as it is read to the end, so damage inside the archive is told
+// apart from images that fail to decode later. A ZipCrypto password isn't checked up
+// front, so a wrong one shows up as corrupt data (bad CRC or deflate stream).
+func zipReadSkip(encrypted bool, err error) (skipKind, string) {
+	switch {
+	case !encrypted && errors.Is(err, zip.ErrChecksum):
+		return skipCorrupt, "corrupt ZIP entry: CRC mismatch"
+	case !encrypted:
+		return skipCorrupt, "corrupt ZIP entry: " + err.Error()
+	case errors.Is(err, cryptzip.ErrAlgorithm):
+		return skipEncrypted, "encrypted ZIP entry: unsupported compression method"
+	}
+	return skipEncrypted, "encrypted ZIP entry: wrong password"
+}
+
+func warnSuffix(warn string) string {
+	if warn == "" {
+		return ""
+	}
+	return " WARNING: " + warn
+}
+
+// outputRecord describes one output of processOneFileEntry. The summary line
+// and the JSON API are both made from it.
+type outputRecord struct {
+	Name    string  `json:"name"`
+	Bytes   int     `json:"bytes"`
+	Scale   float64 `json:"scale,omitempty"`
+	Quality int     `json:"quality,omitempty"`
+	Page    string  `json:"page,omitempty"`   // text or photo, for PDF pages
+	Mode    string  `json:"mode,omitempty"`   // convert or strip; "" for compressed
+	Thumb   bool    `json:"thumb,omitempty"`  // a target without size window, at THUMB_QUALITY
+	Saved   int     `json:"saved,omitempty"`  // strip: bytes of metadata removed
+	Frame   int     `json:"frame,omitempty"`  // animated GIF: the frame kept, of Frames
+	Frames  int     `json:"frames,omitempty"` //
+	Note    string  `json:"note,omitempty"`
+	Warning string  `json:"warning,omitempty"`
+}
+
+// line is the summary line: "<name> -> <n> bytes scale=<s> q=<q> [page=<kind>][ WARNING: ...]".
+func (o outputRecord) line() string {
+	l := fmt.Sprintf("%s -> %d bytes", o.Name, o.Bytes)
+	switch {
+	case o.Mode == "convert" && o.Quality > 0:
+		l += fmt.Sprintf(" (convert q=%d)", o.Quality)
+	case o.Mode == "convert":
+		l += " (convert)"
+	case o.Mode == "strip":
+		l += fmt.Sprintf(" (strip, -%d bytes)", o.Saved)
+	case o.Thumb:
+		l += fmt.Sprintf(" q=%d", o.Quality)
+	default:
+		l += fmt.Sprintf(" scale=%.3f q=%d", o.Scale, o.Quality)
+	}
+	if o.Page != "" {
+		l += " page=" + o.Page
+	}
+	if o.Frames > 0 {
+		l += fmt.Sprintf(" frame=%d/%d", o.Frame, o.Frames)
+	}
+	if o.Note != "" {
+		l += " " + o.Note
+	}
+	return l + warnSuffix(o.Warning)
+}
+
+// outputLines returns the summary lines of records.
+func outputLines(records []outputRecord) []string {
+	lines := make([]string, 0, len(records))
+	for _, o := range records {
+		lines = append(lines, o.line())
+	}
+	return lines
+}
+
 // ----- Processing one file entry -----
-func processOneFileEntry(relpath string, raw []byte, label string, cfg map[string]string) (string, []string, []string, map[string][]byte) {
-	processed := []string{}
-	skipped := []string{}
+func processOneFileEntry(relpath string, raw []byte, label string, opts Options) (string, []outputRecord, []fileSkip, map[string][]byte) {
+	processed := []outputRecord{}
+	skipped := []fileSkip{}
 	outs := map[string][]byte{}
-	ext := strings.ToLower(filepath.Ext(relpath))
-	speedFast := cfg["speed"] == "fast"
-	minSide, _ := strconv.Atoi(cfg["min_side"])
-	scaleMin, _ := strconv.ParseFloat(cfg["scale_min"], 64)
-	upscaleMax, _ := strconv.ParseFloat(cfg["upscale_max"], 64)
-	doSharpen := cfg["sharpen"] == "1"
-	shAmount, _ := strconv.ParseFloat(cfg["sharpen_amount"], 64)
+	ext := inputExt(relpath)
+	speedFast := opts.Speed == "fast"
+	minSide, scaleMin, upscaleMax := opts.MinSide, opts.ScaleMin, opts.UpscaleMax
+	doSharpen, shAmount := opts.Sharpen, opts.SharpenAmount
+	minQuality := opts.MinQuality
 	pdfdpi := PDF_DPI_FAST
 	if !speedFast {
 		pdfdpi = PDF_DPI_BALANCED
@@ -330,65 +461,223 @@ func processOneFileEntry(relpath string, raw []byte, label string, cfg map[strin
 
 	defer func() {
 		if r := recover(); r != nil {
-			skipped = append(skipped, fmt.Sprintf("panic: %v", r))
+			skipped = append(skipped, skipf(skipDecode, "panic: %v", r))
 		}
 	}()
 
+	targets := opts.targets
+	if opts.Mode == "strip" {
+		label, processed, skipped, outs = stripOnlyEntry(relpath, raw, label, targets)
+		if len(processed) > 0 && (opts.Thumbs || opts.ContactSheet) {
+			// the outputs stay untouched; decode only for the thumbnail
+			if img, err := decodeImageFromBytes(relpath, raw); err == nil {
+				if data, err := makeThumb(img); err == nil {
+					outs["thumbs/"+strings.TrimSuffix(relpath, filepath.Ext(relpath))+".jpg"] = data
+				}
+			}
+		}
+		return label, processed, skipped, outs
+	}
+	// emit encodes one decoded image once per target; kind is the PDF page kind ("" for images)
+	emit := func(img image.Image, outBase, what, kind string) {
+		if opts.Thumbs || opts.ContactSheet {
+			if data, err := makeThumb(img); err == nil {
+				outs["thumbs/"+outBase+".jpg"] = data
+			}
+		}
+		if opts.Mode == "convert" {
+			data, q, err := encodeConverted(img, opts, speedFast)
+			if err != nil {
+				skipped = append(skipped, skipf(skipOther, "%s: encode error: %v", what, err))
+				return
+			}
+			outRel := outBase + "." + opts.ConvertFormat
+			outs[outRel] = data
+			processed = append(processed, outputRecord{Name: outRel, Bytes: len(data), Quality: q, Mode: "convert"})
+			return
+		}
+		for _, t := range targets {
+			src, upMax := img, upscaleMax
+			if t.MaxSide > 0 {
+				src = imaging.Fit(img, t.MaxSide, t.MaxSide, imaging.Lanczos)
+				upMax = 1.0
+			}
+			outRel := outBase + ".jpg"
+			if t.Name != "" {
+				outRel = t.Name + "/" + outRel
+			}
+			if t.MaxKB == 0 {
+				data, err := compress.EncodeJPEG(compress.FlattenWhite(src), THUMB_QUALITY)
+				if err != nil {
+					skipped = append(skipped, skipf(skipOther, "%s: encode error: %v", what, err))
+					continue
+				}
+				outs[outRel] = data
+				processed = append(processed, outputRecord{Name: outRel, Bytes: len(data), Quality: THUMB_QUALITY, Thumb: true})
+				continue
+			}
+			c := compress.New(compress.Options{MinKB: t.MinKB, MaxKB: t.MaxKB, MinSide: minSide, ScaleMin: scaleMin,
+				UpscaleMax: upMax, Sharpen: doSharpen, SharpenAmount: shAmount, Fast: speedFast, MinQuality: minQuality})
+			c.Encoder, c.Model = jpegEncoderFor(opts)
+			lean := *c
+			if kind == pageText && TEXT_SCALE_MIN > scaleMin {
+				lean.ScaleMin = TEXT_SCALE_MIN
+			} else if kind == pagePhoto {
+				lean.MinQuality = max(minQuality, PHOTO_MIN_QUALITY)
+			}
+			res, err := lean.Compress(src)
+			if (err != nil || res.Warning != "") && lean.Options != c.Options {
+				// the lean made the target unreachable: drop it
+				res, err = c.Compress(src)
+			}
+			if err != nil {
+				kind := skipOther
+				if errors.Is(err, compress.ErrTargetUnreachable) {
+					kind = skipUnreachable
+				}
+				skipped = append(skipped, skipf(kind, "%s: compress error: %v", what, err))
+				continue
+			}
+			warn := res.Warning
+			if opts.WAGuard {
+				for _, msg := range whatsappWarnings(res.Data, res.Quality) {
+					warn = strings.TrimPrefix(warn+"; "+msg, "; ")
+				}
+			}
+			outs[outRel] = res.Data
+			processed = append(processed, outputRecord{Name: outRel, Bytes: res.Size, Scale: res.Scale, Quality: res.Quality,
+				Page: kind, Warning: warn})
+		}
+	}
+
 	if PDF_EXT[ext] {
+		if err := pdfUnavailable(); err != nil {
+			skipped = append(skipped, skipf(skipPDF, "%s: pdf render unavailable on this server (%s): %v", relpath, PDF_RENDERER, err))
+			return label, processed, skipped, outs
+		}
 		images, err := pdfBytesToImages(raw, pdfdpi)
 		if err != nil {
-			skipped = append(skipped, relpath+": pdf render error: "+err.Error())
+			skipped = append(skipped, skipf(skipPDF, "%s: pdf render error: %v", relpath, err))
 			return label, processed, skipped, outs
 		}
+		kinds := pdfPageKinds(raw)
 		for idx, img := range images {
-			data, scale, q, sizeB, err := compressIntoRange(img, MIN_KB, TARGET_KB, minSide, scaleMin, upscaleMax, doSharpen, shAmount, speedFast)
-			if err != nil {
-				skipped = append(skipped, fmt.Sprintf("%s (page %d): %v", relpath, idx+1, err))
-				continue
+			outBase := strings.TrimSuffix(relpath, filepath.Ext(relpath)) + fmt.Sprintf("_p%d", idx+1)
+			kind := ""
+			if idx < len(kinds) {
+				kind = kinds[idx]
 			}
-			outRel := strings.TrimSuffix(relpath, filepath.Ext(relpath)) + fmt.Sprintf("_p%d.jpg", idx+1)
-			outs[outRel] = data
-			processed = append(processed, fmt.Sprintf("%s -> %d bytes scale=%.3f q=%d", outRel, sizeB, scale, q))
+			emit(img, outBase, fmt.Sprintf("%s (page %d)", relpath, idx+1), kind)
 		}
 	} else if IMG_EXT[ext] {
-		if ext == ".heic" || ext == ".heif" {
-			skipped = append(skipped, relpath+": Butuh HEIC decoder (tidak tersedia)")
+		if (ext == ".heic" || ext == ".heif") && !heifDecode {
+			msg := relpath + ": Butuh HEIC decoder (tidak tersedia)"
+			if info, err := readHEIF(raw); err == nil && info.multi() {
+				// bursts/sequences: only the primary item (pitm) is to be decoded
+				msg += fmt.Sprintf("; burst/sequence, %d gambar, utama item #%d", info.Images, info.Primary)
+			}
+			skipped = append(skipped, fileSkip{skipUnsupported, msg})
 			return label, processed, skipped, outs
 		}
 		img, err := decodeImageFromBytes(relpath, raw)
 		if err != nil {
-			skipped = append(skipped, relpath+": decode error: "+err.Error())
+			kind := skipDecode
+			if errors.Is(err, errTooManyPixels) {
+				kind = skipTooLarge
+			}
+			skipped = append(skipped, skipf(kind, "%s: decode error: %v", relpath, err))
 			return label, processed, skipped, outs
 		}
 		if img == nil {
-			skipped = append(skipped, relpath+": decode returned nil")
+			skipped = append(skipped, skipf(skipDecode, "%s: decode returned nil", relpath))
 			return label, processed, skipped, outs
 		}
+		first := len(processed)
+		frame, frames, note := 0, 0, ""
 		if ext == ".gif" {
-			// keep first frame
-			// imaging.Decode already decodes first frame for GIF
+			// outputs are stills: keep the chosen frame(s) and say so
+			if g, err := decodeGIF(raw); err == nil && len(g.Image) > 1 {
+				n := len(g.Image)
+				if opts.GIFFrame == "all" {
+					outBase := strings.TrimSuffix(relpath, filepath.Ext(relpath))
+					kept := gifFrames(g, "all", func(fr image.Image, k int) {
+						mark := len(processed)
+						emit(fr, fmt.Sprintf("%s_f%d", outBase, k), fmt.Sprintf("%s (frame %d)", relpath, k), "")
+						for j := mark; j < len(processed); j++ {
+							processed[j].Frame, processed[j].Frames = k, n
+						}
+					})
+					if kept < n {
+						skipped = append(skipped, skipf(skipOther, "%s: frames %d-%d not kept: over GIF_MAX_FRAMES (%d)", relpath, kept+1, n, live().GIF_MAX_FRAMES))
+					}
+					return label, processed, skipped, outs
+				}
+				gifFrames(g, opts.GIFFrame, func(fr image.Image, k int) {
+					// the last frame drawn, so fr stays as it is
+					img, frame = fr, k
+				})
+				frames, note = n, "(GIF animasi, hanya 1 frame disimpan)"
+			}
+		} else if ext == ".heic" || ext == ".heif" {
+			if info, err := readHEIF(raw); err == nil && info.multi() {
+				note = fmt.Sprintf("(burst/sequence, %d gambar, hanya gambar utama disimpan)", info.Images)
+			}
 		}
-		data, scale, q, sizeB, err := compressIntoRange(img, MIN_KB, TARGET_KB, minSide, scaleMin, upscaleMax, doSharpen, shAmount, speedFast)
-		if err != nil {
-			skipped = append(skipped, relpath+": compress error: "+err.Error())
-			return label, processed, skipped, outs
+		emit(img, strings.TrimSuffix(relpath, filepath.Ext(relpath)), relpath, "")
+		for i := first; i < len(processed); i++ {
+			processed[i].Frame, processed[i].Frames, processed[i].Note = frame, frames, note
 		}
-		outRel := strings.TrimSuffix(relpath, filepath.Ext(relpath)) + ".jpg"
-		outs[outRel] = data
-		processed = append(processed, fmt.Sprintf("%s -> %d bytes scale=%.3f q=%d", outRel, sizeB, scale, q))
 	}
 	return label, processed, skipped, outs
 }
 
 // ===== HTTP Handlers & server =====
-// For simplicity we store generated zips in memory keyed by token
+// Generated zips are kept locally keyed by token: on disk in the spool, or in
+// memory with ZIP_SPOOL_DIR=off.
 var memZips = struct {
 	sync.RWMutex
-	m map[string][]byte
-}{m: map[string][]byte{}}
+	m map[string]resultZip
+}{m: map[string]resultZip{}}
+
+// mainOutput finds the output a thumbnail belongs to, whatever its format;
+// with several targets that is the first target folder holding the same path.
+// Without one it returns the thumbnail's own path and 0.
+func mainOutput(outs map[string][]byte, thumbRel string) (string, int) {
+	rel := strings.TrimPrefix(thumbRel, "thumbs/")
+	base := strings.TrimSuffix(rel, filepath.Ext(rel))
+	keys := []string{}
+	for k := range outs {
+		if strings.HasPrefix(k, "thumbs/") {
+			continue
+		}
+		if kb := strings.TrimSuffix(k, filepath.Ext(k)); kb == base || strings.HasSuffix(kb, "/"+base) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return rel, 0
+	}
+	// the untargeted output (fewest folders) first, then the first target
+	sort.Slice(keys, func(i, j int) bool {
+		if di, dj := strings.Count(keys[i], "/"), strings.Count(keys[j], "/"); di != dj {
+			return di < dj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys[0], len(outs[keys[0]])
+}
+
+// galleryItem is one thumbnail shown on the result page, inlined as a data URI.
+type galleryItem struct {
+	Name string
+	Src  template.URL
+}
+
+// MAX_GALLERY_ITEMS caps how many thumbnails are inlined into the result page.
+var MAX_GALLERY_ITEMS = 300
 
 // ===== Templates =====
-var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
+var tplIndex = template.Must(template.New("index").Funcs(tplFuncs).Parse(`<!doctype html>
 <html lang="id">
 <head>
   <meta charset="utf-8" />
@@ -403,7 +692,8 @@ var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
         <div class="card mb-3">
           <div class="card-body">
             <h5 class="card-title">⚙️ Pengaturan</h5>
-            <form method="post" action="/process" enctype="multipart/form-data">
+            <form id="processForm" class="job-form" method="post" action="{{base}}/process?stream=1" enctype="multipart/form-data">
+              <input type="hidden" name="job_id">
               <div class="mb-2">
                 <label class="form-label">Preset kecepatan</label>
                 <select name="speed" class="form-select">
@@ -411,6 +701,24 @@ var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
                   <option value="balanced">balanced</option>
                 </select>
               </div>
+              <div class="mb-2">
+                <label class="form-label">Preset tujuan</label>
+                <select name="preset" class="form-select">
+                  <option value="" selected>custom</option>
+                  <option value="whatsapp">WhatsApp (maks 1600 px, kualitas ≥ 60)</option>
+                  {{range presets}}{{if ne . "whatsapp"}}<option value="{{.}}">{{.}}</option>{{end}}{{end}}
+                </select>
+              </div>
+              <div class="row mb-2">
+                <div class="col">
+                  <label class="form-label">Min KB</label>
+                  <input name="min_kb" type="number" class="form-control" value="168" min="1" max="20480">
+                </div>
+                <div class="col">
+                  <label class="form-label">Maks KB</label>
+                  <input name="max_kb" type="number" class="form-control" value="174" min="2" max="20480">
+                </div>
+              </div>
               <div class="mb-2">
                 <label class="form-label">Sisi terpendek minimum (px)</label>
                 <input name="min_side" type="number" class="form-control" value="256" min="64" max="2048" step="32">
@@ -423,6 +731,67 @@ var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
                 <label class="form-label">Batas upscale maksimum</label>
                 <input name="upscale_max" type="number" class="form-control" step="0.1" value="2.0">
               </div>
+              <div class="mb-2">
+                <label class="form-label">Frame GIF animasi</label>
+                <select name="gif_frame" class="form-select">
+                  <option value="first" selected>Pertama</option>
+                  <option value="middle">Tengah</option>
+                  <option value="last">Terakhir</option>
+                  <option value="longest">Paling lama tampil</option>
+                  <option value="all">Semua frame (_f1, _f2, …)</option>
+                </select>
+              </div>
+              <div class="mb-2">
+                <label class="form-label">Hanya ekstensi (opsional)</label>
+                <input name="allow_ext" type="text" class="form-control" placeholder=".jpg,.png,.pdf">
+              </div>
+              <div class="mb-2">
+                <label class="form-label">Tolak ekstensi (opsional)</label>
+                <input name="deny_ext" type="text" class="form-control" placeholder=".gif">
+              </div>
+              <div class="mb-2">
+                <label class="form-label">Abaikan berkas di bawah (KB)</label>
+                <input name="ignore_below_kb" type="number" class="form-control" value="0" min="0" max="1024">
+                <small class="text-muted">Mis. 2 untuk melewati placeholder/thumbnail kosong dari Windows tanpa dicatat. 0 = proses semua.</small>
+              </div>
+              <div class="mb-2">
+                <label class="form-label">Struktur folder hasil</label>
+                <select name="flatten" class="form-select">
+                  <option value="" selected>Pertahankan folder</option>
+                  <option value="prefix">Ratakan; nama kembar diberi awalan folder</option>
+                  <option value="hash">Ratakan; nama kembar diberi akhiran hash</option>
+                  <option value="seq">Ratakan; nama kembar diberi nomor urut</option>
+                </select>
+                <small class="text-muted">Pemetaan nama asli → nama baru tercatat di manifest (format=json).</small>
+              </div>
+              <div class="form-check mb-2">
+                <input class="form-check-input" type="checkbox" name="keep_hidden" id="keep_hidden">
+                <label class="form-check-label" for="keep_hidden">Ikutkan berkas sistem (__MACOSX/, ._*, .DS_Store, Thumbs.db)</label>
+              </div>
+              {{if mozjpeg}}
+              <div class="mb-2">
+                <label class="form-label">Encoder JPEG</label>
+                <select name="jpeg_encoder" class="form-select">
+                  <option value="" selected>bawaan server</option>
+                  <option value="std">standar (baseline 4:2:0)</option>
+                  <option value="mozjpeg">mozjpeg</option>
+                </select>
+              </div>
+              <div class="row mb-2">
+                <div class="col">
+                  <label class="form-label">Subsampling warna</label>
+                  <select name="subsampling" class="form-select">
+                    <option value="" selected>bawaan</option>
+                    <option value="420">4:2:0 (lebih kecil)</option>
+                    <option value="444">4:4:4 (tepi warna tajam)</option>
+                  </select>
+                </div>
+                <div class="col form-check mt-4 ms-2">
+                  <input class="form-check-input" type="checkbox" name="progressive" id="progressive">
+                  <label class="form-check-label" for="progressive">Progressive</label>
+                </div>
+              </div>
+              {{end}}
               <div class="form-check mb-2">
                 <input class="form-check-input" type="checkbox" name="sharpen" id="sharpen" checked>
                 <label class="form-check-label" for="sharpen">Sharpen ringan setelah resize</label>
@@ -431,17 +800,82 @@ var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
                 <label class="form-label">Sharpen amount</label>
                 <input name="sharpen_amount" type="number" class="form-control" step="0.1" value="1.0">
               </div>
+              <div class="form-check mb-2">
+                <input class="form-check-input" type="checkbox" name="thumbs" id="thumbs">
+                <label class="form-check-label" for="thumbs">Buat thumbnail (thumbs/) &amp; galeri</label>
+              </div>
+              <div class="form-check mb-2">
+                <input class="form-check-input" type="checkbox" name="contact_sheet" id="contact_sheet">
+                <label class="form-check-label" for="contact_sheet">Buat contact sheet (ringkasan visual)</label>
+              </div>
+              <div class="mb-2">
+                <label class="form-label">Data pemohon (opsional)</label>
+                <input name="applicant_name" class="form-control mb-1" placeholder="Nama pemohon">
+                <input name="applicant_id" class="form-control mb-1" placeholder="No. pendaftaran / NIK">
+                <select name="doc_type" class="form-select">
+                  <option value="">Jenis dokumen…</option>
+                  {{range docTypes}}<option value="{{.}}">{{.}}</option>{{end}}
+                </select>
+                <small class="text-muted">Hasil dikelompokkan per pemohon dan diberi nama sesuai jenis dokumen.</small>
+              </div>
               <div class="mb-2">
                 <label class="form-label">Nama master ZIP</label>
                 <input name="master_name" class="form-control" value="compressed.zip">
               </div>
-              <p><small class="text-muted">Target otomatis: 168–174 KB (tidak bisa diubah)</small></p>
+              <div class="mb-2">
+                <label class="form-label">Target tambahan (opsional)</label>
+                <input name="targets" class="form-control" placeholder="168-174,95-100,1024px">
+                <small class="text-muted">Kosong = rentang Min–Maks KB di atas. Beberapa target → satu folder per target.</small>
+              </div>
+              <div class="mb-2">
+                <label class="form-label">Mode</label>
+                <select name="mode" class="form-select">
+                  <option value="">Kompres ke target ukuran</option>
+                  <option value="convert">Konversi format saja (tanpa target ukuran)</option>
+                  <option value="strip">Hapus metadata saja (JPEG, tanpa re-encode)</option>
+                </select>
+              </div>
+              <div class="row mb-2">
+                <div class="col">
+                  <label class="form-label">Format konversi</label>
+                  <select name="convert_format" class="form-select">
+                    <option value="jpg">JPG</option>
+                    <option value="png">PNG</option>
+                    {{if jxlEncode}}<option value="jxl">JPEG XL</option>{{end}}
+                  </select>
+                </div>
+                <div class="col">
+                  <label class="form-label">Kualitas JPG/JXL</label>
+                  <input name="convert_quality" type="number" min="1" max="100" class="form-control" value="90">
+                </div>
+                <div class="col">
+                  <label class="form-label">Maks. KB (opsional)</label>
+                  <input name="convert_max_kb" type="number" min="1" class="form-control">
+                </div>
+              </div>
               <hr>
+              <div class="mb-3">
+                <label class="form-label">Kata sandi ZIP (jika terenkripsi)</label>
+                <input class="form-control" type="password" name="zip_password" autocomplete="off">
+                <div class="form-text">Dipakai untuk semua ZIP terenkripsi (ZipCrypto/AES) di unggahan ini dan tidak disimpan.</div>
+              </div>
               <div class="mb-3">
                 <label class="form-label">Upload (ZIP / gambar / PDF)</label>
-                <input class="form-control" type="file" name="files" multiple>
+                <input class="form-control" type="file" name="files" id="files" multiple>
+              </div>
+              <ul id="preflight" class="list-unstyled small text-warning d-none"></ul>
+              <div class="mb-3">
+                <label class="form-label">atau pilih folder (struktur dipertahankan)</label>
+                <input class="form-control" type="file" name="folder" id="folder" webkitdirectory multiple>
               </div>
               <button class="btn btn-primary" type="submit">🚀 Proses & Buat Master ZIP</button>
+              <button class="btn btn-outline-secondary mt-2" type="submit" formaction="{{base}}/inspect">🔍 Pratinjau & pilih isi</button>
+              {{if .User}}
+              <div class="mt-2">
+                <button class="btn btn-sm btn-link p-0" type="button" id="saveDefaults">💾 Simpan sebagai bawaan saya</button>
+                {{if eq .PrefsKind "default"}}· <button class="btn btn-sm btn-link p-0" type="button" id="resetDefaults">Hapus bawaan</button>{{end}}
+              </div>
+              {{end}}
             </form>
           </div>
         </div>
@@ -450,8 +884,10 @@ var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
             <h6>Catatan</h6>
             <ul>
               <li>Video tidak diterima.</li>
-              <li>HEIC/HEIF: belum didukung—akan dilewati.</li>
-              <li>PDF membutuhkan MuPDF di sistem (go-fitz).</li>
+              <li>ZIP di dalam ZIP ikut diproses hingga {{zipDepth}} tingkat; struktur foldernya dipertahankan.</li>
+              <li>ZIP terpecah (.z01, .z02, …, .zip) digabung otomatis bila semua bagiannya diunggah bersama.</li>
+              <li>HEIC/HEIF: {{if heifDecode}}didukung (libheif).{{else}}butuh libheif (heif-dec) di server—akan dilewati.{{end}}</li>
+              <li>PDF membutuhkan MuPDF, Poppler atau PDFium di sistem{{if pdfError}}—<b>tidak tersedia di server ini</b>{{end}}.</li>
             </ul>
           </div>
         </div>
@@ -459,184 +895,884 @@ var tplIndex = template.Must(template.New("index").Parse(`<!doctype html>
       <div class="col-md-9">
         <div class="card">
           <div class="card-body">
+            {{with .User}}<p class="float-end"><small>{{if .Name}}{{.Name}}{{else}}{{.ID}}{{end}} · <a href="{{base}}/auth/logout">Keluar</a></small></p>{{end}}
             <h3>📦 Multi-ZIP / Files → JPG & Kompres 168–174 KB (auto)</h3>
             <p class="text-muted">Upload beberapa ZIP (berisi folder/gambar/PDF) dan/atau file lepas (gambar/PDF).</p>
+            <div id="progress" class="alert alert-secondary d-none">
+              <div id="progressText"></div>
+              <div class="progress my-2" style="height: 1.25rem">
+                <div id="progressBar" class="progress-bar progress-bar-striped progress-bar-animated" role="progressbar" style="width: 0%"></div>
+              </div>
+              <ul id="progressLog" class="list-unstyled small mb-0 overflow-auto" style="max-height: 12rem"></ul>
+            </div>
+            {{with pdfError}}
+            <div class="alert alert-warning">⚠️ PDF tidak bisa diproses di server ini (renderer PDF tidak tersedia); berkas PDF akan dilewati. <small class="text-muted">{{.}}</small></div>
+            {{end}}
+            {{with maintenance}}
+            <div class="alert alert-warning">🛠️ {{.}}</div>
+            {{end}}
             {{if .Message}}
             <div class="alert alert-info">{{.Message}}</div>
             {{end}}
             {{if .Summary}}
             <h5>📊 Ringkasan</h5>
             <pre>{{.Summary}}</pre>
-            <a class="btn btn-success" href="/download/{{.Token}}">⬇️ Download Master ZIP</a>
+            <a class="btn btn-success" href="{{base}}/download/{{.Token}}">⬇️ Download Master ZIP</a>
+            {{with .Expires}}<div class="mt-1"><small class="text-muted">⏳ Tautan berlaku sampai {{.Format "02/01/2006 15:04"}}; setelah itu hasil dihapus.</small></div>{{end}}
+            {{with .Files}}
+            <details class="mt-2">
+              <summary>📄 Unduh per berkas</summary>
+              <ul class="list-unstyled small mt-1">
+                {{range .}}{{range .Paths}}
+                <li><a href="{{base}}/download/{{$.Token}}/{{.}}">⬇️ {{.}}</a></li>
+                {{end}}{{end}}
+              </ul>
+            </details>
+            {{end}}
+            {{if .QR}}
+            <div class="mt-3">
+              <img src="{{.QR}}" width="192" height="192" alt="QR download">
+              <div><small class="text-muted">Pindai untuk mengunduh di ponsel.</small></div>
+            </div>
+            {{end}}
+            <form class="row g-2 mt-3" method="post" action="{{base}}/share">
+              <input type="hidden" name="token" value="{{.Token}}">
+              <div class="col-auto">
+                <select class="form-select" name="expires">
+                  <option value="24h">1 hari</option>
+                  <option value="72h" selected>3 hari</option>
+                  <option value="168h">7 hari</option>
+                </select>
+              </div>
+              <div class="col-auto"><input class="form-control" type="password" name="password" placeholder="Kata sandi (opsional)"></div>
+              <div class="col-auto"><button class="btn btn-outline-primary" type="submit">🔗 Buat link berbagi</button></div>
+            </form>
+            {{if .Skips}}
+            <h5 class="mt-4">⚠️ Dilewati ({{len .Skips}})</h5>
+            <div id="skipFilters" class="btn-group btn-group-sm flex-wrap mb-2">
+              <button type="button" class="btn btn-outline-secondary active" data-cat="">Semua ({{len .Skips}})</button>
+              {{range .SkipCounts}}<button type="button" class="btn btn-outline-secondary" data-cat="{{.Category}}">{{.Name}} ({{.Count}})</button>{{end}}
+            </div>
+            <ul id="skipList" class="list-unstyled small">
+              {{range .Skips}}
+              <li data-cat="{{.Category}}"><code>{{.Label}}</code> {{.Message}}</li>
+              {{end}}
+            </ul>
+            {{end}}
+            {{end}}
+            {{if .Preview}}
+            <h5>🗂️ Pilih berkas yang akan diproses</h5>
+            {{if .Warned}}
+            <div class="alert alert-warning">⚠️ {{.Warned}} berkas kemungkinan bermasalah (lihat tanda ⚠️ di bawah). Perbaiki berkasnya atau hilangkan centangnya sebelum memproses.</div>
+            {{end}}
+            <form class="job-form" method="post" action="{{base}}/confirm">
+              <input type="hidden" name="token" value="{{.StageToken}}">
+              <input type="hidden" name="job_id">
+              <ul class="list-unstyled">
+                {{range .Preview}}
+                <li style="padding-left: {{.Indent}}em">
+                  {{if .Skip}}
+                  <label class="text-muted"><input type="checkbox" disabled>
+                    <code>{{.Label}}/{{.Rel}}</code> <small>dilewati: {{.Skip}}</small></label>
+                  {{else}}
+                  <label><input type="checkbox" name="select" value="{{.ID}}" checked>
+                    <code>{{.Label}}/{{.Rel}}</code> <small class="text-muted">{{.Type}}, {{.SizeB}} bytes</small></label>
+                  {{range .Warnings}}<div class="text-warning small ms-4">⚠️ {{.}}</div>{{end}}
+                  {{end}}
+                </li>
+                {{end}}
+              </ul>
+              <button class="btn btn-primary" type="submit">🚀 Proses yang dipilih</button>
+            </form>
+            {{end}}
+            {{if .Recent}}
+            <h5 class="mt-4">🕘 Hasil terakhir</h5>
+            <ul class="list-unstyled">
+              {{range .Recent}}
+              <li><a href="{{base}}/download/{{.Token}}">⬇️ {{.Token}}</a>
+                <small class="text-muted">{{.Created.Format "02/01 15:04"}}{{if .Title}} — {{.Title}}{{end}}</small></li>
+              {{end}}
+            </ul>
+            {{end}}
+            {{if .Gallery}}
+            <h5 class="mt-4">🖼️ Galeri</h5>
+            <div class="row g-2">
+              {{range .Gallery}}
+              <div class="col-6 col-md-3 col-lg-2 text-center">
+                <img src="{{.Src}}" class="img-thumbnail" alt="{{.Name}}">
+                <div><small class="text-muted text-break">{{.Name}}</small></div>
+              </div>
+              {{end}}
+            </div>
             {{end}}
           </div>
         </div>
       </div>
     </div>
   </div>
+  <script>
+    // follow /events/{id} while the POST is in flight: progress bar, ETA and a
+    // line per finished or skipped file
+    function trackJob(form) {
+      var id = 'j' + Date.now().toString(36) + Math.random().toString(36).slice(2, 8);
+      form.querySelector('input[name="job_id"]').value = id;
+      var box = document.getElementById('progress');
+      var text = document.getElementById('progressText');
+      var bar = document.getElementById('progressBar');
+      var log = document.getElementById('progressLog');
+      var es = new EventSource('{{base}}/events/' + id);
+      var show = function (e) {
+        var ev = JSON.parse(e.data), p = ev.progress;
+        box.classList.remove('d-none');
+        if (p) {
+          var pct = p.total > 0 ? Math.round(100 * p.done / p.total) : 0;
+          bar.style.width = pct + '%';
+          bar.textContent = pct + '%';
+          text.textContent = 'Diproses ' + p.done + '/' + p.total + ' berkas — perkiraan sisa ' + Math.ceil(p.eta_seconds) + ' detik';
+        }
+        if ((ev.type === 'file_done' || ev.type === 'file_skipped') && ev.file) {
+          var li = document.createElement('li');
+          if (ev.type === 'file_done') {
+            li.textContent = '✅ ' + ev.file + ' → ' + (ev.paths || []).length + ' berkas, ' + Math.round((ev.out_bytes || 0) / 1024) + ' KB';
+          } else {
+            li.className = 'text-warning';
+            li.textContent = (ev.ignored ? '⏭️ ' : '⚠️ ') + ev.file + (ev.skipped ? ': ' + ev.skipped.join('; ') : '');
+          }
+          var atEnd = log.scrollTop + log.clientHeight >= log.scrollHeight - 4;
+          log.appendChild(li);
+          if (atEnd) { log.scrollTop = log.scrollHeight; }
+        }
+      };
+      ['progress', 'job_started', 'file_started', 'file_done', 'file_skipped'].forEach(function (t) { es.addEventListener(t, show); });
+      es.addEventListener('job_done', function (e) {
+        show(e);
+        bar.classList.remove('progress-bar-animated');
+        es.close();
+      });
+    }
+    document.querySelectorAll('form.job-form').forEach(function (f) {
+      f.addEventListener('submit', function () { trackJob(f); });
+    });
+    // filter the skipped list by category
+    document.querySelectorAll('#skipFilters button').forEach(function (b) {
+      b.addEventListener('click', function () {
+        document.querySelectorAll('#skipFilters button').forEach(function (o) { o.classList.toggle('active', o === b); });
+        document.querySelectorAll('#skipList li').forEach(function (li) {
+          li.classList.toggle('d-none', b.dataset.cat !== '' && li.dataset.cat !== b.dataset.cat);
+        });
+      });
+    });
+    {{with .Prefs}}
+    // prefill with the user's saved defaults or last-used values
+    (function (prefs) {
+      var f = document.getElementById('processForm');
+      Object.keys(prefs).forEach(function (k) {
+        var el = f.elements[k];
+        if (!el) { return; }
+        if (el.type === 'checkbox') { el.checked = prefs[k] === 'on'; } else if (prefs[k] !== '') { el.value = prefs[k]; }
+      });
+    })({{.}});
+    {{end}}
+    {{with .FieldErrors}}
+    // mark the settings the server rejected
+    (function (errs) {
+      var f = document.getElementById('processForm');
+      Object.keys(errs).forEach(function (k) {
+        var el = f.elements[k];
+        if (!el || !el.parentNode) { return; }
+        el.classList.add('is-invalid');
+        var msg = document.createElement('div');
+        msg.className = 'invalid-feedback';
+        msg.textContent = errs[k];
+        el.parentNode.appendChild(msg);
+      });
+    })({{.}});
+    {{end}}
+    {{if .User}}
+    function postPrefs(fd, done) {
+      fetch('{{base}}/prefs', {method: 'POST', body: fd}).then(function (r) { alert(r.ok ? done : 'Gagal menyimpan bawaan.'); });
+    }
+    document.getElementById('saveDefaults').addEventListener('click', function () {
+      var fd = new FormData(document.getElementById('processForm'));
+      fd.delete('files');
+      fd.delete('folder');
+      postPrefs(fd, 'Bawaan disimpan.');
+    });
+    var reset = document.getElementById('resetDefaults');
+    if (reset) {
+      reset.addEventListener('click', function () {
+        var fd = new FormData();
+        fd.append('reset', '1');
+        postPrefs(fd, 'Bawaan dihapus.');
+      });
+    }
+    {{end}}
+    // pre-flight: check loose files as soon as they are picked, like /inspect
+    // does on the server (preflight.go); ZIP contents only show up there
+    (function () {
+      var form = document.getElementById('processForm');
+      var list = document.getElementById('preflight');
+      var heic = {{heifDecode}}, pdfOK = {{if pdfError}}false{{else}}true{{end}};
+      var warn = function (f, msg) {
+        var li = document.createElement('li');
+        li.textContent = '⚠️ ' + f.name + ': ' + msg;
+        list.appendChild(li);
+        list.classList.remove('d-none');
+      };
+      var check = function () {
+        list.replaceChildren();
+        list.classList.add('d-none');
+        var minKB = parseInt(form.elements['min_kb'].value, 10) || 0;
+        var minSide = parseInt(form.elements['min_side'].value, 10) || 0;
+        Array.prototype.forEach.call(document.getElementById('files').files, function (f) {
+          var ext = f.name.toLowerCase().split('.').pop();
+          if (ext === 'heic' || ext === 'heif') {
+            if (!heic) { warn(f, 'HEIC tidak bisa dibaca server ini (tidak ada decoder); ubah ke JPG dulu'); }
+          } else if (ext === 'pdf') {
+            if (!pdfOK) { warn(f, 'PDF tidak bisa dirender di server ini'); return; }
+            f.text().then(function (t) {
+              if (t.indexOf('/Encrypt') >= 0) { warn(f, 'PDF terenkripsi; bila berkata sandi, halamannya tidak bisa dirender'); }
+            });
+          } else if (['jpg', 'jpeg', 'png', 'gif', 'webp', 'bmp'].indexOf(ext) >= 0) {
+            if (minKB > 0 && f.size < minKB * 1024) {
+              warn(f, 'sudah ' + Math.floor(f.size / 1024) + ' KB, di bawah Min KB (' + minKB + ' KB): akan diperbesar agar masuk rentang');
+            }
+            if (window.createImageBitmap) {
+              createImageBitmap(f).then(function (b) {
+                if (Math.min(b.width, b.height) < minSide) {
+                  warn(f, 'hanya ' + b.width + '×' + b.height + ' px, di bawah sisi minimum ' + minSide + ' px: akan diperbesar (bisa buram)');
+                }
+                b.close();
+              }).catch(function () {});
+            }
+          }
+        });
+      };
+      document.getElementById('files').addEventListener('change', check);
+      ['min_kb', 'min_side'].forEach(function (k) { form.elements[k].addEventListener('change', check); });
+    })();
+    // multipart filenames drop directories; send webkitRelativePath alongside,
+    // ahead of the folder files (a streamed upload reads them in order)
+    document.getElementById('processForm').addEventListener('submit', function (ev) {
+      var form = ev.target;
+      var folder = document.getElementById('folder');
+      form.querySelectorAll('input[name="folder_paths"]').forEach(function (el) { el.remove(); });
+      Array.prototype.forEach.call(folder.files, function (f) {
+        var h = document.createElement('input');
+        h.type = 'hidden';
+        h.name = 'folder_paths';
+        h.value = f.webkitRelativePath || f.name;
+        folder.parentNode.insertBefore(h, folder);
+      });
+    });
+  </script>
 </body>
 </html>`))
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	tplIndex.Execute(w, nil)
+	data := map[string]interface{}{"Recent": recentResults(r), "User": currentUser(r)}
+	if u := currentUser(r); u != nil {
+		data["Prefs"], data["PrefsKind"] = userPrefs(u.ID())
+	}
+	tplIndex.Execute(w, data)
+}
+
+// splitUploadPath cleans a client supplied relative path and splits it into the
+// top-level folder (used as label) and the remainder.
+func splitUploadPath(rel string) (string, string) {
+	rel = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(rel, "\\", "/")), "/")
+	top, rest, ok := strings.Cut(rel, "/")
+	if !ok || top == "" {
+		return "folder", rel
+	}
+	return top, rest
 }
 
 func processHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := admitJob(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if r.URL.Query().Get("stream") == "1" && !JOB_ISOLATION {
+		processStreamed(w, r)
+		return
+	}
 	if err := r.ParseMultipartForm(200 << 20); err != nil { // 200MB
 		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// read settings
-	cfg := map[string]string{}
-	cfg["speed"] = r.FormValue("speed")
-	if cfg["speed"] == "" {
-		cfg["speed"] = "fast"
+	if err := verifyUploadChecksums(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkStoredInputs(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	cfg["min_side"] = r.FormValue("min_side")
-	if cfg["min_side"] == "" {
-		cfg["min_side"] = strconv.Itoa(MIN_SIDE_PX)
+	opts, ok := processSettings(w, r)
+	if !ok {
+		return
 	}
-	cfg["scale_min"] = r.FormValue("scale_min")
-	if cfg["scale_min"] == "" {
-		cfg["scale_min"] = fmt.Sprintf("%f", SCALE_MIN)
+
+	files := r.MultipartForm.File["files"]
+	folderFiles := r.MultipartForm.File["folder"]
+	if len(files) == 0 && len(folderFiles) == 0 && r.FormValue("input_prefix") == "" && len(r.MultipartForm.Value["input_keys"]) == 0 {
+		tplIndex.Execute(w, map[string]interface{}{"Message": "Silakan upload minimal satu file."})
+		return
 	}
-	cfg["upscale_max"] = r.FormValue("upscale_max")
-	if cfg["upscale_max"] == "" {
-		cfg["upscale_max"] = fmt.Sprintf("%f", UPSCALE_MAX)
+
+	jobs := collectJobs(r, opts)
+	if !hasWork(jobs) {
+		tplIndex.Execute(w, map[string]interface{}{"Message": noWorkMessage})
+		return
 	}
-	cfg["sharpen"] = "0"
-	if r.FormValue("sharpen") == "on" {
-		cfg["sharpen"] = "1"
+	manifest, gallery, err := runJobs(jobs, opts, r.FormValue("job_id"))
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
 	}
-	cfg["sharpen_amount"] = r.FormValue("sharpen_amount")
-	if cfg["sharpen_amount"] == "" {
-		cfg["sharpen_amount"] = fmt.Sprintf("%f", SHARPEN_AMOUNT)
+	respondProcessed(w, r, manifest, gallery)
+}
+
+const noWorkMessage = "Tidak ada berkas valid (butuh gambar/PDF, atau ZIP berisi file-file tersebut)."
+
+// processSettings reads the job settings and checks the output options of a
+// /process request, answering it itself when they are invalid.
+func processSettings(w http.ResponseWriter, r *http.Request) (Options, bool) {
+	opts, err := readSettings(r, "")
+	if err != nil {
+		settingsError(w, r, err)
+		return opts, false
 	}
+	rememberLastUsed(r)
+	if outPrefix := r.FormValue("output_prefix"); outPrefix != "" {
+		if store == nil {
+			http.Error(w, "output_prefix needs a STORAGE_BACKEND", http.StatusNotImplemented)
+			return opts, false
+		}
+		if err := checkOutputPrefix(outPrefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return opts, false
+		}
+	}
+	return opts, true
+}
+
+// respondProcessed answers /process with the finished job: the result page, or
+// the manifest as JSON. It exports to output_prefix first when asked.
+func respondProcessed(w http.ResponseWriter, r *http.Request, manifest resultManifest, gallery []galleryItem) {
 	masterName := r.FormValue("master_name")
 	if masterName == "" {
 		masterName = MASTER_ZIP_NAME
 	}
-
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		tplIndex.Execute(w, map[string]interface{}{"Message": "Silakan upload minimal satu file."})
+	outPrefix := r.FormValue("output_prefix")
+	token, summaryText, skips := manifest.Token, manifest.Summary, manifest.Skips
+	setResultOwner(token, resultOwner(r))
+	rememberResult(w, r, token, summaryText)
+	message := ""
+	if outPrefix != "" {
+		n, err := exportToPrefix(token, outPrefix, path.Base(masterName), r.FormValue("output_files") == "on")
+		manifest.Output, manifest.Exported = outPrefix, n
+		message = fmt.Sprintf("Hasil juga disimpan di %s (%d objek).", outPrefix, n)
+		if err != nil {
+			log.Printf("export %s to %s: %v", token, outPrefix, err)
+			manifest.Error = "export: " + err.Error()
+			message = fmt.Sprintf("Gagal menyimpan hasil ke %s: %v", outPrefix, err)
+		}
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(manifest)
 		return
 	}
+	// show result page
+	tplIndex.Execute(w, map[string]interface{}{"Summary": summaryText, "Token": token, "Expires": manifest.Expires, "QR": downloadQR(r, token), "Gallery": gallery,
+		"Files": manifest.Files, "Skips": skips, "SkipCounts": skipCounts(skips), "Message": message})
+}
 
-	// Collect jobs
-	type Job struct {
-		Label string
-		Rel   string
-		Data  []byte
+// Job is one image/PDF to process; Label picks the top-level output folder.
+// Source names the uploaded ZIP or folder it came from ("" for loose files).
+// Jobs with Skip set are not processed, only reported (see skips.go).
+type Job struct {
+	Label    string
+	Rel      string
+	Data     []byte
+	Source   string
+	Skip     string
+	SkipKind skipKind // set with Skip
+}
+
+// hasWork reports whether any job is actually processable.
+func hasWork(jobs []Job) bool {
+	for _, j := range jobs {
+		if j.Skip == "" {
+			return true
+		}
 	}
+	return false
+}
+
+// collectJobs turns loose files, ZIPs and folder uploads of a parsed multipart form into jobs.
+func collectJobs(r *http.Request, opts Options) []Job {
 	jobs := []Job{}
 	usedLabels := map[string]int{}
+	meta := applicantFrom(r)
+	pol := extPolicyFrom(opts)
+	pol.zipPassword = r.FormValue("zip_password")
 
-	for _, fh := range files {
+	splits := newSplitZips()
+	for _, fh := range r.MultipartForm.File["files"] {
 		f, err := fh.Open()
 		if err != nil {
 			continue
 		}
 		b, _ := io.ReadAll(f)
 		f.Close()
-		name := fh.Filename
+		loose := !strings.HasSuffix(strings.ToLower(fh.Filename), ".zip") && splitPart(fh.Filename) == 0
+		jobs = append(jobs, meta.apply(splits.jobs(fh.Filename, b, usedLabels, pol), loose)...)
+	}
+	jobs = append(jobs, meta.apply(splits.incomplete(), false)...)
 
-		if strings.HasSuffix(strings.ToLower(name), ".zip") && ALLOW_ZIP {
-			pairs, err := extractZipToMemory(b)
-			if err != nil {
-				log.Printf("failed unzip %s: %v", name, err)
+	jobs = append(jobs, storedInputJobs(r, usedLabels, pol, meta)...)
+
+	// Folder uploads (webkitdirectory): multipart filenames lose their directories,
+	// so the page sends each file's webkitRelativePath in "folder_paths", same order.
+	folderPaths := r.MultipartForm.Value["folder_paths"]
+	folderStart := len(jobs)
+	for i, fh := range r.MultipartForm.File["folder"] {
+		rel := fh.Filename
+		if i < len(folderPaths) && folderPaths[i] != "" {
+			rel = folderPaths[i]
+		}
+		f, err := fh.Open()
+		if err != nil {
+			continue
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		jobs = append(jobs, jobsFromFolderUpload(rel, b, pol)...)
+	}
+	meta.apply(jobs[folderStart:], false)
+
+	return jobs
+}
+
+// storedInputJobs: inputs already in object storage, referenced by key prefix
+// (input_prefix) or by the exact keys handed out by /upload-url (input_keys).
+func storedInputJobs(r *http.Request, usedLabels map[string]int, pol extPolicy, meta *applicantMeta) []Job {
+	jobs := []Job{}
+	if prefix := r.FormValue("input_prefix"); prefix != "" && store != nil {
+		if err := checkInputPrefix(prefix); err != nil {
+			log.Printf("storage inputs: %v", err)
+			return jobs
+		}
+		more, err := jobsFromStorage(prefix, usedLabels, pol)
+		if err != nil {
+			log.Printf("storage inputs %s: %v", prefix, err)
+		}
+		jobs = append(jobs, meta.apply(more, false)...)
+	}
+	if keys := r.PostForm["input_keys"]; len(keys) > 0 && store != nil {
+		more, err := jobsFromUploadKeys(keys, usedLabels, pol)
+		if err != nil {
+			log.Printf("storage inputs: %v", err)
+		}
+		jobs = append(jobs, meta.apply(more, false)...)
+	}
+	return jobs
+}
+
+// jobsFromFolderUpload turns one file of a folder upload, rel being its
+// webkitRelativePath, into jobs labelled after the top folder.
+func jobsFromFolderUpload(rel string, b []byte, pol extPolicy) []Job {
+	top, rest := splitUploadPath(rel)
+	jobs := []Job{}
+	if pol.hidden(rest) {
+		return jobs
+	}
+	ext := strings.ToLower(filepath.Ext(rest))
+	if ext == ".zip" && ALLOW_ZIP {
+		pairs, err := extractZipToMemory(b, pol.zipPassword)
+		if err != nil {
+			log.Printf("failed unzip %s: %v", rel, err)
+			return append(jobs, Job{Label: top, Rel: rest, Source: path.Join(top, rest), Skip: "unzip error: " + err.Error(), SkipKind: skipOther})
+		}
+		prefix := strings.TrimSuffix(rest, filepath.Ext(rest))
+		for _, p := range pairs {
+			if pol.hidden(p.Rel) {
 				continue
 			}
-			base := strings.TrimSuffix(name, filepath.Ext(name))
-			if base == "" {
-				base = "output"
-			}
-			idx := 1
-			for i := range pairs {
-				rel := pairs[i].Rel
-				if _, ok := IMG_EXT[strings.ToLower(filepath.Ext(rel))]; ok || PDF_EXT[strings.ToLower(filepath.Ext(rel))] {
-					lbl := base
-					if usedLabels[lbl] > 0 {
-						lbl = fmt.Sprintf("%s_%d", base, usedLabels[base]+1)
-					}
-					usedLabels[base]++
-					jobs = append(jobs, Job{Label: lbl, Rel: rel, Data: pairs[i].Data})
+			job := Job{Label: top, Rel: path.Join(prefix, p.Rel), Data: p.Data, Source: path.Join(top, rest, p.From), Skip: p.Skip, SkipKind: p.SkipKind}
+			if why := pol.refuse(p.Rel); why != "" && job.Skip == "" {
+				job.Data, job.Skip, job.SkipKind = nil, why, skipUnsupported
+			}
+			jobs = append(jobs, job)
+		}
+	} else if why := pol.refuse(rest); why == "" {
+		jobs = append(jobs, Job{Label: top, Rel: rest, Data: b, Source: top + "/"})
+	} else {
+		jobs = append(jobs, Job{Label: top, Rel: rest, Source: top + "/", Skip: why, SkipKind: skipUnsupported})
+	}
+	return jobs
+}
+
+// jobsFromUpload expands one uploaded file (loose image/PDF or ZIP) into jobs.
+// usedLabels keeps labels unique across the uploads of one request; pol
+// decides which extensions are taken (exts.go).
+func jobsFromUpload(name string, b []byte, usedLabels map[string]int, pol extPolicy) []Job {
+	jobs := []Job{}
+	if pol.hidden(name) {
+		return jobs
+	}
+	if strings.HasSuffix(strings.ToLower(name), ".zip") && ALLOW_ZIP {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		if base == "" {
+			base = "output"
+		}
+		pairs, err := extractZipToMemory(b, pol.zipPassword)
+		if err != nil {
+			log.Printf("failed unzip %s: %v", name, err)
+			return append(jobs, Job{Label: base, Rel: name, Source: name, Skip: "unzip error: " + err.Error(), SkipKind: skipOther})
+		}
+		idx := 1
+		for i := range pairs {
+			rel := pairs[i].Rel
+			if pol.hidden(rel) {
+				continue
+			}
+			why := pol.refuse(rel)
+			if pairs[i].Skip != "" || why != "" {
+				msg, kind := pairs[i].Skip, pairs[i].SkipKind
+				if msg == "" {
+					msg, kind = why, skipUnsupported
 				}
-				idx++
+				jobs = append(jobs, Job{Label: base, Rel: rel, Source: path.Join(name, pairs[i].From), Skip: msg, SkipKind: kind})
+			} else {
+				lbl := base
+				if usedLabels[lbl] > 0 {
+					lbl = fmt.Sprintf("%s_%d", base, usedLabels[base]+1)
+				}
+				usedLabels[base]++
+				jobs = append(jobs, Job{Label: lbl, Rel: rel, Data: pairs[i].Data, Source: path.Join(name, pairs[i].From)})
+			}
+			idx++
+		}
+	} else {
+		// label after the file itself: "Scan 01 (final).jpg" -> "Scan_01_final"
+		base := safeName(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)))
+		if base == "" {
+			base = "file"
+		}
+		if why := pol.refuse(name); why == "" {
+			lbl := base
+			if usedLabels[base] > 0 {
+				lbl = fmt.Sprintf("%s_%d", base, usedLabels[base]+1)
 			}
+			usedLabels[base]++
+			jobs = append(jobs, Job{Label: lbl, Rel: name, Data: b})
 		} else {
-			ext := strings.ToLower(filepath.Ext(name))
-			if IMG_EXT[ext] || PDF_EXT[ext] {
-				base := fmt.Sprintf("compressed_pict_%d", time.Now().Unix())
-				jobs = append(jobs, Job{Label: base, Rel: name, Data: b})
+			jobs = append(jobs, Job{Label: base, Rel: name, Skip: why, SkipKind: skipUnsupported})
+		}
+	}
+	return jobs
+}
+
+// runJobs processes jobs concurrently into a master ZIP stored under a new token
+// and returns its manifest.
+// It fails with errStoreFull when the result quota has no room left, and
+// with startJob's errors for a bad client-supplied jobID.
+func runJobs(jobs []Job, opts Options, jobID string) (resultManifest, []galleryItem, error) {
+	if err := checkResultRoom(); err != nil {
+		return resultManifest{}, nil, err
+	}
+	progress, err := startJob(jobID, jobs)
+	if err != nil {
+		return resultManifest{}, nil, err
+	}
+	report := newJobReport(progress.ID)
+	build := buildMasterZip
+	if JOB_ISOLATION {
+		build = buildMasterZipIsolated
+	}
+	result, gallery, err := build(jobs, opts, progress.ID)
+	return storeJobResult(progress, report, result, gallery, err)
+}
+
+// errNoWork: a streamed upload turned out to hold nothing to compress.
+var errNoWork = errors.New("no valid files")
+
+// runJobStream is runJobs for jobs that become known while the build runs:
+// produce calls add as inputs arrive (a streamed upload, see stream.go) and
+// the workers start on them right away. An error from produce, or no job
+// with work at all (errNoWork), discards the result. Not for JOB_ISOLATION.
+func runJobStream(produce func(add func([]Job)) error, opts Options, jobID string) (resultManifest, []galleryItem, error) {
+	if err := checkResultRoom(); err != nil {
+		return resultManifest{}, nil, err
+	}
+	progress, err := startJob(jobID, nil)
+	if err != nil {
+		return resultManifest{}, nil, err
+	}
+	report := newJobReport(progress.ID)
+	feed := make(chan Job)
+	type built struct {
+		result  resultZip
+		gallery []galleryItem
+		err     error
+	}
+	done := make(chan built, 1)
+	go func() {
+		result, gallery, err := buildMasterZipFrom(feed, 0, opts, progress.ID)
+		done <- built{result, gallery, err}
+	}()
+	work := false
+	err = produce(func(jobs []Job) {
+		addJobs(progress.ID, jobs)
+		work = work || hasWork(jobs)
+		for _, j := range jobs {
+			feed <- j
+		}
+	})
+	close(feed)
+	b := <-done
+	if err == nil && !work {
+		err = errNoWork
+	}
+	if err != nil && b.err == nil {
+		b.result.remove()
+	} else if err == nil {
+		err = b.err
+	}
+	return storeJobResult(progress, report, b.result, b.gallery, err)
+}
+
+// storeJobResult keeps a finished build under a new token (and in the object
+// storage) and returns the job's manifest; with err set it only closes the job.
+func storeJobResult(progress *jobProgress, report *jobReport, result resultZip, gallery []galleryItem, err error) (resultManifest, []galleryItem, error) {
+	if err != nil {
+		report.finish()
+		publish(jobEvent{Type: evJobDone, Job: progress.ID, Error: err.Error()})
+		return resultManifest{}, nil, err
+	}
+
+	// store zip in memory with token
+	token := newToken("t")
+	if err := reserveResult(token, result.size); err != nil {
+		result.remove()
+		report.finish()
+		publish(jobEvent{Type: evJobDone, Job: progress.ID, Error: err.Error()})
+		return resultManifest{}, nil, err
+	}
+	memZips.Lock()
+	memZips.m[token] = result
+	memZips.Unlock()
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+		key := RESULTS_PREFIX + token + ".zip"
+		var err error
+		if DEDUP_OUTPUTS {
+			key, err = putDedup(ctx, token, result)
+		} else {
+			// the blob backends take whole objects
+			var zipData []byte
+			if zipData, err = result.bytes(); err == nil {
+				err = store.Put(ctx, key, zipData)
 			}
 		}
+		if err != nil {
+			log.Printf("storage put %s: %v", token, err)
+		} else {
+			saveResultMeta(resultMeta{Token: token, Key: key, Size: int(result.size), JobID: progress.ID, Created: time.Now()})
+		}
+		cancel()
 	}
+	manifest := report.finish()
+	manifest.Token, manifest.Download = token, BASE_PATH+"/download/"+token
+	if exp, ok := resultExpiry(token); ok {
+		manifest.Expires = &exp
+	}
+	publish(jobEvent{Type: evJobDone, Job: progress.ID, Token: token})
+	return manifest, gallery, nil
+}
 
-	if len(jobs) == 0 {
-		tplIndex.Execute(w, map[string]interface{}{"Message": "Tidak ada berkas valid (butuh gambar/PDF, atau ZIP berisi file-file tersebut)."})
-		return
+// buildMasterZip compresses jobs with THREADS workers and returns the master
+// ZIP and the sorted gallery. It publishes job_started and the file events of
+// jobID; job_done is left to the caller.
+func buildMasterZip(jobs []Job, opts Options, jobID string) (resultZip, []galleryItem, error) {
+	feed := make(chan Job, len(jobs))
+	for _, j := range jobs {
+		feed <- j
 	}
+	close(feed)
+	return buildMasterZipFrom(feed, len(jobs), opts, jobID)
+}
 
-	// create master zip in-memory
-	buf := &bytes.Buffer{}
-	zw := zip.NewWriter(buf)
-	summaryLines := []string{}
-	skippedAll := map[string][]string{}
-	sem := make(chan struct{}, THREADS)
+// buildMasterZipFrom is buildMasterZip for jobs read from a channel until it is
+// closed; files is the number announced in job_started (0 when unknown).
+func buildMasterZipFrom(jobs <-chan Job, files int, opts Options, jobID string) (resultZip, []galleryItem, error) {
+	publish(jobEvent{Type: evJobStarted, Job: jobID, Files: files})
+
+	// create master zip in the spool
+	archive := newMasterArchive(jobID)
+	defer archive.discard()
+	gallery := []galleryItem{}
+	sheet := []sheetEntry{}
+	sem := make(chan struct{}, live().THREADS)
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
+	flat := newFlatNamer(opts.Flatten)
 
-	for _, job := range jobs {
+	for job := range jobs {
+		waitForMemory(func() int { return len(sem) })
+		// named here, in arrival order, so the same upload flattens the same way
+		rel := job.Rel
+		if job.Skip == "" {
+			rel = flat.name(job.Label, job.Rel)
+		}
 		wg.Add(1)
 		sem <- struct{}{}
-		go func(job Job) {
+		go func(job Job, rel string) {
 			defer wg.Done()
 			label := job.Label
 			lblFolder := label + "_compressed"
-			// write folder entry
-			mu.Lock()
-			zw.Create(lblFolder + "/")
-			mu.Unlock()
-
-			labelKey, processed, skipped, outs := processOneFileEntry(job.Rel, job.Data, label, cfg)
-			for _, s := range processed {
-				summaryLines = append(summaryLines, fmt.Sprintf("%s: %s", labelKey, s))
+			if job.Skip == "" && len(job.Data) < opts.IgnoreBelowKB<<10 {
+				publish(jobEvent{Type: evFileSkipped, Job: jobID, File: job.Rel, Label: label, Source: job.Source,
+					InBytes: len(job.Data), Ignored: true})
+				<-sem
+				return
+			}
+			if job.Skip == "" && len(job.Data) == 0 {
+				job.Skip, job.SkipKind = "placeholder: empty file (0 bytes)", skipPlaceholder
+			}
+			if job.Skip != "" {
+				publish(jobEvent{Type: evFileSkipped, Job: jobID, File: job.Rel, Label: label, Source: job.Source,
+					Skipped: []string{job.Rel + ": " + job.Skip}, SkipKinds: []skipKind{job.SkipKind}})
+				<-sem
+				return
+			}
+			publish(jobEvent{Type: evFileStarted, Job: jobID, File: job.Rel, Label: label, Source: job.Source, InBytes: len(job.Data)})
+			started := time.Now()
+			labelKey, processed, skipped, outs := processOneFileEntry(rel, job.Data, label, opts)
+			if len(processed) == 0 {
+				skipped = placeholderSkips(rel, len(job.Data), skipped)
+			}
+			outBytes := 0
+			paths := []string{}
+			files := map[string][]byte{}
+			for rel, data := range outs {
+				if !strings.HasPrefix(rel, "thumbs/") {
+					outBytes += len(data)
+					paths = append(paths, filepath.Join(lblFolder, rel))
+					files[filepath.Join(lblFolder, rel)] = data
+				}
 			}
-			if len(skipped) > 0 {
-				skippedAll[labelKey] = append(skippedAll[labelKey], skipped...)
+			sort.Strings(paths)
+			done := jobEvent{Type: evFileDone, Job: jobID, File: job.Rel, Label: labelKey, Source: job.Source,
+				Lines: outputLines(processed), Records: processed, Paths: paths, Skipped: skipMessages(skipped), SkipKinds: skipKinds(skipped), InBytes: len(job.Data), OutBytes: outBytes, Seconds: time.Since(started).Seconds()}
+			if rel != job.Rel {
+				done.Flat = rel
 			}
+			done.outputs = files
+			if len(processed) == 0 {
+				done.Type = evFileSkipped
+			}
+			publish(done)
 			// write outputs to zip
 			mu.Lock()
 			for rel, data := range outs {
-				fpath := filepath.Join(lblFolder, rel)
-				fw, _ := zw.Create(fpath)
-				fw.Write(data)
+				isThumb := strings.HasPrefix(rel, "thumbs/")
+				if isThumb && opts.ContactSheet {
+					mainRel, size := mainOutput(outs, rel)
+					sheet = append(sheet, sheetEntry{Name: filepath.Join(lblFolder, mainRel), SizeB: size, Thumb: data})
+				}
+				if isThumb && !opts.Thumbs {
+					continue
+				}
+				archive.Add(filepath.Join(lblFolder, rel), data)
+				if isThumb && len(gallery) < MAX_GALLERY_ITEMS {
+					gallery = append(gallery, galleryItem{
+						Name: filepath.Join(lblFolder, strings.TrimPrefix(rel, "thumbs/")),
+						Src:  template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data)),
+					})
+				}
 			}
 			mu.Unlock()
 			<-sem
-		}(job)
+		}(job, rel)
 	}
 	wg.Wait()
-	zw.Close()
-
-	// store zip in memory with token
-	token := fmt.Sprintf("t%d", time.Now().UnixNano())
-	memZips.Lock()
-	memZips.m[token] = buf.Bytes()
-	memZips.Unlock()
-
-	summaryText := strings.Join(summaryLines, "\n")
-	// show result page
-	tplIndex.Execute(w, map[string]interface{}{"Summary": summaryText, "Token": token})
+	if len(sheet) > 0 {
+		sort.Slice(sheet, func(i, j int) bool { return sheet[i].Name < sheet[j].Name })
+		pages, err := buildContactSheets(sheet)
+		if err != nil {
+			log.Printf("contact sheet: %v", err)
+		}
+		for i, page := range pages {
+			archive.Add(fmt.Sprintf("contact_sheet_%d.jpg", i+1), page)
+		}
+	}
+	result, err := archive.finish()
+	if err != nil {
+		return resultZip{}, nil, err
+	}
+	sort.Slice(gallery, func(i, j int) bool { return gallery[i].Name < gallery[j].Name })
+	return result, gallery, nil
 }
 
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	tok := strings.TrimPrefix(r.URL.Path, "/download/")
+	tok, entry, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+	if entry != "" {
+		downloadEntry(w, r, tok, entry)
+		return
+	}
 	memZips.RLock()
-	data, ok := memZips.m[tok]
+	result, ok := memZips.m[tok]
 	memZips.RUnlock()
+	touchResult(tok)
+	if ok {
+		f, err := result.open()
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=compressed.zip")
+		if exp, ok := resultExpiry(tok); ok {
+			w.Header().Set("Expires", exp.UTC().Format(http.TimeFormat))
+		}
+		http.ServeContent(w, r, "", time.Time{}, f)
+		return
+	}
+	if store == nil && proxyToOwner(w, r, tok) {
+		return
+	}
+	var data []byte
+	if store != nil {
+		key, err := resultKey(r.Context(), tok)
+		if err == errNoResult {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if strings.HasSuffix(key, ".json") {
+			serveDedupZip(w, r, key)
+			return
+		}
+		if u, err := store.SignedURL(key, SIGNED_URL_TTL); err == nil {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+		if b, err := store.Get(ctx, key); err == nil {
+			data, ok = b, true
+		}
+		cancel()
+	}
 	if !ok {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -646,22 +1782,292 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func main() {
-	// check env overrides
+// resultKey is the storage key of a result: its ZIP, or its manifest with
+// DEDUP_OUTPUTS; Redis knows the key when it is shared between replicas.
+func resultKey(ctx context.Context, tok string) (string, error) {
+	if redisClient != nil {
+		meta, err := loadResultMeta(ctx, tok)
+		if err != nil {
+			return "", err
+		}
+		return meta.Key, nil
+	}
+	if DEDUP_OUTPUTS {
+		return manifestKey(tok), nil
+	}
+	return RESULTS_PREFIX + tok + ".zip", nil
+}
+
+// downloadEntry serves one file of a result, /download/{token}/{path in the ZIP},
+// so a single output can be fetched without the whole archive.
+func downloadEntry(w http.ResponseWriter, r *http.Request, tok, name string) {
+	memZips.RLock()
+	result, ok := memZips.m[tok]
+	memZips.RUnlock()
+	if !ok && store == nil && proxyToOwner(w, r, tok) {
+		return
+	}
+	touchResult(tok)
+	var data []byte
+	err := errNoResult
+	switch {
+	case strings.HasSuffix(name, "/"):
+	case ok:
+		var f zipFile
+		if f, err = result.open(); err == nil {
+			data, err = readZipEntry(f, result.size, name)
+			f.Close()
+		}
+	case store != nil:
+		ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+		defer cancel()
+		var key string
+		if key, err = resultKey(ctx, tok); err != nil {
+			break
+		}
+		if strings.HasSuffix(key, ".json") {
+			var entries []manifestEntry
+			if entries, err = loadManifest(ctx, key); err != nil {
+				break
+			}
+			err = errNoResult
+			for _, e := range entries {
+				if e.Name == name && e.Hash != "" {
+					data, err = store.Get(ctx, CAS_PREFIX+e.Hash)
+				}
+			}
+			break
+		}
+		var b []byte
+		if b, err = store.Get(ctx, key); err == nil {
+			data, err = readZipEntry(bytes.NewReader(b), int64(len(b)), name)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	ct := mime.TypeByExtension(extLower(name))
+	if ct == "" {
+		ct = http.DetectContentType(data)
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	if exp, ok := resultExpiry(tok); ok {
+		w.Header().Set("Expires", exp.UTC().Format(http.TimeFormat))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// readZipEntry reads the file called name from a ZIP; errNoResult when absent.
+func readZipEntry(ra io.ReaderAt, size int64, name string) ([]byte, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, errNoResult
+}
+
+// setupProcessing applies the env overrides of the compression settings.
+func setupProcessing() {
+	updateLive(processingSettings)
+	setupSpool()
+}
+
+// processingSettings reads the settings a reload can change into c.
+func processingSettings(c *liveConfig) error {
+	d := liveDefaults
+	c.SPEED_PRESET, c.THREADS = d.SPEED_PRESET, d.THREADS
+	c.MAX_ENTRY_BYTES, c.MAX_ZIP_BYTES, c.MAX_ZIP_FILES, c.MAX_ZIP_DEPTH = d.MAX_ENTRY_BYTES, d.MAX_ZIP_BYTES, d.MAX_ZIP_FILES, d.MAX_ZIP_DEPTH
+	c.GIF_MAX_FRAMES, c.MAX_PIXELS = d.GIF_MAX_FRAMES, d.MAX_PIXELS
 	if v := os.Getenv("SPEED_PRESET"); v != "" {
-		SPEED_PRESET = v
+		c.SPEED_PRESET = v
 	}
 	if v := os.Getenv("THREADS"); v != "" {
 		if t, err := strconv.Atoi(v); err == nil {
-			THREADS = t
+			c.THREADS = t
 		}
 	}
+	if v := os.Getenv("MAX_ENTRY_MB"); v != "" {
+		if mb, err := strconv.Atoi(v); err == nil && mb > 0 {
+			c.MAX_ENTRY_BYTES = int64(mb) << 20
+		}
+	}
+	if mb, err := strconv.Atoi(os.Getenv("MAX_ZIP_TOTAL_MB")); err == nil && mb > 0 {
+		c.MAX_ZIP_BYTES = int64(mb) << 20
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_ZIP_FILES")); err == nil && n > 0 {
+		c.MAX_ZIP_FILES = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_ZIP_DEPTH")); err == nil && n > 0 {
+		c.MAX_ZIP_DEPTH = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("GIF_MAX_FRAMES")); err == nil && n > 0 {
+		c.GIF_MAX_FRAMES = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_PIXELS")); err == nil && n > 0 {
+		c.MAX_PIXELS = n
+	}
+	c.ZIP_STRICT = os.Getenv("ZIP_STRICT") == "1"
+	return nil
+}
+
+// setupDecoders prepares everything that turns input files into images.
+func setupDecoders() error {
+	setupSandbox()
+	if err := setupPDFRenderer(); err != nil {
+		return fmt.Errorf("pdf: %w", err)
+	}
+	setupPageKinds()
+	setupJXL()
+	setupJPEGEncoder()
+	setupHEIF()
+	if err := setupExternalDecoder(); err != nil {
+		return fmt.Errorf("external decoder: %w", err)
+	}
+	if err := setupExtensions(); err != nil {
+		return fmt.Errorf("extensions: %w", err)
+	}
+	return nil
+}
+
+func main() {
+	if err := loadConfigFile(); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if v := os.Getenv("JPEGTRAN"); v != "" {
+		JPEGTRAN = v
+	}
+	if len(os.Args) > 1 {
+		c, ok := findCommand(os.Args[1])
+		if os.Args[1] == "-h" || os.Args[1] == "--help" {
+			c, ok = findCommand("help")
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+			printCLIHelp()
+			os.Exit(2)
+		}
+		runCommand(c, os.Args[2:])
+		return
+	}
+	if runAsService(runServer) {
+		return
+	}
+	runServer()
+}
+
+// runServer starts the web server; it returns only when the process exits.
+func runServer() {
+	addr := ":8080"
+	if needsSetup() {
+		runSetupWizard(addr)
+		if err := loadConfigFile(); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+	}
+
+	setupProcessing()
+	removeStaleResults()
+	setupExpiry()
+
+	if v := os.Getenv("HISTORY_DB"); v != "" {
+		HISTORY_DB = v
+	}
+	openHistory(HISTORY_DB)
+	if err := setupStorage(); err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+	if err := setupRedis(); err != nil {
+		log.Fatalf("redis: %v", err)
+	}
+	if err := setupReplicas(); err != nil {
+		log.Fatalf("replicas: %v", err)
+	}
+	if err := setupDedup(); err != nil {
+		log.Fatalf("dedup: %v", err)
+	}
+	if err := setupQuota(); err != nil {
+		log.Fatalf("quota: %v", err)
+	}
+	setupBackpressure()
+	if err := setupIsolation(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupDecoders(); err != nil {
+		log.Fatal(err)
+	}
+	setupPDFCheck()
+	setupEvents()
+	if err := setupQueue(); err != nil {
+		log.Fatalf("event queue: %v", err)
+	}
+	setupCORS()
+	setupExtension()
+	setupDocTypes()
+	setupSession()
+	setupShares()
+	setupAdmin()
+	if err := setupProxy(); err != nil {
+		log.Fatalf("proxy: %v", err)
+	}
+	if err := setupAuth(); err != nil {
+		log.Fatalf("oidc: %v", err)
+	}
+	if err := setupTLS(); err != nil {
+		log.Fatalf("tls: %v", err)
+	}
+	setupNotifiers()
+	setupReload()
+	if mc, ok := mailConfigFromEnv(); ok {
+		go runMailPoller(mc)
+	}
 
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/process", processHandler)
+	http.HandleFunc("/api/v1/compress", apiCompressHandler)
+	http.HandleFunc("/api/v1/analyze", apiAnalyzeHandler)
+	http.HandleFunc(extensionPath+"compress", extensionCompressHandler)
 	http.HandleFunc("/download/", downloadHandler)
+	http.HandleFunc("/check", checkHandler)
+	http.HandleFunc("/compare", compareHandler)
+	http.HandleFunc("/inspect", inspectHandler)
+	http.HandleFunc("/confirm", confirmHandler)
+	http.HandleFunc("/jobs/", jobStatusHandler)
+	http.HandleFunc("/events/", eventsHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/upload-url", uploadURLHandler)
+	http.HandleFunc("/diff", diffHandler)
+	http.HandleFunc("/rotate", rotateHandler)
+	http.HandleFunc("/share", shareHandler)
+	http.HandleFunc("/s/", shareDownloadHandler)
+	http.HandleFunc("/admin", adminHandler)
+	http.HandleFunc("/admin/delete", adminDeleteHandler)
+	http.HandleFunc("/cleanup", cleanupHandler)
+	http.HandleFunc("/admin/maintenance", maintenanceHandler)
+	http.HandleFunc("/admin/config", configHandler)
+	http.HandleFunc("/auth/login", loginHandler)
+	http.HandleFunc("/auth/callback", callbackHandler)
+	http.HandleFunc("/auth/logout", logoutHandler)
+	http.HandleFunc("/prefs", prefsHandler)
+	http.HandleFunc("/capabilities", capabilitiesHandler)
+	http.HandleFunc("/metrics", metricsHandler)
 
-	addr := ":8080"
-	log.Printf("Server listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Printf("Server listening on %s%s/", addr, BASE_PATH)
+	handler := withProxy(withCORS(withAuth(http.DefaultServeMux)))
+	if TLS_CERT != "" {
+		log.Fatal(http.ListenAndServeTLS(addr, TLS_CERT, TLS_KEY, handler))
+	}
+	log.Fatal(http.ListenAndServe(addr, handler))
 }
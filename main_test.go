@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// setLive applies change to the live settings for the rest of the test.
+func setLive(t *testing.T, change func(c *liveConfig)) {
+	t.Helper()
+	prev := liveCfg.Load()
+	t.Cleanup(func() { liveCfg.Store(prev) })
+	c := *live()
+	change(&c)
+	liveCfg.Store(&c)
+}
+
+type testZipFile struct {
+	name string
+	data []byte
+}
+
+// makeZip builds a ZIP the way archive/zip writes it: deflated entries with
+// data descriptors.
+func makeZip(t *testing.T, files ...testZipFile) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func entryNames(entries []zipEntry) []string {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Rel)
+	}
+	return names
+}
+
+func TestExtractZipFileLimit(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.MAX_ZIP_FILES = 2 })
+	b := makeZip(t, testZipFile{"a.jpg", []byte("a")}, testZipFile{"b.jpg", []byte("b")}, testZipFile{"c.jpg", []byte("c")})
+	if _, err := extractZipToMemory(b, ""); !errors.Is(err, errZipLimit) {
+		t.Fatalf("got error %v, want errZipLimit", err)
+	}
+}
+
+func TestExtractZipTotalLimit(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.MAX_ZIP_BYTES = 1000 })
+	// zeros deflate to almost nothing: only the inflated size counts
+	b := makeZip(t, testZipFile{"a.jpg", make([]byte, 600)}, testZipFile{"b.jpg", make([]byte, 600)})
+	if _, err := extractZipToMemory(b, ""); !errors.Is(err, errZipLimit) {
+		t.Fatalf("got error %v, want errZipLimit", err)
+	}
+}
+
+func TestExtractZipSkipsLargeEntry(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.MAX_ENTRY_BYTES = 100 })
+	b := makeZip(t, testZipFile{"big.jpg", make([]byte, 200)}, testZipFile{"small.jpg", []byte("small")})
+	entries, err := extractZipToMemory(b, "")
+	if err != nil {
+		t.Fatalf("extractZipToMemory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got entries %v, want big.jpg and small.jpg", entryNames(entries))
+	}
+	if entries[0].SkipKind != skipTooLarge || entries[0].Data != nil {
+		t.Errorf("big.jpg: got skip %q with %d bytes, want it skipped unread", entries[0].Skip, len(entries[0].Data))
+	}
+	if entries[1].Skip != "" || string(entries[1].Data) != "small" {
+		t.Errorf("small.jpg: got skip %q, data %q", entries[1].Skip, entries[1].Data)
+	}
+}
+
+func TestExtractZipNestedDepth(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.MAX_ZIP_DEPTH = 2 })
+	deepest := makeZip(t, testZipFile{"c.jpg", []byte("c")})
+	inner := makeZip(t, testZipFile{"b.jpg", []byte("b")}, testZipFile{"deeper.zip", deepest})
+	b := makeZip(t, testZipFile{"a.jpg", []byte("a")}, testZipFile{"inner.zip", inner})
+	entries, err := extractZipToMemory(b, "")
+	if err != nil {
+		t.Fatalf("extractZipToMemory: %v", err)
+	}
+	want := []string{"a.jpg", "inner/b.jpg", "inner/deeper.zip"}
+	if got := entryNames(entries); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got entries %v, want %v", got, want)
+	}
+	if entries[1].From != "inner.zip" || string(entries[1].Data) != "b" {
+		t.Errorf("inner/b.jpg: got from %q, data %q", entries[1].From, entries[1].Data)
+	}
+	if !strings.Contains(entries[2].Skip, "MAX_ZIP_DEPTH") {
+		t.Errorf("inner/deeper.zip: got skip %q, want the depth limit", entries[2].Skip)
+	}
+}
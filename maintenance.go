@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Maintenance mode =====
+// An admin switch for safe upgrades: while it is on this replica takes no new
+// jobs (/process, /inspect, /confirm and the API answer 503 with a friendly
+// page or JSON, the mail gateway stops polling), but running jobs finish and
+// results, downloads and shares keep working. The admin page shows how many
+// jobs are still running; restart once it reaches 0. The switch is not kept
+// across restarts.
+//
+//	curl -u admin:secret -d on=1 -d message='Kembali pukul 14.00' .../admin/maintenance
+//	curl -u admin:secret -H 'Accept: application/json' .../admin/maintenance   (active_jobs)
+
+// MAINTENANCE_RETRY is the Retry-After sent while in maintenance, in seconds.
+var MAINTENANCE_RETRY = 300
+
+var maintenance = struct {
+	sync.Mutex
+	on      bool
+	since   time.Time
+	message string
+}{}
+
+const defaultMaintenanceMessage = "Layanan sedang dalam pemeliharaan. Pekerjaan yang sedang berjalan tetap diselesaikan dan hasil tetap bisa diunduh; silakan coba lagi sebentar lagi."
+
+// maintenanceNotice is the text shown to users, "" when not in maintenance.
+func maintenanceNotice() string {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	switch {
+	case !maintenance.on:
+		return ""
+	case maintenance.message != "":
+		return maintenance.message
+	}
+	return defaultMaintenanceMessage
+}
+
+func setMaintenance(on bool, message string) {
+	maintenance.Lock()
+	if on && !maintenance.on {
+		maintenance.since = time.Now()
+	}
+	maintenance.on, maintenance.message = on, message
+	maintenance.Unlock()
+}
+
+// activeJobs counts the jobs still running on this replica.
+func activeJobs() int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	n := 0
+	for _, p := range jobsRunning {
+		if p.State == "running" {
+			n++
+		}
+	}
+	return n
+}
+
+// maintenanceHandler: GET reports the state, POST on=1|0 (message=...) switches it.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		on := r.FormValue("on") == "1"
+		setMaintenance(on, strings.TrimSpace(r.FormValue("message")))
+		log.Printf("admin: %s turned maintenance mode %s", clientIP(r), map[bool]string{true: "on", false: "off"}[on])
+	}
+	maintenance.Lock()
+	on, since, message := maintenance.on, maintenance.since, maintenance.message
+	maintenance.Unlock()
+	if wantsJSON(r) {
+		state := map[string]interface{}{"maintenance": on, "active_jobs": activeJobs()}
+		if on {
+			state["since"], state["message"] = since, message
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+		return
+	}
+	msg := "Mode pemeliharaan dimatikan; pekerjaan baru diterima lagi."
+	if on {
+		msg = "Mode pemeliharaan aktif: pekerjaan baru ditolak, yang berjalan tetap diselesaikan."
+	}
+	http.Redirect(w, r, BASE_PATH+"/admin?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/adityafaths/multicompressgo/compress"
+)
+
+// ===== JPEG encoder =====
+// image/jpeg always writes baseline 4:2:0. With mozjpeg's cjpeg installed a
+// request can ask for more: jpeg_encoder=mozjpeg (smaller files at the same
+// quality), progressive=on and subsampling=444 (sharp colour edges, e.g. red
+// stamps on scans) or 420. progressive and subsampling pick mozjpeg unless
+// jpeg_encoder says otherwise. JPEG_ENCODER sets the default for requests
+// that say nothing; without cjpeg only std is offered.
+//
+//	CJPEG=/opt/mozjpeg/bin/cjpeg JPEG_ENCODER=mozjpeg
+
+var (
+	CJPEG        = "cjpeg"
+	JPEG_ENCODER = "std"
+
+	cjpegFound bool
+)
+
+var jpegSubsamplings = map[string]string{"420": "2x2", "444": "1x1"}
+
+// mozjpegModel keeps the quality predictions for mozjpeg apart: its file
+// sizes at a given quality differ from image/jpeg's.
+var mozjpegModel = compress.NewQualityModel()
+
+func setupJPEGEncoder() {
+	if v := os.Getenv("CJPEG"); v != "" {
+		CJPEG = v
+	}
+	_, err := exec.LookPath(CJPEG)
+	cjpegFound = err == nil
+	JPEG_ENCODER = "std"
+	if v := os.Getenv("JPEG_ENCODER"); v == "mozjpeg" && cjpegFound {
+		JPEG_ENCODER = v
+	}
+}
+
+// jpegEncoders lists the encoders this server offers.
+func jpegEncoders() []string {
+	if cjpegFound {
+		return []string{"std", "mozjpeg"}
+	}
+	return []string{"std"}
+}
+
+// parseJPEGEncoder validates the encoder settings of o.
+func parseJPEGEncoder(o *Options) error {
+	switch o.JPEGEncoder {
+	case "", "std", "mozjpeg":
+	default:
+		return fieldError{"jpeg_encoder", fmt.Errorf("unknown jpeg_encoder %q (%s)", o.JPEGEncoder, strings.Join(jpegEncoders(), ", "))}
+	}
+	if _, ok := jpegSubsamplings[o.Subsampling]; !ok && o.Subsampling != "" {
+		return fieldError{"subsampling", fmt.Errorf("subsampling must be 420 or 444, got %q", o.Subsampling)}
+	}
+	switch {
+	case o.JPEGEncoder == "std" && (o.Progressive || o.Subsampling == "444"):
+		return fieldError{"jpeg_encoder", fmt.Errorf("the std encoder writes baseline 4:2:0 only; use mozjpeg for progressive or 444")}
+	case jpegEncoderName(*o) == "mozjpeg" && !cjpegFound:
+		return fieldError{"jpeg_encoder", fmt.Errorf("mozjpeg (for jpeg_encoder, progressive or subsampling) needs cjpeg, not installed here")}
+	}
+	return nil
+}
+
+// jpegEncoderName resolves the encoder a request gets: its own choice, else
+// mozjpeg when it asks for progressive or subsampling, else JPEG_ENCODER.
+func jpegEncoderName(o Options) string {
+	switch {
+	case o.JPEGEncoder != "":
+		return o.JPEGEncoder
+	case o.Progressive || o.Subsampling != "":
+		return "mozjpeg"
+	}
+	return JPEG_ENCODER
+}
+
+// jpegEncoderFor is the encoder and quality model a job's JPEGs are written with.
+func jpegEncoderFor(opts Options) (compress.Encoder, *compress.QualityModel) {
+	if jpegEncoderName(opts) != "mozjpeg" || !cjpegFound {
+		return compress.StdEncoder{}, compress.DefaultModel
+	}
+	return cjpegEncoder{progressive: opts.Progressive, sample: jpegSubsamplings[opts.Subsampling]}, mozjpegModel
+}
+
+// cjpegEncoder pipes the image to cjpeg as PPM (PGM for grayscale).
+type cjpegEncoder struct {
+	progressive bool
+	sample      string // cjpeg -sample, "" for its default
+}
+
+func (e cjpegEncoder) Encode(img image.Image, quality int) ([]byte, error) {
+	args := []string{"-quality", strconv.Itoa(quality), "-optimize"}
+	if e.progressive {
+		args = append(args, "-progressive")
+	} else {
+		args = append(args, "-baseline") // mozjpeg writes progressive by default
+	}
+	if e.sample != "" {
+		args = append(args, "-sample", e.sample)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, CJPEG, args...)
+	cmd.Stdin = bytes.NewReader(netpbm(img))
+	out, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", filepath.Base(CJPEG), err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", filepath.Base(CJPEG), err)
+	}
+	return out.Bytes(), nil
+}
+
+// netpbm writes img as binary PGM when it is grayscale, PPM otherwise. The
+// callers flatten transparency first, so alpha is dropped.
+func netpbm(img image.Image) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	buf := &bytes.Buffer{}
+	bw := bufio.NewWriter(buf)
+	if g, ok := img.(*image.Gray); ok {
+		fmt.Fprintf(bw, "P5\n%d %d\n255\n", w, h)
+		for y := 0; y < h; y++ {
+			bw.Write(g.Pix[y*g.Stride : y*g.Stride+w])
+		}
+		bw.Flush()
+		return buf.Bytes()
+	}
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", w, h)
+	if n, ok := img.(*image.NRGBA); ok { // what the resizes produce
+		for y := 0; y < h; y++ {
+			row := n.Pix[y*n.Stride : y*n.Stride+4*w]
+			for x := 0; x < 4*w; x += 4 {
+				bw.Write(row[x : x+3])
+			}
+		}
+		bw.Flush()
+		return buf.Bytes()
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			bw.Write([]byte{c.R, c.G, c.B})
+		}
+	}
+	bw.Flush()
+	return buf.Bytes()
+}
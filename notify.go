@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ===== Job completion notifications =====
+// Configured via env: SLACK_WEBHOOK_URL, TELEGRAM_BOT_TOKEN + TELEGRAM_CHAT_ID.
+// PUBLIC_BASE_URL (e.g. https://compress.example.com) makes the download link absolute.
+
+type notifier interface {
+	Notify(text string) error
+}
+
+var (
+	notifiers       []notifier
+	PUBLIC_BASE_URL = ""
+	notifyClient    = &http.Client{Timeout: 10 * time.Second}
+)
+
+type slackNotifier struct{ webhook string }
+
+func (s slackNotifier) Notify(text string) error {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	return postNotification(s.webhook, "application/json", bytes.NewReader(body))
+}
+
+type telegramNotifier struct{ token, chatID string }
+
+func (t telegramNotifier) Notify(text string) error {
+	form := url.Values{"chat_id": {t.chatID}, "text": {text}, "disable_web_page_preview": {"true"}}
+	endpoint := "https://api.telegram.org/bot" + t.token + "/sendMessage"
+	return postNotification(endpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
+
+func postNotification(endpoint, contentType string, body io.Reader) error {
+	resp, err := notifyClient.Post(endpoint, contentType, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func setupNotifiers() {
+	PUBLIC_BASE_URL = os.Getenv("PUBLIC_BASE_URL")
+	if v := os.Getenv("SLACK_WEBHOOK_URL"); v != "" {
+		notifiers = append(notifiers, slackNotifier{webhook: v})
+	}
+	if tok, chat := os.Getenv("TELEGRAM_BOT_TOKEN"), os.Getenv("TELEGRAM_CHAT_ID"); tok != "" && chat != "" {
+		notifiers = append(notifiers, telegramNotifier{token: tok, chatID: chat})
+	}
+}
+
+// notifyOnDone announces finished jobs that produced a download.
+func notifyOnDone(ev jobEvent) {
+	if ev.Type != evJobDone || ev.Token == "" {
+		return
+	}
+	if p, ok := jobSnapshot(ev.Job); ok {
+		notifyJobDone(p, ev.Token)
+	}
+}
+
+// notifyJobDone posts a summary to every configured backend without blocking the request.
+func notifyJobDone(p jobProgress, token string) {
+	if len(notifiers) == 0 {
+		return
+	}
+	text := fmt.Sprintf("✅ Job %s selesai dalam %s: %d diproses, %d dilewati.\nDownload: %s/download/%s",
+		p.ID, p.Finished.Sub(p.Started).Round(time.Second), p.Done-p.Skipped, p.Skipped, PUBLIC_BASE_URL, token)
+	for _, n := range notifiers {
+		go func(n notifier) {
+			if err := n.Notify(text); err != nil {
+				log.Printf("notify %T: %v", n, err)
+			}
+		}(n)
+	}
+}
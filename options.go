@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ===== Job options =====
+// Options are one job's settings, parsed once from the form (or a mail
+// subject) with defaults filled in and every value range-checked. A bad value
+// is an error naming the field, never a silent zero.
+
+type Options struct {
+	Speed         string  `json:"speed"`
+	Preset        string  `json:"preset,omitempty"`
+	MinKB         int     `json:"min_kb"`
+	MaxKB         int     `json:"max_kb"`
+	MinSide       int     `json:"min_side"`
+	MaxSide       int     `json:"max_side,omitempty"` // long side cap of the default target (the whatsapp preset)
+	ScaleMin      float64 `json:"scale_min"`
+	UpscaleMax    float64 `json:"upscale_max"`
+	Sharpen       bool    `json:"sharpen"`
+	SharpenAmount float64 `json:"sharpen_amount"`
+	MinQuality    int     `json:"min_quality"`
+	WAGuard       bool    `json:"wa_guard,omitempty"`
+	Targets       string  `json:"targets,omitempty"`
+	Thumbs        bool    `json:"thumbs"`
+	ContactSheet  bool    `json:"contact_sheet"`
+	GIFFrame      string  `json:"gif_frame,omitempty"`
+	AllowExt      string  `json:"allow_ext,omitempty"`
+	DenyExt       string  `json:"deny_ext,omitempty"`
+	IgnoreBelowKB int     `json:"ignore_below_kb,omitempty"` // inputs smaller than this are left out, not reported
+	KeepHidden    bool    `json:"keep_hidden,omitempty"`     // take __MACOSX/, .DS_Store, ... as inputs too
+	JPEGEncoder   string  `json:"jpeg_encoder,omitempty"`    // std or mozjpeg (mozjpeg.go)
+	Progressive   bool    `json:"progressive,omitempty"`
+	Subsampling   string  `json:"subsampling,omitempty"` // 420 or 444
+	Flatten       string  `json:"flatten,omitempty"`     // "", prefix, hash or seq (flatten.go)
+
+	Mode           string `json:"mode,omitempty"` // "", "strip" or "convert"
+	ConvertFormat  string `json:"convert_format,omitempty"`
+	ConvertQuality int    `json:"convert_quality,omitempty"`
+	ConvertMaxKB   int    `json:"convert_max_kb,omitempty"`
+
+	targets []outputTarget
+}
+
+// readSettings parses the job settings of a request (field names prefixed, e.g.
+// "a_" for the compare endpoint).
+func readSettings(r *http.Request, prefix string) (Options, error) {
+	return settingsFrom(func(k string) string { return r.FormValue(prefix + k) })
+}
+
+// settingsFrom builds Options from any key/value source (form, mail subject, ...).
+// A preset fills in the keys the source left empty. All invalid fields are
+// reported together as settingsErrors.
+func settingsFrom(val func(string) string) (Options, error) {
+	vals := map[string]string{}
+	for _, k := range []string{
+		"speed", "preset", "min_kb", "max_kb", "min_side", "max_side", "scale_min", "upscale_max", "sharpen", "sharpen_amount", "min_quality", "wa_guard",
+		"targets", "thumbs", "contact_sheet", "gif_frame", "allow_ext", "deny_ext", "ignore_below_kb", "keep_hidden",
+		"jpeg_encoder", "progressive", "subsampling", "flatten",
+		"mode", "convert_format", "convert_quality", "convert_max_kb",
+	} {
+		vals[k] = strings.TrimSpace(val(k))
+	}
+	if err := applyPreset(vals); err != nil {
+		return Options{}, settingsErrors{{"preset", err}}
+	}
+
+	o := Options{Preset: vals["preset"], Targets: vals["targets"], GIFFrame: vals["gif_frame"],
+		AllowExt: vals["allow_ext"], DenyExt: vals["deny_ext"], Mode: vals["mode"],
+		JPEGEncoder: vals["jpeg_encoder"], Subsampling: vals["subsampling"], Flatten: vals["flatten"]}
+	errs := settingsErrors{}
+	var err error
+	switch o.Speed = vals["speed"]; o.Speed {
+	case "":
+		o.Speed = "fast"
+	case "fast", "balanced":
+	default:
+		errs.add("speed", fmt.Errorf("speed must be fast or balanced, got %q", o.Speed))
+	}
+	o.MinKB, err = optInt(vals, "min_kb", MIN_KB, 1, MAX_TARGET_KB)
+	errs.add("min_kb", err)
+	o.MaxKB, err = optInt(vals, "max_kb", TARGET_KB, 2, MAX_TARGET_KB)
+	if err == nil && o.MinKB > 0 && o.MinKB >= o.MaxKB {
+		err = fmt.Errorf("max_kb must be above min_kb (%d KB), got %d KB", o.MinKB, o.MaxKB)
+	}
+	errs.add("max_kb", err)
+	o.MinSide, err = optInt(vals, "min_side", MIN_SIDE_PX, 16, 20000)
+	errs.add("min_side", err)
+	o.MaxSide, err = optInt(vals, "max_side", 0, 0, 20000)
+	if err == nil && o.MaxSide > 0 && o.MaxSide < 16 {
+		err = fmt.Errorf("max_side must be 0 (no cap) or from 16 px, got %d", o.MaxSide)
+	}
+	errs.add("max_side", err)
+	o.ScaleMin, err = optFloat(vals, "scale_min", SCALE_MIN, 0.01, 1)
+	if err == nil && o.ScaleMin >= 1 {
+		err = fmt.Errorf("scale_min must be below 1 (it is how far images may shrink), got %q", vals["scale_min"])
+	}
+	errs.add("scale_min", err)
+	o.UpscaleMax, err = optFloat(vals, "upscale_max", UPSCALE_MAX, 1, 10)
+	errs.add("upscale_max", err)
+	o.SharpenAmount, err = optFloat(vals, "sharpen_amount", SHARPEN_AMOUNT, 0, 5)
+	errs.add("sharpen_amount", err)
+	o.MinQuality, err = optInt(vals, "min_quality", MIN_QUALITY, MIN_QUALITY, MAX_QUALITY)
+	errs.add("min_quality", err)
+	o.IgnoreBelowKB, err = optInt(vals, "ignore_below_kb", 0, 0, 1024)
+	errs.add("ignore_below_kb", err)
+	for _, b := range []struct {
+		key string
+		dst *bool
+	}{{"sharpen", &o.Sharpen}, {"wa_guard", &o.WAGuard}, {"thumbs", &o.Thumbs}, {"contact_sheet", &o.ContactSheet}, {"keep_hidden", &o.KeepHidden}, {"progressive", &o.Progressive}} {
+		*b.dst, err = optBool(vals, b.key)
+		errs.add(b.key, err)
+	}
+	errs.add("gif_frame", validateGIFFrame(o.GIFFrame))
+	errs.add("allow_ext", validateExtPolicy(o.AllowExt))
+	errs.add("flatten", validateFlatten(o.Flatten))
+	errs.add("jpeg_encoder", parseJPEGEncoder(&o))
+	switch o.Mode {
+	case "", "strip":
+	case "convert":
+		errs.add("convert_format", parseConvert(&o, vals))
+	default:
+		errs.add("mode", fmt.Errorf("unknown mode %q", o.Mode))
+	}
+	if o.targets, err = parseTargets(o.Targets, outputTarget{MinKB: o.MinKB, MaxKB: o.MaxKB, MaxSide: o.MaxSide}); err != nil {
+		errs.add("targets", fmt.Errorf("invalid targets: %v", err))
+	}
+	if len(errs) > 0 {
+		return Options{}, errs
+	}
+	return o, nil
+}
+
+// fieldError ties a settings error to the form field it came from.
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e fieldError) Error() string { return e.Err.Error() }
+
+// settingsErrors lists every invalid field of one submission, in form order.
+type settingsErrors []fieldError
+
+func (errs settingsErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records err under field, or under its own field when it is a fieldError.
+func (errs *settingsErrors) add(field string, err error) {
+	if err == nil {
+		return
+	}
+	var fe fieldError
+	if errors.As(err, &fe) {
+		*errs = append(*errs, fe)
+		return
+	}
+	*errs = append(*errs, fieldError{field, err})
+}
+
+// byField maps field name to message for the form.
+func (errs settingsErrors) byField() map[string]string {
+	m := map[string]string{}
+	for _, e := range errs {
+		if _, dup := m[e.Field]; !dup {
+			m[e.Field] = e.Error()
+		}
+	}
+	return m
+}
+
+// settingsError answers a rejected submission: JSON callers get the message
+// and a field map, the browser form comes back filled in with the bad fields
+// marked.
+func settingsError(w http.ResponseWriter, r *http.Request, err error) {
+	var errs settingsErrors
+	if !errors.As(err, &errs) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": errs.Error(), "fields": errs.byField()})
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	tplIndex.Execute(w, map[string]interface{}{"Recent": recentResults(r), "User": currentUser(r),
+		"Prefs": formPrefs(r), "FieldErrors": errs.byField(),
+		"Message": "Pengaturan tidak valid (" + errs.Error() + "). Perbaiki kolom yang ditandai lalu pilih ulang berkasnya."})
+}
+
+// optInt reads vals[key] as a whole number in lo..hi; empty means def.
+func optInt(vals map[string]string, key string, def, lo, hi int) (int, error) {
+	v := vals[key]
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fieldError{key, fmt.Errorf("%s must be a whole number from %d to %d, got %q", key, lo, hi, v)}
+	}
+	return n, nil
+}
+
+// optFloat reads vals[key] as a number in lo..hi; empty means def.
+func optFloat(vals map[string]string, key string, def, lo, hi float64) (float64, error) {
+	v := vals[key]
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	// NaN slips past both range comparisons, so reject it (and ±Inf) explicitly
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f < lo || f > hi {
+		return 0, fieldError{key, fmt.Errorf("%s must be a number from %g to %g, got %q", key, lo, hi, v)}
+	}
+	return f, nil
+}
+
+// optBool reads a checkbox ("on") or flag ("1"/"true"); empty means off.
+func optBool(vals map[string]string, key string) (bool, error) {
+	switch strings.ToLower(vals[key]) {
+	case "", "0", "off", "false":
+		return false, nil
+	case "on", "1", "true":
+		return true, nil
+	}
+	return false, fieldError{key, fmt.Errorf("%s must be on or off, got %q", key, vals[key])}
+}
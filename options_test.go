@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// formSettings runs settingsFrom over a fixed set of form values.
+func formSettings(form map[string]string) (Options, error) {
+	return settingsFrom(func(k string) string { return form[k] })
+}
+
+func TestSettingsFromDefaults(t *testing.T) {
+	o, err := formSettings(nil)
+	if err != nil {
+		t.Fatalf("settingsFrom: %v", err)
+	}
+	if o.MinKB != MIN_KB || o.MaxKB != TARGET_KB || o.MinSide != MIN_SIDE_PX || o.Speed != "fast" {
+		t.Errorf("got min_kb %d, max_kb %d, min_side %d, speed %q; want the defaults", o.MinKB, o.MaxKB, o.MinSide, o.Speed)
+	}
+	if len(o.targets) != 1 || o.targets[0].MinKB != MIN_KB || o.targets[0].MaxKB != TARGET_KB {
+		t.Errorf("got targets %+v, want the min_kb-max_kb window", o.targets)
+	}
+}
+
+func TestSettingsFromRejects(t *testing.T) {
+	for _, tc := range []struct {
+		form  map[string]string
+		field string
+	}{
+		{map[string]string{"min_kb": "abc"}, "min_kb"},
+		{map[string]string{"min_kb": "0"}, "min_kb"},
+		{map[string]string{"max_kb": "999999999"}, "max_kb"},
+		{map[string]string{"min_kb": "200", "max_kb": "100"}, "max_kb"},
+		{map[string]string{"min_kb": "100", "max_kb": "100"}, "max_kb"},
+		{map[string]string{"min_side": "8"}, "min_side"},
+		{map[string]string{"max_side": "8"}, "max_side"},
+		{map[string]string{"scale_min": "NaN"}, "scale_min"},
+		{map[string]string{"scale_min": "1"}, "scale_min"},
+		{map[string]string{"upscale_max": "Inf"}, "upscale_max"},
+		{map[string]string{"sharpen_amount": "-Inf"}, "sharpen_amount"},
+		{map[string]string{"sharpen": "maybe"}, "sharpen"},
+		{map[string]string{"speed": "turbo"}, "speed"},
+		{map[string]string{"mode": "shrink"}, "mode"},
+	} {
+		_, err := formSettings(tc.form)
+		var errs settingsErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%v: got error %v, want settingsErrors", tc.form, err)
+			continue
+		}
+		if _, ok := errs.byField()[tc.field]; !ok {
+			t.Errorf("%v: errors %v don't name %s", tc.form, errs.byField(), tc.field)
+		}
+	}
+}
+
+func TestSettingsFromReportsAllFields(t *testing.T) {
+	_, err := formSettings(map[string]string{"min_kb": "x", "scale_min": "NaN", "speed": "turbo"})
+	var errs settingsErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v, want settingsErrors", err)
+	}
+	for _, field := range []string{"min_kb", "scale_min", "speed"} {
+		if _, ok := errs.byField()[field]; !ok {
+			t.Errorf("errors %v don't name %s", errs.byField(), field)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	fitz "github.com/gen2brain/go-fitz"
+)
+
+// ===== PDF renderers =====
+// PDFs can be rasterized by different native backends, since deployments have
+// different libraries installed and fidelity varies by document (scanned forms
+// vs. vector drawings vs. odd fonts):
+//   - mupdf:   go-fitz, in-process (or in the decode sandbox); the default
+//   - poppler: the pdftoppm command (poppler-utils)
+//   - pdfium:  the pdfium_test command from a PDFium build
+//
+// The command-line backends already run as their own processes, so the decode
+// sandbox only wraps mupdf; DECODE_TIMEOUT still bounds them.
+//
+// Each page is rendered at the DPI that brings its long side to about
+// PDF_LONG_SIDE_PX, so an A3 drawing stays legible and a till receipt doesn't
+// become a 5000 px strip. The speed preset's DPI only applies with
+// PDF_LONG_SIDE_PX=0.
+//
+// Up to PDF_THREADS pages of one document render at once (mupdf opens the file
+// once per worker, poppler runs that many pdftoppm), on top of THREADS files
+// in parallel, so a busy server may render THREADS x PDF_THREADS pages.
+//
+// Under that concurrency MuPDF now and then runs short of memory for a new
+// context or for the in-memory document stream, and a moment later it works.
+// Only those two errors are retried, up to PDF_RETRIES times, after
+// PDF_RETRY_BACKOFF, then twice that and so on (plus jitter). Everything else
+// (a broken or password-protected document, a missing page, bad page
+// contents) fails at once, so a damaged file is skipped without waiting.
+//
+//	PDF_RENDERER=poppler PDFTOPPM=/usr/bin/pdftoppm PDFIUM_TEST=/opt/pdfium/pdfium_test
+//	PDF_LONG_SIDE_PX=2000 PDF_DPI_MIN=72 PDF_DPI_MAX=300 PDF_THREADS=4
+//	PDF_RETRIES=2 PDF_RETRY_BACKOFF=200ms
+
+type pdfRenderer func(pdfBytes []byte, dpi int) ([]image.Image, error)
+
+var pdfRenderers = map[string]pdfRenderer{
+	"mupdf":   renderMuPDF,
+	"poppler": renderPoppler,
+	"pdfium":  renderPDFium,
+}
+
+var (
+	PDF_RENDERER     = "mupdf"
+	PDFTOPPM         = "pdftoppm"
+	PDFIUM_TEST      = "pdfium_test"
+	PDF_LONG_SIDE_PX = 2000
+	PDF_DPI_MIN      = 72
+	PDF_DPI_MAX      = 300
+	PDF_THREADS      = 4
+
+	PDF_RETRIES       = 2
+	PDF_RETRY_BACKOFF = 200 * time.Millisecond
+)
+
+func setupPDFRenderer() error {
+	if v := os.Getenv("PDF_RENDERER"); v != "" {
+		PDF_RENDERER = strings.ToLower(v)
+	}
+	if _, ok := pdfRenderers[PDF_RENDERER]; !ok {
+		return fmt.Errorf("unknown PDF_RENDERER %q (one of %s)", PDF_RENDERER, strings.Join(pdfRendererNames(), ", "))
+	}
+	if v := os.Getenv("PDFTOPPM"); v != "" {
+		PDFTOPPM = v
+	}
+	if v := os.Getenv("PDFIUM_TEST"); v != "" {
+		PDFIUM_TEST = v
+	}
+	if n, err := strconv.Atoi(os.Getenv("PDF_LONG_SIDE_PX")); err == nil && n >= 0 {
+		PDF_LONG_SIDE_PX = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PDF_DPI_MIN")); err == nil && n > 0 {
+		PDF_DPI_MIN = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PDF_DPI_MAX")); err == nil && n > 0 {
+		PDF_DPI_MAX = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PDF_THREADS")); err == nil && n > 0 {
+		PDF_THREADS = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PDF_RETRIES")); err == nil && n >= 0 {
+		PDF_RETRIES = n
+	}
+	if v := os.Getenv("PDF_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("PDF_RETRY_BACKOFF: expected a duration like 200ms, got %q", v)
+		}
+		PDF_RETRY_BACKOFF = d
+	}
+	if PDF_DPI_MIN > PDF_DPI_MAX {
+		return fmt.Errorf("PDF_DPI_MIN %d above PDF_DPI_MAX %d", PDF_DPI_MIN, PDF_DPI_MAX)
+	}
+	return nil
+}
+
+func pdfRendererNames() []string {
+	names := make([]string, 0, len(pdfRenderers))
+	for name := range pdfRenderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderPDF rasterizes every page with the configured backend.
+func renderPDF(pdfBytes []byte, dpi int) ([]image.Image, error) {
+	return pdfRenderers[PDF_RENDERER](pdfBytes, dpi)
+}
+
+// transientMuPDF are the go-fitz errors worth another try: allocation
+// failures under load. The rest (ErrOpenDocument, ErrRunPageContents,
+// ErrNeedsPassword, ...) come from the file and come out the same every time.
+var transientMuPDF = []error{fitz.ErrCreateContext, fitz.ErrOpenMemory}
+
+func transientPDFError(err error) bool {
+	for _, t := range transientMuPDF {
+		if errors.Is(err, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryMuPDF runs fn, again after a growing pause while it fails with a
+// transient MuPDF error, at most PDF_RETRIES more times.
+func retryMuPDF(what string, fn func() error) error {
+	err := fn()
+	for i := 0; i < PDF_RETRIES && err != nil && transientPDFError(err); i++ {
+		wait := PDF_RETRY_BACKOFF << i
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		log.Printf("mupdf %s: %v; retry %d/%d in %s", what, err, i+1, PDF_RETRIES, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		err = fn()
+	}
+	return err
+}
+
+// eachPage hands pages 0..n-1 to up to PDF_THREADS workers and returns the
+// first error; pages not yet started are dropped after one fails. newWorker
+// runs on each worker's goroutine and returns its render func and a cleanup.
+// With a single worker everything runs on the caller's goroutine.
+func eachPage(n int, newWorker func() (render func(page int) error, done func(), err error)) error {
+	workers := clampInt(PDF_THREADS, 1, n)
+	if workers <= 1 {
+		render, done, err := newWorker()
+		if err != nil {
+			return err
+		}
+		defer done()
+		for i := 0; i < n; i++ {
+			if err := render(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var (
+		mu    sync.Mutex
+		first error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return first != nil
+	}
+	pages := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			render, done, err := newWorker()
+			if err != nil {
+				fail(err)
+			} else {
+				defer done()
+			}
+			for i := range pages {
+				if err == nil && !failed() {
+					if perr := render(i); perr != nil {
+						fail(perr)
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < n && !failed(); i++ {
+		pages <- i
+	}
+	close(pages)
+	wg.Wait()
+	return first
+}
+
+// pageDPI picks the render DPI for a page of wPt x hPt points (1/72 in) so its
+// long side comes out near PDF_LONG_SIDE_PX, kept within PDF_DPI_MIN..PDF_DPI_MAX.
+// fallback (the speed preset's DPI) applies when the budget is off or the size unknown.
+func pageDPI(wPt, hPt float64, fallback int) int {
+	long := math.Max(wPt, hPt)
+	if PDF_LONG_SIDE_PX <= 0 || long <= 0 {
+		return fallback
+	}
+	return clampInt(int(math.Round(float64(PDF_LONG_SIDE_PX)*72/long)), PDF_DPI_MIN, PDF_DPI_MAX)
+}
+
+// runRenderer writes the PDF into a temp dir, lets render run the tool(s) there
+// and decodes the PNGs left behind, in the order pageOf assigns.
+func runRenderer(pdfBytes []byte, render func(ctx context.Context, in, dir string) error, pageOf func(file string) (int, bool)) ([]image.Image, error) {
+	dir, err := os.MkdirTemp("", "pdf-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(in, pdfBytes, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	if err := render(ctx, in, dir); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := map[int]string{}
+	nums := []int{}
+	for _, e := range entries {
+		if n, ok := pageOf(e.Name()); ok {
+			pages[n] = e.Name()
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	imgs := []image.Image{}
+	for _, n := range nums {
+		img, err := imaging.Open(filepath.Join(dir, pages[n]))
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", n, err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// runTool runs an external renderer and returns its stdout; stderr goes into the error.
+func runTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	out, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", filepath.Base(name), err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", filepath.Base(name), err)
+	}
+	return out.Bytes(), nil
+}
+
+// pageNumber parses the page number between prefix and ".png" in a file name.
+func pageNumber(file, prefix string) (int, bool) {
+	if !strings.HasPrefix(file, prefix) || !strings.HasSuffix(file, ".png") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, prefix), ".png"))
+	return n, err == nil
+}
+
+var pdfinfoPageRe = regexp.MustCompile(`(?m)^Page\s+(\d+) size: ([\d.]+) x ([\d.]+) pts`)
+
+// popplerPageSizes asks pdfinfo (shipped next to pdftoppm) for every page's size in points.
+func popplerPageSizes(ctx context.Context, in string) (map[int][2]float64, error) {
+	out, err := runTool(ctx, popplerTool("pdfinfo"), "-f", "1", "-l", "100000", in)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[int][2]float64{}
+	for _, m := range pdfinfoPageRe.FindAllStringSubmatch(string(out), -1) {
+		n, _ := strconv.Atoi(m[1])
+		w, _ := strconv.ParseFloat(m[2], 64)
+		h, _ := strconv.ParseFloat(m[3], 64)
+		sizes[n] = [2]float64{w, h}
+	}
+	return sizes, nil
+}
+
+// renderPoppler: pdftoppm writes page-1.png (zero-padded for longer documents),
+// one page at a time when pdfinfo knows the page sizes.
+func renderPoppler(pdfBytes []byte, dpi int) ([]image.Image, error) {
+	return runRenderer(pdfBytes,
+		func(ctx context.Context, in, dir string) error {
+			out := filepath.Join(dir, "page")
+			sizes, err := popplerPageSizes(ctx, in)
+			if err != nil || len(sizes) == 0 || PDF_LONG_SIDE_PX <= 0 {
+				_, err := runTool(ctx, PDFTOPPM, "-png", "-r", strconv.Itoa(dpi), in, out)
+				return err
+			}
+			nums := make([]int, 0, len(sizes))
+			for n := range sizes {
+				nums = append(nums, n)
+			}
+			sort.Ints(nums)
+			render := func(i int) error {
+				wh := sizes[nums[i]]
+				page := strconv.Itoa(nums[i])
+				r := strconv.Itoa(pageDPI(wh[0], wh[1], dpi))
+				_, err := runTool(ctx, PDFTOPPM, "-png", "-r", r, "-f", page, "-l", page, in, out)
+				return err
+			}
+			return eachPage(len(nums), func() (func(int) error, func(), error) {
+				return render, func() {}, nil
+			})
+		},
+		func(file string) (int, bool) { return pageNumber(file, "page-") })
+}
+
+// renderPDFium: pdfium_test writes in.pdf.0.png, in.pdf.1.png, ... next to the
+// input, at --scale times 72 DPI for the whole document. It can't report page
+// sizes, so pages over the pixel budget are downscaled afterwards instead.
+func renderPDFium(pdfBytes []byte, dpi int) ([]image.Image, error) {
+	imgs, err := runRenderer(pdfBytes,
+		func(ctx context.Context, in, dir string) error {
+			_, err := runTool(ctx, PDFIUM_TEST, "--png", fmt.Sprintf("--scale=%.4f", float64(dpi)/72), in)
+			return err
+		},
+		func(file string) (int, bool) { return pageNumber(file, "in.pdf.") })
+	if err != nil || PDF_LONG_SIDE_PX <= 0 {
+		return imgs, err
+	}
+	for i, img := range imgs {
+		if b := img.Bounds(); b.Dx() > PDF_LONG_SIDE_PX || b.Dy() > PDF_LONG_SIDE_PX {
+			imgs[i] = imaging.Fit(img, PDF_LONG_SIDE_PX, PDF_LONG_SIDE_PX, imaging.Lanczos)
+		}
+	}
+	return imgs, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	fitz "github.com/gen2brain/go-fitz"
+)
+
+// ===== PDF page kinds =====
+// Text pages (forms, letters, transcripts with a real text layer) and photo
+// pages lose detail differently: text blurs when shrunk but survives a low JPEG
+// quality, photos block up at low quality but shrink gracefully. Each PDF
+// page's extractable text decides which way the optimizer leans:
+//   - text:  scale_min is raised to TEXT_SCALE_MIN, so quality gives way first
+//   - photo: the quality floor is raised to PHOTO_MIN_QUALITY, so size gives way first
+//
+// Scans have no text layer and count as photo pages. When the lean makes the
+// target unreachable the page is compressed without it. Text comes from the
+// selected renderer (MuPDF, or pdftotext for poppler); pdfium pages get no lean.
+//
+//	TEXT_PAGE_CHARS=200 TEXT_SCALE_MIN=0.8 PHOTO_MIN_QUALITY=55
+
+const (
+	pageText  = "text"
+	pagePhoto = "photo"
+)
+
+var (
+	TEXT_PAGE_CHARS   = 200
+	TEXT_SCALE_MIN    = 0.8
+	PHOTO_MIN_QUALITY = 55
+)
+
+var pdfTexters = map[string]func(pdfBytes []byte) ([]int, error){
+	"mupdf":   mupdfTexter,
+	"poppler": popplerTextChars,
+}
+
+func setupPageKinds() {
+	if n, err := strconv.Atoi(os.Getenv("TEXT_PAGE_CHARS")); err == nil && n > 0 {
+		TEXT_PAGE_CHARS = n
+	}
+	if f, err := strconv.ParseFloat(os.Getenv("TEXT_SCALE_MIN"), 64); err == nil && f > 0 && f <= 1 {
+		TEXT_SCALE_MIN = f
+	}
+	if n, err := strconv.Atoi(os.Getenv("PHOTO_MIN_QUALITY")); err == nil {
+		PHOTO_MIN_QUALITY = clampInt(n, MIN_QUALITY, MAX_QUALITY)
+	}
+}
+
+func countChars(s string) int {
+	n := 0
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// pdfPageKinds classifies every page; nil when the renderer can't extract text.
+func pdfPageKinds(pdfBytes []byte) []string {
+	texter, ok := pdfTexters[PDF_RENDERER]
+	if !ok {
+		return nil
+	}
+	chars, err := texter(pdfBytes)
+	if err != nil {
+		log.Printf("pdf text: %v", err)
+		return nil
+	}
+	kinds := make([]string, len(chars))
+	for i, n := range chars {
+		kinds[i] = pagePhoto
+		if n >= TEXT_PAGE_CHARS {
+			kinds[i] = pageText
+		}
+	}
+	return kinds
+}
+
+// mupdfTexter extracts in the decode sandbox when it is on, like rendering does.
+func mupdfTexter(pdfBytes []byte) ([]int, error) {
+	if !DECODE_SANDBOX {
+		return mupdfTextChars(pdfBytes)
+	}
+	chars := []int{}
+	err := runSandboxed(pdfBytes, func(r io.Reader) error {
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			n, err := strconv.Atoi(sc.Text())
+			if err != nil {
+				return err
+			}
+			chars = append(chars, n)
+		}
+		return sc.Err()
+	}, "-ext", ".pdf", "-text")
+	return chars, err
+}
+
+func mupdfTextChars(pdfBytes []byte) ([]int, error) {
+	chars := []int{}
+	err := withMuPDF(pdfBytes, func(doc *fitz.Document, _ string) error {
+		for n := 0; n < doc.NumPage(); n++ {
+			text, err := doc.Text(n)
+			if err != nil {
+				return err
+			}
+			chars = append(chars, countChars(text))
+		}
+		return nil
+	})
+	return chars, err
+}
+
+// popplerTool finds a poppler-utils command next to PDFTOPPM.
+func popplerTool(name string) string {
+	if strings.ContainsRune(PDFTOPPM, os.PathSeparator) {
+		return filepath.Join(filepath.Dir(PDFTOPPM), name)
+	}
+	return name
+}
+
+// popplerTextChars runs pdftotext, which ends every page with a form feed.
+func popplerTextChars(pdfBytes []byte) ([]int, error) {
+	tmp, err := os.CreateTemp("", "text-*.pdf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(pdfBytes); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	tmp.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	out, err := runTool(ctx, popplerTool("pdftotext"), tmp.Name(), "-")
+	if err != nil {
+		return nil, err
+	}
+	pages := strings.Split(string(out), "\f")
+	if len(pages) > 1 {
+		pages = pages[:len(pages)-1]
+	}
+	chars := make([]int, len(pages))
+	for i, p := range pages {
+		chars[i] = countChars(p)
+	}
+	return chars, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// ===== Pre-flight warnings =====
+// Likely problems with an input, found before it is processed so the user can
+// fix the file instead of finding it in the skip list afterwards: HEIC without
+// a decoder, encrypted PDFs, images below min_side and files already under
+// min_kb. They are warnings, not skips: the job still takes the file. The
+// preview (/inspect) lists them per entry; the page checks loose files the
+// same way in the browser as soon as they are picked.
+
+// preflightWarnings returns what is likely to go wrong with one input.
+func preflightWarnings(rel string, raw []byte, opts Options) []string {
+	ext := inputExt(rel)
+	warns := []string{}
+	switch {
+	case (ext == ".heic" || ext == ".heif") && !heifDecode:
+		warns = append(warns, "HEIC tidak bisa dibaca server ini (tidak ada decoder); ubah ke JPG dulu")
+	case PDF_EXT[ext]:
+		if pdfUnavailable() != nil {
+			warns = append(warns, "PDF tidak bisa dirender di server ini")
+		} else if pdfEncrypted(raw) {
+			warns = append(warns, "PDF terenkripsi; bila berkata sandi, halamannya tidak bisa dirender")
+		}
+	case IMG_EXT[ext]:
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(raw)); err == nil && min(cfg.Width, cfg.Height) < opts.MinSide {
+			warns = append(warns, fmt.Sprintf("hanya %d×%d px, di bawah sisi minimum %d px: akan diperbesar (bisa buram)", cfg.Width, cfg.Height, opts.MinSide))
+		}
+		if opts.MinKB > 0 && len(raw) < opts.MinKB<<10 {
+			warns = append(warns, fmt.Sprintf("sudah %d KB, di bawah Min KB (%d KB): akan diperbesar agar masuk rentang", len(raw)>>10, opts.MinKB))
+		}
+	}
+	return warns
+}
+
+// pdfEncrypted reports whether the trailer names an /Encrypt dictionary.
+// Documents with only an owner password still render; the warning covers both.
+func pdfEncrypted(raw []byte) bool {
+	return bytes.Contains(raw, []byte("/Encrypt"))
+}
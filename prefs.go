@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ===== Per-user form memory =====
+// For logged-in (OIDC) users the processing form remembers the last values
+// they submitted, or their saved personal defaults which take precedence.
+// Kept in the history database, so HISTORY_DB=off disables it.
+
+// prefFields are the form fields worth remembering (not uploads or job names).
+var prefFields = []string{
+	"speed", "preset", "min_kb", "max_kb", "min_side", "max_side", "scale_min", "upscale_max", "sharpen", "sharpen_amount", "gif_frame",
+	"targets", "thumbs", "contact_sheet", "mode", "convert_format", "convert_quality", "convert_max_kb",
+	"allow_ext", "deny_ext", "ignore_below_kb", "keep_hidden", "flatten",
+	"jpeg_encoder", "progressive", "subsampling",
+}
+
+const (
+	prefsLast    = "last"
+	prefsDefault = "default"
+)
+
+func formPrefs(r *http.Request) map[string]string {
+	vals := map[string]string{}
+	for _, k := range prefFields {
+		vals[k] = r.FormValue(k)
+	}
+	return vals
+}
+
+func saveUserPrefs(user, kind string, vals map[string]string) {
+	if historyDB == nil || user == "" {
+		return
+	}
+	b, _ := json.Marshal(vals)
+	if _, err := historyDB.Exec(`INSERT OR REPLACE INTO user_prefs (user, kind, vals, updated) VALUES (?, ?, ?, ?)`,
+		user, kind, string(b), time.Now().Unix()); err != nil {
+		log.Printf("prefs: %v", err)
+	}
+}
+
+// userPrefs returns the user's defaults, else their last-used values, else nil.
+func userPrefs(user string) (map[string]string, string) {
+	if historyDB == nil || user == "" {
+		return nil, ""
+	}
+	for _, kind := range []string{prefsDefault, prefsLast} {
+		var raw string
+		err := historyDB.QueryRow(`SELECT vals FROM user_prefs WHERE user = ? AND kind = ?`, user, kind).Scan(&raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("prefs: %v", err)
+			return nil, ""
+		}
+		vals := map[string]string{}
+		if json.Unmarshal([]byte(raw), &vals) == nil {
+			return vals, kind
+		}
+	}
+	return nil, ""
+}
+
+// rememberLastUsed stores the submitted form for the logged-in user.
+func rememberLastUsed(r *http.Request) {
+	if u := currentUser(r); u != nil {
+		saveUserPrefs(u.ID(), prefsLast, formPrefs(r))
+	}
+}
+
+// prefsHandler: POST saves the posted fields as the user's defaults, POST
+// reset=1 drops them (the form falls back to last-used values).
+func prefsHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil || historyDB == nil {
+		http.Error(w, "personal defaults need a login and HISTORY_DB", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("reset") == "1" {
+		if _, err := historyDB.Exec(`DELETE FROM user_prefs WHERE user = ? AND kind = ?`, u.ID(), prefsDefault); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		vals := formPrefs(r)
+		if _, err := settingsFrom(func(k string) string { return vals[k] }); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		saveUserPrefs(u.ID(), prefsDefault, vals)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Upload preview & selective processing =====
+// Phase 1: POST /inspect stores the upload and lists its entries.
+// Phase 2: POST /confirm with the staging token and the selected entry ids.
+
+// STAGE_TTL is how long an inspected upload waits for confirmation.
+var STAGE_TTL = 30 * time.Minute
+
+type stagedUpload struct {
+	Opts    Options
+	Jobs    []Job
+	Created time.Time
+}
+
+var stagedUploads = struct {
+	sync.Mutex
+	m map[string]stagedUpload
+}{m: map[string]stagedUpload{}}
+
+type previewEntry struct {
+	ID     int    `json:"id"`
+	Label  string `json:"label"`
+	Rel    string `json:"rel"`
+	SizeB  int    `json:"size_bytes"`
+	Type   string `json:"type"`
+	Skip   string `json:"skip,omitempty"`
+	Indent int    `json:"-"`
+
+	Warnings []string `json:"warnings,omitempty"` // pre-flight (preflight.go)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || r.FormValue("format") == "json"
+}
+
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := admitJob(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := r.ParseMultipartForm(200 << 20); err != nil {
+		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := verifyUploadChecksums(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkStoredInputs(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := readSettings(r, "")
+	if err != nil {
+		settingsError(w, r, err)
+		return
+	}
+	rememberLastUsed(r)
+	jobs := collectJobs(r, opts)
+	if !hasWork(jobs) {
+		tplIndex.Execute(w, map[string]interface{}{"Message": "Tidak ada berkas valid (butuh gambar/PDF, atau ZIP berisi file-file tersebut)."})
+		return
+	}
+
+	token := newToken("s")
+	stagedUploads.Lock()
+	for k, st := range stagedUploads.m {
+		if time.Since(st.Created) > STAGE_TTL {
+			delete(stagedUploads.m, k)
+		}
+	}
+	stagedUploads.m[token] = stagedUpload{Opts: opts, Jobs: jobs, Created: time.Now()}
+	stagedUploads.Unlock()
+
+	entries := make([]previewEntry, 0, len(jobs))
+	warned := 0
+	for i, j := range jobs {
+		typ := "image"
+		if j.Skip != "" {
+			typ = string(j.SkipKind)
+		} else if PDF_EXT[inputExt(j.Rel)] {
+			typ = "pdf"
+		}
+		e := previewEntry{ID: i, Label: j.Label, Rel: j.Rel, SizeB: len(j.Data), Type: typ, Skip: j.Skip, Indent: strings.Count(j.Rel, "/") + 1}
+		if j.Skip == "" {
+			e.Warnings = preflightWarnings(j.Rel, j.Data, opts)
+			warned += min(len(e.Warnings), 1)
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		if entries[a].Label != entries[b].Label {
+			return entries[a].Label < entries[b].Label
+		}
+		return entries[a].Rel < entries[b].Rel
+	})
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "entries": entries, "warned": warned})
+		return
+	}
+	tplIndex.Execute(w, map[string]interface{}{"Preview": entries, "StageToken": token, "Warned": warned})
+}
+
+func confirmHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := admitJob(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := r.FormValue("token")
+	stagedUploads.Lock()
+	st, ok := stagedUploads.m[token]
+	stagedUploads.Unlock()
+	if !ok {
+		http.Error(w, "Upload not found or expired", http.StatusNotFound)
+		return
+	}
+
+	jobs := []Job{}
+	for _, v := range r.Form["select"] {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 0 || id >= len(st.Jobs) {
+			http.Error(w, "invalid entry id: "+v, http.StatusBadRequest)
+			return
+		}
+		jobs = append(jobs, st.Jobs[id])
+	}
+	if !hasWork(jobs) {
+		tplIndex.Execute(w, map[string]interface{}{"Message": "Tidak ada entri yang dipilih."})
+		return
+	}
+	// a bad selection above leaves the preview for another try; a valid one
+	// uses it up, once
+	stagedUploads.Lock()
+	_, ok = stagedUploads.m[token]
+	delete(stagedUploads.m, token)
+	stagedUploads.Unlock()
+	if !ok {
+		http.Error(w, "Upload already confirmed or expired", http.StatusConflict)
+		return
+	}
+
+	manifest, gallery, err := runJobs(jobs, st.Opts, r.FormValue("job_id"))
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	token, summaryText, skips := manifest.Token, manifest.Summary, manifest.Skips
+	setResultOwner(token, resultOwner(r))
+	rememberResult(w, r, token, summaryText)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "download_url": BASE_PATH + "/download/" + token, "summary": summaryText, "skipped": skips, "expires": manifest.Expires})
+		return
+	}
+	tplIndex.Execute(w, map[string]interface{}{"Summary": summaryText, "Token": token, "Expires": manifest.Expires, "QR": downloadQR(r, token), "Gallery": gallery,
+		"Files": manifest.Files, "Skips": skips, "SkipCounts": skipCounts(skips)})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Running behind a reverse proxy =====
+// BASE_PATH serves the whole app under a prefix (nginx "location /compress/").
+// X-Forwarded-For/-Proto are only believed from TRUSTED_PROXIES, so a client
+// can't spoof its address in the access log (ACCESS_LOG=1) or the rate limit.
+// RATE_LIMIT caps the POST requests (uploads, API calls) of one client address
+// per minute, bursts of up to RATE_BURST (default RATE_LIMIT); over it the
+// answer is 429 with Retry-After. 0 (default) turns it off.
+//
+//	BASE_PATH=/compress TRUSTED_PROXIES=127.0.0.1/32,10.0.0.0/8 ACCESS_LOG=1 RATE_LIMIT=30
+//
+// PUBLIC_BASE_URL and REPLICAS URLs then include the prefix too
+// (https://example.com/compress, http://10.0.0.2:8080/compress).
+
+var (
+	BASE_PATH       = ""
+	TRUSTED_PROXIES []*net.IPNet
+	ACCESS_LOG      = false
+	RATE_LIMIT      = 0 // POST requests per client and minute, 0 = off
+	RATE_BURST      = 0
+)
+
+// tplFuncs gives templates {{base}} for building links under BASE_PATH,
+// {{presets}} for the preset names (built-in and imported), {{docTypes}} and
+// {{pdfError}} (why PDFs cannot be rendered, "" when they can), {{jxlEncode}},
+// {{mozjpeg}}, {{zipDepth}} and {{maintenance}} (the maintenance notice, ""
+// when taking jobs).
+var tplFuncs = template.FuncMap{
+	"base":        func() string { return BASE_PATH },
+	"presets":     presetNames,
+	"docTypes":    func() []string { return live().DOC_TYPES },
+	"jxlEncode":   func() bool { return jxlEncode },
+	"heifDecode":  func() bool { return heifDecode },
+	"mozjpeg":     func() bool { return cjpegFound },
+	"maintenance": maintenanceNotice,
+	"zipDepth":    func() int { return live().MAX_ZIP_DEPTH },
+	"pdfError": func() string {
+		if err := pdfUnavailable(); err != nil {
+			return err.Error()
+		}
+		return ""
+	},
+}
+
+func setupProxy() error {
+	BASE_PATH = strings.TrimRight(os.Getenv("BASE_PATH"), "/")
+	if BASE_PATH != "" && !strings.HasPrefix(BASE_PATH, "/") {
+		BASE_PATH = "/" + BASE_PATH
+	}
+	TRUSTED_PROXIES = nil
+	for _, c := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			c += "/32"
+			if strings.Contains(c, ":") {
+				c = strings.TrimSuffix(c, "/32") + "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return err
+		}
+		TRUSTED_PROXIES = append(TRUSTED_PROXIES, n)
+	}
+	ACCESS_LOG = os.Getenv("ACCESS_LOG") == "1"
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad RATE_LIMIT %q", v)
+		}
+		RATE_LIMIT = n
+	}
+	RATE_BURST = RATE_LIMIT
+	if n, err := strconv.Atoi(os.Getenv("RATE_BURST")); err == nil && n > 0 {
+		RATE_BURST = n
+	}
+	return nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, n := range TRUSTED_PROXIES {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP walks X-Forwarded-For from the right, skipping trusted proxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// requestScheme is "https" when TLS terminates here or at a trusted proxy.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if trustedProxy(net.ParseIP(host)) && r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// rateBucket is the token bucket of one client address.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateBuckets = struct {
+	sync.Mutex
+	m     map[string]*rateBucket
+	swept time.Time
+}{m: map[string]*rateBucket{}}
+
+// rateAllow takes a token from ip's bucket; when it is empty it returns false
+// and how long until the next token.
+func rateAllow(ip string, now time.Time) (bool, time.Duration) {
+	perSec := float64(RATE_LIMIT) / 60
+	rateBuckets.Lock()
+	defer rateBuckets.Unlock()
+	if now.Sub(rateBuckets.swept) > time.Minute {
+		// a full bucket is the same as none
+		full := time.Duration(float64(RATE_BURST) / perSec * float64(time.Second))
+		for k, b := range rateBuckets.m {
+			if now.Sub(b.last) > full {
+				delete(rateBuckets.m, k)
+			}
+		}
+		rateBuckets.swept = now
+	}
+	b := rateBuckets.m[ip]
+	if b == nil {
+		b = &rateBucket{tokens: float64(RATE_BURST), last: now}
+		rateBuckets.m[ip] = b
+	}
+	b.tokens = math.Min(float64(RATE_BURST), b.tokens+now.Sub(b.last).Seconds()*perSec)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSec * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// withRateLimit answers 429 to clients over RATE_LIMIT.
+func withRateLimit(next http.Handler) http.Handler {
+	if RATE_LIMIT == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if ok, wait := rateAllow(clientIP(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps the event streams working with the access log on.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.NewResponseController reach the connection underneath.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// withProxy strips BASE_PATH, applies RATE_LIMIT and writes the access log.
+func withProxy(next http.Handler) http.Handler {
+	next = withRateLimit(next)
+	if BASE_PATH != "" {
+		inner := http.StripPrefix(BASE_PATH, next)
+		next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == BASE_PATH {
+				http.Redirect(w, r, BASE_PATH+"/", http.StatusMovedPermanently)
+				return
+			}
+			if !strings.HasPrefix(r.URL.Path, BASE_PATH+"/") {
+				http.NotFound(w, r)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+	if !ACCESS_LOG {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %s %s %d %s", clientIP(r), requestScheme(r), r.Method, r.URL.RequestURI(), rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// ===== Download QR code =====
+// The result page shows a QR code of the download link so the ZIP can be pulled
+// straight onto a phone. Behind a proxy set PUBLIC_BASE_URL, or TRUSTED_PROXIES
+// so the scheme is taken from X-Forwarded-Proto.
+
+// absoluteDownloadURL is the download link as seen from outside.
+func absoluteDownloadURL(r *http.Request, token string) string {
+	if PUBLIC_BASE_URL != "" {
+		return PUBLIC_BASE_URL + "/download/" + token
+	}
+	return requestScheme(r) + "://" + r.Host + BASE_PATH + "/download/" + token
+}
+
+// downloadQR returns a PNG data URL for the result page, or "" on failure.
+func downloadQR(r *http.Request, token string) template.URL {
+	png, err := qrcode.Encode(absoluteDownloadURL(r, token), qrcode.Medium, 192)
+	if err != nil {
+		log.Printf("qr %s: %v", token, err)
+		return ""
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Result store quota =====
+// MAX_STORAGE_BYTES caps the combined size of kept result ZIPs (memory and
+// STORAGE_BACKEND). When a new result doesn't fit, the least recently used ones
+// are evicted; results younger than RESULT_MIN_AGE are kept so fresh links keep
+// working, and if that still leaves no room the job is rejected.
+//
+//	MAX_STORAGE_BYTES=2147483648 RESULT_MIN_AGE=10m
+
+var errStoreFull = errors.New("result storage is full")
+
+type resultUsage struct {
+	size     int64
+	created  time.Time
+	lastUsed time.Time
+	owner    string // client IP or mail sender, for the admin page
+}
+
+var resultLRU = struct {
+	sync.Mutex
+	m     map[string]*resultUsage
+	total int64
+}{m: map[string]*resultUsage{}}
+
+func setupQuota() error {
+	if err := updateLive(quotaLimits); err != nil {
+		return err
+	}
+	seedResultUsage()
+	return nil
+}
+
+// quotaLimits reads the settings a reload can change into c.
+func quotaLimits(c *liveConfig) error {
+	c.MAX_STORAGE_BYTES, c.RESULT_MIN_AGE = liveDefaults.MAX_STORAGE_BYTES, liveDefaults.RESULT_MIN_AGE
+	if v := os.Getenv("MAX_STORAGE_BYTES"); v != "" {
+		if _, err := fmt.Sscan(v, &c.MAX_STORAGE_BYTES); err != nil || c.MAX_STORAGE_BYTES < 0 {
+			return fmt.Errorf("bad MAX_STORAGE_BYTES %q", v)
+		}
+	}
+	if d, err := time.ParseDuration(os.Getenv("RESULT_MIN_AGE")); err == nil && d >= 0 {
+		c.RESULT_MIN_AGE = d
+	}
+	return nil
+}
+
+// seedResultUsage picks up results a local-disk store kept across restarts.
+func seedResultUsage() {
+	l, ok := store.(localStorage)
+	if !ok {
+		return
+	}
+	keys, err := l.List(context.Background(), RESULTS_PREFIX)
+	if err != nil {
+		log.Printf("quota: %v", err)
+		return
+	}
+	resultLRU.Lock()
+	defer resultLRU.Unlock()
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".zip") {
+			continue
+		}
+		fi, err := os.Stat(l.path(key))
+		if err != nil {
+			continue
+		}
+		tok := strings.TrimSuffix(strings.TrimPrefix(key, RESULTS_PREFIX), ".zip")
+		resultLRU.m[tok] = &resultUsage{size: fi.Size(), created: fi.ModTime(), lastUsed: fi.ModTime()}
+		resultLRU.total += fi.Size()
+	}
+}
+
+// checkResultRoom fails fast when nothing could be evicted to fit even a tiny result.
+func checkResultRoom() error {
+	cfg := live()
+	if cfg.MAX_STORAGE_BYTES == 0 {
+		return nil
+	}
+	resultLRU.Lock()
+	defer resultLRU.Unlock()
+	pinned := int64(0)
+	for _, u := range resultLRU.m {
+		if time.Since(u.created) < cfg.RESULT_MIN_AGE {
+			pinned += u.size
+		}
+	}
+	if pinned >= cfg.MAX_STORAGE_BYTES {
+		return fmt.Errorf("%w: %d bytes held by results younger than %s, try again later", errStoreFull, pinned, cfg.RESULT_MIN_AGE)
+	}
+	return nil
+}
+
+// reserveResult accounts size bytes for token, evicting LRU results as needed.
+// Results are tracked even without a quota so the admin page can list them.
+// The victims are dropped from the accounting under the lock and evicted
+// after it: evictResult does storage I/O and takes other locks.
+func reserveResult(token string, size int64) error {
+	victims, err := accountResult(token, size)
+	for _, t := range victims {
+		log.Printf("quota: evicting %s", t)
+		evictResult(t)
+	}
+	return err
+}
+
+// accountResult adds token to the accounting and returns the results
+// dropped from it to make room.
+func accountResult(token string, size int64) ([]string, error) {
+	cfg := live()
+	resultLRU.Lock()
+	defer resultLRU.Unlock()
+	var victims []string
+	if cfg.MAX_STORAGE_BYTES > 0 && resultLRU.total+size > cfg.MAX_STORAGE_BYTES {
+		toks := make([]string, 0, len(resultLRU.m))
+		for t, u := range resultLRU.m {
+			if time.Since(u.created) >= cfg.RESULT_MIN_AGE {
+				toks = append(toks, t)
+			}
+		}
+		sort.Slice(toks, func(i, j int) bool { return resultLRU.m[toks[i]].lastUsed.Before(resultLRU.m[toks[j]].lastUsed) })
+		free := cfg.MAX_STORAGE_BYTES - resultLRU.total
+		n := 0
+		for ; n < len(toks) && free < size; n++ {
+			free += resultLRU.m[toks[n]].size
+		}
+		if free < size {
+			return nil, fmt.Errorf("%w: result needs %d bytes, only %d can be freed", errStoreFull, size, free)
+		}
+		victims = toks[:n]
+		for _, t := range victims {
+			resultLRU.total -= resultLRU.m[t].size
+			delete(resultLRU.m, t)
+		}
+	}
+	now := time.Now()
+	resultLRU.m[token] = &resultUsage{size: size, created: now, lastUsed: now}
+	resultLRU.total += size
+	return victims, nil
+}
+
+func touchResult(token string) {
+	resultLRU.Lock()
+	if u, ok := resultLRU.m[token]; ok {
+		u.lastUsed = time.Now()
+	}
+	resultLRU.Unlock()
+}
+
+// resultOwnerOf returns who made token, "" when this replica doesn't know
+// (a result from another replica or kept across a restart).
+func resultOwnerOf(token string) string {
+	resultLRU.Lock()
+	defer resultLRU.Unlock()
+	if u, ok := resultLRU.m[token]; ok {
+		return u.owner
+	}
+	return ""
+}
+
+func setResultOwner(token, owner string) {
+	resultLRU.Lock()
+	if u, ok := resultLRU.m[token]; ok {
+		u.owner = owner
+	}
+	resultLRU.Unlock()
+}
+
+// evictResult deletes a result from memory and storage; the caller has already
+// dropped it from resultLRU.
+func evictResult(token string) {
+	memZips.Lock()
+	memZips.m[token].remove()
+	delete(memZips.m, token)
+	memZips.Unlock()
+	if store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+		del := func() error { return store.Delete(ctx, RESULTS_PREFIX+token+".zip") }
+		if DEDUP_OUTPUTS {
+			del = func() error { return releaseManifest(ctx, token) }
+		}
+		if err := del(); err != nil {
+			log.Printf("quota: delete %s: %v", token, err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ===== Config reload =====
+// The server re-reads CONFIG_FILE on SIGHUP and when the file changes (checked
+// every CONFIG_WATCH, off to disable), so presets, limits and admin credentials
+// can be tuned on a busy instance. Jobs already running keep the options they
+// started with; a new setting applies to the next job or request. Settings not
+// in liveSettings (storage, TLS, BASE_PATH, decoders, ...) are only logged as
+// needing a restart. An invalid file is refused and the running config kept.
+// Real env vars still win over the file, as at start.
+//
+//	CONFIG_WATCH=5s
+//	kill -HUP $(pidof multicompressgo)     (or: systemctl reload multicompressgo)
+
+var CONFIG_WATCH = 5 * time.Second
+
+// liveConfig holds the settings a reload can change, named after their env
+// vars. Requests read them through live(); a reload builds a new liveConfig
+// and swaps it in whole, so nothing reads one while it is being written.
+type liveConfig struct {
+	ADMIN_USER, ADMIN_PASSWORD string
+
+	SESSION_SECRET []byte
+	SESSION_RECENT int
+
+	MAX_ACTIVE_JOBS   int // 0 = no limit
+	MEM_HARD_LIMIT_MB int
+	MEM_SOFT_LIMIT_MB int
+
+	MAX_STORAGE_BYTES int64 // 0 = unlimited
+	RESULT_MIN_AGE    time.Duration
+	RESULT_TTL        time.Duration
+
+	SPEED_PRESET    string // "fast" or "balanced"
+	THREADS         int
+	MAX_ENTRY_BYTES int64 // per ZIP entry, MAX_ENTRY_MB
+	MAX_ZIP_BYTES   int64 // per uploaded ZIP, all entries, MAX_ZIP_TOTAL_MB
+	MAX_ZIP_FILES   int   // entries per uploaded ZIP
+	MAX_ZIP_DEPTH   int   // ZIP levels expanded, 1 = no ZIPs inside ZIPs
+	GIF_MAX_FRAMES  int
+	MAX_PIXELS      int  // width x height an image or GIF screen may declare
+	ZIP_STRICT      bool // refuse ZIPs with a damaged central directory instead of salvaging them
+
+	SHARE_TTL, SHARE_MAX_TTL time.Duration
+
+	CORS_ORIGINS               map[string]bool
+	CORS_METHODS, CORS_HEADERS string
+
+	PRESETS map[string]map[string]string // builtinPresets plus CONFIG_FILE's
+
+	DOC_TYPES []string
+	// EXTENSION_TOKENS maps token -> name ("name:token", or a bare token
+	// named after its position).
+	EXTENSION_TOKENS map[string]string
+}
+
+// liveDefaults are the values with nothing set; a setting removed from
+// CONFIG_FILE goes back to its default. Steps replace maps and slices rather
+// than write to them, so these can be shared.
+var liveDefaults = liveConfig{
+	ADMIN_USER:       "admin",
+	SESSION_RECENT:   10,
+	RESULT_MIN_AGE:   10 * time.Minute,
+	RESULT_TTL:       24 * time.Hour,
+	SPEED_PRESET:     "fast",
+	THREADS:          4,
+	MAX_ENTRY_BYTES:  100 << 20,
+	MAX_ZIP_BYTES:    1 << 30,
+	MAX_ZIP_FILES:    10000,
+	MAX_ZIP_DEPTH:    2,
+	GIF_MAX_FRAMES:   100,
+	MAX_PIXELS:       150_000_000,
+	SHARE_TTL:        72 * time.Hour,
+	SHARE_MAX_TTL:    30 * 24 * time.Hour,
+	CORS_ORIGINS:     map[string]bool{},
+	CORS_METHODS:     "GET, POST, OPTIONS",
+	CORS_HEADERS:     "Content-Type, Accept, X-Files-SHA256",
+	PRESETS:          builtinPresets,
+	DOC_TYPES:        []string{"KTP", "KK", "Ijazah", "Transkrip nilai", "Pas foto", "Surat lamaran", "Lainnya"},
+	EXTENSION_TOKENS: map[string]string{},
+}
+
+var (
+	liveCfg     atomic.Pointer[liveConfig]
+	liveWriteMu sync.Mutex
+)
+
+// live returns the settings in effect. Read it once per request or step when
+// several fields must agree.
+func live() *liveConfig {
+	if c := liveCfg.Load(); c != nil {
+		return c
+	}
+	return &liveDefaults
+}
+
+// updateLive runs steps on a copy of the settings in effect and swaps the
+// result in; nothing changes when a step fails. Each step resets its fields
+// to liveDefaults before reading the env.
+func updateLive(steps ...func(c *liveConfig) error) error {
+	liveWriteMu.Lock()
+	defer liveWriteMu.Unlock()
+	c := *live()
+	for _, step := range steps {
+		if err := step(&c); err != nil {
+			return err
+		}
+	}
+	liveCfg.Store(&c)
+	return nil
+}
+
+// liveSettings are the settings a reload applies, with the step that reads
+// them; a step runs only when one of its keys changed.
+var liveSettings = []struct {
+	keys  []string
+	apply func(c *liveConfig) error
+}{
+	{[]string{"ADMIN_USER", "ADMIN_PASSWORD"}, adminSettings},
+	{[]string{"SESSION_SECRET", "SESSION_RECENT"}, sessionSettings},
+	{[]string{"MAX_ACTIVE_JOBS", "MEM_HARD_LIMIT_MB", "MEM_SOFT_LIMIT_MB", "MAX_HEAP_MB"}, backpressureSettings},
+	{[]string{"MAX_STORAGE_BYTES", "RESULT_MIN_AGE"}, quotaLimits},
+	{[]string{"RESULT_TTL"}, expirySettings},
+	{[]string{"SPEED_PRESET", "THREADS", "MAX_ENTRY_MB", "MAX_ZIP_TOTAL_MB", "MAX_ZIP_FILES", "MAX_ZIP_DEPTH", "GIF_MAX_FRAMES", "MAX_PIXELS", "ZIP_STRICT"}, processingSettings},
+	{[]string{"SHARE_TTL", "SHARE_MAX_TTL"}, shareSettings},
+	{[]string{"CORS_ORIGINS", "CORS_METHODS", "CORS_HEADERS"}, corsSettings},
+	{[]string{"DOC_TYPES"}, docTypeSettings},
+	{[]string{"EXTENSION_TOKENS"}, extensionSettings},
+}
+
+var reloadMu sync.Mutex
+
+// reloadConfig applies CONFIG_FILE again. It returns the changed settings that
+// took effect and those that need a restart.
+func reloadConfig() (applied, restart []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	b, err := readConfigFile(CONFIG_FILE)
+	if err == nil {
+		err = validateConfig(b)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	changed := map[string]bool{}
+	for _, k := range applyConfigBundle(b) {
+		changed[k] = true
+	}
+	steps := []func(c *liveConfig) error{}
+	for _, s := range liveSettings {
+		hit := false
+		for _, k := range s.keys {
+			if changed[k] {
+				hit = true
+				applied = append(applied, k)
+				delete(changed, k)
+			}
+		}
+		if hit {
+			keys, apply := s.keys, s.apply
+			steps = append(steps, func(c *liveConfig) error {
+				if err := apply(c); err != nil {
+					return fmt.Errorf("%s: %w", strings.Join(keys, "/"), err)
+				}
+				return nil
+			})
+		}
+	}
+	if err := updateLive(steps...); err != nil {
+		return nil, nil, err
+	}
+	for _, k := range configKeys {
+		if changed[k] {
+			restart = append(restart, k)
+		}
+	}
+	return applied, restart, nil
+}
+
+// setupReload starts the SIGHUP handler and the CONFIG_FILE watcher.
+func setupReload() {
+	if v := os.Getenv("CONFIG_WATCH"); v == "off" || v == "0" {
+		CONFIG_WATCH = 0
+	} else if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		CONFIG_WATCH = d
+	}
+	reload := func(why string) {
+		applied, restart, err := reloadConfig()
+		switch {
+		case err != nil:
+			log.Printf("config: reload (%s) refused, keeping the running config: %v", why, err)
+		case len(applied) > 0 || len(restart) > 0:
+			log.Printf("config: reloaded %s (%s): applied %v, restart needed for %v", CONFIG_FILE, why, applied, restart)
+		default:
+			log.Printf("config: reloaded %s (%s): presets refreshed, no setting changed", CONFIG_FILE, why)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload("SIGHUP")
+		}
+	}()
+	if CONFIG_WATCH == 0 {
+		return
+	}
+	go func() {
+		last := configModTime()
+		for range time.Tick(CONFIG_WATCH) {
+			if t := configModTime(); !t.Equal(last) {
+				last = t
+				reload("file changed")
+			}
+		}
+	}()
+}
+
+// configModTime is CONFIG_FILE's mtime, zero while it doesn't exist.
+func configModTime() time.Time {
+	fi, err := os.Stat(CONFIG_FILE)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ===== Multi-replica routing without shared storage =====
+// Each replica stamps its REPLICA_ID onto the tokens it mints ("t<hex>-<id>").
+// A /download/ landing on another replica is reverse-proxied to the owner listed
+// in REPLICAS, so a plain round-robin load balancer works.
+//
+//	REPLICA_ID=a REPLICAS=a=http://10.0.0.1:8080,b=http://10.0.0.2:8080
+
+// replicaHopHeader marks proxied requests so a stale token can't loop.
+const replicaHopHeader = "X-Multicompress-Hop"
+
+var (
+	REPLICA_ID = ""
+	replicas   = map[string]*httputil.ReverseProxy{}
+)
+
+func setupReplicas() error {
+	REPLICA_ID = os.Getenv("REPLICA_ID")
+	spec := os.Getenv("REPLICAS")
+	if spec == "" {
+		return nil
+	}
+	if REPLICA_ID == "" || strings.Contains(REPLICA_ID, "-") {
+		return fmt.Errorf("REPLICAS needs a REPLICA_ID without '-'")
+	}
+	for _, part := range strings.Split(spec, ",") {
+		id, raw, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return fmt.Errorf("bad REPLICAS entry %q (want id=url)", part)
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("bad REPLICAS url %q", raw)
+		}
+		if id == REPLICA_ID {
+			continue
+		}
+		rp := httputil.NewSingleHostReverseProxy(u)
+		rp.Transport = &http.Transport{ResponseHeaderTimeout: 30 * time.Second}
+		rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("replica %s: %v", id, err)
+			http.Error(w, "replica "+id+" unavailable", http.StatusBadGateway)
+		}
+		replicas[id] = rp
+	}
+	return nil
+}
+
+// randomID returns 32 hex digits from crypto/rand: ids that grant access on
+// their own (downloads, previews, job events) must not be guessable.
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newToken returns prefix plus a randomID, tagged with this replica's id when set.
+func newToken(prefix string) string {
+	tok := prefix + randomID()
+	if REPLICA_ID != "" {
+		tok += "-" + REPLICA_ID
+	}
+	return tok
+}
+
+// proxyToOwner forwards r to the replica that minted token; false if that is us
+// (or unknown), in which case the caller answers itself.
+func proxyToOwner(w http.ResponseWriter, r *http.Request, token string) bool {
+	i := strings.LastIndex(token, "-")
+	if i < 0 || r.Header.Get(replicaHopHeader) != "" {
+		return false
+	}
+	rp, ok := replicas[token[i+1:]]
+	if !ok {
+		return false
+	}
+	r.Header.Set(replicaHopHeader, REPLICA_ID)
+	rp.ServeHTTP(w, r)
+	return true
+}
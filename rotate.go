@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ===== Lossless JPEG rotation =====
+// Delegates to jpegtran (libjpeg-turbo), which rearranges DCT blocks instead of
+// decoding, so orientation fixes cost no quality. Only the ICC profile is kept:
+// a stale EXIF Orientation tag would otherwise rotate the picture a second time.
+// Without trim, sizes that aren't a multiple of the MCU (8/16 px) are refused
+// rather than silently cropped.
+//
+//	POST /rotate files=... op=90|180|270|h|v [trim=on]
+//	multicompressgo rotate -op 90 [-trim] a.jpg b.jpg   (writes a_rot90.jpg, ...)
+
+var JPEGTRAN = "jpegtran"
+
+var rotateOps = map[string][]string{
+	"90":  {"-rotate", "90"},
+	"180": {"-rotate", "180"},
+	"270": {"-rotate", "270"},
+	"h":   {"-flip", "horizontal"},
+	"v":   {"-flip", "vertical"},
+}
+
+func rotateJPEG(data []byte, op string, trim bool) ([]byte, error) {
+	opArgs, ok := rotateOps[op]
+	if !ok {
+		return nil, fmt.Errorf("unknown op %q (90, 180, 270, h or v)", op)
+	}
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG")
+	}
+	args := []string{"-copy", "icc", "-perfect"}
+	if trim {
+		args[2] = "-trim"
+	}
+	cmd := exec.Command(JPEGTRAN, append(args, opArgs...)...)
+	cmd.Stdin = bytes.NewReader(data)
+	out, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("jpegtran: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("jpegtran: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+func rotatedName(name, op string) string {
+	base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	return base + "_rot" + op + ".jpg"
+}
+
+func rotateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(200 << 20); err != nil {
+		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, trim := r.FormValue("op"), r.FormValue("trim") == "on"
+	files := r.MultipartForm.File["files"]
+	if len(files) == 0 {
+		http.Error(w, "no files", http.StatusBadRequest)
+		return
+	}
+	outs := map[string][]byte{}
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			http.Error(w, fh.Filename+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			http.Error(w, fh.Filename+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := rotateJPEG(b, op, trim)
+		if err != nil {
+			http.Error(w, fh.Filename+": "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		outs[rotatedName(fh.Filename, op)] = data
+	}
+	if len(outs) == 1 {
+		for name, data := range outs {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+			w.Write(data)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=rotated.zip")
+	zw := zip.NewWriter(w)
+	for name, data := range outs {
+		fw, _ := zw.Create(name)
+		fw.Write(data)
+	}
+	zw.Close()
+}
+
+var rotateOpts struct {
+	op   string
+	trim bool
+}
+
+func rotateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&rotateOpts.op, "op", "90", "90, 180, 270, h (mirror) or v (flip)")
+	fs.BoolVar(&rotateOpts.trim, "trim", false, "drop partial edge blocks instead of refusing")
+}
+
+// runRotateCLI implements `multicompressgo rotate`; exits 1 if any file failed.
+func runRotateCLI(args []string) {
+	failed := 0
+	for _, name := range args {
+		b, err := os.ReadFile(name)
+		if err == nil {
+			b, err = rotateJPEG(b, rotateOpts.op, rotateOpts.trim)
+		}
+		if err == nil {
+			out := filepath.Join(filepath.Dir(name), rotatedName(name, rotateOpts.op))
+			err = os.WriteFile(out, b, 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adityafaths/multicompressgo/compress"
+	"github.com/disintegration/imaging"
+)
+
+// ===== Decoder sandbox =====
+// With DECODE_SANDBOX=1 the risky decoders (MuPDF for PDFs, the TIFF/WebP
+// parsers) run in a child "decode-worker" process with a timeout and an
+// address-space limit, so a crash or runaway allocation in native code only
+// fails that one file. Decoded pages come back over stdout as raw NRGBA frames.
+// DECODE_HARDEN=1 (Linux, implies the sandbox) additionally confines the worker
+// to a fresh temp directory with landlock (applied before the worker re-execs
+// itself, so all of its threads are covered) and forbids network, exec,
+// io_uring, namespaces and signalling other processes via seccomp; if the
+// kernel lacks either, decoding fails rather than running unconfined.
+//
+//	DECODE_SANDBOX=1 DECODE_TIMEOUT=2m DECODE_MEM_MB=2048 DECODE_HARDEN=1
+
+var (
+	DECODE_SANDBOX = false
+	DECODE_HARDEN  = false
+	DECODE_TIMEOUT = 2 * time.Minute
+	DECODE_MEM_MB  = 2048
+	SANDBOX_EXT    = map[string]bool{".pdf": true, ".tif": true, ".tiff": true, ".webp": true}
+)
+
+func setupSandbox() {
+	DECODE_HARDEN = os.Getenv("DECODE_HARDEN") == "1"
+	DECODE_SANDBOX = os.Getenv("DECODE_SANDBOX") == "1" || DECODE_HARDEN
+	if d, err := time.ParseDuration(os.Getenv("DECODE_TIMEOUT")); err == nil && d > 0 {
+		DECODE_TIMEOUT = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("DECODE_MEM_MB")); err == nil && n > 0 {
+		DECODE_MEM_MB = n
+	}
+}
+
+// decodeSandboxed decodes data (an image or PDF named by ext) in a child process.
+func decodeSandboxed(ext string, data []byte, dpi int) ([]image.Image, error) {
+	var imgs []image.Image
+	err := runSandboxed(data, func(r io.Reader) (err error) {
+		imgs, err = readFrames(r)
+		return err
+	}, "-ext", ext, "-dpi", strconv.Itoa(dpi),
+		"-long-side", strconv.Itoa(PDF_LONG_SIDE_PX), "-dpi-min", strconv.Itoa(PDF_DPI_MIN), "-dpi-max", strconv.Itoa(PDF_DPI_MAX),
+		"-pdf-threads", strconv.Itoa(PDF_THREADS))
+	return imgs, err
+}
+
+// runSandboxed feeds data to a decode-worker started with args; read consumes its stdout.
+func runSandboxed(data []byte, read func(io.Reader) error, args ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DECODE_TIMEOUT)
+	defer cancel()
+	args = append([]string{"decode-worker", "-mem", strconv.Itoa(DECODE_MEM_MB)}, args...)
+	if DECODE_HARDEN {
+		dir, err := os.MkdirTemp("", "decode-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		args = append(args, "-workdir", dir)
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	readErr := read(bufio.NewReader(stdout))
+	waitErr := cmd.Wait()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("decoder timed out after %s", DECODE_TIMEOUT)
+	case waitErr != nil:
+		// first line only: a runtime crash dumps every goroutine after it
+		if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); msg != "" {
+			return fmt.Errorf("decoder: %s (%v)", msg, waitErr)
+		}
+		return fmt.Errorf("decoder crashed: %v", waitErr)
+	case readErr != nil:
+		return readErr
+	}
+	return nil
+}
+
+// Frames are: width uint32, height uint32, then width*height*4 NRGBA bytes.
+// Neither side may exceed maxFrameSide.
+const maxFrameSide = 1 << 16
+
+func writeFrame(w io.Writer, img image.Image) error {
+	n := imaging.Clone(img)
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, uint32(n.Rect.Dx()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(n.Rect.Dy()))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(n.Pix)
+	return err
+}
+
+func readFrames(r io.Reader) ([]image.Image, error) {
+	imgs := []image.Image{}
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			return imgs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("decoder output: %w", err)
+		}
+		w, h := int(binary.BigEndian.Uint32(hdr)), int(binary.BigEndian.Uint32(hdr[4:]))
+		// the worker is not trusted: a frame it could not have held within
+		// DECODE_MEM_MB is a bug or an attack, not something to allocate
+		if w <= 0 || h <= 0 || w > maxFrameSide || h > maxFrameSide || int64(w)*int64(h)*4 > int64(DECODE_MEM_MB)<<20 {
+			return nil, fmt.Errorf("decoder output: bad frame size %dx%d", w, h)
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		if _, err := io.ReadFull(r, img.Pix); err != nil {
+			return nil, fmt.Errorf("decoder output: %w", err)
+		}
+		imgs = append(imgs, img)
+	}
+}
+
+// runDecodeWorker is the child side: `multicompressgo decode-worker -ext .pdf < file`.
+func runDecodeWorker(args []string) {
+	fs := flag.NewFlagSet("decode-worker", flag.ExitOnError)
+	ext := fs.String("ext", "", "input extension")
+	dpi := fs.Int("dpi", PDF_DPI_FAST, "PDF render DPI")
+	fs.IntVar(&PDF_LONG_SIDE_PX, "long-side", PDF_LONG_SIDE_PX, "PDF page long side in px (0 = fixed -dpi)")
+	fs.IntVar(&PDF_DPI_MIN, "dpi-min", PDF_DPI_MIN, "lowest per-page PDF DPI")
+	fs.IntVar(&PDF_DPI_MAX, "dpi-max", PDF_DPI_MAX, "highest per-page PDF DPI")
+	fs.IntVar(&PDF_THREADS, "pdf-threads", 1, "PDF pages rendered at once")
+	mem := fs.Int("mem", 0, "address space limit in MB (0 = none)")
+	workdir := fs.String("workdir", "", "harden: confine the worker to this directory")
+	confined := fs.Bool("confined", false, "internal: set on the re-exec after landlock")
+	text := fs.Bool("text", false, "print the text length of each PDF page instead of rendering")
+	fs.Parse(args)
+	if *workdir != "" {
+		if !*confined {
+			// landlock, then run again as a process whose every thread is confined
+			err := confineWorker(*workdir, append(os.Args[:len(os.Args):len(os.Args)], "-confined"))
+			fmt.Fprintln(os.Stderr, "harden:", err)
+			os.Exit(1)
+		}
+		os.Setenv("TMPDIR", *workdir)
+		if err := hardenWorker(); err != nil {
+			fmt.Fprintln(os.Stderr, "harden:", err)
+			os.Exit(1)
+		}
+	}
+	if *mem > 0 {
+		if err := limitMemory(*mem); err != nil {
+			fmt.Fprintln(os.Stderr, "memory limit:", err)
+			os.Exit(1)
+		}
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *text {
+		chars, err := mupdfTextChars(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, n := range chars {
+			fmt.Println(n)
+		}
+		return
+	}
+	var imgs []image.Image
+	if PDF_EXT[*ext] {
+		imgs, err = renderMuPDF(data, *dpi)
+	} else {
+		var img image.Image
+		img, err = compress.Decode(data)
+		imgs = []image.Image{img}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for _, img := range imgs {
+		if err := writeFrame(out, img); err != nil {
+			os.Exit(1)
+		}
+	}
+	out.Flush()
+}
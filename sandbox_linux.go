@@ -0,0 +1,10 @@
+package main
+
+import "syscall"
+
+// limitMemory caps this process's address space; allocations beyond it fail
+// (Go panics, MuPDF reports an error) instead of pushing the host into OOM.
+func limitMemory(mb int) error {
+	lim := uint64(mb) << 20
+	return syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: lim, Max: lim})
+}
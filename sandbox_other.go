@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// limitMemory is a no-op outside Linux; the timeout still applies.
+func limitMemory(mb int) error { return nil }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/adityafaths/multicompressgo/compress"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// ===== Self-test =====
+// `multicompressgo selftest` exercises every backend this deployment is
+// configured for (decoding generated JPEG/PNG/TIFF/BMP/WebP samples, JPEG XL
+// and HEIC when their tools are present, the external decoder, the PDF
+// renderer, metadata stripping and the 168–174 KB search) and prints what
+// works and how long it took. Run it after deploying; it exits 1 when a
+// configured backend fails. It also warms up the page cache for the native
+// tools and the quality model of this process.
+//
+//	multicompressgo selftest [-json]
+
+// selftestWebP is a 1×1 lossless WebP; Go has no WebP encoder to make one.
+const selftestWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+type selftestResult struct {
+	Name   string  `json:"name"`
+	Status string  `json:"status"` // ok, fail or skip
+	MS     float64 `json:"ms"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+var selftestOpts struct {
+	json bool
+}
+
+func selftestFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&selftestOpts.json, "json", false, "print the report as JSON")
+}
+
+func runSelftestCLI(args []string) {
+	setupProcessing()
+	if err := setupDecoders(); err != nil {
+		log.Fatal(err)
+	}
+
+	results := runSelftest()
+	failed := 0
+	for _, r := range results {
+		if r.Status == "fail" {
+			failed++
+		}
+	}
+	if selftestOpts.json {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"results": results, "failed": failed})
+	} else {
+		for _, r := range results {
+			fmt.Printf("%-4s %-22s %8.1f ms  %s\n", r.Status, r.Name, r.MS, r.Detail)
+		}
+		fmt.Printf("\n%d checks, %d failed\n", len(results), failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func runSelftest() []selftestResult {
+	results := []selftestResult{}
+	check := func(name string, fn func() (string, error)) {
+		start := time.Now()
+		detail, err := fn()
+		r := selftestResult{Name: name, Status: "ok", MS: float64(time.Since(start).Microseconds()) / 1000, Detail: detail}
+		if err != nil {
+			r.Status, r.Detail = "fail", err.Error()
+		}
+		results = append(results, r)
+	}
+	skip := func(name, why string) {
+		results = append(results, selftestResult{Name: name, Status: "skip", Detail: why})
+	}
+	decode := func(ext string, data []byte) func() (string, error) {
+		return func() (string, error) {
+			img, err := decodeImageFromBytes("selftest"+ext, data)
+			if err != nil {
+				return "", err
+			}
+			if img == nil {
+				return "", fmt.Errorf("decoder returned no image")
+			}
+			return fmt.Sprintf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy()), nil
+		}
+	}
+
+	img := syntheticImage(rand.New(rand.NewSource(1)), 1600, 1200)
+	jpg, _ := compress.EncodeJPEG(img, 90)
+	samples := []struct {
+		ext string
+		enc func() ([]byte, error)
+	}{
+		{".jpg", func() ([]byte, error) { return jpg, nil }},
+		{".png", func() ([]byte, error) { b := &bytes.Buffer{}; err := png.Encode(b, img); return b.Bytes(), err }},
+		{".tif", func() ([]byte, error) { b := &bytes.Buffer{}; err := tiff.Encode(b, img, nil); return b.Bytes(), err }},
+		{".bmp", func() ([]byte, error) { b := &bytes.Buffer{}; err := bmp.Encode(b, img); return b.Bytes(), err }},
+		{".webp", func() ([]byte, error) { return base64.StdEncoding.DecodeString(selftestWebP) }},
+	}
+	var pngData []byte
+	for _, s := range samples {
+		data, err := s.enc()
+		if err != nil {
+			check("decode "+s.ext, func() (string, error) { return "", fmt.Errorf("making sample: %v", err) })
+			continue
+		}
+		if s.ext == ".png" {
+			pngData = data
+		}
+		check("decode "+s.ext, decode(s.ext, data))
+	}
+
+	switch {
+	case jxlDecode && jxlEncode:
+		check("jpeg xl", func() (string, error) {
+			enc, err := newJXLEncoder(img, true)
+			if err != nil {
+				return "", err
+			}
+			defer enc.close()
+			data, err := enc.encode(80)
+			if err != nil {
+				return "", err
+			}
+			return decode(".jxl", data)()
+		})
+	case jxlDecode:
+		skip("jpeg xl", "djxl found but no cjxl to make a sample")
+	default:
+		skip("jpeg xl", "djxl not found")
+	}
+	if heifDecode {
+		skip("heic", HEIF_DEC+" found; no encoder to make a sample")
+	} else {
+		skip("heic", "heif-dec not found")
+	}
+	if EXTERNAL_DECODER != "" {
+		check("external decoder", func() (string, error) {
+			img, err := decodeExternal(".png", pngData)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %dx%d", externalKind, img.Bounds().Dx(), img.Bounds().Dy()), nil
+		})
+	} else {
+		skip("external decoder", "EXTERNAL_DECODER not set")
+	}
+	check("pdf ("+PDF_RENDERER+")", func() (string, error) {
+		if err := checkPDF(); err != nil {
+			return "", err
+		}
+		return "1 page", nil
+	})
+	check("strip metadata", func() (string, error) {
+		out, err := stripJPEGMetadata(jpg)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d -> %d bytes", len(jpg), len(out)), nil
+	})
+	check(fmt.Sprintf("compress %d-%d KB", MIN_KB, TARGET_KB), func() (string, error) {
+		opts := compress.DefaultOptions()
+		opts.MinKB, opts.MaxKB, opts.Fast = MIN_KB, TARGET_KB, live().SPEED_PRESET != "balanced"
+		res, err := compress.New(opts).Compress(img)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d bytes scale=%.3f q=%d", res.Size, res.Scale, res.Quality), nil
+	})
+	return results
+}
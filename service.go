@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ===== System service =====
+// install-service registers this binary as a service that starts the web
+// server at boot with the given config file: a systemd unit on Linux, a
+// Windows service (automatic start, restarted on failure) on Windows. The
+// config path is made absolute and handed over as CONFIG_FILE; the service
+// runs in its directory, so relative paths in the config (ZIP_SPOOL_DIR,
+// HISTORY_DB, ...) resolve next to it. Without a config yet the setup wizard
+// answers on :8080 at first start. Both commands need root / Administrator.
+//
+//	sudo multicompressgo install-service -config /etc/multicompress.json -user multicompress
+//	multicompressgo install-service -print     (show the unit instead of installing)
+//	multicompressgo uninstall-service
+
+type serviceSpec struct {
+	name   string
+	exe    string
+	config string
+	user   string // systemd only
+}
+
+var serviceOpts struct {
+	name      string
+	config    string
+	user      string
+	printOnly bool
+}
+
+func installServiceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&serviceOpts.name, "name", cliName, "service name")
+	fs.StringVar(&serviceOpts.config, "config", CONFIG_FILE, "config file the service reads (CONFIG_FILE)")
+	fs.StringVar(&serviceOpts.user, "user", "", "systemd: run as this user instead of root")
+	fs.BoolVar(&serviceOpts.printOnly, "print", false, "print what would be installed and exit")
+}
+
+func uninstallServiceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&serviceOpts.name, "name", cliName, "service name")
+}
+
+func runInstallServiceCLI(args []string) {
+	spec := serviceSpec{name: serviceOpts.name, user: serviceOpts.user}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err == nil {
+		spec.config, err = filepath.Abs(serviceOpts.config)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	spec.exe = exe
+	if serviceOpts.printOnly {
+		fmt.Print(describeService(spec))
+		return
+	}
+	if err := installService(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "install-service: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("installed and started service %s (config %s)\n", spec.name, spec.config)
+	if _, err := os.Stat(spec.config); os.IsNotExist(err) {
+		fmt.Printf("%s doesn't exist yet: finish the setup wizard on http://localhost:8080/\n", spec.config)
+	}
+}
+
+func runUninstallServiceCLI(args []string) {
+	if err := uninstallService(serviceOpts.name); err != nil {
+		fmt.Fprintf(os.Stderr, "uninstall-service: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("stopped and removed service %s (the config and results are kept)\n", serviceOpts.name)
+}
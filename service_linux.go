@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SYSTEMD_UNIT_DIR is where install-service writes the unit.
+var SYSTEMD_UNIT_DIR = "/etc/systemd/system"
+
+func unitPath(name string) string {
+	return filepath.Join(SYSTEMD_UNIT_DIR, name+".service")
+}
+
+// describeService renders the systemd unit for spec.
+func describeService(spec serviceSpec) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[Unit]\nDescription=%s photo and PDF compressor\nAfter=network-online.target\nWants=network-online.target\n\n", cliName)
+	fmt.Fprintf(b, "[Service]\nExecStart=%s\nEnvironment=%s\nWorkingDirectory=%s\n",
+		systemdQuote(spec.exe), systemdQuote("CONFIG_FILE="+spec.config), filepath.Dir(spec.config))
+	b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\n")
+	if spec.user != "" {
+		fmt.Fprintf(b, "User=%s\n", spec.user)
+	}
+	b.WriteString("Restart=on-failure\nRestartSec=5\n\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes s when systemd would otherwise split it.
+func systemdQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"\\") {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func installService(spec serviceSpec) error {
+	path := unitPath(spec.name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists (uninstall-service first)", path)
+	}
+	if err := os.WriteFile(path, []byte(describeService(spec)), 0o644); err != nil {
+		return fmt.Errorf("%w (run as root)", err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return systemctl("enable", "--now", spec.name+".service")
+}
+
+func uninstallService(name string) error {
+	path := unitPath(name)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no unit %s", path)
+	}
+	if err := systemctl("disable", "--now", name+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// runAsService is for Windows, where the service manager starts the server.
+func runAsService(serve func()) bool { return false }
@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+var errNoServiceManager = errors.New("install-service supports systemd (Linux) and Windows services only")
+
+func describeService(spec serviceSpec) string {
+	return errNoServiceManager.Error() + "\n"
+}
+
+func installService(spec serviceSpec) error { return errNoServiceManager }
+
+func uninstallService(name string) error { return errNoServiceManager }
+
+func runAsService(serve func()) bool { return false }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// describeService shows the service install-service would register.
+func describeService(spec serviceSpec) string {
+	return fmt.Sprintf("service:     %s (automatic start, restart on failure)\nbinary:      %s\nCONFIG_FILE: %s\nlog:         %s\n",
+		spec.name, spec.exe, spec.config, serviceLogPath(spec.config))
+}
+
+// serviceLogPath is where the server logs when run by the service manager,
+// which has no console.
+func serviceLogPath(config string) string {
+	return filepath.Join(filepath.Dir(config), cliName+".log")
+}
+
+func installService(spec serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("%w (run as Administrator)", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(spec.name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists (uninstall-service first)", spec.name)
+	}
+	s, err := m.CreateService(spec.name, spec.exe, mgr.Config{
+		DisplayName: cliName,
+		Description: "Compresses photos and scanned PDFs into size-bounded JPEGs (web server on :8080).",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 24*60*60)
+	if err == nil {
+		// the service manager passes this per-service environment to the process
+		var k registry.Key
+		k, err = registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+spec.name, registry.SET_VALUE)
+		if err == nil {
+			err = k.SetStringsValue("Environment", []string{"CONFIG_FILE=" + spec.config})
+			k.Close()
+		}
+	}
+	if err == nil {
+		err = s.Start()
+	}
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("%w (run as Administrator)", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("no service %s: %w", name, err)
+	}
+	defer s.Close()
+	if st, err := s.Control(svc.Stop); err == nil {
+		for i := 0; i < 20 && st.State != svc.Stopped; i++ {
+			time.Sleep(500 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return s.Delete()
+}
+
+type serviceHandler struct {
+	serve func()
+}
+
+func (h serviceHandler) Execute(args []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go h.serve()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range reqs {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runAsService runs serve under the service manager when it started the
+// process, and reports whether it did. The working directory becomes the
+// config's (instead of System32) and the log goes to a file beside it.
+func runAsService(serve func()) bool {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		return false
+	}
+	if err := os.Chdir(filepath.Dir(CONFIG_FILE)); err != nil {
+		log.Printf("service: %v", err)
+	}
+	if f, err := os.OpenFile(serviceLogPath(CONFIG_FILE), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err == nil {
+		log.SetOutput(f)
+	}
+	if err := svc.Run(cliName, serviceHandler{serve}); err != nil {
+		log.Printf("service: %v", err)
+	}
+	return true
+}
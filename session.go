@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Recent results (signed cookie) =====
+// The index page lists the browser's last few results so a closed tab doesn't
+// lose the download token. The list lives in an HMAC-signed cookie, nothing is
+// kept server-side; entries disappear after RESULT_TTL or once the ZIP is gone.
+// Without SESSION_SECRET a random key is used and lists reset on restart (set
+// the same secret on every replica).
+//
+//	SESSION_SECRET=change-me SESSION_RECENT=10
+
+const recentCookie = "mc_recent"
+
+type recentResult struct {
+	Token   string    `json:"t"`
+	Title   string    `json:"s"` // first line of the summary
+	Created time.Time `json:"c"`
+}
+
+func setupSession() { updateLive(sessionSettings) }
+
+// sessionSettings reads SESSION_SECRET and SESSION_RECENT into c.
+func sessionSettings(c *liveConfig) error {
+	if s := os.Getenv("SESSION_SECRET"); s != "" {
+		c.SESSION_SECRET = []byte(s)
+	} else {
+		c.SESSION_SECRET = make([]byte, 32)
+		rand.Read(c.SESSION_SECRET)
+		if len(replicas) > 0 {
+			log.Printf("SESSION_SECRET not set: recent results won't carry across replicas")
+		}
+	}
+	c.SESSION_RECENT = liveDefaults.SESSION_RECENT
+	if n, err := strconv.Atoi(os.Getenv("SESSION_RECENT")); err == nil && n > 0 {
+		c.SESSION_RECENT = n
+	}
+	return nil
+}
+
+func signCookie(payload string) string {
+	m := hmac.New(sha256.New, live().SESSION_SECRET)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// setSignedCookie stores v as JSON with an HMAC so it can't be edited client-side.
+func setSignedCookie(w http.ResponseWriter, r *http.Request, name string, v interface{}, maxAge time.Duration) {
+	raw, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + signCookie(payload),
+		Path:     BASE_PATH + "/",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readSignedCookie fills v and reports false if the cookie is missing or tampered with.
+func readSignedCookie(r *http.Request, name string, v interface{}) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signCookie(payload))) {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: BASE_PATH + "/", MaxAge: -1})
+}
+
+// rememberResult prepends token to the browser's recent list. Call before
+// writing the body.
+func rememberResult(w http.ResponseWriter, r *http.Request, token, summary string) {
+	title, _, _ := strings.Cut(strings.TrimSpace(summary), "\n")
+	if len(title) > 80 {
+		title = title[:80] + "…"
+	}
+	cfg := live()
+	list := []recentResult{{Token: token, Title: title, Created: time.Now()}}
+	for _, e := range recentResults(r) {
+		if len(list) == cfg.SESSION_RECENT {
+			break
+		}
+		list = append(list, e)
+	}
+	setSignedCookie(w, r, recentCookie, list, cfg.RESULT_TTL)
+}
+
+// recentResults is the cookie list minus expired or evicted results.
+func recentResults(r *http.Request) []recentResult {
+	out := []recentResult{}
+	var list []recentResult
+	readSignedCookie(r, recentCookie, &list)
+	ttl := live().RESULT_TTL
+	for _, e := range list {
+		if time.Since(e.Created) < ttl && resultAvailable(e.Token) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// resultAvailable is a cheap guess: results in storage or on another replica
+// are trusted until RESULT_TTL, local in-memory ones must still be in memZips.
+func resultAvailable(token string) bool {
+	memZips.RLock()
+	_, ok := memZips.m[token]
+	memZips.RUnlock()
+	if ok || store != nil {
+		return true
+	}
+	if i := strings.LastIndex(token, "-"); i >= 0 {
+		_, remote := replicas[token[i+1:]]
+		return remote
+	}
+	return false
+}
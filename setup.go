@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== First-run setup wizard =====
+// A fresh install (no CONFIG_FILE and none of the config env vars set) starts
+// with only /setup: admin password, result storage folder, processing defaults
+// and optional TLS. Saving writes CONFIG_FILE and the server starts normally.
+// The page asks for a one-time code printed in the log so whoever can read the
+// console, not whoever reaches the port first, does the setup. The code has
+// 128 bits, and after setupMaxFailures wrong codes setup refuses every try
+// until the server is restarted (with a new code).
+//
+//	SETUP_WIZARD=off   skip it (e.g. containers configured purely by env)
+//	TLS_CERT=/etc/ssl/cert.pem TLS_KEY=/etc/ssl/key.pem   serve HTTPS
+
+var (
+	TLS_CERT = ""
+	TLS_KEY  = ""
+)
+
+func setupTLS() error {
+	TLS_CERT, TLS_KEY = os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (TLS_CERT == "") != (TLS_KEY == "") {
+		return errTLSPair
+	}
+	return nil
+}
+
+var errTLSPair = errors.New("TLS_CERT and TLS_KEY must be set together")
+
+func needsSetup() bool {
+	if os.Getenv("SETUP_WIZARD") == "off" {
+		return false
+	}
+	if _, err := os.Stat(CONFIG_FILE); err == nil {
+		return false
+	}
+	for _, k := range configKeys {
+		if _, set := os.LookupEnv(k); set {
+			return false
+		}
+	}
+	return true
+}
+
+// setupMaxFailures is how many wrong setup codes are taken before setup closes.
+const setupMaxFailures = 10
+
+// runSetupWizard serves the setup page on addr until the config is saved.
+func runSetupWizard(addr string) {
+	if err := setupProxy(); err != nil {
+		log.Fatalf("proxy: %v", err)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+	log.Printf("first run: open http://localhost%s%s/setup and enter setup code %s", addr, BASE_PATH, code)
+
+	done := make(chan struct{})
+	var finish sync.Once // two submits racing past the code check must not close done twice
+	var codeMu sync.Mutex
+	failures := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/setup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			tplSetup.Execute(w, map[string]interface{}{"Threads": runtime.NumCPU()})
+			return
+		}
+		codeMu.Lock()
+		closed := failures >= setupMaxFailures
+		ok := !closed && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(r.FormValue("code"))), []byte(code)) == 1
+		if !closed && !ok {
+			if failures++; failures == setupMaxFailures {
+				log.Printf("setup: %d wrong codes, setup closed until the server is restarted", failures)
+			}
+		}
+		codeMu.Unlock()
+		if closed {
+			w.WriteHeader(http.StatusTooManyRequests)
+			tplSetup.Execute(w, map[string]interface{}{"Threads": runtime.NumCPU(), "Error": "Terlalu banyak kode salah; setup ditutup. Mulai ulang server untuk kode baru."})
+			return
+		}
+		if !ok {
+			log.Printf("setup: wrong code from %s", clientIP(r))
+			tplSetup.Execute(w, map[string]interface{}{"Threads": runtime.NumCPU(), "Error": "Kode setup salah (lihat log server)."})
+			return
+		}
+		bundle, msg := setupBundle(r)
+		if msg == "" {
+			if err := importConfig(bundle); err != nil {
+				msg = "Gagal menyimpan konfigurasi: " + err.Error()
+			}
+		}
+		if msg != "" {
+			tplSetup.Execute(w, map[string]interface{}{"Threads": runtime.NumCPU(), "Error": msg})
+			return
+		}
+		scheme := "http"
+		if bundle.Settings["TLS_CERT"] != "" {
+			scheme = "https"
+		}
+		log.Printf("setup: configuration written to %s", CONFIG_FILE)
+		tplSetup.Execute(w, map[string]interface{}{"Done": true, "URL": scheme + "://" + r.Host + BASE_PATH + "/"})
+		finish.Do(func() { close(done) })
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, BASE_PATH+"/setup", http.StatusFound)
+	})
+	srv := &http.Server{Addr: addr, Handler: withProxy(mux)}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	<-done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+// setupBundle turns the form into a config bundle, or returns a message for the user.
+func setupBundle(r *http.Request) (configBundle, string) {
+	b := configBundle{Version: 1, Settings: map[string]string{}}
+	pw := r.FormValue("admin_password")
+	if len(pw) < 8 {
+		return b, "Kata sandi admin minimal 8 karakter."
+	}
+	if pw != r.FormValue("admin_password2") {
+		return b, "Konfirmasi kata sandi tidak sama."
+	}
+	b.Settings["ADMIN_PASSWORD"] = pw
+	if u := strings.TrimSpace(r.FormValue("admin_user")); u != "" {
+		b.Settings["ADMIN_USER"] = u
+	}
+	if dir := strings.TrimSpace(r.FormValue("storage_dir")); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return b, "Folder penyimpanan tidak bisa dibuat: " + err.Error()
+		}
+		b.Settings["STORAGE_BACKEND"] = "local"
+		b.Settings["STORAGE_LOCAL_DIR"] = dir
+	}
+	switch speed := r.FormValue("speed"); speed {
+	case "fast", "balanced":
+		b.Settings["SPEED_PRESET"] = speed
+	default:
+		return b, "Preset kecepatan tidak dikenal."
+	}
+	n, err := strconv.Atoi(r.FormValue("threads"))
+	if err != nil || n < 1 {
+		return b, "Jumlah thread harus angka ≥ 1."
+	}
+	b.Settings["THREADS"] = strconv.Itoa(n)
+	cert, key := strings.TrimSpace(r.FormValue("tls_cert")), strings.TrimSpace(r.FormValue("tls_key"))
+	if cert != "" || key != "" {
+		if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			return b, "Sertifikat TLS tidak bisa dibaca: " + err.Error()
+		}
+		b.Settings["TLS_CERT"] = cert
+		b.Settings["TLS_KEY"] = key
+	}
+	return b, ""
+}
+
+var tplSetup = template.Must(template.New("setup").Funcs(tplFuncs).Parse(`<!doctype html>
+<html lang="id">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width,initial-scale=1" />
+  <title>Setup awal</title>
+  <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body class="bg-light">
+  <div class="container py-4" style="max-width: 40rem">
+    <h3>🛠️ Setup awal</h3>
+    {{if .Done}}
+    <div class="alert alert-success">Konfigurasi tersimpan. Server sedang dimulai ulang.</div>
+    <p><a class="btn btn-primary" href="{{.URL}}">Buka aplikasi</a></p>
+    {{else}}
+    {{if .Error}}<div class="alert alert-danger">{{.Error}}</div>{{end}}
+    <form method="post" action="{{base}}/setup">
+      <div class="mb-3">
+        <label class="form-label">Kode setup</label>
+        <input class="form-control" name="code" required autofocus>
+        <div class="form-text">Tercetak di log server saat aplikasi dijalankan.</div>
+      </div>
+      <h5>Admin</h5>
+      <div class="mb-2"><label class="form-label">Nama pengguna</label><input class="form-control" name="admin_user" value="admin"></div>
+      <div class="mb-2"><label class="form-label">Kata sandi</label><input class="form-control" type="password" name="admin_password" minlength="8" required></div>
+      <div class="mb-3"><label class="form-label">Ulangi kata sandi</label><input class="form-control" type="password" name="admin_password2" minlength="8" required></div>
+      <h5>Penyimpanan</h5>
+      <div class="mb-3">
+        <label class="form-label">Folder hasil</label>
+        <input class="form-control" name="storage_dir" value="data">
+        <div class="form-text">Kosongkan untuk menyimpan hasil di memori saja (hilang saat restart).</div>
+      </div>
+      <h5>Bawaan pemrosesan</h5>
+      <div class="mb-2">
+        <label class="form-label">Preset kecepatan</label>
+        <select class="form-select" name="speed"><option value="fast" selected>fast</option><option value="balanced">balanced</option></select>
+      </div>
+      <div class="mb-3"><label class="form-label">Thread</label><input class="form-control" type="number" name="threads" min="1" value="{{.Threads}}"></div>
+      <h5>TLS (opsional)</h5>
+      <div class="mb-2"><label class="form-label">Berkas sertifikat (PEM)</label><input class="form-control" name="tls_cert" placeholder="/etc/ssl/certs/server.pem"></div>
+      <div class="mb-3"><label class="form-label">Berkas kunci (PEM)</label><input class="form-control" name="tls_key" placeholder="/etc/ssl/private/server.key"></div>
+      <button class="btn btn-success" type="submit">💾 Simpan & mulai</button>
+    </form>
+    {{end}}
+  </div>
+</body>
+</html>`))
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ===== Share links =====
+// POST /share (token, expires, password) makes a /s/<id> link for a result
+// that can be handed out instead of the owner's download token, which stays
+// secret (tokens are random, see newToken). Only the result's owner, or an
+// admin, can share it. Links expire (SHARE_TTL by default, at most
+// SHARE_MAX_TTL) and may require a password.
+// Shares live in Redis when REDIS_URL is set, otherwise in memory on the
+// replica that minted them (/s/ is proxied there like /download/).
+//
+//	SHARE_TTL=72h SHARE_MAX_TTL=720h
+
+type shareLink struct {
+	ID      string    `json:"id"`
+	Token   string    `json:"token"`
+	Hash    []byte    `json:"hash,omitempty"` // bcrypt of the password
+	Expires time.Time `json:"expires"`
+}
+
+var shares = struct {
+	sync.Mutex
+	m map[string]shareLink
+}{m: map[string]shareLink{}}
+
+func setupShares() { updateLive(shareSettings) }
+
+// shareSettings reads SHARE_TTL and SHARE_MAX_TTL into c.
+func shareSettings(c *liveConfig) error {
+	c.SHARE_TTL, c.SHARE_MAX_TTL = liveDefaults.SHARE_TTL, liveDefaults.SHARE_MAX_TTL
+	if d, err := time.ParseDuration(os.Getenv("SHARE_TTL")); err == nil && d > 0 {
+		c.SHARE_TTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("SHARE_MAX_TTL")); err == nil && d > 0 {
+		c.SHARE_MAX_TTL = d
+	}
+	return nil
+}
+
+// newShareID is a token with its own prefix: unguessable, with the replica tag.
+func newShareID() string { return newToken("s") }
+
+func saveShare(ctx context.Context, s shareLink) error {
+	if redisClient != nil {
+		b, _ := json.Marshal(s)
+		return redisClient.Set(ctx, "share:"+s.ID, b, time.Until(s.Expires)).Err()
+	}
+	shares.Lock()
+	defer shares.Unlock()
+	for id, old := range shares.m {
+		if time.Now().After(old.Expires) {
+			delete(shares.m, id)
+		}
+	}
+	shares.m[s.ID] = s
+	return nil
+}
+
+func loadShare(ctx context.Context, id string) (shareLink, error) {
+	var s shareLink
+	if redisClient != nil {
+		b, err := redisClient.Get(ctx, "share:"+id).Bytes()
+		if err == redis.Nil {
+			return s, errNoResult
+		}
+		if err != nil {
+			return s, err
+		}
+		if err := json.Unmarshal(b, &s); err != nil {
+			return s, err
+		}
+	} else {
+		shares.Lock()
+		var ok bool
+		s, ok = shares.m[id]
+		shares.Unlock()
+		if !ok {
+			return s, errNoResult
+		}
+	}
+	if time.Now().After(s.Expires) {
+		return s, errNoResult
+	}
+	return s, nil
+}
+
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" || !resultAvailable(token) {
+		http.Error(w, "unknown result token", http.StatusNotFound)
+		return
+	}
+	// only whoever made the result (or an admin) hands it out; without a
+	// recorded owner the unguessable token itself is the proof
+	if owner := resultOwnerOf(token); owner != "" && owner != resultOwner(r) {
+		if u := currentUser(r); u == nil || u.Role != roleAdmin {
+			log.Printf("share %s: refused for %s, result owned by %s", token, resultOwner(r), owner)
+			http.Error(w, "not your result", http.StatusForbidden)
+			return
+		}
+	}
+	cfg := live()
+	ttl := cfg.SHARE_TTL
+	if v := r.FormValue("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid expires: "+v, http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl > cfg.SHARE_MAX_TTL {
+		ttl = cfg.SHARE_MAX_TTL
+	}
+	s := shareLink{ID: newShareID(), Token: token, Expires: time.Now().Add(ttl)}
+	if pw := r.FormValue("password"); pw != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Hash = h
+	}
+	if err := saveShare(r.Context(), s); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	link := absoluteShareURL(r, s.ID)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": s.ID, "url": link, "expires": s.Expires, "password": s.Hash != nil})
+		return
+	}
+	tplIndex.Execute(w, map[string]interface{}{
+		"Message": "Link berbagi (berlaku sampai " + s.Expires.Format("02/01/2006 15:04") + "): " + link,
+	})
+}
+
+func absoluteShareURL(r *http.Request, id string) string {
+	if PUBLIC_BASE_URL != "" {
+		return PUBLIC_BASE_URL + "/s/" + id
+	}
+	return requestScheme(r) + "://" + r.Host + BASE_PATH + "/s/" + id
+}
+
+var tplSharePassword = template.Must(template.New("share").Funcs(tplFuncs).Parse(`<!doctype html>
+<html lang="id">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width,initial-scale=1" />
+  <title>Unduh hasil</title>
+  <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body class="bg-light">
+  <div class="container py-5" style="max-width: 28rem">
+    <h4>🔒 Hasil dilindungi kata sandi</h4>
+    {{if .Wrong}}<div class="alert alert-danger">Kata sandi salah.</div>{{end}}
+    <form method="post" action="{{base}}/s/{{.ID}}">
+      <input class="form-control mb-2" type="password" name="password" autofocus>
+      <button class="btn btn-success" type="submit">⬇️ Download</button>
+    </form>
+  </div>
+</body>
+</html>`))
+
+// shareDownloadHandler serves /s/<id>, asking for the password first if set.
+func shareDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/s/")
+	if redisClient == nil && proxyToOwner(w, r, id) {
+		return
+	}
+	s, err := loadShare(r.Context(), id)
+	if err == errNoResult {
+		http.Error(w, "Link tidak ditemukan atau sudah kedaluwarsa", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if s.Hash != nil {
+		pw := r.PostFormValue("password")
+		if r.Method != http.MethodPost || bcrypt.CompareHashAndPassword(s.Hash, []byte(pw)) != nil {
+			if pw != "" {
+				log.Printf("share %s: wrong password from %s", id, clientIP(r))
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			tplSharePassword.Execute(w, map[string]interface{}{"ID": id, "Wrong": pw != ""})
+			return
+		}
+	}
+	dl := r.Clone(r.Context())
+	dl.Method = http.MethodGet
+	dl.URL.Path = "/download/" + s.Token
+	downloadHandler(w, dl)
+}
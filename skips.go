@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ===== Skip taxonomy =====
+// Skipped files are sorted into a few categories so the result page can show
+// counts and filter by cause instead of one long list. The category is set
+// where the skip is made (processOneFileEntry, the ZIP reader, the upload
+// expansion) and travels with the message; the message is for people only
+// and is never parsed.
+
+// skipKind is the category of a skip.
+type skipKind string
+
+const (
+	skipPlaceholder skipKind = "placeholder"
+	skipUnsupported skipKind = "unsupported"
+	skipDecode      skipKind = "decode"
+	skipPDF         skipKind = "pdf"
+	skipUnreachable skipKind = "unreachable"
+	skipTooLarge    skipKind = "too_large"
+	skipEncrypted   skipKind = "encrypted"
+	skipCorrupt     skipKind = "corrupt"
+	skipOther       skipKind = "other"
+)
+
+var skipCategoryOrder = []skipKind{skipPlaceholder, skipUnsupported, skipDecode, skipPDF, skipUnreachable, skipTooLarge, skipEncrypted, skipCorrupt, skipOther}
+
+var skipCategoryNames = map[skipKind]string{
+	skipPlaceholder: "Kosong/placeholder",
+	skipUnsupported: "Format tidak didukung",
+	skipDecode:      "Gagal dibaca",
+	skipPDF:         "PDF gagal dirender",
+	skipUnreachable: "Target ukuran tak tercapai",
+	skipTooLarge:    "Terlalu besar",
+	skipEncrypted:   "Terenkripsi",
+	skipCorrupt:     "Rusak di dalam ZIP",
+	skipOther:       "Lainnya",
+}
+
+// skipItem is one skipped file (or PDF page / target) as shown on the result page.
+type skipItem struct {
+	Label    string   `json:"label"`
+	Message  string   `json:"message"`
+	Category skipKind `json:"category"`
+}
+
+type skipCount struct {
+	Category skipKind
+	Name     string
+	Count    int
+}
+
+// fileSkip is one reason (part of) a file was skipped.
+type fileSkip struct {
+	Kind    skipKind
+	Message string
+}
+
+func skipf(kind skipKind, format string, a ...interface{}) fileSkip {
+	return fileSkip{kind, fmt.Sprintf(format, a...)}
+}
+
+// skipMessages returns the messages of skips, for the places that show text only.
+func skipMessages(skips []fileSkip) []string {
+	msgs := make([]string, len(skips))
+	for i, s := range skips {
+		msgs[i] = s.Message
+	}
+	return msgs
+}
+
+// skipKinds returns the categories of skips, in the same order.
+func skipKinds(skips []fileSkip) []skipKind {
+	kinds := make([]skipKind, len(skips))
+	for i, s := range skips {
+		kinds[i] = s.Kind
+	}
+	return kinds
+}
+
+// placeholderBytes: an input this small that does not decode is taken for a
+// placeholder (the 0-byte and ~1 KB thumbnail stubs Windows leaves in ZIPs)
+// rather than a broken image. ignore_below_kb leaves such files out entirely.
+const placeholderBytes = 2 << 10
+
+// placeholderSkips rewords the decode errors of a tiny input that produced no
+// output as one placeholder skip; other skips are returned as they are. rel is
+// the name processOneFileEntry got, the subject of its messages.
+func placeholderSkips(rel string, size int, skipped []fileSkip) []fileSkip {
+	if size >= placeholderBytes || len(skipped) == 0 {
+		return skipped
+	}
+	for _, s := range skipped {
+		if s.Kind != skipDecode {
+			return skipped
+		}
+	}
+	return []fileSkip{skipf(skipPlaceholder, "%s: placeholder: %d bytes, not a readable image", rel, size)}
+}
+
+// newSkipItems lists the skips of one file; kinds are the categories of msgs,
+// in the same order. A message without one counts as other.
+func newSkipItems(label string, msgs []string, kinds []skipKind) []skipItem {
+	items := make([]skipItem, 0, len(msgs))
+	for i, m := range msgs {
+		kind := skipOther
+		if i < len(kinds) && kinds[i] != "" {
+			kind = kinds[i]
+		}
+		items = append(items, skipItem{Label: label, Message: m, Category: kind})
+	}
+	return items
+}
+
+// skipCounts lists the non-empty categories in display order.
+func skipCounts(items []skipItem) []skipCount {
+	n := map[skipKind]int{}
+	for _, it := range items {
+		n[it.Category]++
+	}
+	out := []skipCount{}
+	for _, c := range skipCategoryOrder {
+		if n[c] > 0 {
+			out = append(out, skipCount{Category: c, Name: skipCategoryNames[c], Count: n[c]})
+		}
+	}
+	return out
+}
+
+// skipText renders the skips for plain-text channels (mail replies).
+func skipText(items []skipItem) string {
+	if len(items) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dilewati (%d):\n", len(items))
+	for _, c := range skipCounts(items) {
+		fmt.Fprintf(&b, "  %s: %d\n", c.Name, c.Count)
+	}
+	for _, it := range items {
+		fmt.Fprintf(&b, "- %s: %s\n", it.Label, it.Message)
+	}
+	return b.String()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ===== Split ZIP sets =====
+// Mail providers that cap attachments push users to split archives
+// ("zip -s 20m", 7-Zip/WinRAR "split to volumes"): scans.z01, scans.z02, ...
+// and a final scans.zip that holds the central directory. Uploaded together
+// (in any order, as files of one request) the parts are put back into one
+// archive before extraction; a set with a part missing is reported as skipped.
+//
+// Joining concatenates the parts and rebases the per-part offsets of the
+// central directory onto the whole. ZIP64 sets are refused.
+//
+//	curl -F files=@scans.z01 -F files=@scans.z02 -F files=@scans.zip .../process
+
+var splitPartRe = regexp.MustCompile(`(?i)\.z(\d{2,3})$`)
+
+// splitPart is the 1-based number of a ".z01"-style part, 0 for other names.
+func splitPart(name string) int {
+	m := splitPartRe.FindStringSubmatch(name)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// splitZips gathers the split sets among the uploads of one request.
+type splitZips struct {
+	parts map[string]map[int][]byte // set (name without extension) -> part number -> data
+	last  map[string]splitLast
+	order []string
+}
+
+// splitLast is the final ".zip" of a set and how many parts come before it.
+type splitLast struct {
+	name  string
+	data  []byte
+	disks int
+}
+
+func newSplitZips() *splitZips {
+	return &splitZips{parts: map[string]map[int][]byte{}, last: map[string]splitLast{}}
+}
+
+// jobs is jobsFromUpload for an upload that may belong to a split set: parts
+// are held (no jobs) until the set is complete, then the joined archive is
+// expanded under the name of its .zip.
+func (s *splitZips) jobs(name string, b []byte, usedLabels map[string]int, pol extPolicy) []Job {
+	n := splitPart(name)
+	if !ALLOW_ZIP || n == 0 && extLower(name) != ".zip" {
+		return jobsFromUpload(name, b, usedLabels, pol)
+	}
+	set := strings.TrimSuffix(name, path.Ext(name))
+	if n > 0 {
+		if s.parts[set] == nil {
+			s.parts[set] = map[int][]byte{}
+		}
+		s.parts[set][n] = b
+	} else {
+		disks, err := zipDisk(b)
+		if err != nil || disks == 0 {
+			return jobsFromUpload(name, b, usedLabels, pol)
+		}
+		s.last[set] = splitLast{name: name, data: b, disks: disks}
+	}
+	if _, seen := s.last[set]; !seen || s.parts[set] == nil {
+		s.remember(set)
+		return nil
+	}
+	last := s.last[set]
+	all := make([][]byte, 0, last.disks+1)
+	for i := 1; i <= last.disks; i++ {
+		p, ok := s.parts[set][i]
+		if !ok {
+			s.remember(set)
+			return nil
+		}
+		all = append(all, p)
+	}
+	delete(s.parts, set)
+	delete(s.last, set)
+	joined, err := joinSplitZip(append(all, last.data))
+	if err != nil {
+		return []Job{{Label: safeName(path.Base(set)), Rel: last.name, Source: last.name, Skip: "unzip error: split ZIP: " + err.Error(), SkipKind: skipOther}}
+	}
+	return jobsFromUpload(last.name, joined, usedLabels, pol)
+}
+
+func (s *splitZips) remember(set string) {
+	for _, o := range s.order {
+		if o == set {
+			return
+		}
+	}
+	s.order = append(s.order, set)
+}
+
+// incomplete reports the sets still missing parts once all uploads are in.
+func (s *splitZips) incomplete() []Job {
+	jobs := []Job{}
+	for _, set := range s.order {
+		last, ok := s.last[set]
+		if !ok && s.parts[set] == nil {
+			continue // completed
+		}
+		label := safeName(path.Base(set))
+		if !ok {
+			nums := []int{}
+			for n := range s.parts[set] {
+				nums = append(nums, n)
+			}
+			sort.Ints(nums)
+			for _, n := range nums {
+				rel := fmt.Sprintf("%s.z%02d", set, n)
+				jobs = append(jobs, Job{Label: label, Rel: rel, Source: rel, Skip: "split ZIP incomplete: " + path.Base(set) + ".zip (the last part) is missing", SkipKind: skipOther})
+			}
+			continue
+		}
+		missing := []string{}
+		for i := 1; i <= last.disks; i++ {
+			if _, ok := s.parts[set][i]; !ok {
+				missing = append(missing, fmt.Sprintf("%s.z%02d", path.Base(set), i))
+			}
+		}
+		jobs = append(jobs, Job{Label: label, Rel: last.name, Source: last.name, Skip: "split ZIP incomplete: missing " + strings.Join(missing, ", "), SkipKind: skipOther})
+	}
+	return jobs
+}
+
+const (
+	eocdSig    = 0x06054b50
+	eocdLen    = 22
+	cdEntrySig = 0x02014b50
+	cdEntryLen = 46
+)
+
+// findEOCD locates the end of central directory record of a ZIP (part).
+func findEOCD(b []byte) (int, error) {
+	lo := len(b) - eocdLen - 0xffff
+	if lo < 0 {
+		lo = 0
+	}
+	for i := len(b) - eocdLen; i >= lo; i-- {
+		if binary.LittleEndian.Uint32(b[i:]) == eocdSig {
+			return i, nil
+		}
+	}
+	return 0, errors.New("not a ZIP file")
+}
+
+// zipDisk is the number of the part holding the end of the archive, i.e. how
+// many parts come before b in a split set; 0 for a plain ZIP.
+func zipDisk(b []byte) (int, error) {
+	at, err := findEOCD(b)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint16(b[at+4:])), nil
+}
+
+// joinSplitZip turns the parts of a split set, in order with the .zip last,
+// into one plain archive.
+func joinSplitZip(parts [][]byte) ([]byte, error) {
+	starts := make([]int64, len(parts))
+	var buf bytes.Buffer
+	for i, p := range parts {
+		starts[i] = int64(buf.Len())
+		buf.Write(p)
+	}
+	b := buf.Bytes()
+	last := len(parts) - 1
+	at, err := findEOCD(parts[last])
+	if err != nil {
+		return nil, err
+	}
+	eocd := b[starts[last]+int64(at):]
+	le := binary.LittleEndian
+	disk := func(n uint16) (int64, error) {
+		if int(n) > last {
+			return 0, fmt.Errorf("refers to part %d of %d", int(n)+1, len(parts))
+		}
+		return starts[n], nil
+	}
+	if int(le.Uint16(eocd[4:])) != last {
+		return nil, fmt.Errorf("the .zip says %d parts, got %d", int(le.Uint16(eocd[4:]))+1, len(parts))
+	}
+	entries, cdOff := le.Uint16(eocd[10:]), le.Uint32(eocd[16:])
+	if entries == 0xffff || cdOff == 0xffffffff {
+		return nil, errors.New("ZIP64 split archives are not supported")
+	}
+	base, err := disk(le.Uint16(eocd[6:]))
+	if err != nil {
+		return nil, fmt.Errorf("central directory %v", err)
+	}
+	cd := base + int64(cdOff)
+	pos := cd
+	for i := 0; i < int(entries); i++ {
+		if pos+cdEntryLen > int64(len(b)) || le.Uint32(b[pos:]) != cdEntrySig {
+			return nil, errors.New("corrupt central directory")
+		}
+		e := b[pos:]
+		if le.Uint32(e[20:]) == 0xffffffff || le.Uint32(e[24:]) == 0xffffffff || le.Uint32(e[42:]) == 0xffffffff {
+			return nil, errors.New("ZIP64 split archives are not supported")
+		}
+		start, err := disk(le.Uint16(e[34:]))
+		if err != nil {
+			return nil, fmt.Errorf("entry %d %v", i+1, err)
+		}
+		off := start + int64(le.Uint32(e[42:]))
+		if off > 0xffffffff {
+			return nil, errors.New("joined archive over 4 GB")
+		}
+		le.PutUint16(e[34:], 0)
+		le.PutUint32(e[42:], uint32(off))
+		pos += cdEntryLen + int64(le.Uint16(e[28:])) + int64(le.Uint16(e[30:])) + int64(le.Uint16(e[32:]))
+	}
+	if cd > 0xffffffff {
+		return nil, errors.New("joined archive over 4 GB")
+	}
+	le.PutUint16(eocd[4:], 0)
+	le.PutUint16(eocd[6:], 0)
+	le.PutUint16(eocd[8:], entries)
+	le.PutUint32(eocd[16:], uint32(cd))
+	return b, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestSplitPart(t *testing.T) {
+	for name, want := range map[string]int{
+		"scans.z01":   1,
+		"scans.Z02":   2,
+		"scans.z100":  100,
+		"scans.zip":   0,
+		"scans.z1":    0,
+		"scans.z01.x": 0,
+	} {
+		if got := splitPart(name); got != want {
+			t.Errorf("splitPart(%q) = %d, want %d", name, got, want)
+		}
+	}
+}
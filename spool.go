@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/adityafaths/multicompressgo/compress"
+)
+
+// ===== Master ZIP spool =====
+// The master ZIP is assembled in ZIP_SPOOL_DIR as workers finish instead of
+// growing an in-memory buffer, and synced to disk every ZIP_SYNC_EVERY
+// entries. When the job is done the file is renamed to <job>.zip and kept as
+// the result: downloads stream it from disk, so memory stays flat however big
+// the batch. After a crash an unfinished archive stays behind as
+// <job>.zip.part and can be repaired with `zip -FF`; such leftovers are
+// logged at startup, finished results of the previous run are removed.
+// ZIP_SPOOL_DIR=off assembles and keeps results in memory as before.
+//
+//	ZIP_SPOOL_DIR=/var/lib/multicompress/spool ZIP_SYNC_EVERY=16
+
+var (
+	ZIP_SPOOL_DIR  = filepath.Join(os.TempDir(), "multicompressgo-spool")
+	ZIP_SYNC_EVERY = 16
+)
+
+func setupSpool() {
+	if v := os.Getenv("ZIP_SPOOL_DIR"); v != "" {
+		ZIP_SPOOL_DIR = v
+	}
+	if ZIP_SPOOL_DIR == "off" {
+		ZIP_SPOOL_DIR = ""
+		return
+	}
+	if n, err := strconv.Atoi(os.Getenv("ZIP_SYNC_EVERY")); err == nil && n >= 0 {
+		ZIP_SYNC_EVERY = n
+	}
+	if err := os.MkdirAll(ZIP_SPOOL_DIR, 0o700); err != nil {
+		log.Printf("spool: %v, assembling ZIPs in memory", err)
+		ZIP_SPOOL_DIR = ""
+		return
+	}
+	parts, _ := filepath.Glob(filepath.Join(ZIP_SPOOL_DIR, "*.zip.part"))
+	for _, p := range parts {
+		log.Printf("spool: partial archive of an interrupted job: %s", p)
+	}
+}
+
+// removeStaleResults deletes the finished results of a previous server run:
+// they were only reachable through memZips. Only the server calls it, the
+// CLI and workers share the spool with a running one.
+func removeStaleResults() {
+	if ZIP_SPOOL_DIR == "" {
+		return
+	}
+	stale, _ := filepath.Glob(filepath.Join(ZIP_SPOOL_DIR, "*.zip"))
+	for _, p := range stale {
+		os.Remove(p)
+	}
+	if len(stale) > 0 {
+		log.Printf("spool: removed %d results of the previous run", len(stale))
+	}
+}
+
+// masterArchive is a master ZIP being assembled, in the spool or in memory.
+type masterArchive struct {
+	*compress.Archive
+	file *os.File
+}
+
+// newMasterArchive starts the master ZIP of jobID; call finish, or discard
+// when the job failed.
+func newMasterArchive(jobID string) *masterArchive {
+	if ZIP_SPOOL_DIR == "" {
+		return &masterArchive{Archive: compress.NewArchive()}
+	}
+	// a unique name, as for isolated jobs: the job ID comes from the client
+	// and a reused one must not truncate the archive of a running job
+	f, err := os.CreateTemp(ZIP_SPOOL_DIR, jobID+"-*.zip.part")
+	if err != nil {
+		log.Printf("spool: %v, assembling in memory", err)
+		return &masterArchive{Archive: compress.NewArchive()}
+	}
+	return &masterArchive{Archive: compress.NewFileArchive(f, ZIP_SYNC_EVERY), file: f}
+}
+
+// finish completes the archive; a spooled one loses its .part suffix and
+// becomes the result file.
+func (m *masterArchive) finish() (resultZip, error) {
+	if m.file == nil {
+		data, err := m.Bytes()
+		return resultZip{data: data, size: int64(len(data))}, err
+	}
+	defer m.discard()
+	size, err := m.Finish()
+	if err != nil {
+		return resultZip{}, err
+	}
+	path := strings.TrimSuffix(m.file.Name(), ".part")
+	if err := os.Rename(m.file.Name(), path); err != nil {
+		return resultZip{}, err
+	}
+	return resultZip{path: path, size: size}, nil
+}
+
+// discard closes and removes the spool file, if it is still there.
+func (m *masterArchive) discard() {
+	if m.file != nil {
+		m.file.Close()
+		os.Remove(m.file.Name())
+	}
+}
+
+// resultZip is a finished master ZIP: a file (in ZIP_SPOOL_DIR, normally) or,
+// with the spool off, its bytes.
+type resultZip struct {
+	path string
+	data []byte
+	size int64
+}
+
+// zipFile reads a resultZip; http.ServeContent and zip.NewReader take it as is.
+type zipFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+type memZipFile struct{ *bytes.Reader }
+
+func (memZipFile) Close() error { return nil }
+
+func (z resultZip) open() (zipFile, error) {
+	if z.path == "" {
+		return memZipFile{bytes.NewReader(z.data)}, nil
+	}
+	return os.Open(z.path)
+}
+
+// bytes loads the whole ZIP, for the few consumers that need it in memory.
+func (z resultZip) bytes() ([]byte, error) {
+	if z.path == "" {
+		return z.data, nil
+	}
+	return os.ReadFile(z.path)
+}
+
+// saveAs moves the ZIP to path (copying across file systems).
+func (z resultZip) saveAs(path string, perm os.FileMode) error {
+	if z.path == "" {
+		return os.WriteFile(path, z.data, perm)
+	}
+	if err := os.Rename(z.path, path); err == nil {
+		return os.Chmod(path, perm)
+	}
+	src, err := os.Open(z.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(z.path)
+}
+
+// remove deletes the result file, if any.
+func (z resultZip) remove() {
+	if z.path != "" {
+		os.Remove(z.path)
+	}
+}
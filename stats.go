@@ -0,0 +1,124 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/adityafaths/multicompressgo/compress"
+)
+
+// ===== /stats dashboard =====
+// Aggregates the SQLite history; bars are plain CSS so no chart library is needed.
+
+type statBar struct {
+	Label   string
+	Value   float64
+	Percent float64 // width relative to the largest value in the series
+	Note    string
+}
+
+type statsPage struct {
+	Enabled     bool
+	Jobs        int
+	Files       int
+	AvgRatio    float64
+	FailureRate float64
+	PerDay      []statBar
+	ByFormat    []statBar
+	ByHour      []statBar
+	Quality     compress.QualityStats
+}
+
+func queryBars(q string, args ...interface{}) []statBar {
+	rows, err := historyDB.Query(q, args...)
+	if err != nil {
+		log.Printf("stats: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	bars := []statBar{}
+	peak := 0.0
+	for rows.Next() {
+		var b statBar
+		if err := rows.Scan(&b.Label, &b.Value, &b.Note); err != nil {
+			log.Printf("stats: %v", err)
+			return nil
+		}
+		if b.Value > peak {
+			peak = b.Value
+		}
+		bars = append(bars, b)
+	}
+	for i := range bars {
+		if peak > 0 {
+			bars[i].Percent = bars[i].Value / peak * 100
+		}
+	}
+	return bars
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	page := statsPage{Enabled: historyDB != nil, Quality: compress.DefaultModel.Stats()}
+	if historyDB != nil {
+		historyDB.QueryRow(`SELECT COUNT(*) FROM jobs`).Scan(&page.Jobs)
+		historyDB.QueryRow(`SELECT COUNT(*),
+			COALESCE(AVG(CASE WHEN ok = 1 AND in_bytes > 0 THEN CAST(out_bytes AS REAL) / in_bytes END), 0),
+			COALESCE(100.0 * AVG(1 - ok), 0) FROM files`).Scan(&page.Files, &page.AvgRatio, &page.FailureRate)
+		page.PerDay = queryBars(`SELECT date(finished, 'unixepoch') AS d, COUNT(*), '' FROM files
+			GROUP BY d ORDER BY d DESC LIMIT 30`)
+		page.ByFormat = queryBars(`SELECT ext, 100.0 * AVG(1 - ok), '% dari ' || COUNT(*) || ' berkas' FROM files
+			GROUP BY ext ORDER BY COUNT(*) DESC`)
+		page.ByHour = queryBars(`SELECT strftime('%H', finished, 'unixepoch', 'localtime') AS h, COUNT(*), '' FROM files
+			GROUP BY h ORDER BY h`)
+	}
+	tplStats.Execute(w, page)
+}
+
+var tplStats = template.Must(template.New("stats").Funcs(tplFuncs).Parse(`<!doctype html>
+<html lang="id">
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width,initial-scale=1" />
+  <title>Statistik pemrosesan</title>
+  <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
+</head>
+<body class="bg-light">
+  <div class="container py-4">
+    <h3>📈 Statistik pemrosesan</h3>
+    {{if not .Enabled}}
+    <div class="alert alert-warning">Riwayat nonaktif (HISTORY_DB=off atau gagal dibuka).</div>
+    {{else}}
+    <div class="row mb-4">
+      <div class="col"><div class="card"><div class="card-body"><h6>Job</h6><h4>{{.Jobs}}</h4></div></div></div>
+      <div class="col"><div class="card"><div class="card-body"><h6>Berkas</h6><h4>{{.Files}}</h4></div></div></div>
+      <div class="col"><div class="card"><div class="card-body"><h6>Rasio kompresi rata-rata</h6><h4>{{printf "%.2f" .AvgRatio}}</h4></div></div></div>
+      <div class="col"><div class="card"><div class="card-body"><h6>Tingkat gagal</h6><h4>{{printf "%.1f%%" .FailureRate}}</h4></div></div></div>
+    </div>
+    <h5>Berkas per hari (30 hari terakhir)</h5>
+    {{template "bars" .PerDay}}
+    <h5 class="mt-4">Tingkat gagal per format (%)</h5>
+    {{template "bars" .ByFormat}}
+    <h5 class="mt-4">Jam tersibuk</h5>
+    {{template "bars" .ByHour}}
+    {{end}}
+    <h5 class="mt-4">Prediksi kualitas (sejak server start)</h5>
+    {{with .Quality}}
+    <p>{{.Searches}} pencarian, {{.Seeded}} dimulai dari prediksi, tepat (±1) {{printf "%.0f%%" .HitRate}}.
+      Rata-rata encode: {{printf "%.1f" .AvgSeeded}} dengan prediksi vs {{printf "%.1f" .AvgPlain}} tanpa.</p>
+    {{end}}
+    <p class="mt-4"><a href="{{base}}/">← Kembali</a></p>
+  </div>
+</body>
+</html>
+    {{define "bars"}}
+    {{range .}}
+    <div class="d-flex align-items-center mb-1">
+      <div style="width: 8em"><small>{{.Label}}</small></div>
+      <div class="progress flex-grow-1"><div class="progress-bar" style="width: {{.Percent}}%"></div></div>
+      <div class="ms-2" style="width: 10em"><small>{{printf "%.0f" .Value}} {{.Note}}</small></div>
+    </div>
+    {{else}}
+    <p class="text-muted">Belum ada data.</p>
+    {{end}}
+    {{end}}`))
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"google.golang.org/api/iterator"
+)
+
+// ===== Object storage =====
+// Optional backend for result archives and input files, selected with
+// STORAGE_BACKEND=local|azure|gcs|s3. Without it everything stays local.
+// Inputs can be pulled from a key prefix (input_prefix, or -input-prefix in the
+// CLI) and the result written back under another one (output_prefix /
+// -output-prefix), as the master ZIP or, with output_files=on / -output-files,
+// as the individual outputs.
+//
+// A request's input_prefix must lie under one of INPUT_PREFIXES (comma
+// separated, default UPLOADS_PREFIX), so callers cannot read results/ or
+// other areas of the store; the CLI's -input-prefix is not limited.
+//
+//	local: STORAGE_LOCAL_DIR
+//	azure: AZURE_STORAGE_ACCOUNT, AZURE_STORAGE_KEY, AZURE_STORAGE_CONTAINER
+//	gcs:   GCS_BUCKET (credentials via GOOGLE_APPLICATION_CREDENTIALS)
+//	s3:    S3_BUCKET, S3_REGION, S3_ENDPOINT and S3_PATH_STYLE=1 for MinIO and
+//	       other S3-compatible stores (credentials via AWS_ACCESS_KEY_ID /
+//	       AWS_SECRET_ACCESS_KEY, AWS_PROFILE or the instance role)
+
+type blobStorage interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a time-limited direct link, or errNoSignedURL.
+	SignedURL(key string, ttl time.Duration) (string, error)
+	// SignedPutURL returns a time-limited URL a client can PUT the object to.
+	SignedPutURL(key string, ttl time.Duration) (string, error)
+}
+
+var errNoSignedURL = errors.New("storage backend has no signed URLs")
+
+var (
+	store           blobStorage
+	SIGNED_URL_TTL  = 15 * time.Minute
+	RESULTS_PREFIX  = "results/"
+	UPLOADS_PREFIX  = "uploads/"
+	storageTimeout  = 2 * time.Minute
+	errUnknownStore = errors.New("unknown STORAGE_BACKEND")
+	errInputPrefix  = errors.New("input_prefix not allowed")
+	INPUT_PREFIXES  = []string{UPLOADS_PREFIX}
+)
+
+func setupStorage() error {
+	if v := os.Getenv("INPUT_PREFIXES"); v != "" {
+		INPUT_PREFIXES = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				INPUT_PREFIXES = append(INPUT_PREFIXES, strings.TrimSuffix(p, "/")+"/")
+			}
+		}
+	}
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "":
+		return nil
+	case "local":
+		dir := os.Getenv("STORAGE_LOCAL_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+		store = localStorage{root: dir}
+	case "azure":
+		s, err := newAzureStorage(os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY"), os.Getenv("AZURE_STORAGE_CONTAINER"))
+		if err != nil {
+			return err
+		}
+		store = s
+	case "gcs":
+		s, err := newGCSStorage(os.Getenv("GCS_BUCKET"))
+		if err != nil {
+			return err
+		}
+		store = s
+	case "s3":
+		s, err := newS3Storage(os.Getenv("S3_BUCKET"), os.Getenv("S3_REGION"), os.Getenv("S3_ENDPOINT"), os.Getenv("S3_PATH_STYLE") == "1")
+		if err != nil {
+			return err
+		}
+		store = s
+	default:
+		return fmt.Errorf("%w: %q", errUnknownStore, backend)
+	}
+	return nil
+}
+
+// ----- local disk -----
+type localStorage struct{ root string }
+
+func (l localStorage) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+key)), "/")))
+}
+
+func (l localStorage) Put(ctx context.Context, key string, data []byte) error {
+	p := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o644)
+}
+
+func (l localStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(l.path(key))
+}
+
+func (l localStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.Walk(l.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(l.root, p)
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (l localStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(l.path(key))
+}
+
+func (l localStorage) SignedURL(key string, ttl time.Duration) (string, error) {
+	return "", errNoSignedURL
+}
+
+func (l localStorage) SignedPutURL(key string, ttl time.Duration) (string, error) {
+	return "", errNoSignedURL
+}
+
+// ----- Azure Blob -----
+type azureStorage struct {
+	client    *azblob.Client
+	container string
+}
+
+func newAzureStorage(account, key, container string) (*azureStorage, error) {
+	if account == "" || key == "" || container == "" {
+		return nil, errors.New("azure storage needs AZURE_STORAGE_ACCOUNT, AZURE_STORAGE_KEY and AZURE_STORAGE_CONTAINER")
+	}
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := azblob.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.blob.core.windows.net/", account), cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &azureStorage{client: client, container: container}, nil
+}
+
+func (a *azureStorage) Put(ctx context.Context, key string, data []byte) error {
+	_, err := a.client.UploadBuffer(ctx, a.container, key, data, nil)
+	return err
+}
+
+func (a *azureStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := a.client.DownloadStream(ctx, a.container, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (a *azureStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	pager := a.client.NewListBlobsFlatPager(a.container, &azblob.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range page.Segment.BlobItems {
+			keys = append(keys, *b.Name)
+		}
+	}
+	return keys, nil
+}
+
+func (a *azureStorage) Delete(ctx context.Context, key string) error {
+	_, err := a.client.DeleteBlob(ctx, a.container, key, nil)
+	return err
+}
+
+func (a *azureStorage) SignedURL(key string, ttl time.Duration) (string, error) {
+	blob := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(key)
+	return blob.GetSASURL(sas.BlobPermissions{Read: true}, time.Now().Add(ttl), nil)
+}
+
+// SignedPutURL needs the client to send "x-ms-blob-type: BlockBlob" with the PUT.
+func (a *azureStorage) SignedPutURL(key string, ttl time.Duration) (string, error) {
+	blob := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(key)
+	return blob.GetSASURL(sas.BlobPermissions{Create: true, Write: true}, time.Now().Add(ttl), nil)
+}
+
+// ----- Google Cloud Storage -----
+type gcsStorage struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSStorage(bucket string) (*gcsStorage, error) {
+	if bucket == "" {
+		return nil, errors.New("gcs storage needs GCS_BUCKET")
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStorage{bucket: client.Bucket(bucket)}, nil
+}
+
+func (g *gcsStorage) Put(ctx context.Context, key string, data []byte) error {
+	w := g.bucket.Object(key).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (g *gcsStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := g.bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (g *gcsStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, attrs.Name)
+	}
+}
+
+func (g *gcsStorage) Delete(ctx context.Context, key string) error {
+	return g.bucket.Object(key).Delete(ctx)
+}
+
+func (g *gcsStorage) SignedURL(key string, ttl time.Duration) (string, error) {
+	return g.bucket.SignedURL(key, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(ttl),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+func (g *gcsStorage) SignedPutURL(key string, ttl time.Duration) (string, error) {
+	return g.bucket.SignedURL(key, &storage.SignedURLOptions{
+		Method:  "PUT",
+		Expires: time.Now().Add(ttl),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+// ----- Amazon S3 and compatibles -----
+type s3Storage struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+}
+
+func newS3Storage(bucket, region, endpoint string, pathStyle bool) (*s3Storage, error) {
+	if bucket == "" {
+		return nil, errors.New("s3 storage needs S3_BUCKET")
+	}
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	})
+	return &s3Storage{client: client, presign: s3.NewPresignClient(client), bucket: bucket}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key), Body: bytes.NewReader(data)})
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	pager := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	return err
+}
+
+func (s *s3Storage) SignedURL(key string, ttl time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3Storage) SignedPutURL(key string, ttl time.Duration) (string, error) {
+	req, err := s.presign.PresignPutObject(context.Background(), &s3.PutObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// checkInputPrefix refuses a client's input_prefix outside INPUT_PREFIXES.
+func checkInputPrefix(prefix string) error {
+	if strings.Contains("/"+prefix+"/", "/../") {
+		return fmt.Errorf("%w: %q", errInputPrefix, prefix)
+	}
+	for _, allowed := range INPUT_PREFIXES {
+		if strings.HasPrefix(prefix, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q is not under %s", errInputPrefix, prefix, strings.Join(INPUT_PREFIXES, ", "))
+}
+
+// checkStoredInputs vets the storage references of a request (input_prefix,
+// input_keys) before any job is built; handlers answer 400 with the error.
+func checkStoredInputs(r *http.Request) error {
+	if store == nil {
+		return nil
+	}
+	if prefix := r.FormValue("input_prefix"); prefix != "" {
+		if err := checkInputPrefix(prefix); err != nil {
+			return err
+		}
+	}
+	for _, key := range r.PostForm["input_keys"] {
+		if err := checkUploadKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobsFromStorage pulls every object under prefix as an input.
+func jobsFromStorage(prefix string, usedLabels map[string]int, pol extPolicy) ([]Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return jobsFromKeys(ctx, keys, func(key string) string { return strings.TrimPrefix(key, prefix) }, usedLabels, pol)
+}
+
+// jobsFromKeys fetches the given objects, named as name(key). Split ZIP sets
+// (splitzip.go) are joined across the keys.
+func jobsFromKeys(ctx context.Context, keys []string, name func(string) string, usedLabels map[string]int, pol extPolicy) ([]Job, error) {
+	jobs := []Job{}
+	splits := newSplitZips()
+	for _, key := range keys {
+		if pol.hidden(name(key)) {
+			continue
+		}
+		if why := pol.refuse(key); why != "" && extLower(key) != ".zip" && splitPart(key) == 0 {
+			jobs = append(jobs, Job{Label: "file", Rel: name(key), Skip: why, SkipKind: skipUnsupported})
+			continue
+		}
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		jobs = append(jobs, splits.jobs(name(key), data, usedLabels, pol)...)
+	}
+	return append(jobs, splits.incomplete()...), nil
+}
+
+// checkOutputPrefix refuses prefixes that would write into the server's own areas.
+func checkOutputPrefix(prefix string) error {
+	for _, own := range []string{RESULTS_PREFIX, UPLOADS_PREFIX, CAS_PREFIX} {
+		if strings.HasPrefix(prefix, own) || strings.HasPrefix(own, prefix) {
+			return fmt.Errorf("output prefix %q overlaps %q", prefix, own)
+		}
+	}
+	return nil
+}
+
+// exportResult writes a finished result under prefix: the master ZIP as
+// prefix+name, or each file in it when files is set. It returns the number of
+// objects written.
+func exportResult(ctx context.Context, result resultZip, prefix, name string, files bool) (int, error) {
+	if !files {
+		data, err := result.bytes()
+		if err != nil {
+			return 0, err
+		}
+		if err := store.Put(ctx, prefix+name, data); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	f, err := result.open()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, result.size)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return n, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return n, err
+		}
+		if err := store.Put(ctx, prefix+zf.Name, data); err != nil {
+			return n, fmt.Errorf("%s: %w", zf.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// exportToPrefix is exportResult for the kept result of token.
+func exportToPrefix(token, prefix, name string, files bool) (int, error) {
+	memZips.RLock()
+	result, ok := memZips.m[token]
+	memZips.RUnlock()
+	if !ok {
+		return 0, errNoResult
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	return exportResult(ctx, result, prefix, name, files)
+}
+
+// ===== Direct-to-storage uploads =====
+// Large ZIPs can skip the Go server entirely:
+//  1. POST /upload-url with one "name" per file -> [{name, key, url, headers}]
+//  2. the browser PUTs each file to its url (sending the listed headers)
+//  3. POST /process with the returned keys as "input_keys"
+// The bucket/container needs a CORS rule allowing PUT from this site's origin.
+
+type uploadSlot struct {
+	Name    string            `json:"name"`
+	Key     string            `json:"key"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func uploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if store == nil {
+		http.Error(w, "no STORAGE_BACKEND configured", http.StatusNotImplemented)
+		return
+	}
+	r.ParseForm()
+	names := r.Form["name"]
+	if len(names) == 0 {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	batch := UPLOADS_PREFIX + randomID() + "/"
+	slots := make([]uploadSlot, 0, len(names))
+	for _, name := range names {
+		if ext := extLower(name); !serverAccepts(ext) && ext != ".zip" {
+			http.Error(w, "unsupported file type: "+name, http.StatusBadRequest)
+			return
+		}
+		key := batch + path.Base(filepath.ToSlash(name))
+		u, err := store.SignedPutURL(key, SIGNED_URL_TTL)
+		if errors.Is(err, errNoSignedURL) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slot := uploadSlot{Name: name, Key: key, URL: u}
+		if _, ok := store.(*azureStorage); ok {
+			slot.Headers = map[string]string{"x-ms-blob-type": "BlockBlob"}
+		}
+		slots = append(slots, slot)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slots)
+}
+
+// checkUploadKey accepts only keys of the shape /upload-url issues,
+// UPLOADS_PREFIX + batch id + "/" + base name; anything else (other
+// prefixes, extra folders, "..") could point at results or foreign objects.
+func checkUploadKey(key string) error {
+	rest, ok := strings.CutPrefix(key, UPLOADS_PREFIX)
+	batch, name, _ := strings.Cut(rest, "/")
+	if !ok || path.Clean(key) != key || batch == "" || strings.Trim(batch, "0123456789abcdef") != "" ||
+		name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("%s: not an upload key", key)
+	}
+	return nil
+}
+
+// jobsFromUploadKeys loads objects uploaded through /upload-url.
+func jobsFromUploadKeys(keys []string, usedLabels map[string]int, pol extPolicy) ([]Job, error) {
+	for _, key := range keys {
+		if err := checkUploadKey(key); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	// each upload key is a folder of its own; the file keeps its name
+	return jobsFromKeys(ctx, keys, path.Base, usedLabels, pol)
+}
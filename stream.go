@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ===== Streamed uploads =====
+// POST /process?stream=1 reads the multipart body part by part and hands each
+// uploaded file to the workers as soon as it is in, so compressing overlaps
+// with the rest of the upload instead of waiting for ParseMultipartForm to
+// buffer the whole body. The page uses it; with JOB_ISOLATION the request is
+// buffered as before (the job worker takes all jobs at once).
+//
+// In exchange the settings and every other field must come before the first
+// file, as the page sends them. A field after it (only input_prefix and
+// input_keys may follow) is refused with 400 and the work done so far is
+// dropped; so is an upload whose files_sha256/folder_sha256 digest doesn't
+// match. folder_paths must precede the folder files. The fields together are
+// capped like ParseMultipartForm caps them (streamFormMax bytes, at most
+// streamFieldsMax values); beyond that the answer is 413.
+//
+//	curl -F targets=168-174 -F files=@scans1.zip -F files=@scans2.zip '.../process?stream=1'
+
+var (
+	errLateField    = errors.New("form field after the first file (send settings first)")
+	errBadUpload    = errors.New("bad upload")
+	errFormTooLarge = errors.New("form fields too large")
+)
+
+// Bounds on the non-file fields of a streamed upload: one field, all of them
+// (ParseMultipartForm's 10 MB) and their number.
+const (
+	streamFieldMax  = 1 << 20
+	streamFormMax   = 10 << 20
+	streamFieldsMax = 1000
+)
+
+func processStreamed(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Parse error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the fields land in the request's form as they arrive, so FormValue and
+	// readSettings work as for a parsed form
+	r.Form, r.PostForm = url.Values{}, url.Values{}
+	for k, v := range r.URL.Query() {
+		r.Form[k] = v
+	}
+	r.MultipartForm = &multipart.Form{Value: r.PostForm, File: map[string][]*multipart.FileHeader{}}
+	part, err := nextUpload(mr, r, false)
+	if errors.Is(err, errFormTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, ok := processSettings(w, r)
+	if !ok {
+		return
+	}
+	if part == nil && r.FormValue("input_prefix") == "" && len(r.PostForm["input_keys"]) == 0 {
+		tplIndex.Execute(w, map[string]interface{}{"Message": "Silakan upload minimal satu file."})
+		return
+	}
+
+	manifest, gallery, err := runJobStream(func(add func([]Job)) error {
+		return streamJobs(mr, part, r, opts, add)
+	}, opts, r.FormValue("job_id"))
+	switch {
+	case errors.Is(err, errNoWork):
+		tplIndex.Execute(w, map[string]interface{}{"Message": noWorkMessage})
+		return
+	case errors.Is(err, errFormTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errLateField), errors.Is(err, errBadUpload), errors.Is(err, errChecksum):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	respondProcessed(w, r, manifest, gallery)
+}
+
+// nextUpload adds the fields ahead of the next file part to r's form and
+// returns that part, nil at the end of the body. Once files have started
+// (late) only input_prefix and input_keys are still taken.
+func nextUpload(mr *multipart.Reader, r *http.Request, late bool) (*multipart.Part, error) {
+	// what earlier calls took counts against the limits too
+	total, fields := 0, 0
+	for _, vs := range r.PostForm {
+		for _, v := range vs {
+			total += len(v)
+			fields++
+		}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadUpload, err)
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+		name := part.FormName()
+		if late && name != "input_prefix" && name != "input_keys" {
+			return nil, fmt.Errorf("%w: %q", errLateField, name)
+		}
+		b, err := io.ReadAll(io.LimitReader(part, streamFieldMax+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadUpload, err)
+		}
+		if len(b) > streamFieldMax {
+			return nil, fmt.Errorf("%w: field %q over %d bytes", errFormTooLarge, name, streamFieldMax)
+		}
+		total += len(b)
+		if fields++; total > streamFormMax || fields > streamFieldsMax {
+			return nil, fmt.Errorf("%w: over %d fields or %d bytes", errFormTooLarge, streamFieldsMax, streamFormMax)
+		}
+		r.Form.Add(name, string(b))
+		r.PostForm.Add(name, string(b))
+	}
+}
+
+// streamJobs reads the file parts from part on and adds their jobs as each
+// one is complete; storage inputs (input_prefix, input_keys) come last.
+func streamJobs(mr *multipart.Reader, part *multipart.Part, r *http.Request, opts Options, add func([]Job)) error {
+	usedLabels := map[string]int{}
+	meta := applicantFrom(r)
+	pol := extPolicyFrom(opts)
+	pol.zipPassword = r.FormValue("zip_password")
+	seen := map[string]int{}
+	splits := newSplitZips()
+	for part != nil {
+		field, name := part.FormName(), part.FileName()
+		b, err := io.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errBadUpload, name, err)
+		}
+		i := seen[field]
+		seen[field]++
+		switch field {
+		case "files":
+			if err := verifyDigest(name, bytes.NewReader(b), streamDigest(r, field, i)); err != nil {
+				return err
+			}
+			loose := !strings.HasSuffix(strings.ToLower(name), ".zip") && splitPart(name) == 0
+			add(meta.apply(splits.jobs(name, b, usedLabels, pol), loose))
+		case "folder":
+			if err := verifyDigest(name, bytes.NewReader(b), streamDigest(r, field, i)); err != nil {
+				return err
+			}
+			rel := name
+			if paths := r.PostForm["folder_paths"]; i < len(paths) && paths[i] != "" {
+				rel = paths[i]
+			}
+			add(meta.apply(jobsFromFolderUpload(rel, b, pol), false))
+		}
+		if part, err = nextUpload(mr, r, true); err != nil {
+			return err
+		}
+	}
+	add(meta.apply(splits.incomplete(), false))
+	if err := checkStoredInputs(r); err != nil {
+		return fmt.Errorf("%w: %v", errBadUpload, err)
+	}
+	add(storedInputJobs(r, usedLabels, pol, meta))
+	return nil
+}
+
+// streamDigest is the expected SHA-256 of the i-th upload of field, "" if none
+// (see checksum.go).
+func streamDigest(r *http.Request, field string, i int) string {
+	want := r.PostForm[field+"_sha256"]
+	if field == "files" && len(want) == 0 && r.Header.Get("X-Files-SHA256") != "" {
+		want = strings.Split(r.Header.Get("X-Files-SHA256"), ",")
+	}
+	if i < len(want) {
+		return want[i]
+	}
+	return ""
+}
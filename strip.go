@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ===== Strip-only mode =====
+// mode=strip drops EXIF/XMP (with their embedded thumbnails), ICC profiles,
+// comments and other APPn blobs from JPEGs without touching the scan data, so
+// there is no generation loss. APP0 JFIF and APP14 Adobe stay (the latter
+// decides the colour transform). A non-default EXIF Orientation is rewritten
+// into a minimal EXIF block so the picture doesn't turn sideways.
+
+var errNotJPEG = errors.New("not a JPEG")
+
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errNotJPEG
+	}
+	jfif, kept := []byte{}, &bytes.Buffer{}
+	orientation := 1
+	i := 2
+	for {
+		for i < len(data) && data[i] == 0xFF && i+1 < len(data) && data[i+1] == 0xFF {
+			i++ // fill bytes
+		}
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, fmt.Errorf("corrupt JPEG at offset %d", i)
+		}
+		marker := data[i+1]
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil, fmt.Errorf("corrupt JPEG segment at offset %d", i)
+		}
+		seg, payload := data[i:i+2+n], data[i+4:i+2+n]
+		if marker == 0xDA {
+			// SOI, JFIF, EXIF must lead; scan data and everything after is kept verbatim
+			out := bytes.NewBuffer(append([]byte{0xFF, 0xD8}, jfif...))
+			if orientation != 1 {
+				out.Write(orientationExif(orientation))
+			}
+			out.Write(kept.Bytes())
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		switch {
+		case marker == 0xE0 && bytes.HasPrefix(payload, []byte("JFIF\x00")):
+			jfif = seg
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			orientation = exifOrientation(payload[6:])
+		case marker == 0xEE:
+			kept.Write(seg)
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+			// other APPn and comments: dropped
+		default:
+			kept.Write(seg)
+		}
+		i += 2 + n
+	}
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of a TIFF blob; 1 if absent.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder = binary.BigEndian
+	if tiff[0] == 'I' {
+		bo = binary.LittleEndian
+	}
+	off := int(bo.Uint32(tiff[4:]))
+	if off+2 > len(tiff) {
+		return 1
+	}
+	count := int(bo.Uint16(tiff[off:]))
+	for k := 0; k < count; k++ {
+		e := off + 2 + 12*k
+		if e+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(bo.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// orientationExif builds an APP1 segment holding only the Orientation tag.
+func orientationExif(o int) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, // header, IFD0 at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0, // Orientation SHORT = o
+		0, 0, 0, 0} // no next IFD
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// stripOnlyEntry is processOneFileEntry for mode=strip: one untouched-scan output per target.
+func stripOnlyEntry(relpath string, raw []byte, label string, targets []outputTarget) (string, []outputRecord, []fileSkip, map[string][]byte) {
+	outs := map[string][]byte{}
+	ext := extLower(relpath)
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".jfif" {
+		return label, nil, []fileSkip{skipf(skipUnsupported, "%s: strip mode only handles JPEG", relpath)}, outs
+	}
+	data, err := stripJPEGMetadata(raw)
+	if err != nil {
+		return label, nil, []fileSkip{skipf(skipDecode, "%s: strip error: %v", relpath, err)}, outs
+	}
+	processed := []outputRecord{}
+	outBase := strings.TrimSuffix(relpath, filepath.Ext(relpath))
+	for _, t := range targets {
+		outRel := outBase + ".jpg"
+		if t.Name != "" {
+			outRel = t.Name + "/" + outRel
+		}
+		warn := ""
+		if t.MaxKB > 0 && (len(data) < t.MinKB*1024 || len(data) > t.MaxKB*1024) {
+			warn = fmt.Sprintf("outside %d–%d KB", t.MinKB, t.MaxKB)
+		}
+		outs[outRel] = data
+		processed = append(processed, outputRecord{Name: outRel, Bytes: len(data), Mode: "strip", Saved: len(raw) - len(data), Warning: warn})
+	}
+	return label, processed, nil, outs
+}
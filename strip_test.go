@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG encodes a small gradient at quality.
+func testJPEG(t *testing.T, quality int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	plain := testJPEG(t, 80)
+	comment := append([]byte{0xFF, 0xFE, 0, 7}, "hello"...)
+	icc := append([]byte{0xFF, 0xE2, 0, 16}, "ICC_PROFILE\x00\x01\x01"...)
+	in := append([]byte{0xFF, 0xD8}, orientationExif(6)...)
+	in = append(in, comment...)
+	in = append(in, icc...)
+	in = append(in, plain[2:]...)
+
+	out, err := stripJPEGMetadata(in)
+	if err != nil {
+		t.Fatalf("stripJPEGMetadata: %v", err)
+	}
+	if bytes.Contains(out, []byte("hello")) || bytes.Contains(out, []byte("ICC_PROFILE")) {
+		t.Error("comment or ICC profile kept")
+	}
+	if !bytes.HasPrefix(out[2:], orientationExif(6)) {
+		t.Error("orientation 6 not kept right after SOI")
+	}
+	if !bytes.HasSuffix(out, plain[bytes.Index(plain, []byte{0xFF, 0xDA}):]) {
+		t.Error("scan data changed")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("output doesn't decode: %v", err)
+	}
+}
+
+func TestStripJPEGMetadataDefaultOrientation(t *testing.T) {
+	plain := testJPEG(t, 80)
+	in := append(append([]byte{0xFF, 0xD8}, orientationExif(1)...), plain[2:]...)
+	out, err := stripJPEGMetadata(in)
+	if err != nil {
+		t.Fatalf("stripJPEGMetadata: %v", err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Errorf("got %d bytes, want the %d bytes without the EXIF block", len(out), len(plain))
+	}
+}
+
+func TestStripJPEGMetadataRejects(t *testing.T) {
+	if _, err := stripJPEGMetadata([]byte("GIF89a")); !errors.Is(err, errNotJPEG) {
+		t.Errorf("GIF: got error %v, want errNotJPEG", err)
+	}
+	plain := testJPEG(t, 80)
+	if _, err := stripJPEGMetadata(plain[:40]); err == nil {
+		t.Error("truncated JPEG: got no error")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ===== Per-source summary =====
+// Besides one line per output, the summary opens with one line per uploaded
+// ZIP (or folder): files processed and skipped, input → output size and the
+// average JPEG quality of the compressed outputs (targets without a size
+// window are always THUMB_QUALITY and left out), so a bad archive stands out
+// among many.
+
+type sourceStats struct {
+	Files, Done, Skipped int
+	InBytes, OutBytes    int
+	qSum, qN             int
+}
+
+// add folds one finished job into the stats; processed are its outputs.
+func (s *sourceStats) add(inBytes, outBytes int, processed []outputRecord, skipped []string) {
+	s.Files++
+	if len(processed) > 0 {
+		s.Done++
+	}
+	s.Skipped += len(skipped)
+	s.InBytes += inBytes
+	s.OutBytes += outBytes
+	for _, o := range processed {
+		if o.Mode == "" && !o.Thumb && o.Quality > 0 {
+			s.qSum += o.Quality
+			s.qN++
+		}
+	}
+}
+
+func (s *sourceStats) line(source string) string {
+	l := fmt.Sprintf("[%s] %d/%d diproses, %d dilewati, %.2f MB -> %.2f MB",
+		source, s.Done, s.Files, s.Skipped, float64(s.InBytes)/(1<<20), float64(s.OutBytes)/(1<<20))
+	if s.qN > 0 {
+		l += fmt.Sprintf(", q rata-rata %d", (s.qSum+s.qN/2)/s.qN)
+	}
+	return l
+}
+
+// sourceSummary returns the per-source lines, or nil when every job was a
+// loose file (the per-file lines already say it all).
+func sourceSummary(stats map[string]*sourceStats) []string {
+	if len(stats) == 0 || (len(stats) == 1 && stats[""] != nil) {
+		return nil
+	}
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		label := name
+		if label == "" {
+			label = "berkas lepas"
+		}
+		lines = append(lines, stats[name].line(label))
+	}
+	return lines
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/adityafaths/multicompressgo/compress"
+	"github.com/disintegration/imaging"
+)
+
+// ===== Output targets =====
+// One input can produce several variants in a single pass. Each target gets its
+// own folder inside the label folder when more than one target is requested.
+
+// THUMB_QUALITY is used for targets that only cap dimensions (no size window).
+var THUMB_QUALITY = 85
+
+// Preview thumbnails stored under thumbs/ and shown in the result gallery.
+var (
+	THUMB_SIDE_PX = 200
+	THUMB_MAX_KB  = 20
+)
+
+type outputTarget struct {
+	Name    string // folder name, empty for the default single target
+	MinKB   int
+	MaxKB   int // 0 = no size window, encode at THUMB_QUALITY
+	MaxSide int // 0 = no dimension cap
+}
+
+// parseTargets parses a comma separated spec such as "168-174,95-100,1024px,90-100@1600px".
+// An empty spec yields def, the job's min_kb–max_kb window.
+func parseTargets(spec string, def outputTarget) ([]outputTarget, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return []outputTarget{def}, nil
+	}
+	out := []outputTarget{}
+	seen := map[string]bool{}
+	for _, tok := range strings.Split(spec, ",") {
+		tok = strings.ToLower(strings.TrimSpace(tok))
+		if tok == "" {
+			continue
+		}
+		t := outputTarget{}
+		sizePart, sidePart := tok, ""
+		if i := strings.Index(tok, "@"); i >= 0 {
+			sizePart, sidePart = tok[:i], tok[i+1:]
+		} else if strings.HasSuffix(tok, "px") {
+			sizePart, sidePart = "", tok
+		}
+		if sidePart != "" {
+			n, err := strconv.Atoi(strings.TrimSuffix(sidePart, "px"))
+			if err != nil || n < 16 {
+				return nil, fmt.Errorf("target %q: invalid pixel size", tok)
+			}
+			t.MaxSide = n
+		}
+		if sizePart != "" {
+			lo, hi, ok := strings.Cut(strings.TrimSuffix(sizePart, "kb"), "-")
+			a, errA := strconv.Atoi(lo)
+			b, errB := strconv.Atoi(hi)
+			if !ok || errA != nil || errB != nil || a < 1 {
+				return nil, fmt.Errorf("target %q: expected MIN-MAX in KB", tok)
+			}
+			if b > MAX_TARGET_KB {
+				return nil, fmt.Errorf("target %q: maximum is limited to %d KB", tok, MAX_TARGET_KB)
+			}
+			if a >= b {
+				return nil, fmt.Errorf("target %q: minimum %d KB must be below maximum %d KB", tok, a, b)
+			}
+			t.MinKB, t.MaxKB = a, b
+		}
+		t.Name = targetFolderName(t)
+		if seen[t.Name] {
+			continue
+		}
+		seen[t.Name] = true
+		out = append(out, t)
+	}
+	if len(out) == 0 {
+		return []outputTarget{def}, nil
+	}
+	if len(out) == 1 {
+		out[0].Name = ""
+	}
+	return out, nil
+}
+
+func targetFolderName(t outputTarget) string {
+	parts := []string{}
+	if t.MaxKB > 0 {
+		parts = append(parts, fmt.Sprintf("%d-%dKB", t.MinKB, t.MaxKB))
+	}
+	if t.MaxSide > 0 {
+		parts = append(parts, fmt.Sprintf("%dpx", t.MaxSide))
+	}
+	return strings.Join(parts, "_")
+}
+
+// makeThumb renders a small preview (THUMB_SIDE_PX box, at most ~THUMB_MAX_KB).
+func makeThumb(img image.Image) ([]byte, error) {
+	small := compress.FlattenWhite(imaging.Fit(img, THUMB_SIDE_PX, THUMB_SIDE_PX, imaging.Lanczos))
+	data, _, err := compress.SearchQuality(small, THUMB_MAX_KB, MIN_QUALITY, THUMB_QUALITY, compress.DefaultModel)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return compress.EncodeJPEG(small, MIN_QUALITY)
+	}
+	return data, nil
+}
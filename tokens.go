@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ===== Result token metadata (Redis) =====
+// With REDIS_URL set, token -> result metadata lives in Redis with a TTL so any
+// replica behind a load balancer can serve /download/<token>; the ZIP itself is
+// read from the object storage (STORAGE_BACKEND). The TTL is RESULT_TTL (see
+// expiry.go).
+//
+//	REDIS_URL=redis://:password@redis:6379/0 RESULT_TTL=48h
+
+type resultMeta struct {
+	Token   string    `json:"token"`
+	Key     string    `json:"key"` // object key in store
+	Size    int       `json:"size"`
+	JobID   string    `json:"job_id"`
+	Created time.Time `json:"created"`
+}
+
+var (
+	redisClient *redis.Client
+	errNoResult = errors.New("result not found")
+)
+
+func setupRedis() error {
+	u := os.Getenv("REDIS_URL")
+	if u == "" {
+		return nil
+	}
+	opt, err := redis.ParseURL(u)
+	if err != nil {
+		return err
+	}
+	c := redis.NewClient(opt)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx).Err(); err != nil {
+		return err
+	}
+	if store == nil {
+		log.Printf("REDIS_URL set without STORAGE_BACKEND: other replicas won't find the ZIPs")
+	}
+	redisClient = c
+	return nil
+}
+
+func saveResultMeta(m resultMeta) {
+	if redisClient == nil {
+		return
+	}
+	b, _ := json.Marshal(m)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := redisClient.Set(ctx, "result:"+m.Token, b, live().RESULT_TTL).Err(); err != nil {
+		log.Printf("redis save %s: %v", m.Token, err)
+	}
+}
+
+func loadResultMeta(ctx context.Context, token string) (resultMeta, error) {
+	var m resultMeta
+	b, err := redisClient.Get(ctx, "result:"+token).Bytes()
+	if err == redis.Nil {
+		return m, errNoResult
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
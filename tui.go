@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ===== Terminal UI =====
+// `multicompressgo compress -tui` shows the batch as a live terminal view:
+// one row per file with a progress bar (estimated from the per-type
+// throughput, like the web page's ETA), running counters and the ETA, then a
+// final report with the skips. The view draws on stderr, so -json still
+// carries the manifest on stdout; without a terminal the plain progress lines
+// are printed instead. q or Ctrl+C abandons the batch.
+//
+//	multicompressgo compress -tui -in ./scans -out compressed.zip
+
+const (
+	tuiWaiting = iota
+	tuiWorking
+	tuiDone
+	tuiSkipped
+)
+
+type tuiFile struct {
+	name, source string
+	state        int
+	started      time.Time
+	expect       float64 // seconds, from typeStats when the file started
+	inBytes      int
+	outBytes     int
+	note         string // first skip reason
+}
+
+type tuiModel struct {
+	jobID    string
+	files    []tuiFile
+	started  time.Time
+	width    int
+	height   int
+	done     bool
+	aborted  bool
+	manifest resultManifest
+	err      error
+}
+
+type tuiEventMsg jobEvent
+
+type tuiTickMsg time.Time
+
+type tuiDoneMsg struct {
+	manifest resultManifest
+	err      error
+}
+
+// runCompressTUI runs run (building and writing the batch) under the terminal
+// view. aborted is true when the user quit before it finished.
+func runCompressTUI(jobs []Job, jobID string, run func() (resultManifest, error)) (resultManifest, bool, error) {
+	model := &tuiModel{jobID: jobID, started: time.Now(), width: 80, height: 24}
+	for _, j := range jobs {
+		model.files = append(model.files, tuiFile{name: j.Rel, source: j.Source, inBytes: len(j.Data)})
+	}
+	// the CLI has no process-wide subscribers; track this job for the ETA
+	stopProgress := subscribe(trackProgress)
+	defer stopProgress()
+	if _, err := startJob(jobID, jobs); err != nil {
+		return resultManifest{}, false, err
+	}
+	prog := tea.NewProgram(model, tea.WithOutput(os.Stderr))
+	stop := subscribe(func(ev jobEvent) {
+		if ev.Job == jobID {
+			prog.Send(tuiEventMsg(ev))
+		}
+	})
+	go func() {
+		m, err := run()
+		stop()
+		prog.Send(tuiDoneMsg{m, err})
+	}()
+	if _, err := prog.Run(); err != nil {
+		return resultManifest{}, false, err
+	}
+	return model.manifest, model.aborted, model.err
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tuiTick()
+}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(200*time.Millisecond, func(t time.Time) tea.Msg { return tuiTickMsg(t) })
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if s := msg.String(); s == "q" || s == "ctrl+c" {
+			m.aborted = true
+			return m, tea.Quit
+		}
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tuiTickMsg:
+		if !m.done {
+			return m, tuiTick()
+		}
+	case tuiEventMsg:
+		m.apply(jobEvent(msg))
+	case tuiDoneMsg:
+		m.done, m.manifest, m.err = true, msg.manifest, msg.err
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+// apply moves the file an event is about to its new state. Files are matched
+// by source and name; the first one not yet past that state wins.
+func (m *tuiModel) apply(ev jobEvent) {
+	want := map[string]int{evFileStarted: tuiWorking, evFileDone: tuiDone, evFileSkipped: tuiSkipped}[ev.Type]
+	if want == tuiWaiting {
+		return
+	}
+	for i := range m.files {
+		f := &m.files[i]
+		if f.name != ev.File || f.source != ev.Source || f.state >= tuiDone || f.state >= want {
+			continue
+		}
+		f.state = want
+		switch want {
+		case tuiWorking:
+			f.started = time.Now()
+			jobsMu.Lock()
+			f.expect = secondsPerFile(fileType(f.name))
+			jobsMu.Unlock()
+		case tuiDone, tuiSkipped:
+			f.outBytes = ev.OutBytes
+			if len(ev.Skipped) > 0 {
+				f.note = ev.Skipped[0]
+			}
+		}
+		return
+	}
+}
+
+func (m *tuiModel) View() string {
+	b := &strings.Builder{}
+	finished, skipped, in, out := 0, 0, 0, 0
+	for _, f := range m.files {
+		if f.state >= tuiDone {
+			finished++
+			in += f.inBytes
+			out += f.outBytes
+		}
+		if f.state == tuiSkipped {
+			skipped++
+		}
+	}
+	fmt.Fprintf(b, "%d/%d files, %d skipped, %s -> %s, %s elapsed",
+		finished, len(m.files), skipped, tuiSize(in), tuiSize(out), tuiDuration(time.Since(m.started).Seconds()))
+	if p, ok := jobSnapshot(m.jobID); ok && !m.done && finished > 0 {
+		fmt.Fprintf(b, ", ETA %s", tuiDuration(p.ETASeconds))
+	}
+	b.WriteString("\n" + tuiBar(float64(finished)/float64(max(len(m.files), 1)), m.width-2) + "\n\n")
+
+	if m.done || m.aborted {
+		m.report(b)
+		return b.String()
+	}
+	// keep the first unfinished file near the top so the window follows the batch
+	rows := max(m.height-5, 3)
+	first := 0
+	for first < len(m.files) && m.files[first].state >= tuiDone {
+		first++
+	}
+	start := clampInt(first-2, 0, max(len(m.files)-rows, 0))
+	nameW := clampInt(m.width/2, 16, 60)
+	for _, f := range m.files[start:min(start+rows, len(m.files))] {
+		mark, tail := " ", "waiting"
+		switch f.state {
+		case tuiWorking:
+			mark = ">"
+			frac := 0.95
+			if f.expect > 0 && time.Since(f.started).Seconds() < 0.95*f.expect {
+				frac = time.Since(f.started).Seconds() / f.expect
+			}
+			tail = tuiBar(frac, 20)
+		case tuiDone:
+			mark, tail = "✓", tuiBar(1, 20)+" "+tuiSize(f.outBytes)
+		case tuiSkipped:
+			mark, tail = "✗", "skipped: "+f.note
+		}
+		line := fmt.Sprintf("%s %-*s %s", mark, nameW, tuiTrim(f.name, nameW), tail)
+		b.WriteString(tuiTrim(line, m.width) + "\n")
+	}
+	return b.String()
+}
+
+// report is the view after the batch: the skips and where the ZIP went.
+func (m *tuiModel) report(b *strings.Builder) {
+	switch {
+	case m.aborted:
+		b.WriteString("aborted\n")
+		return
+	case m.err != nil:
+		fmt.Fprintf(b, "failed: %v\n", m.err)
+		return
+	}
+	for _, s := range m.manifest.Skips {
+		fmt.Fprintf(b, "skipped %s: %s\n", s.Label, s.Message)
+	}
+	if len(m.manifest.Skips) > 0 {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(b, "%s: wrote %s\n", m.manifest.Status, m.manifest.Output)
+}
+
+func tuiBar(frac float64, width int) string {
+	width = max(width, 4)
+	n := clampInt(int(frac*float64(width)+0.5), 0, width)
+	return strings.Repeat("█", n) + strings.Repeat("░", width-n)
+}
+
+func tuiTrim(s string, width int) string {
+	r := []rune(s)
+	if width < 2 || len(r) <= width {
+		return s
+	}
+	return string(r[:width-1]) + "…"
+}
+
+func tuiSize(n int) string {
+	if n < 1<<20 {
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+func tuiDuration(sec float64) string {
+	d := time.Duration(sec) * time.Second
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
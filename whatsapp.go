@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"strconv"
+)
+
+// ===== Destination presets =====
+// A preset fills in the settings the form left empty (see settingsFrom); a
+// min_kb or max_kb of the form also keeps the preset's targets out, since
+// those are the same setting. The presets in effect are live().PRESETS: the
+// built-in ones plus CONFIG_FILE's.
+
+var builtinPresets = map[string]map[string]string{
+	// WhatsApp's "standard quality" resizes anything above 1600 px on the long
+	// side and re-encodes low quality JPEGs again, compounding artifacts.
+	"whatsapp": {"max_side": strconv.Itoa(WA_MAX_SIDE), "min_quality": strconv.Itoa(WA_MIN_QUALITY), "wa_guard": "1"},
+}
+
+var (
+	WA_MAX_SIDE    = 1600
+	WA_MIN_QUALITY = 60
+	WA_MAX_BYTES   = 1 << 20
+)
+
+func applyPreset(vals map[string]string) error {
+	if vals["preset"] == "" {
+		return nil
+	}
+	p, ok := live().PRESETS[vals["preset"]]
+	if !ok {
+		return fmt.Errorf("unknown preset %q", vals["preset"])
+	}
+	window := vals["min_kb"] != "" || vals["max_kb"] != ""
+	for k, v := range p {
+		if vals[k] == "" && !(k == "targets" && window) {
+			vals[k] = v
+		}
+	}
+	return nil
+}
+
+// whatsappWarnings lists reasons an output will probably be recompressed by WhatsApp.
+func whatsappWarnings(data []byte, quality int) []string {
+	warns := []string{}
+	if c, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && max(c.Width, c.Height) > WA_MAX_SIDE {
+		warns = append(warns, fmt.Sprintf("WhatsApp will resize (long side %d px > %d px)", max(c.Width, c.Height), WA_MAX_SIDE))
+	}
+	if quality < WA_MIN_QUALITY {
+		warns = append(warns, fmt.Sprintf("WhatsApp will likely recompress (quality %d < %d)", quality, WA_MIN_QUALITY))
+	}
+	if len(data) > WA_MAX_BYTES {
+		warns = append(warns, fmt.Sprintf("WhatsApp will likely recompress (%d bytes > %d)", len(data), WA_MAX_BYTES))
+	}
+	return warns
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ===== Damaged ZIPs =====
+// A ZIP cut off before its end (an interrupted upload, a half-finished
+// download) has lost its central directory, so archive/zip refuses all of it
+// although most entries are intact. salvageZip walks the local file headers
+// from the front instead and keeps every entry whose data is complete and
+// matches its CRC; the entry the archive breaks off in is reported as corrupt.
+// Encrypted entries are not salvaged. ZIP_STRICT=1 turns this off (main.go).
+
+const (
+	localHeaderSig = 0x04034b50
+	localHeaderLen = 30
+	descriptorSig  = 0x08074b50
+)
+
+var errEntryTooLarge = errors.New("entry too large")
+
+func salvageZip(b []byte, password string, depth int, budget *zipBudget) ([]zipEntry, error) {
+	le := binary.LittleEndian
+	out := []zipEntry{}
+	pos := 0
+	if len(b) >= 4 && le.Uint32(b) == descriptorSig { // first part of a split set
+		pos = 4
+	}
+	found := 0
+	for pos+localHeaderLen <= len(b) && le.Uint32(b[pos:]) == localHeaderSig {
+		h := b[pos:]
+		flags, method := le.Uint16(h[6:]), le.Uint16(h[8:])
+		crc, size := le.Uint32(h[14:]), int(le.Uint32(h[18:]))
+		nameLen, extraLen := int(le.Uint16(h[26:])), int(le.Uint16(h[28:]))
+		start := pos + localHeaderLen + nameLen + extraLen
+		if start > len(b) {
+			break
+		}
+		name := string(h[localHeaderLen : localHeaderLen+nameLen])
+		found++
+		if budget.files--; budget.files < 0 {
+			return nil, fmt.Errorf("%w: more than %d files (MAX_ZIP_FILES)", errZipLimit, live().MAX_ZIP_FILES)
+		}
+		if flags&0x1 != 0 {
+			out = append(out, zipEntry{Rel: name, Skip: "encrypted ZIP entry: archive damaged, cannot be read", SkipKind: skipEncrypted})
+			if flags&0x8 != 0 || start+size > len(b) {
+				break // no way to find the next entry
+			}
+			pos = start + size
+			continue
+		}
+
+		// without a data descriptor the header has the size and the next
+		// entry's offset; with one, only the end of the deflate stream tells
+		var data []byte
+		var err error
+		next := start + size
+		switch {
+		case flags&0x8 == 0 && next > len(b):
+			err = io.ErrUnexpectedEOF
+		case flags&0x8 == 0 && method == zipStore:
+			data = b[start:next]
+		case flags&0x8 == 0 && method == zipDeflate:
+			data, _, err = inflateAt(b[:next], start)
+		case method == zipDeflate:
+			if data, next, err = inflateAt(b, start); err == nil {
+				crc, next, err = readDescriptor(b, next)
+			}
+		default:
+			err = fmt.Errorf("compression method %d cannot be recovered", method)
+		}
+		switch {
+		case err != nil && flags&0x8 == 0 && next <= len(b):
+			kind, msg := zipSalvageSkip(err)
+			out = append(out, zipEntry{Rel: name, Skip: msg, SkipKind: kind})
+			pos = next
+			continue
+		case err != nil:
+			kind, msg := zipSalvageSkip(err)
+			out = append(out, zipEntry{Rel: name, Skip: msg, SkipKind: kind})
+			return out, nil // the rest of the archive cannot be located
+		case crc32.ChecksumIEEE(data) != crc:
+			out = append(out, zipEntry{Rel: name, Skip: "corrupt ZIP entry: CRC mismatch", SkipKind: skipCorrupt})
+			pos = next
+			continue
+		}
+		if name != "" && name[len(name)-1] != '/' {
+			if out, err = appendZipEntry(out, name, data, password, depth, budget); err != nil {
+				return nil, err
+			}
+		}
+		pos = next
+	}
+	if found == 0 {
+		return nil, zip.ErrFormat
+	}
+	return out, nil
+}
+
+func zipSalvageSkip(err error) (skipKind, string) {
+	if errors.Is(err, errEntryTooLarge) {
+		return skipTooLarge, fmt.Sprintf("too large: over %d bytes", live().MAX_ENTRY_BYTES)
+	}
+	return skipCorrupt, "corrupt ZIP entry: " + err.Error()
+}
+
+const (
+	zipStore   = 0
+	zipDeflate = 8
+)
+
+// inflateAt decompresses the deflate stream starting at b[start:] and returns
+// it with the offset just past it. bytes.Reader is an io.ByteReader, so flate
+// reads no further than the end of the stream.
+func inflateAt(b []byte, start int) ([]byte, int, error) {
+	r := bytes.NewReader(b[start:])
+	fr := flate.NewReader(r)
+	defer fr.Close()
+	limit := live().MAX_ENTRY_BYTES
+	data, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) > limit {
+		return nil, 0, errEntryTooLarge
+	}
+	return data, len(b) - r.Len(), nil
+}
+
+// readDescriptor reads the data descriptor at pos (its signature is optional)
+// and returns the CRC it carries and the offset after it.
+func readDescriptor(b []byte, pos int) (uint32, int, error) {
+	le := binary.LittleEndian
+	if pos+4 <= len(b) && le.Uint32(b[pos:]) == descriptorSig {
+		pos += 4
+	}
+	if pos+12 > len(b) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return le.Uint32(b[pos:]), pos + 12, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// truncatedZip is a three-entry ZIP cut off inside the last entry's data,
+// so its central directory is gone.
+func truncatedZip(t *testing.T) []byte {
+	t.Helper()
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+	b := makeZip(t, testZipFile{"a.jpg", []byte("first")}, testZipFile{"b.jpg", bytes.Repeat([]byte("second"), 100)}, testZipFile{"c.jpg", noise})
+	sig := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sig, 0x02014b50) // central directory header
+	return b[:bytes.Index(b, sig)-1000]
+}
+
+func TestSalvageTruncatedZip(t *testing.T) {
+	entries, err := extractZipToMemory(truncatedZip(t), "")
+	if err != nil {
+		t.Fatalf("extractZipToMemory: %v", err)
+	}
+	if got := entryNames(entries); strings.Join(got, ",") != "a.jpg,b.jpg,c.jpg" {
+		t.Fatalf("got entries %v, want a.jpg, b.jpg and c.jpg", got)
+	}
+	if entries[0].Skip != "" || string(entries[0].Data) != "first" {
+		t.Errorf("a.jpg: got skip %q, data %q", entries[0].Skip, entries[0].Data)
+	}
+	if entries[1].Skip != "" || !bytes.Equal(entries[1].Data, bytes.Repeat([]byte("second"), 100)) {
+		t.Errorf("b.jpg: got skip %q, %d bytes", entries[1].Skip, len(entries[1].Data))
+	}
+	if entries[2].SkipKind != skipCorrupt || entries[2].Data != nil {
+		t.Errorf("c.jpg: got skip %q with %d bytes, want it reported corrupt", entries[2].Skip, len(entries[2].Data))
+	}
+}
+
+func TestSalvageStrict(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.ZIP_STRICT = true })
+	if _, err := extractZipToMemory(truncatedZip(t), ""); !errors.Is(err, zip.ErrFormat) {
+		t.Fatalf("got error %v, want zip.ErrFormat", err)
+	}
+}
+
+func TestSalvageNotAZip(t *testing.T) {
+	if _, err := extractZipToMemory([]byte("not a zip at all, just some text"), ""); !errors.Is(err, zip.ErrFormat) {
+		t.Fatalf("got error %v, want zip.ErrFormat", err)
+	}
+}
+
+func TestSalvageFileLimit(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.MAX_ZIP_FILES = 2 })
+	if _, err := extractZipToMemory(truncatedZip(t), ""); !errors.Is(err, errZipLimit) {
+		t.Fatalf("got error %v, want errZipLimit", err)
+	}
+}
+
+func TestSalvageSkipsLargeEntry(t *testing.T) {
+	setLive(t, func(c *liveConfig) { c.MAX_ENTRY_BYTES = 100 })
+	entries, err := extractZipToMemory(truncatedZip(t), "")
+	if err != nil {
+		t.Fatalf("extractZipToMemory: %v", err)
+	}
+	if len(entries) < 2 || entries[1].SkipKind != skipTooLarge {
+		t.Fatalf("got entries %v, want b.jpg skipped as too large", entryNames(entries))
+	}
+}